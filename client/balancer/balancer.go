@@ -0,0 +1,393 @@
+// Package balancer picks the server each new client stream is opened against
+// and keeps per-server health from periodic probes.
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/transport"
+)
+
+// window is how many recent probe results the success rate covers.
+const window = 10
+
+// downAfter consecutive probe failures mark a server unhealthy; a single
+// success brings it back.
+const downAfter = 2
+
+// Upstream is one server with the transport, key and method streams to it
+// use.
+type Upstream struct {
+	Name      string
+	Transport transport.Transport
+	MasterKey []byte
+	Method    protocol.Method
+	Weight    int
+	// Domain is the server's hostname, empty if it is addressed by IP.
+	Domain string
+
+	healthy atomic.Bool
+	// rtt is the last successful probe's handshake round trip in
+	// nanoseconds; zero until the first success.
+	rtt atomic.Int64
+
+	mu       sync.Mutex
+	results  [window]bool
+	count    int
+	pos      int
+	failures int
+}
+
+// NewUpstream returns an upstream that is considered healthy until probed.
+func NewUpstream(name string, tr transport.Transport, masterKey []byte, method protocol.Method, weight int) *Upstream {
+	u := &Upstream{Name: name, Transport: tr, MasterKey: masterKey, Method: method, Weight: weight}
+	u.healthy.Store(true)
+	return u
+}
+
+// Healthy reports whether the server passed its recent probes.
+func (u *Upstream) Healthy() bool {
+	return u.healthy.Load()
+}
+
+// RTT returns the last measured handshake round trip, or 0 if unknown.
+func (u *Upstream) RTT() time.Duration {
+	return time.Duration(u.rtt.Load())
+}
+
+// SuccessRate returns the share of successful probes in the recent window,
+// or 1 before the first probe.
+func (u *Upstream) SuccessRate() float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.count == 0 {
+		return 1
+	}
+	ok := 0
+	for _, r := range u.results[:u.count] {
+		if r {
+			ok++
+		}
+	}
+	return float64(ok) / float64(u.count)
+}
+
+// record stores a probe result and reports whether the health state
+// changed.
+func (u *Upstream) record(rtt time.Duration, err error) bool {
+	u.mu.Lock()
+	u.results[u.pos] = err == nil
+	u.pos = (u.pos + 1) % window
+	u.count = min(u.count+1, window)
+	if err != nil {
+		u.failures++
+	} else {
+		u.failures = 0
+		u.rtt.Store(int64(max(rtt, time.Nanosecond)))
+	}
+	healthy := u.failures < downAfter
+	u.mu.Unlock()
+	return u.healthy.Swap(healthy) != healthy
+}
+
+// score is u's weight scaled by its recent success rate, so a flaky server
+// gets a smaller share.
+func (u *Upstream) score() float64 {
+	return float64(max(u.Weight, 1)) * u.SuccessRate()
+}
+
+// latency is u's last RTT divided by its recent success rate, so a fast but
+// flaky server ranks behind a reliable one; 0 if unmeasured.
+func (u *Upstream) latency() int64 {
+	rtt := u.rtt.Load()
+	if rtt == 0 {
+		return 0
+	}
+	return int64(float64(rtt) / max(u.SuccessRate(), 1.0/window))
+}
+
+// ProbeFunc performs one probe against u and returns the handshake RTT.
+type ProbeFunc func(ctx context.Context, u *Upstream) (time.Duration, error)
+
+// Balancer selects an upstream per stream according to a policy. Switching
+// servers only affects streams opened afterwards.
+type Balancer struct {
+	state  atomic.Pointer[state]
+	policy string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// state is the server list and the preferred server, swapped as a unit so
+// Pick never sees an index from a different list.
+type state struct {
+	upstreams []*Upstream
+	selected  int
+}
+
+// New returns a Balancer over upstreams with selected as the preferred
+// (manual/failover) server.
+func New(policy string, selected int, upstreams ...*Upstream) (*Balancer, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("balancer: no servers")
+	}
+	switch policy {
+	case "":
+		policy = config.FailoverManual
+	case config.FailoverManual, config.FailoverFailover, config.FailoverLowestLatency, config.FailoverWeighted:
+	default:
+		return nil, fmt.Errorf("balancer: unknown policy %q", policy)
+	}
+	if selected < 0 || selected >= len(upstreams) {
+		selected = 0
+	}
+	b := &Balancer{policy: policy}
+	b.state.Store(&state{upstreams: upstreams, selected: selected})
+	return b, nil
+}
+
+// Policy returns the selection policy.
+func (b *Balancer) Policy() string {
+	return b.policy
+}
+
+// Upstreams returns the servers in configuration order.
+func (b *Balancer) Upstreams() []*Upstream {
+	return b.state.Load().upstreams
+}
+
+// IsServerDomain reports whether domain is the hostname of any server, so
+// that resolving or proxying it would loop back through the proxy.
+func (b *Balancer) IsServerDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	for _, u := range b.Upstreams() {
+		if u.Domain != "" && strings.EqualFold(u.Domain, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the upstream called name, or nil.
+func (b *Balancer) Lookup(name string) *Upstream {
+	for _, u := range b.Upstreams() {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// Selected returns the index of the preferred server.
+func (b *Balancer) Selected() int {
+	return b.state.Load().selected
+}
+
+// SelectedUpstream returns the preferred server.
+func (b *Balancer) SelectedUpstream() *Upstream {
+	st := b.state.Load()
+	return st.upstreams[st.selected]
+}
+
+// Select makes upstream i the preferred server. Established streams keep
+// using the server they were opened against.
+func (b *Balancer) Select(i int) error {
+	for {
+		old := b.state.Load()
+		if i < 0 || i >= len(old.upstreams) {
+			return fmt.Errorf("balancer: server index %d out of range", i)
+		}
+		if old.selected == i {
+			return nil
+		}
+		if b.state.CompareAndSwap(old, &state{upstreams: old.upstreams, selected: i}) {
+			log.Info("[BALANCER] server selected", "server", old.upstreams[i].Name)
+			return nil
+		}
+	}
+}
+
+// Replace swaps in a new server list with selected as the preferred server
+// and returns the upstreams that are no longer part of it. Streams already
+// open keep their server; the caller closes the returned transports once it
+// no longer needs them.
+func (b *Balancer) Replace(selected int, upstreams ...*Upstream) ([]*Upstream, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("balancer: no servers")
+	}
+	if selected < 0 || selected >= len(upstreams) {
+		selected = 0
+	}
+	old := b.state.Swap(&state{upstreams: upstreams, selected: selected})
+	var removed []*Upstream
+	for _, u := range old.upstreams {
+		if !slices.Contains(upstreams, u) {
+			removed = append(removed, u)
+		}
+	}
+	log.Info("[BALANCER] servers replaced", "servers", len(upstreams), "removed", len(removed), "selected", upstreams[selected].Name)
+	return removed, nil
+}
+
+// Pick returns the upstream the next stream should use. The lowest-latency
+// and weighted policies discount servers by their recent probe success rate.
+func (b *Balancer) Pick() *Upstream {
+	st := b.state.Load()
+	preferred := st.upstreams[st.selected]
+	if b.policy == config.FailoverManual || len(st.upstreams) == 1 {
+		return preferred
+	}
+
+	var healthy []*Upstream
+	for _, u := range st.upstreams {
+		if u.Healthy() {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return preferred
+	}
+
+	switch b.policy {
+	case config.FailoverLowestLatency:
+		return slices.MinFunc(healthy, func(a, b *Upstream) int {
+			return cmpRTT(a.latency(), b.latency())
+		})
+	case config.FailoverWeighted:
+		total := 0.0
+		for _, u := range healthy {
+			total += u.score()
+		}
+		n := rand.Float64() * total
+		for _, u := range healthy {
+			if n -= u.score(); n < 0 {
+				return u
+			}
+		}
+		return healthy[len(healthy)-1]
+	}
+	if preferred.Healthy() {
+		return preferred
+	}
+	return healthy[0]
+}
+
+// cmpRTT orders measured round trips before unmeasured ones.
+func cmpRTT(a, b int64) int {
+	if a == 0 {
+		a = math.MaxInt64
+	}
+	if b == 0 {
+		b = math.MaxInt64
+	}
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Stats sums the transport stats of every server.
+func (b *Balancer) Stats() transport.TransportStats {
+	var sum transport.TransportStats
+	for _, u := range b.Upstreams() {
+		s := u.Transport.Stats()
+		sum.Conns += s.Conns
+		sum.ActiveStreams += s.ActiveStreams
+		sum.PriorityActiveStreams += s.PriorityActiveStreams
+		sum.BulkActiveStreams += s.BulkActiveStreams
+		sum.PriorityConns += s.PriorityConns
+		sum.BulkConns += s.BulkConns
+	}
+	return sum
+}
+
+// probe runs one probe round against every server in parallel.
+func (b *Balancer) probe(ctx context.Context, timeout time.Duration, fn ProbeFunc) {
+	upstreams := b.Upstreams()
+	var wg sync.WaitGroup
+	for _, u := range upstreams {
+		wg.Go(func() {
+			pctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			rtt, err := fn(pctx, u)
+			if ctx.Err() != nil {
+				return
+			}
+			if !u.record(rtt, err) {
+				log.Debug("[BALANCER] probe", "server", u.Name, "rtt", rtt, "err", err)
+				return
+			}
+			if err != nil {
+				log.Warn("[BALANCER] server down", "server", u.Name, "err", err)
+			} else {
+				log.Info("[BALANCER] server up", "server", u.Name, "rtt", rtt)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// StartProbing probes every server each interval until Close, also under
+// the manual policy, where the results are only reported. Probing is off
+// when interval <= 0. Servers added by Replace are probed from the next
+// round.
+func (b *Balancer) StartProbing(interval, timeout time.Duration, fn ProbeFunc) {
+	if interval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	b.done = make(chan struct{})
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			b.probe(ctx, timeout, fn)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// CloseIdle closes idle connections of every server's transport.
+func (b *Balancer) CloseIdle() {
+	for _, u := range b.Upstreams() {
+		u.Transport.CloseIdle()
+	}
+}
+
+// Close stops probing and closes every transport.
+func (b *Balancer) Close() error {
+	if b.cancel != nil {
+		b.cancel()
+		<-b.done
+	}
+	var firstErr error
+	for _, u := range b.Upstreams() {
+		if err := u.Transport.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,262 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/transport"
+)
+
+type fakeTransport struct {
+	stats  transport.TransportStats
+	closed bool
+}
+
+func (f *fakeTransport) Open(ctx context.Context, req transport.OpenRequest) (transport.Stream, error) {
+	return nil, errors.New("not implemented")
+}
+func (f *fakeTransport) CloseIdle()                      {}
+func (f *fakeTransport) Stats() transport.TransportStats { return f.stats }
+func (f *fakeTransport) Close() error                    { f.closed = true; return nil }
+
+func newUpstreams(names ...string) []*Upstream {
+	var us []*Upstream
+	for _, n := range names {
+		us = append(us, NewUpstream(n, &fakeTransport{}, nil, 0, 1))
+	}
+	return us
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(config.FailoverManual, 0); err == nil {
+		t.Error("expected error without servers")
+	}
+	if _, err := New("random", 0, newUpstreams("a")...); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+	b, err := New("", 5, newUpstreams("a", "b")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Policy() != config.FailoverManual || b.Selected() != 0 {
+		t.Errorf("policy = %q, selected = %d", b.Policy(), b.Selected())
+	}
+}
+
+func TestLookup(t *testing.T) {
+	b, _ := New(config.FailoverFailover, 0, newUpstreams("a", "b")...)
+	if u := b.Lookup("b"); u == nil || u.Name != "b" {
+		t.Errorf("Lookup(b) = %v", u)
+	}
+	if u := b.Lookup("c"); u != nil {
+		t.Errorf("Lookup(c) = %v, want nil", u)
+	}
+}
+
+func TestPickManual(t *testing.T) {
+	b, _ := New(config.FailoverManual, 1, newUpstreams("a", "b")...)
+	b.Upstreams()[1].healthy.Store(false)
+	if got := b.Pick().Name; got != "b" {
+		t.Errorf("Pick = %q, want b", got)
+	}
+	if err := b.Select(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Pick().Name; got != "a" {
+		t.Errorf("Pick after Select = %q, want a", got)
+	}
+	if err := b.Select(2); err == nil {
+		t.Error("expected out of range error")
+	}
+}
+
+func TestPickFailover(t *testing.T) {
+	b, _ := New(config.FailoverFailover, 1, newUpstreams("a", "b", "c")...)
+	if got := b.Pick().Name; got != "b" {
+		t.Errorf("Pick = %q, want preferred b", got)
+	}
+	b.Upstreams()[1].healthy.Store(false)
+	if got := b.Pick().Name; got != "a" {
+		t.Errorf("Pick = %q, want first healthy a", got)
+	}
+	for _, u := range b.Upstreams() {
+		u.healthy.Store(false)
+	}
+	if got := b.Pick().Name; got != "b" {
+		t.Errorf("Pick = %q, want preferred b when all are down", got)
+	}
+}
+
+func TestPickLowestLatency(t *testing.T) {
+	b, _ := New(config.FailoverLowestLatency, 0, newUpstreams("a", "b", "c")...)
+	b.Upstreams()[0].rtt.Store(int64(80 * time.Millisecond))
+	b.Upstreams()[1].rtt.Store(int64(20 * time.Millisecond))
+	// c is unmeasured and must not win.
+	if got := b.Pick().Name; got != "b" {
+		t.Errorf("Pick = %q, want b", got)
+	}
+	b.Upstreams()[1].healthy.Store(false)
+	if got := b.Pick().Name; got != "a" {
+		t.Errorf("Pick = %q, want a", got)
+	}
+}
+
+func TestPickWeighted(t *testing.T) {
+	us := newUpstreams("a", "b", "c")
+	us[0].Weight = 3
+	us[2].healthy.Store(false)
+	b, _ := New(config.FailoverWeighted, 0, us...)
+
+	counts := map[string]int{}
+	for range 4000 {
+		counts[b.Pick().Name]++
+	}
+	if counts["c"] != 0 {
+		t.Errorf("unhealthy server picked %d times", counts["c"])
+	}
+	if ratio := float64(counts["a"]) / float64(counts["b"]); ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("a:b ratio = %.2f, want about 3", ratio)
+	}
+}
+
+func TestPickSuccessRate(t *testing.T) {
+	b, _ := New(config.FailoverLowestLatency, 0, newUpstreams("a", "b")...)
+	a, bu := b.Upstreams()[0], b.Upstreams()[1]
+	probeErr := errors.New("timeout")
+	// a is faster but fails every other probe, staying healthy.
+	for range 5 {
+		a.record(10*time.Millisecond, nil)
+		a.record(0, probeErr)
+		bu.record(15*time.Millisecond, nil)
+	}
+	if !a.Healthy() {
+		t.Fatal("a should still be healthy")
+	}
+	if got := b.Pick().Name; got != "b" {
+		t.Errorf("Pick = %q, want the reliable b", got)
+	}
+
+	w, _ := New(config.FailoverWeighted, 0, newUpstreams("a", "b")...)
+	for range 5 {
+		w.Upstreams()[0].record(0, probeErr)
+		w.Upstreams()[0].record(time.Millisecond, nil)
+	}
+	counts := map[string]int{}
+	for range 4000 {
+		counts[w.Pick().Name]++
+	}
+	if ratio := float64(counts["a"]) / float64(counts["b"]); ratio < 0.4 || ratio > 0.6 {
+		t.Errorf("a:b ratio = %.2f, want about 0.5", ratio)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	u := NewUpstream("a", &fakeTransport{}, nil, 0, 1)
+	if !u.Healthy() || u.SuccessRate() != 1 {
+		t.Fatal("new upstream should be healthy")
+	}
+	if u.record(10*time.Millisecond, nil) {
+		t.Error("success on a healthy upstream should not change state")
+	}
+	if u.RTT() != 10*time.Millisecond {
+		t.Errorf("RTT = %v", u.RTT())
+	}
+	probeErr := errors.New("timeout")
+	if u.record(0, probeErr) || !u.Healthy() {
+		t.Error("a single failure should not mark the upstream down")
+	}
+	if !u.record(0, probeErr) || u.Healthy() {
+		t.Error("consecutive failures should mark the upstream down")
+	}
+	if got := u.SuccessRate(); got < 0.33 || got > 0.34 {
+		t.Errorf("SuccessRate = %v, want 1/3", got)
+	}
+	if !u.record(5*time.Millisecond, nil) || !u.Healthy() {
+		t.Error("a success should bring the upstream back")
+	}
+}
+
+func TestProbingMovesStreams(t *testing.T) {
+	b, _ := New(config.FailoverFailover, 0, newUpstreams("a", "b")...)
+	var mu sync.Mutex
+	probed := map[string]int{}
+	b.StartProbing(10*time.Millisecond, time.Second, func(ctx context.Context, u *Upstream) (time.Duration, error) {
+		mu.Lock()
+		probed[u.Name]++
+		mu.Unlock()
+		if u.Name == "a" {
+			return 0, errors.New("down")
+		}
+		return time.Millisecond, nil
+	})
+	deadline := time.Now().Add(time.Second)
+	for b.Pick().Name != "b" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := b.Pick().Name; got != "b" {
+		t.Errorf("Pick = %q, want b after a failed its probes", got)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range b.Upstreams() {
+		if !u.Transport.(*fakeTransport).closed {
+			t.Errorf("transport of %s not closed", u.Name)
+		}
+	}
+
+	manual, _ := New(config.FailoverManual, 0, newUpstreams("a", "b")...)
+	manual.StartProbing(10*time.Millisecond, time.Second, func(ctx context.Context, u *Upstream) (time.Duration, error) {
+		return 0, errors.New("down")
+	})
+	for manual.Upstreams()[1].Healthy() && time.Now().Before(deadline.Add(time.Second)) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	_ = manual.Close()
+	if manual.Upstreams()[1].Healthy() {
+		t.Error("manual policy should still probe every server")
+	}
+	if got := manual.Pick().Name; got != "a" {
+		t.Errorf("Pick = %q, want the selected server a under the manual policy", got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	us := newUpstreams("a", "b")
+	us[0].Transport.(*fakeTransport).stats = transport.TransportStats{Conns: 1, ActiveStreams: 2}
+	us[1].Transport.(*fakeTransport).stats = transport.TransportStats{Conns: 2, ActiveStreams: 3}
+	b, _ := New(config.FailoverFailover, 0, us...)
+	if s := b.Stats(); s.Conns != 3 || s.ActiveStreams != 5 {
+		t.Errorf("Stats = %+v", s)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	us := newUpstreams("a", "b")
+	b, _ := New(config.FailoverManual, 1, us...)
+	c := NewUpstream("c", &fakeTransport{}, nil, 0, 1)
+
+	removed, err := b.Replace(1, us[1], c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != us[0] {
+		t.Errorf("removed = %v, want [a]", removed)
+	}
+	if got := b.Pick().Name; got != "c" {
+		t.Errorf("Pick = %q, want c", got)
+	}
+	if b.Lookup("a") != nil {
+		t.Error("a should be gone")
+	}
+	if _, err := b.Replace(0); err == nil {
+		t.Error("expected error for an empty server list")
+	}
+	if got := b.SelectedUpstream().Name; got != "c" {
+		t.Errorf("SelectedUpstream = %q after failed Replace", got)
+	}
+}
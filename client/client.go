@@ -2,15 +2,20 @@ package client
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/nange/easyss/v3/client/balancer"
 	"github.com/nange/easyss/v3/client/config"
 	"github.com/nange/easyss/v3/client/dns"
+	"github.com/nange/easyss/v3/client/proxy"
 	"github.com/nange/easyss/v3/client/router"
 	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/protocol"
 	"github.com/nange/easyss/v3/shaper"
 	"github.com/nange/easyss/v3/transport"
 	"github.com/nange/easyss/v3/transport/http2"
@@ -21,9 +26,9 @@ import (
 type Client struct {
 	cfg           *config.ClientConfig
 	router        *router.Router
-	transport     *http2.HTTP2Transport
+	balancer      *balancer.Balancer
+	fingerprints  map[*balancer.Upstream]string
 	shaperCfg     shaper.Config
-	masterKey     []byte
 	dialer        *dialer.Dialer
 	closeIdleDone chan struct{}
 
@@ -31,17 +36,11 @@ type Client struct {
 }
 
 func New(cfg *config.ClientConfig) (*Client, error) {
-	masterKey, err := crypto.DeriveMasterKey(cfg.DefaultServer().Password)
+	rcfg, err := routerConfig(cfg, nil)
 	if err != nil {
 		return nil, err
 	}
-
-	rt, err := router.New(router.Config{
-		ProxyRule:  router.ParseProxyRule(cfg.Routing.ProxyRule),
-		IPV6Rule:   router.ParseIPV6Rule(cfg.Routing.IPV6Rule),
-		DirectFile: cfg.Routing.DirectFile,
-		ProxyFile:  cfg.Routing.ProxyFile,
-	})
+	rt, err := router.New(rcfg)
 	if err != nil {
 		return nil, err
 	}
@@ -61,48 +60,355 @@ func New(cfg *config.ClientConfig) (*Client, error) {
 		"server_ipv6", serverIPV6,
 	)
 
-	tlsCfg := cfg.UTLSConfig()
 	directDialer, directIface := newDirectDialer()
 
-	shaperCfg := shaper.Config{
-		BatchWindowMS: cfg.Shaper.BatchWindowMS,
-		Cover: shaper.CoverConfig{
-			BudgetRatio: cfg.Shaper.CoverBudgetRatio,
-			BudgetCap:   cfg.Shaper.CoverBudgetCap,
-		},
-	}
-
 	client := &Client{
 		cfg:           cfg,
 		router:        rt,
-		shaperCfg:     shaperCfg,
-		masterKey:     masterKey,
+		shaperCfg:     shaperConfig(cfg.Shaper),
 		dialer:        directDialer,
 		closeIdleDone: make(chan struct{}),
 	}
 
-	tr, err := http2.New(http2.Config{
-		ServerURL:         cfg.ServerURL(),
-		TLSConfig:         tlsCfg,
-		MaxSlotCount:      cfg.Transport.ConnCountMax,
-		StreamThreshold:   cfg.Transport.StreamThreshold,
-		PrioritySlotRatio: cfg.Transport.PrioritySlotRatio,
-		Timeout:           cfg.TimeoutDuration(),
+	upstreams, err := client.newUpstreams(cfg.Servers, nil, cfg.Transport)
+	if err != nil {
+		return nil, err
+	}
+	err = checkOutbounds(upstreams, rt.Outbounds())
+	var b *balancer.Balancer
+	if err == nil {
+		b, err = balancer.New(cfg.Failover.Policy, cfg.DefaultServerIndex(), upstreams...)
+	}
+	if err != nil {
+		for _, u := range upstreams {
+			_ = u.Transport.Close()
+		}
+		return nil, err
+	}
+	client.balancer = b
+	client.fingerprints = fingerprints(cfg.Servers, upstreams)
+
+	log.Info("[CLIENT] transport initialized", "server_url", cfg.ServerURL(), "max_slots", cfg.Transport.ConnCountMax, "stream_threshold", cfg.Transport.StreamThreshold, "server_addr", cfg.DefaultServerAddr(), "servers", len(upstreams), "failover_policy", b.Policy(), "direct_iface", directIface)
+
+	go client.closeIdleLoop()
+
+	return client, nil
+}
+
+// newUpstreams creates one upstream per server profile, in configuration
+// order, taking unchanged servers from reuse (keyed by
+// config.ServerFingerprint). Chained servers are built after the server they
+// are reached through and are only reused if that server is.
+func (c *Client) newUpstreams(servers []*config.ServerProfile, reuse map[string]*balancer.Upstream, tc config.TransportConfig) ([]*balancer.Upstream, error) {
+	byName := make(map[string]int, len(servers))
+	for i, srv := range servers {
+		byName[srv.DisplayName()] = i
+	}
+
+	upstreams := make([]*balancer.Upstream, len(servers))
+	reused := make([]bool, len(servers))
+	building := make([]bool, len(servers))
+	var build func(i int) error
+	build = func(i int) error {
+		if upstreams[i] != nil {
+			return nil
+		}
+		srv := servers[i]
+		if building[i] {
+			return fmt.Errorf("server %q: chain cycle", srv.DisplayName())
+		}
+		building[i] = true
+
+		var entry *balancer.Upstream
+		entryReused := true
+		if srv.Chain != "" {
+			j, ok := byName[srv.Chain]
+			if !ok {
+				return fmt.Errorf("server %q: chain server %q not found", srv.DisplayName(), srv.Chain)
+			}
+			if err := build(j); err != nil {
+				return err
+			}
+			entry = upstreams[j]
+			entryReused = reused[j]
+		}
+		if u := reuse[config.ServerFingerprint(srv)]; u != nil && entryReused {
+			upstreams[i] = u
+			reused[i] = true
+			return nil
+		}
+		u, err := c.newUpstream(srv, entry, tc)
+		if err != nil {
+			return err
+		}
+		upstreams[i] = u
+		return nil
+	}
+
+	for i := range servers {
+		if err := build(i); err != nil {
+			for j, u := range upstreams {
+				if u != nil && !reused[j] {
+					_ = u.Transport.Close()
+				}
+			}
+			return nil, err
+		}
+	}
+	return upstreams, nil
+}
+
+// UpdateServers switches the client to servers in place. Unchanged servers
+// keep their transports and connections; streams open on a removed server
+// keep running until they end or the stream idle timeout passes. The
+// configuration's server list is replaced only on success.
+func (c *Client) UpdateServers(servers []*config.ServerProfile) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.replaceServers(servers, c.cfg.Transport, c.router.Outbounds(), nil)
+}
+
+// UpdateRuleSet swaps rs in for the configured rule set of the same name,
+// for rule providers refreshing in the background. Every server rs names
+// must exist.
+func (c *Client) UpdateRuleSet(rs *router.RuleSet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := checkOutbounds(c.balancer.Upstreams(), rs.Outbounds()); err != nil {
+		return err
+	}
+	if !c.router.ReplaceRuleSet(rs) {
+		return fmt.Errorf("rule set %s is not configured", rs.Name)
+	}
+	return nil
+}
+
+// Reload applies the routing, shaper, transport and server settings of next
+// in place; the caller handles the rest of the configuration. Streams
+// already running keep their server and shaper. A transport change rebuilds
+// every upstream, otherwise only changed servers are. On error nothing is
+// applied.
+func (c *Client) Reload(next *config.ClientConfig) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rcfg, err := routerConfig(next, c.router)
+	if err != nil {
+		return err
+	}
+	rcfg.IPV6Rule = router.ParseIPV6Rule(c.cfg.Routing.IPV6Rule)
+	err = c.replaceServers(next.Servers, next.Transport, rcfg.Outbounds(), func() error {
+		return c.router.Reload(rcfg)
+	})
+	if err != nil {
+		return err
+	}
+
+	ipv6Rule := c.cfg.Routing.IPV6Rule
+	c.cfg.Routing = next.Routing
+	c.cfg.Routing.IPV6Rule = ipv6Rule
+	c.cfg.Transport = next.Transport
+	c.cfg.Shaper = next.Shaper
+	c.shaperCfg = shaperConfig(next.Shaper)
+	return nil
+}
+
+// replaceServers builds upstreams for servers, checks them against the
+// outbounds the routing rules name, runs commit and swaps them in. Unchanged
+// servers are reused unless tc differs from the current transport settings.
+// If any step fails the new upstreams are closed and nothing changes.
+func (c *Client) replaceServers(servers []*config.ServerProfile, tc config.TransportConfig, outbounds []string, commit func() error) error {
+	if len(servers) == 0 {
+		return errors.New("no servers configured")
+	}
+	reuse := make(map[string]*balancer.Upstream, len(c.fingerprints))
+	if tc == c.cfg.Transport {
+		for u, fp := range c.fingerprints {
+			reuse[fp] = u
+		}
+	}
+	upstreams, err := c.newUpstreams(servers, reuse, tc)
+	if err != nil {
+		return err
+	}
+	if err := checkOutbounds(upstreams, outbounds); err != nil {
+		closeNew(upstreams, c.fingerprints)
+		return err
+	}
+	if commit != nil {
+		if err := commit(); err != nil {
+			closeNew(upstreams, c.fingerprints)
+			return err
+		}
+	}
+
+	selected := 0
+	for i, srv := range servers {
+		if srv.Default {
+			selected = i
+			break
+		}
+	}
+	removed, err := c.balancer.Replace(selected, upstreams...)
+	if err != nil {
+		closeNew(upstreams, c.fingerprints)
+		return err
+	}
+	c.fingerprints = fingerprints(servers, upstreams)
+	c.cfg.SetServers(servers)
+
+	if len(removed) > 0 {
+		time.AfterFunc(10*c.cfg.TimeoutDuration(), func() {
+			for _, u := range removed {
+				_ = u.Transport.Close()
+			}
+		})
+	}
+	return nil
+}
+
+func fingerprints(servers []*config.ServerProfile, upstreams []*balancer.Upstream) map[*balancer.Upstream]string {
+	fps := make(map[*balancer.Upstream]string, len(upstreams))
+	for i, u := range upstreams {
+		fps[u] = config.ServerFingerprint(servers[i])
+	}
+	return fps
+}
+
+// closeNew closes the upstreams that are not in current.
+func closeNew(upstreams []*balancer.Upstream, current map[*balancer.Upstream]string) {
+	for _, u := range upstreams {
+		if _, ok := current[u]; !ok {
+			_ = u.Transport.Close()
+		}
+	}
+}
+
+// newUpstream creates the transport, master key and method for one server
+// profile.
+// With a non-nil entry, connections to the server are tunneled through a
+// /v3/tcp stream on entry instead of dialed directly.
+func (c *Client) newUpstream(srv *config.ServerProfile, entry *balancer.Upstream, tc config.TransportConfig) (*balancer.Upstream, error) {
+	masterKey, err := crypto.DeriveMasterKey(srv.Password)
+	if err != nil {
+		return nil, err
+	}
+	h2Cfg := http2.Config{
+		ServerURL:         srv.URL(),
+		TLSConfig:         srv.UTLSConfig(),
+		MaxSlotCount:      tc.ConnCountMax,
+		StreamThreshold:   tc.StreamThreshold,
+		PrioritySlotRatio: tc.PrioritySlotRatio,
+		Timeout:           c.cfg.TimeoutDuration(),
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dialWithConfig(ctx, cfg, client.dialer, rt, network, addr)
+			return dialWithConfig(ctx, c.cfg, c.dialer, c.router, network, addr)
 		},
-	})
+	}
+	if entry != nil {
+		tunnel := proxy.NewStreamHandler(entry.Transport, entry.MasterKey, entry.Method, c.shaperCfg, 0)
+		h2Cfg.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return tunnel.DialTunnel(ctx, entry, addr)
+		}
+		log.Info("[CLIENT] chained server", "server", srv.DisplayName(), "via", entry.Name)
+	}
+	tr, err := http2.New(h2Cfg)
 	if err != nil {
 		return nil, err
 	}
+	method := protocol.MethodFromString(srv.Method)
+	if method == 0 {
+		method = protocol.MethodAES256GCM
+	}
+	u := balancer.NewUpstream(srv.DisplayName(), tr, masterKey, method, srv.Weight)
+	if net.ParseIP(srv.Address) == nil {
+		u.Domain = srv.Address
+	}
+	return u, nil
+}
 
-	client.transport = tr
+// routerConfig converts the routing settings of cfg, loading its rule set
+// files. Rule sets with a URL keep their current rules from cur, if any, and
+// are otherwise empty until the rule provider applies them.
+func routerConfig(cfg *config.ClientConfig, cur *router.Router) (router.Config, error) {
+	rcfg := router.Config{
+		ProxyRule:  router.ParseProxyRule(cfg.Routing.ProxyRule),
+		IPV6Rule:   router.ParseIPV6Rule(cfg.Routing.IPV6Rule),
+		DirectFile: cfg.Routing.DirectFile,
+		ProxyFile:  cfg.Routing.ProxyFile,
+		BlockFile:  cfg.Routing.BlockFile,
+		Country:    cfg.Routing.GeoData.Country,
+		GeoIPFile:  cfg.Routing.GeoData.GeoIPFile,
+		GeoSiteDir: cfg.Routing.GeoData.GeoSiteDir,
+		Rules:      routeRules(cfg.Routing.Rules),
+		Learn: router.LearnConfig{
+			Enabled:  cfg.Routing.Learn.Enabled,
+			File:     cfg.Routing.Learn.File,
+			Failures: cfg.Routing.Learn.Failures,
+			TTL:      time.Duration(cfg.Routing.Learn.TTL) * time.Second,
+		},
+		Race: router.RaceConfig{
+			Enabled:   cfg.Routing.Race.Enabled,
+			HeadStart: time.Duration(cfg.Routing.Race.HeadStartMS) * time.Millisecond,
+			TTL:       time.Duration(cfg.Routing.Race.TTL) * time.Second,
+		},
+	}
+	for _, rs := range cfg.Routing.RuleSets {
+		if (rs.File == "") == (rs.URL == "") {
+			return router.Config{}, fmt.Errorf("rule set %q: set exactly one of file and url", rs.Name())
+		}
+		if rs.URL != "" {
+			set := &router.RuleSet{Name: rs.URL}
+			if cur != nil {
+				if prev := cur.RuleSet(rs.URL); prev != nil {
+					set = prev
+				}
+			}
+			rcfg.RuleSets = append(rcfg.RuleSets, set)
+			continue
+		}
+		set, err := router.LoadRuleSet(rs.File, rs.Format, rs.Outbound)
+		if err != nil {
+			return router.Config{}, err
+		}
+		rcfg.RuleSets = append(rcfg.RuleSets, set)
+	}
+	return rcfg, nil
+}
 
-	log.Info("[CLIENT] transport initialized", "server_url", cfg.ServerURL(), "max_slots", cfg.Transport.ConnCountMax, "stream_threshold", cfg.Transport.StreamThreshold, "server_addr", cfg.DefaultServerAddr(), "direct_iface", directIface)
+func shaperConfig(sc config.ShaperConfig) shaper.Config {
+	return shaper.Config{
+		BatchWindowMS: sc.BatchWindowMS,
+		Cover: shaper.CoverConfig{
+			BudgetRatio: sc.CoverBudgetRatio,
+			BudgetCap:   sc.CoverBudgetCap,
+		},
+	}
+}
 
-	go client.closeIdleLoop()
+func routeRules(rules []config.RouteRule) []router.Rule {
+	out := make([]router.Rule, 0, len(rules))
+	for _, r := range rules {
+		out = append(out, router.Rule{Outbound: r.Outbound, Hosts: r.Hosts, File: r.File, Ports: r.Ports, Network: r.Network, Processes: r.Processes})
+	}
+	return out
+}
 
-	return client, nil
+// checkOutbounds verifies every server in outbounds exists and that no
+// server name shadows a built-in outbound.
+func checkOutbounds(upstreams []*balancer.Upstream, outbounds []string) error {
+	names := make(map[string]bool, len(upstreams))
+	for _, u := range upstreams {
+		if u.Name == router.OutboundDirect || u.Name == router.OutboundBlock {
+			return fmt.Errorf("server name %q is reserved", u.Name)
+		}
+		names[u.Name] = true
+	}
+	for _, name := range outbounds {
+		if !names[name] {
+			return fmt.Errorf("routing rule outbound %q: no server with that name", name)
+		}
+	}
+	return nil
 }
 
 func newDirectDialer() (*dialer.Dialer, string) {
@@ -196,19 +502,43 @@ func (c *Client) Router() *router.Router {
 	return c.router
 }
 
+// Transport returns the transport of the selected server.
 func (c *Client) Transport() transport.Transport {
-	return c.transport
+	return c.selected().Transport
+}
+
+// Balancer returns the balancer choosing the server of each new stream.
+func (c *Client) Balancer() *balancer.Balancer {
+	return c.balancer
+}
+
+// TransportStats returns the transport stats summed over all servers.
+func (c *Client) TransportStats() transport.TransportStats {
+	return c.balancer.Stats()
+}
+
+// SelectServer makes server i the preferred one. Streams opened afterwards
+// use it (subject to the failover policy); existing streams are untouched.
+func (c *Client) SelectServer(i int) error {
+	return c.balancer.Select(i)
+}
+
+func (c *Client) selected() *balancer.Upstream {
+	return c.balancer.SelectedUpstream()
 }
 
 func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	return dialWithConfig(ctx, c.cfg, c.dialer, c.router, network, addr)
 }
 
+// MasterKey returns the master key of the selected server.
 func (c *Client) MasterKey() []byte {
-	return c.masterKey
+	return c.selected().MasterKey
 }
 
 func (c *Client) ShaperConfig() shaper.Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.shaperCfg
 }
 
@@ -221,7 +551,7 @@ func (c *Client) Close() error {
 	defer c.mu.Unlock()
 
 	close(c.closeIdleDone)
-	return c.transport.Close()
+	return c.balancer.Close()
 }
 
 func (c *Client) closeIdleLoop() {
@@ -230,7 +560,7 @@ func (c *Client) closeIdleLoop() {
 	for {
 		select {
 		case <-ticker.C:
-			c.transport.CloseIdle()
+			c.balancer.CloseIdle()
 		case <-c.closeIdleDone:
 			return
 		}
@@ -29,6 +29,7 @@ func BuildSimpleConfig(s *sharedconfig.SimpleConfig) (*ClientConfig, error) {
 			Method:   s.Method,
 			SNI:      s.SN,
 			CAPath:   s.CAPath,
+			Pin:      s.Pin,
 			Default:  true,
 		}},
 		Local: LocalConfig{
@@ -46,6 +47,7 @@ func BuildSimpleConfig(s *sharedconfig.SimpleConfig) (*ClientConfig, error) {
 			IPV6Rule:   s.IPV6Rule,
 			DirectFile: s.DirectFile,
 			ProxyFile:  s.ProxyFile,
+			BlockFile:  s.BlockFile,
 		},
 		Transport: TransportConfig{
 			Protocol:     proto,
@@ -57,6 +59,7 @@ func BuildSimpleConfig(s *sharedconfig.SimpleConfig) (*ClientConfig, error) {
 		Log: LogConfig{
 			Level:    s.LogLevel,
 			FilePath: s.LogFilePath,
+			Privacy:  s.LogPrivacy,
 		},
 		Timeout: s.Timeout,
 	}
@@ -130,6 +133,9 @@ func ApplySimpleOverrides(cfg *ClientConfig, s *sharedconfig.SimpleConfig) {
 	if s.ProxyFile != "" {
 		cfg.Routing.ProxyFile = s.ProxyFile
 	}
+	if s.BlockFile != "" {
+		cfg.Routing.BlockFile = s.BlockFile
+	}
 	if s.Timeout > 0 {
 		cfg.Timeout = s.Timeout
 	}
@@ -139,6 +145,9 @@ func ApplySimpleOverrides(cfg *ClientConfig, s *sharedconfig.SimpleConfig) {
 	if s.LogFilePath != "" {
 		cfg.Log.FilePath = s.LogFilePath
 	}
+	if s.LogPrivacy != "" {
+		cfg.Log.Privacy = s.LogPrivacy
+	}
 	if s.DisableSysProxy {
 		cfg.Local.DisableSysProxy = true
 	}
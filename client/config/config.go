@@ -3,8 +3,14 @@ package config
 import (
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	utls "github.com/refraction-networking/utls"
@@ -23,6 +29,9 @@ const ProxyDNSServer = "8.8.8.8:53"
 const DefaultSystemDNS = "223.5.5.5"
 
 type ServerProfile struct {
+	// Name identifies the server in routing rules; it defaults to
+	// address:port.
+	Name     string `json:"name,omitempty"`
 	Address  string `json:"address"`
 	Port     int    `json:"port"`
 	Password string `json:"password"`
@@ -30,6 +39,61 @@ type ServerProfile struct {
 	SNI      string `json:"sn"`
 	CAPath   string `json:"ca_path"`
 	Default  bool   `json:"default"`
+	// Weight is the share of new streams the server receives under the
+	// weighted failover policy; <= 0 counts as 1.
+	Weight int `json:"weight,omitempty"`
+	// Chain names the server this one is reached through: its connections
+	// run inside a stream to the Chain server instead of a direct dial.
+	Chain string `json:"chain,omitempty"`
+	// Pin is the hex SHA-256 of the server's leaf certificate. When set it
+	// replaces CA verification, so self-signed certificates work without
+	// a ca_path.
+	Pin string `json:"pin,omitempty"`
+	// Subscription is the source the profile was imported from; profiles
+	// with a source are replaced whenever that subscription refreshes.
+	Subscription string `json:"subscription,omitempty"`
+}
+
+// DefaultSubscriptionInterval is how often subscriptions refresh when no
+// interval is configured.
+const DefaultSubscriptionInterval = time.Hour
+
+// Subscription is a URL or local file listing server profiles, as
+// easyss:// links (optionally base64-encoded as a whole) or a JSON array.
+type Subscription struct {
+	URL string `json:"url"`
+	// Interval is the refresh period in seconds; 0 uses the default and a
+	// negative value only loads the subscription at startup.
+	Interval int `json:"interval,omitempty"`
+}
+
+// IntervalDuration returns the refresh period; 0 means no refresh.
+func (s Subscription) IntervalDuration() time.Duration {
+	if s.Interval < 0 {
+		return 0
+	}
+	if s.Interval == 0 {
+		return DefaultSubscriptionInterval
+	}
+	return time.Duration(s.Interval) * time.Second
+}
+
+// Failover policies decide which server new streams are opened against.
+const (
+	FailoverManual        = "manual"
+	FailoverFailover      = "failover"
+	FailoverLowestLatency = "lowest_latency"
+	FailoverWeighted      = "weighted"
+)
+
+// DefaultProbeTarget is the plain HTTP endpoint probes ask the servers to
+// reach.
+const DefaultProbeTarget = "www.gstatic.com:80"
+
+type FailoverConfig struct {
+	Policy        string `json:"policy"`
+	ProbeInterval int    `json:"probe_interval"`
+	ProbeTarget   string `json:"probe_target"`
 }
 
 type LocalConfig struct {
@@ -44,10 +108,123 @@ type LocalConfig struct {
 }
 
 type RoutingConfig struct {
-	ProxyRule  string `json:"proxy_rule"`
-	IPV6Rule   string `json:"ipv6_rule"`
-	DirectFile string `json:"direct_file"`
-	ProxyFile  string `json:"proxy_file"`
+	ProxyRule  string          `json:"proxy_rule"`
+	IPV6Rule   string          `json:"ipv6_rule"`
+	DirectFile string          `json:"direct_file"`
+	ProxyFile  string          `json:"proxy_file"`
+	BlockFile  string          `json:"block_file,omitempty"`
+	Rules      []RouteRule     `json:"rules,omitempty"`
+	RuleSets   []RuleSetConfig `json:"rule_sets,omitempty"`
+	GeoData    GeoDataConfig   `json:"geodata,omitzero"`
+	// FindProcess is a FindProcess mode, FindProcessAuto if empty.
+	FindProcess string      `json:"find_process,omitempty"`
+	Learn       LearnConfig `json:"learn,omitzero"`
+	Race        RaceConfig  `json:"race,omitzero"`
+	// DisableSniff stops TUN mode from sniffing the domain of connections
+	// to IPs from their TLS server name, HTTP Host or QUIC Initial.
+	DisableSniff bool `json:"disable_sniff,omitempty"`
+}
+
+// LearnConfig enables learned routing: domains the auto rules send direct
+// are retried through the proxy when their direct connections fail, and
+// after Failures failures within an hour go through the proxy for TTL
+// seconds. File keeps them across restarts.
+type LearnConfig struct {
+	Enabled  bool   `json:"enabled"`
+	File     string `json:"file,omitempty"`
+	Failures int    `json:"failures,omitempty"`
+	TTL      int    `json:"ttl,omitempty"`
+}
+
+// RaceConfig enables racing: domains the auto rules would proxy for lack
+// of data are connected both directly, with a head start of HeadStartMS
+// milliseconds, and through the proxy, and the faster path routes the
+// domain for TTL seconds.
+type RaceConfig struct {
+	Enabled     bool `json:"enabled"`
+	HeadStartMS int  `json:"head_start_ms,omitempty"`
+	TTL         int  `json:"ttl,omitempty"`
+}
+
+// FindProcess modes decide when the client looks up the local process of
+// a connection (Linux only): while routing rules match on processes, for
+// every connection so the logs name it, or never.
+const (
+	FindProcessAuto   = "auto"
+	FindProcessAlways = "always"
+	FindProcessOff    = "off"
+)
+
+// GeoDataConfig replaces the built-in mainland China GeoIP and GeoSite
+// data. Country is the ISO code the auto proxy rules treat as local (CN if
+// empty), GeoIPFile a MaxMind country mmdb and GeoSiteDir a directory of
+// <category>.txt domain lists; "direct" and "block" replace the lists auto
+// and auto_block use.
+type GeoDataConfig struct {
+	Country    string `json:"country,omitempty"`
+	GeoIPFile  string `json:"geoip_file,omitempty"`
+	GeoSiteDir string `json:"geosite_dir,omitempty"`
+	// GeoIPURL and GeoSiteURLs (category to URL) are what easyss
+	// update-geodata downloads; empty uses the defaults.
+	GeoIPURL    string            `json:"geoip_url,omitempty"`
+	GeoSiteURLs map[string]string `json:"geosite_urls,omitempty"`
+}
+
+// RouteRule sends matching hosts to Outbound: a server name, "direct" or
+// "block". Hosts and the lines of File use the direct_file syntax. Ports
+// ("22", "8000-8999"), Network ("tcp", "udp" or "icmp") and Processes
+// ("git", "/usr/bin/curl" or "uid:1000") restrict the rule to those
+// connections; with no hosts it applies to every host.
+type RouteRule struct {
+	Hosts     []string `json:"hosts,omitempty"`
+	File      string   `json:"file,omitempty"`
+	Ports     []string `json:"ports,omitempty"`
+	Network   string   `json:"network,omitempty"`
+	Processes []string `json:"processes,omitempty"`
+	Outbound  string   `json:"outbound"`
+}
+
+// DefaultRuleSetInterval is how often remote rule sets refresh when no
+// interval is configured.
+const DefaultRuleSetInterval = 24 * time.Hour
+
+// RuleSetConfig loads a rule list from File or from URL, a rule provider
+// refreshed in the background. Format is "rules" (Clash/Surge, the
+// default) or "list" (the direct_file syntax). Outbound is the action of
+// rules that do not name one: DIRECT, REJECT, PROXY or a server name.
+type RuleSetConfig struct {
+	File     string `json:"file,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Format   string `json:"format,omitempty"`
+	Outbound string `json:"outbound,omitempty"`
+	// Interval is the refresh period of a URL in seconds; 0 uses the
+	// default and a negative value only loads it at startup.
+	Interval int `json:"interval,omitempty"`
+	// SHA256 is the hex digest a fetched list must have.
+	SHA256 string `json:"sha256,omitempty"`
+	// PublicKey is a base64 ed25519 key; when set, a fetched list must
+	// carry a valid signature, fetched from SignatureURL or URL + ".sig".
+	PublicKey    string `json:"public_key,omitempty"`
+	SignatureURL string `json:"signature_url,omitempty"`
+}
+
+// Name identifies the rule set: its URL, or its file.
+func (rs RuleSetConfig) Name() string {
+	if rs.URL != "" {
+		return rs.URL
+	}
+	return rs.File
+}
+
+// IntervalDuration returns the refresh period; 0 means no refresh.
+func (rs RuleSetConfig) IntervalDuration() time.Duration {
+	if rs.Interval < 0 {
+		return 0
+	}
+	if rs.Interval == 0 {
+		return DefaultRuleSetInterval
+	}
+	return time.Duration(rs.Interval) * time.Second
 }
 
 type TransportConfig struct {
@@ -64,13 +241,17 @@ type ShaperConfig struct {
 }
 
 type LogConfig struct {
-	Level    string `json:"level"`
-	FilePath string `json:"file_path"`
+	Level      string `json:"level"`
+	FilePath   string `json:"file_path"`
+	Privacy    string `json:"privacy"`
+	PrivacyKey string `json:"privacy_key"`
 }
 
 type ClientConfig struct {
 	ConfigVersion int              `json:"version"`
 	Servers       []*ServerProfile `json:"servers"`
+	Subscriptions []Subscription   `json:"subscriptions,omitempty"`
+	Failover      FailoverConfig   `json:"failover"`
 	Local         LocalConfig      `json:"local"`
 	Routing       RoutingConfig    `json:"routing"`
 	Transport     TransportConfig  `json:"transport"`
@@ -80,9 +261,31 @@ type ClientConfig struct {
 	AuthUsername  string           `json:"auth_username"`
 	AuthPassword  string           `json:"auth_password"`
 	PprofEnabled  bool             `json:"pprof_enabled"`
+
+	// serversMu guards Servers once a running client shares the config.
+	// Writers replace the slice and never modify a published profile, so
+	// ServerList can hand out the slice itself.
+	serversMu sync.RWMutex
+}
+
+// ServerList returns the current server list, which the caller must not
+// modify.
+func (c *ClientConfig) ServerList() []*ServerProfile {
+	c.serversMu.RLock()
+	defer c.serversMu.RUnlock()
+	return c.Servers
+}
+
+// SetServers makes servers the server list.
+func (c *ClientConfig) SetServers(servers []*ServerProfile) {
+	c.serversMu.Lock()
+	c.Servers = servers
+	c.serversMu.Unlock()
 }
 
 func (c *ClientConfig) DefaultServer() *ServerProfile {
+	c.serversMu.RLock()
+	defer c.serversMu.RUnlock()
 	for _, s := range c.Servers {
 		if s.Default {
 			return s
@@ -99,7 +302,7 @@ func (c *ClientConfig) ServerURL() string {
 	if srv == nil {
 		return ""
 	}
-	return fmt.Sprintf("https://%s:%d", srv.Address, srv.Port)
+	return srv.URL()
 }
 
 func (c *ClientConfig) TimeoutDuration() time.Duration {
@@ -109,15 +312,47 @@ func (c *ClientConfig) TimeoutDuration() time.Duration {
 	return time.Duration(c.Timeout) * time.Second
 }
 
+// ProbeIntervalDuration returns how often servers are probed; 0 means
+// probing is disabled.
+func (c *ClientConfig) ProbeIntervalDuration() time.Duration {
+	if c.Failover.ProbeInterval < 0 {
+		return 0
+	}
+	if c.Failover.ProbeInterval == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.Failover.ProbeInterval) * time.Second
+}
+
 func (c *ClientConfig) UTLSConfig() *utls.Config {
 	srv := c.DefaultServer()
 	if srv == nil {
 		return nil
 	}
+	return srv.UTLSConfig()
+}
+
+// Addr returns the server's host:port.
+func (s *ServerProfile) Addr() string {
+	return net.JoinHostPort(s.Address, strconv.Itoa(s.Port))
+}
+
+// DisplayName returns Name, or Addr if the profile is unnamed.
+func (s *ServerProfile) DisplayName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Addr()
+}
 
-	sni := srv.SNI
+func (s *ServerProfile) URL() string {
+	return "https://" + s.Addr()
+}
+
+func (s *ServerProfile) UTLSConfig() *utls.Config {
+	sni := s.SNI
 	if sni == "" {
-		sni = srv.Address
+		sni = s.Address
 	}
 
 	utlsCfg := &utls.Config{
@@ -125,12 +360,27 @@ func (c *ClientConfig) UTLSConfig() *utls.Config {
 		NextProtos: config.NextProtos,
 	}
 
-	if srv.CAPath != "" {
+	if s.Pin != "" {
+		pin := strings.ToLower(s.Pin)
+		utlsCfg.InsecureSkipVerify = true
+		utlsCfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			if got := CertPin(rawCerts[0]); got != pin {
+				return fmt.Errorf("certificate pin mismatch: got %s", got)
+			}
+			return nil
+		}
+		return utlsCfg
+	}
+
+	if s.CAPath != "" {
 		pool, err := x509.SystemCertPool()
 		if err != nil || pool == nil {
 			pool = x509.NewCertPool()
 		}
-		pem, err := os.ReadFile(srv.CAPath)
+		pem, err := os.ReadFile(s.CAPath)
 		if err == nil && pool.AppendCertsFromPEM(pem) {
 			utlsCfg.RootCAs = pool
 		}
@@ -148,12 +398,13 @@ func LoadConfig(path string) (*ClientConfig, error) {
 	var probe struct {
 		ConfigVersion int              `json:"version"`
 		Servers       []*ServerProfile `json:"servers"`
+		Subscriptions []Subscription   `json:"subscriptions"`
 		Server        string           `json:"server"`
 	}
 	if err := json.Unmarshal(data, &probe); err != nil {
 		return nil, err
 	}
-	if probe.ConfigVersion != 3 || len(probe.Servers) == 0 {
+	if probe.ConfigVersion != 3 || len(probe.Servers)+len(probe.Subscriptions) == 0 {
 		var s config.SimpleConfig
 		if err := json.Unmarshal(data, &s); err != nil {
 			return nil, err
@@ -170,6 +421,32 @@ func LoadConfig(path string) (*ClientConfig, error) {
 	return &cfg, nil
 }
 
+// SaveConfig writes cfg to path as full-mode JSON, replacing the file
+// atomically.
+func SaveConfig(path string, cfg *ClientConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close() //nolint:errcheck
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close() //nolint:errcheck
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 func applyDefaults(c *ClientConfig) {
 	if c.Timeout <= 0 {
 		c.Timeout = config.DefaultTimeout
@@ -201,16 +478,29 @@ func applyDefaults(c *ClientConfig) {
 	if c.Routing.IPV6Rule == "" {
 		c.Routing.IPV6Rule = "auto"
 	}
+	if c.Routing.FindProcess == "" {
+		c.Routing.FindProcess = FindProcessAuto
+	}
 	if c.Log.Level == "" {
 		c.Log.Level = "info"
 	}
+	if c.Failover.Policy == "" {
+		c.Failover.Policy = FailoverManual
+	}
+	if c.Failover.ProbeTarget == "" {
+		c.Failover.ProbeTarget = DefaultProbeTarget
+	}
 	for _, srv := range c.Servers {
-		if srv.Port == 0 {
-			srv.Port = 443
-		}
-		if srv.Method == "" {
-			srv.Method = "aes-256-gcm"
-		}
+		applyServerDefaults(srv)
+	}
+}
+
+func applyServerDefaults(srv *ServerProfile) {
+	if srv.Port == 0 {
+		srv.Port = 443
+	}
+	if srv.Method == "" {
+		srv.Method = "aes-256-gcm"
 	}
 }
 
@@ -227,12 +517,29 @@ func (c *ClientConfig) Clone() *ClientConfig {
 }
 
 func (c *ClientConfig) SetDefaultServerIndex(i int) {
+	c.serversMu.Lock()
+	defer c.serversMu.Unlock()
+	c.setDefaultServerIndex(i)
+}
+
+// setDefaultServerIndex replaces the profiles whose default flag changes
+// with updated copies.
+func (c *ClientConfig) setDefaultServerIndex(i int) {
+	servers := make([]*ServerProfile, len(c.Servers))
 	for j, s := range c.Servers {
-		s.Default = (j == i)
+		if s.Default != (j == i) {
+			srv := *s
+			srv.Default = j == i
+			s = &srv
+		}
+		servers[j] = s
 	}
+	c.Servers = servers
 }
 
 func (c *ClientConfig) ServerListAddrs() []string {
+	c.serversMu.RLock()
+	defer c.serversMu.RUnlock()
 	var addrs []string
 	for _, s := range c.Servers {
 		addrs = append(addrs, fmt.Sprintf("%s:%d", s.Address, s.Port))
@@ -249,6 +556,8 @@ func (c *ClientConfig) DefaultServerAddr() string {
 }
 
 func (c *ClientConfig) DefaultServerIndex() int {
+	c.serversMu.RLock()
+	defer c.serversMu.RUnlock()
 	for i, s := range c.Servers {
 		if s.Default {
 			return i
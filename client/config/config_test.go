@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/nange/easyss/v3/config"
@@ -192,6 +193,42 @@ func TestSetDefaultServerIndex(t *testing.T) {
 	}
 }
 
+func TestServerListSnapshot(t *testing.T) {
+	cfg := &ClientConfig{
+		Servers: []*ServerProfile{
+			{Address: "s1.example.com", Default: true},
+			{Address: "s2.example.com"},
+		},
+	}
+	snap := cfg.ServerList()
+	cfg.SetDefaultServerIndex(1)
+	cfg.ImportServers(&ServerProfile{Name: "s3", Address: "s3.example.com"})
+	// 已取出的快照不受后续修改影响
+	if !snap[0].Default || snap[1].Default || len(snap) != 2 {
+		t.Error("snapshot changed after SetDefaultServerIndex/ImportServers")
+	}
+	if cfg.DefaultServerIndex() != 1 || len(cfg.ServerList()) != 3 {
+		t.Errorf("default = %d, servers = %d", cfg.DefaultServerIndex(), len(cfg.ServerList()))
+	}
+
+	// 并发读写（配合 -race）
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Go(func() {
+			for j := range 100 {
+				if i%2 == 0 {
+					cfg.SetServers([]*ServerProfile{{Address: "a.example.com"}, {Address: "b.example.com"}})
+					cfg.SetDefaultServerIndex(j % 2)
+				} else {
+					_ = cfg.DefaultServer()
+					_ = cfg.ServerListAddrs()
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
 func TestServerListAddrs(t *testing.T) {
 	t.Run("多服务器", func(t *testing.T) {
 		cfg := &ClientConfig{
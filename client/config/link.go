@@ -0,0 +1,242 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nange/easyss/v3/protocol"
+)
+
+// LinkScheme is the URI scheme of share links:
+//
+//	easyss://<method>:<password>@<host>:<port>?sni=<sni>&pin=<pin>#<name>
+const LinkScheme = "easyss"
+
+// CertPin returns the pin of a DER-encoded certificate: its hex SHA-256.
+func CertPin(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// Link encodes the profile as an easyss:// share link. Local-only settings
+// (ca_path, default, weight, chain) are not part of the link.
+func (s *ServerProfile) Link() string {
+	q := url.Values{}
+	if s.SNI != "" {
+		q.Set("sni", s.SNI)
+	}
+	if s.Pin != "" {
+		q.Set("pin", s.Pin)
+	}
+	u := url.URL{
+		Scheme:   LinkScheme,
+		User:     url.UserPassword(s.Method, s.Password),
+		Host:     s.Addr(),
+		RawQuery: q.Encode(),
+		Fragment: s.Name,
+	}
+	return u.String()
+}
+
+// ParseLink decodes an easyss:// share link. A missing port defaults to 443.
+func ParseLink(link string) (*ServerProfile, error) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return nil, fmt.Errorf("parse link: %w", err)
+	}
+	if u.Scheme != LinkScheme {
+		return nil, fmt.Errorf("parse link: unsupported scheme %q", u.Scheme)
+	}
+	if u.User == nil {
+		return nil, errors.New("parse link: missing method and password")
+	}
+	password, _ := u.User.Password()
+	srv := &ServerProfile{
+		Name:     u.Fragment,
+		Address:  u.Hostname(),
+		Password: password,
+		Method:   u.User.Username(),
+		SNI:      u.Query().Get("sni"),
+		Pin:      strings.ToLower(u.Query().Get("pin")),
+	}
+	if srv.Address == "" {
+		return nil, errors.New("parse link: missing address")
+	}
+	if srv.Password == "" {
+		return nil, errors.New("parse link: missing password")
+	}
+	if p := u.Port(); p != "" {
+		port, err := strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("parse link: invalid port %q", p)
+		}
+		srv.Port = port
+	}
+	if srv.Method != "" && protocol.MethodFromString(srv.Method) == 0 {
+		return nil, fmt.Errorf("parse link: unsupported method %q", srv.Method)
+	}
+	if srv.Pin != "" {
+		if b, err := hex.DecodeString(srv.Pin); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("parse link: invalid pin %q", srv.Pin)
+		}
+	}
+	applyServerDefaults(srv)
+	return srv, nil
+}
+
+// ParseServerList decodes a subscription body: a JSON array of profiles, or
+// easyss:// links one per line, optionally base64-encoded as a whole. Blank
+// lines and lines starting with # are ignored.
+func ParseServerList(data []byte) ([]*ServerProfile, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errors.New("empty server list")
+	}
+
+	if data[0] == '[' {
+		var servers []*ServerProfile
+		if err := json.Unmarshal(data, &servers); err != nil {
+			return nil, fmt.Errorf("parse server list: %w", err)
+		}
+		for i, srv := range servers {
+			if srv == nil || srv.Address == "" || srv.Password == "" {
+				return nil, fmt.Errorf("parse server list: entry %d needs address and password", i)
+			}
+			applyServerDefaults(srv)
+		}
+		return servers, nil
+	}
+
+	if !bytes.Contains(data, []byte("://")) {
+		decoded, err := decodeBase64(string(data))
+		if err != nil {
+			return nil, errors.New("parse server list: neither links, base64 nor JSON")
+		}
+		data = decoded
+	}
+
+	var servers []*ServerProfile
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		srv, err := ParseLink(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		servers = append(servers, srv)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("empty server list")
+	}
+	return servers, nil
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	var err error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		var b []byte
+		if b, err = enc.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	return nil, err
+}
+
+// ServerIndex returns the index of the server whose DisplayName is name, or
+// -1.
+func (c *ClientConfig) ServerIndex(name string) int {
+	c.serversMu.RLock()
+	defer c.serversMu.RUnlock()
+	return c.serverIndex(name)
+}
+
+func (c *ClientConfig) serverIndex(name string) int {
+	for i, s := range c.Servers {
+		if s.DisplayName() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// ImportServers adds servers, replacing existing profiles with the same
+// DisplayName in place. Imported profiles never become the default.
+func (c *ClientConfig) ImportServers(servers ...*ServerProfile) {
+	c.serversMu.Lock()
+	defer c.serversMu.Unlock()
+	// Work on a copy, as ServerList may have handed out the current slice.
+	c.Servers = slices.Clone(c.Servers)
+	for _, srv := range servers {
+		srv.Default = false
+		if i := c.serverIndex(srv.DisplayName()); i >= 0 {
+			srv.Default = c.Servers[i].Default
+			c.Servers[i] = srv
+			continue
+		}
+		c.Servers = append(c.Servers, srv)
+	}
+}
+
+// MergeSubscription replaces the profiles previously imported from source
+// with servers and reports whether the server list changed. Profiles whose
+// name is taken by a server from elsewhere are skipped. The default server
+// is kept by name; if it disappeared, the first server becomes the default.
+func (c *ClientConfig) MergeSubscription(source string, servers []*ServerProfile) bool {
+	c.serversMu.Lock()
+	defer c.serversMu.Unlock()
+	before, _ := json.Marshal(c.Servers)
+
+	defaultName := ""
+	for _, s := range c.Servers {
+		if s.Default {
+			defaultName = s.DisplayName()
+			break
+		}
+	}
+
+	kept := make([]*ServerProfile, 0, len(c.Servers)+len(servers))
+	taken := make(map[string]bool)
+	for _, s := range c.Servers {
+		if s.Subscription != source {
+			kept = append(kept, s)
+			taken[s.DisplayName()] = true
+		}
+	}
+	for _, s := range servers {
+		name := s.DisplayName()
+		if taken[name] {
+			continue
+		}
+		taken[name] = true
+		srv := *s
+		srv.Subscription = source
+		srv.Default = false
+		kept = append(kept, &srv)
+	}
+	c.Servers = kept
+	c.setDefaultServerIndex(c.serverIndex(defaultName))
+
+	after, _ := json.Marshal(c.Servers)
+	return !bytes.Equal(before, after)
+}
+
+// ServerFingerprint identifies a profile's connection settings, ignoring
+// the default flag, so unchanged servers can be told apart from edited ones.
+func ServerFingerprint(s *ServerProfile) string {
+	srv := *s
+	srv.Default = false
+	b, _ := json.Marshal(&srv)
+	return string(b)
+}
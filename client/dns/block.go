@@ -0,0 +1,33 @@
+package dns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// blockedTTL is the TTL of blocked answers, short so unblocking an entry
+// takes effect soon.
+const blockedTTL = 60
+
+// BlockedReply returns the sinkhole reply to the query req of a blocked
+// domain: 0.0.0.0 for A, :: for AAAA and NXDOMAIN for other types, so
+// programs fail fast instead of retrying an empty answer.
+func BlockedReply(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if len(req.Question) == 0 {
+		return m
+	}
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: blockedTTL}
+	switch q.Qtype {
+	case dns.TypeA:
+		m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+	case dns.TypeAAAA:
+		m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+	default:
+		m.Rcode = dns.RcodeNameError
+	}
+	return m
+}
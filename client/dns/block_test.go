@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlockedReply(t *testing.T) {
+	tests := []struct {
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{dns.TypeAAAA, dns.RcodeSuccess, "::"},
+		{dns.TypeHTTPS, dns.RcodeNameError, ""},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("ads.example.com.", tt.qtype)
+		m := BlockedReply(req)
+		if !m.Response || m.Id != req.Id || m.Rcode != tt.rcode {
+			t.Errorf("%s: reply header = %+v", dns.TypeToString[tt.qtype], m.MsgHdr)
+		}
+		var got string
+		switch rr := firstAnswer(m).(type) {
+		case *dns.A:
+			got = rr.A.String()
+		case *dns.AAAA:
+			got = rr.AAAA.String()
+		}
+		if got != tt.answer {
+			t.Errorf("%s: answer %q, want %q", dns.TypeToString[tt.qtype], got, tt.answer)
+		}
+	}
+}
+
+func firstAnswer(m *dns.Msg) dns.RR {
+	if len(m.Answer) == 0 {
+		return nil
+	}
+	return m.Answer[0]
+}
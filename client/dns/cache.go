@@ -19,20 +19,21 @@ const (
 // Cache stores DNS query results in two separate caches: one for proxied
 // results and one for direct (non-proxied) results.
 type Cache struct {
-	proxied      *freecache.Cache
-	direct       *freecache.Cache
-	serverDomain string
+	proxied        *freecache.Cache
+	direct         *freecache.Cache
+	isServerDomain func(string) bool
 }
 
 // NewCache creates a new DNS cache with separate storage for proxied and
-// direct results. Entries for serverDomain (usually the proxy server's own
-// hostname) are cached without expiration so that a TTL expiry can never
-// trigger a burst of concurrent direct queries for it.
-func NewCache(serverDomain string) *Cache {
+// direct results. Entries for domains isServerDomain reports (the proxy
+// servers' own hostnames), if it is not nil, are cached without expiration
+// so that a TTL expiry can never trigger a burst of concurrent direct
+// queries for them.
+func NewCache(isServerDomain func(string) bool) *Cache {
 	return &Cache{
-		proxied:      freecache.NewCache(cacheSize),
-		direct:       freecache.NewCache(cacheSize),
-		serverDomain: serverDomain,
+		proxied:        freecache.NewCache(cacheSize),
+		direct:         freecache.NewCache(cacheSize),
+		isServerDomain: isServerDomain,
 	}
 }
 
@@ -70,7 +71,7 @@ func (c *Cache) Set(msg *dns.Msg, isDirect bool) error {
 			return err
 		}
 		key := []byte(q.Name + dns.TypeToString[q.Qtype])
-		ttl := dnsCacheTTL(msg, c.serverDomain)
+		ttl := dnsCacheTTL(msg, c.isServerDomain)
 		if isDirect {
 			return c.direct.Set(key, v, ttl)
 		}
@@ -80,14 +81,13 @@ func (c *Cache) Set(msg *dns.Msg, isDirect bool) error {
 }
 
 // dnsCacheTTL returns the cache lifetime in seconds for the given DNS
-// message. Entries for the proxy server's own domain never expire (0 means
+// message. Entries for the proxy servers' own domains never expire (0 means
 // forever in freecache); other domains are cached for the minimal answer TTL
 // clamped to [minCacheTTL, maxCacheTTL].
-func dnsCacheTTL(msg *dns.Msg, serverDomain string) int {
-	if serverDomain != "" {
+func dnsCacheTTL(msg *dns.Msg, isServerDomain func(string) bool) int {
+	if isServerDomain != nil {
 		q := msg.Question[0]
-		domain := strings.TrimSuffix(q.Name, ".")
-		if strings.EqualFold(domain, serverDomain) {
+		if isServerDomain(strings.TrimSuffix(q.Name, ".")) {
 			return 0
 		}
 	}
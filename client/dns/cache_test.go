@@ -1,6 +1,7 @@
 package dns
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -8,7 +9,7 @@ import (
 )
 
 func TestNewCache(t *testing.T) {
-	c := NewCache("")
+	c := NewCache(nil)
 	if c == nil {
 		t.Fatal("NewCache returned nil")
 	}
@@ -18,7 +19,7 @@ func TestNewCache(t *testing.T) {
 }
 
 func TestCache_SetAndGet(t *testing.T) {
-	c := NewCache("")
+	c := NewCache(nil)
 
 	// 构造 A 记录查询响应
 	msg := &dns.Msg{}
@@ -53,7 +54,7 @@ func TestCache_SetAndGet(t *testing.T) {
 }
 
 func TestCache_SetAndGet_AAAA(t *testing.T) {
-	c := NewCache("")
+	c := NewCache(nil)
 
 	msg := &dns.Msg{}
 	msg.SetQuestion("example.com.", dns.TypeAAAA)
@@ -77,7 +78,7 @@ func TestCache_SetAndGet_AAAA(t *testing.T) {
 }
 
 func TestCache_Get_Miss(t *testing.T) {
-	c := NewCache("")
+	c := NewCache(nil)
 
 	// 未存储的 key 返回 nil
 	if got := c.Get("nonexistent.com.", "A", false); got != nil {
@@ -86,7 +87,7 @@ func TestCache_Get_Miss(t *testing.T) {
 }
 
 func TestCache_Set_NilMsg(t *testing.T) {
-	c := NewCache("")
+	c := NewCache(nil)
 
 	// nil msg 应不报错
 	if err := c.Set(nil, false); err != nil {
@@ -95,7 +96,7 @@ func TestCache_Set_NilMsg(t *testing.T) {
 }
 
 func TestCache_Set_EmptyQuestion(t *testing.T) {
-	c := NewCache("")
+	c := NewCache(nil)
 
 	msg := &dns.Msg{} // 无 Question
 	if err := c.Set(msg, false); err != nil {
@@ -104,7 +105,7 @@ func TestCache_Set_EmptyQuestion(t *testing.T) {
 }
 
 func TestCache_Set_NonARecord(t *testing.T) {
-	c := NewCache("")
+	c := NewCache(nil)
 
 	// MX 记录不应被缓存
 	msg := &dns.Msg{}
@@ -126,7 +127,7 @@ func TestCache_Set_NonARecord(t *testing.T) {
 }
 
 func TestCache_Get_UnpackError(t *testing.T) {
-	c := NewCache("")
+	c := NewCache(nil)
 
 	// 直接写入损坏的数据到内部缓存
 	key := []byte("test.com.A")
@@ -141,7 +142,7 @@ func TestCache_Get_UnpackError(t *testing.T) {
 }
 
 func TestCache_DirectVsProxied(t *testing.T) {
-	c := NewCache("")
+	c := NewCache(nil)
 
 	// 存储到 proxied
 	msgProxied := &dns.Msg{}
@@ -176,7 +177,7 @@ func TestDNSCacheTTL_Clamp(t *testing.T) {
 	msgLow.SetQuestion("example.com.", dns.TypeA)
 	rrLow, _ := dns.NewRR("example.com. 5 IN A 1.2.3.4")
 	msgLow.Answer = append(msgLow.Answer, rrLow)
-	if ttl := dnsCacheTTL(msgLow, ""); ttl != 30*60 {
+	if ttl := dnsCacheTTL(msgLow, nil); ttl != 30*60 {
 		t.Errorf("low TTL expected %d, got %d", 30*60, ttl)
 	}
 
@@ -185,7 +186,7 @@ func TestDNSCacheTTL_Clamp(t *testing.T) {
 	msgHigh.SetQuestion("example.com.", dns.TypeA)
 	rrHigh, _ := dns.NewRR("example.com. 86400 IN A 1.2.3.4")
 	msgHigh.Answer = append(msgHigh.Answer, rrHigh)
-	if ttl := dnsCacheTTL(msgHigh, ""); ttl != 2*60*60 {
+	if ttl := dnsCacheTTL(msgHigh, nil); ttl != 2*60*60 {
 		t.Errorf("high TTL expected %d, got %d", 2*60*60, ttl)
 	}
 
@@ -194,11 +195,16 @@ func TestDNSCacheTTL_Clamp(t *testing.T) {
 	msgMid.SetQuestion("example.com.", dns.TypeA)
 	rrMid, _ := dns.NewRR("example.com. 3600 IN A 1.2.3.4")
 	msgMid.Answer = append(msgMid.Answer, rrMid)
-	if ttl := dnsCacheTTL(msgMid, ""); ttl != 3600 {
+	if ttl := dnsCacheTTL(msgMid, nil); ttl != 3600 {
 		t.Errorf("mid TTL expected 3600, got %d", ttl)
 	}
 }
 
+// serverDomain returns a matcher for the server hostname domain.
+func serverDomain(domain string) func(string) bool {
+	return func(d string) bool { return strings.EqualFold(d, domain) }
+}
+
 func TestDNSCacheTTL_ServerDomain(t *testing.T) {
 	msg := &dns.Msg{}
 	msg.SetQuestion("mysite.net.", dns.TypeA)
@@ -206,23 +212,23 @@ func TestDNSCacheTTL_ServerDomain(t *testing.T) {
 	msg.Answer = append(msg.Answer, rr)
 
 	// 服务器域名（大小写不敏感匹配）→ 永不过期
-	if ttl := dnsCacheTTL(msg, "MySite.Net"); ttl != 0 {
+	if ttl := dnsCacheTTL(msg, serverDomain("MySite.Net")); ttl != 0 {
 		t.Errorf("server domain expected ttl 0, got %d", ttl)
 	}
 
 	// 非服务器域名 → 正常 clamp
-	if ttl := dnsCacheTTL(msg, "other.net"); ttl != 30*60 {
+	if ttl := dnsCacheTTL(msg, serverDomain("other.net")); ttl != 30*60 {
 		t.Errorf("non-server domain expected %d, got %d", 30*60, ttl)
 	}
 
-	// serverDomain 为空时不受影响
-	if ttl := dnsCacheTTL(msg, ""); ttl != 30*60 {
-		t.Errorf("empty serverDomain expected %d, got %d", 30*60, ttl)
+	// 未设置服务器域名时不受影响
+	if ttl := dnsCacheTTL(msg, nil); ttl != 30*60 {
+		t.Errorf("no server domain expected %d, got %d", 30*60, ttl)
 	}
 }
 
 func TestCache_ServerDomain_NeverExpires(t *testing.T) {
-	c := NewCache("mysite.net")
+	c := NewCache(serverDomain("mysite.net"))
 
 	msg := &dns.Msg{}
 	msg.SetQuestion("mysite.net.", dns.TypeA)
@@ -239,7 +245,7 @@ func TestCache_ServerDomain_NeverExpires(t *testing.T) {
 	}
 
 	// 普通域名仍按 clamp 下限缓存（1s 后仍命中，验证 minCacheTTL）
-	c2 := NewCache("")
+	c2 := NewCache(nil)
 	msg2 := &dns.Msg{}
 	msg2.SetQuestion("example.com.", dns.TypeA)
 	rr2, _ := dns.NewRR("example.com. 1 IN A 1.2.3.4")
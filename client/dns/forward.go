@@ -10,6 +10,7 @@ import (
 	"github.com/miekg/dns"
 	"github.com/nange/easyss/v3/client/config"
 	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/stats"
 )
 
 type ForwardServer struct {
@@ -17,11 +18,15 @@ type ForwardServer struct {
 	client     *dns.Client
 	dnsServers []string
 	dnsServer  *dns.Server
+	blocked    func(domain string) bool
 	mu         sync.Mutex
 	running    bool
 }
 
-func NewForwardServer(listenAddr string, disableIPV6 bool) *ForwardServer {
+// NewForwardServer returns a server forwarding queries to the direct DNS
+// servers. Queries for the domains blocked reports true for, if it is not
+// nil, are answered with BlockedReply.
+func NewForwardServer(listenAddr string, disableIPV6 bool, blocked func(domain string) bool) *ForwardServer {
 	servers := config.DirectDNSServers
 	if disableIPV6 {
 		var filtered []string
@@ -38,6 +43,7 @@ func NewForwardServer(listenAddr string, disableIPV6 bool) *ForwardServer {
 		listenAddr: listenAddr,
 		client:     &dns.Client{},
 		dnsServers: servers,
+		blocked:    blocked,
 	}
 }
 
@@ -77,6 +83,13 @@ func (s *ForwardServer) handleDNS(w dns.ResponseWriter, r *dns.Msg) {
 
 	q := r.Question[0]
 
+	if s.blocked != nil && s.blocked(strings.TrimSuffix(q.Name, ".")) {
+		log.Info("[DNS-FORWARD] blocked", "name", q.Name, "qtype", dns.TypeToString[q.Qtype])
+		stats.RecordBlockedDNSQuery()
+		_ = w.WriteMsg(BlockedReply(r))
+		return
+	}
+
 	reply, err := s.forwardQuery(r)
 	if err != nil {
 		log.Debug("[DNS-FORWARD] forward query failed", "name", q.Name, "err", err)
@@ -0,0 +1,181 @@
+// Package geodata downloads the GeoIP and GeoSite files the router can use
+// in place of its embedded mainland China data, verifying each one against
+// the SHA-256 checksum published next to it.
+package geodata
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// DefaultGeoIPURL is the country database downloaded when none is
+// configured.
+const DefaultGeoIPURL = "https://github.com/Loyalsoldier/geoip/releases/latest/download/Country.mmdb"
+
+// DefaultGeoSiteURLs are the GeoSite categories downloaded when none are
+// configured.
+var DefaultGeoSiteURLs = map[string]string{
+	router.GeoSiteDirect: "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/direct-list.txt",
+	router.GeoSiteBlock:  "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/reject-list.txt",
+	"proxy":              "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/proxy-list.txt",
+}
+
+// ChecksumSuffix is appended to a file's URL to get its checksum file, in
+// sha256sum format.
+const ChecksumSuffix = ".sha256sum"
+
+// maxFileSize bounds a downloaded file.
+const maxFileSize = 128 << 20
+
+// download is a verified file waiting to be written to path.
+type download struct {
+	path string
+	data []byte
+}
+
+// Update downloads the GeoIP database to cfg.GeoIPFile and the GeoSite
+// categories into cfg.GeoSiteDir, skipping whichever is not set. Every file
+// is downloaded and verified before any is written, so a failed update
+// leaves the old files in place. It returns the paths written.
+func Update(ctx context.Context, client *http.Client, cfg config.GeoDataConfig) ([]string, error) {
+	if cfg.GeoIPFile == "" && cfg.GeoSiteDir == "" {
+		return nil, errors.New("neither geoip_file nor geosite_dir is set")
+	}
+
+	var downloads []download
+	if cfg.GeoIPFile != "" {
+		src := cfg.GeoIPURL
+		if src == "" {
+			src = DefaultGeoIPURL
+		}
+		data, err := fetchVerified(ctx, client, src)
+		if err != nil {
+			return nil, fmt.Errorf("geoip: %w", err)
+		}
+		db, err := geoip2.FromBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("geoip: %s is not a valid mmdb: %w", src, err)
+		}
+		_ = db.Close()
+		downloads = append(downloads, download{path: cfg.GeoIPFile, data: data})
+	}
+	if cfg.GeoSiteDir != "" {
+		sites := cfg.GeoSiteURLs
+		if len(sites) == 0 {
+			sites = DefaultGeoSiteURLs
+		}
+		categories := make([]string, 0, len(sites))
+		for category := range sites {
+			categories = append(categories, category)
+		}
+		slices.Sort(categories)
+		for _, category := range categories {
+			if category == "" || strings.ContainsAny(category, `/\`) {
+				return nil, fmt.Errorf("geosite: invalid category name %q", category)
+			}
+			data, err := fetchVerified(ctx, client, sites[category])
+			if err != nil {
+				return nil, fmt.Errorf("geosite %s: %w", category, err)
+			}
+			path := filepath.Join(cfg.GeoSiteDir, strings.ToLower(category)+".txt")
+			downloads = append(downloads, download{path: path, data: data})
+		}
+	}
+
+	var written []string
+	for _, d := range downloads {
+		if err := writeFile(d.path, d.data); err != nil {
+			return written, err
+		}
+		written = append(written, d.path)
+	}
+	return written, nil
+}
+
+// fetchVerified downloads src and checks it against src + ChecksumSuffix.
+func fetchVerified(ctx context.Context, client *http.Client, src string) ([]byte, error) {
+	data, err := get(ctx, client, src)
+	if err != nil {
+		return nil, err
+	}
+	sumFile, err := get(ctx, client, src+ChecksumSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("checksum: %w", err)
+	}
+	fields := strings.Fields(string(sumFile))
+	if len(fields) == 0 {
+		return nil, errors.New("checksum: empty checksum file")
+	}
+	want, err := hex.DecodeString(fields[0])
+	if err != nil || len(want) != sha256.Size {
+		return nil, errors.New("checksum: not a sha256 checksum")
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], want) {
+		return nil, fmt.Errorf("checksum mismatch for %s", src)
+	}
+	return data, nil
+}
+
+func get(ctx context.Context, client *http.Client, src string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", src, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFileSize {
+		return nil, fmt.Errorf("%s: file too large", src)
+	}
+	return data, nil
+}
+
+// writeFile replaces path with data through a temporary file, so readers
+// never see a partial file.
+func writeFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
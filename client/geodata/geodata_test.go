@@ -0,0 +1,94 @@
+package geodata
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nange/easyss/v3/assets"
+	"github.com/nange/easyss/v3/client/config"
+)
+
+func serve(t *testing.T, files map[string][]byte) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func sum(data []byte, name string) []byte {
+	s := sha256.Sum256(data)
+	return []byte(hex.EncodeToString(s[:]) + "  " + name + "\n")
+}
+
+func TestUpdate(t *testing.T) {
+	sites := []byte("netflix.com\nfull:nflxvideo.net\n")
+	ts := serve(t, map[string][]byte{
+		"/Country.mmdb":             assets.GeoIPCNPrivate,
+		"/Country.mmdb.sha256sum":   sum(assets.GeoIPCNPrivate, "Country.mmdb"),
+		"/netflix.txt":              sites,
+		"/netflix.txt.sha256sum":    sum(sites, "netflix.txt"),
+		"/bad.txt":                  sites,
+		"/bad.txt.sha256sum":        sum([]byte("other"), "bad.txt"),
+		"/notmmdb.mmdb":             sites,
+		"/notmmdb.mmdb.sha256sum":   sum(sites, "notmmdb.mmdb"),
+		"/nochecksum.txt":           sites,
+		"/nochecksum.txt.sha256sum": []byte("\n"),
+	})
+
+	dir := t.TempDir()
+	cfg := config.GeoDataConfig{
+		GeoIPFile:   filepath.Join(dir, "Country.mmdb"),
+		GeoSiteDir:  filepath.Join(dir, "geosite"),
+		GeoIPURL:    ts.URL + "/Country.mmdb",
+		GeoSiteURLs: map[string]string{"Netflix": ts.URL + "/netflix.txt"},
+	}
+	written, err := Update(context.Background(), ts.Client(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 2 {
+		t.Fatalf("written = %v", written)
+	}
+	if got, _ := os.ReadFile(cfg.GeoIPFile); !bytes.Equal(got, assets.GeoIPCNPrivate) {
+		t.Error("geoip file differs")
+	}
+	if got, _ := os.ReadFile(filepath.Join(cfg.GeoSiteDir, "netflix.txt")); !bytes.Equal(got, sites) {
+		t.Error("geosite file differs")
+	}
+
+	for name, bad := range map[string]config.GeoDataConfig{
+		"checksum mismatch": {GeoSiteDir: cfg.GeoSiteDir, GeoSiteURLs: map[string]string{"netflix": ts.URL + "/bad.txt"}},
+		"missing checksum":  {GeoSiteDir: cfg.GeoSiteDir, GeoSiteURLs: map[string]string{"netflix": ts.URL + "/nochecksum.txt"}},
+		"not found":         {GeoSiteDir: cfg.GeoSiteDir, GeoSiteURLs: map[string]string{"netflix": ts.URL + "/none.txt"}},
+		"invalid mmdb":      {GeoIPFile: cfg.GeoIPFile, GeoIPURL: ts.URL + "/notmmdb.mmdb"},
+		"invalid category":  {GeoSiteDir: cfg.GeoSiteDir, GeoSiteURLs: map[string]string{"../x": ts.URL + "/netflix.txt"}},
+		"nothing to update": {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Update(context.Background(), ts.Client(), bad); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+	// Failed updates leave the verified files in place.
+	if got, _ := os.ReadFile(filepath.Join(cfg.GeoSiteDir, "netflix.txt")); !bytes.Equal(got, sites) {
+		t.Error("geosite file changed by a failed update")
+	}
+	if got, _ := os.ReadFile(cfg.GeoIPFile); !bytes.Equal(got, assets.GeoIPCNPrivate) {
+		t.Error("geoip file changed by a failed update")
+	}
+}
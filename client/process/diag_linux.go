@@ -0,0 +1,132 @@
+//go:build linux
+
+package process
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/nange/easyss/v3/client/router"
+)
+
+const (
+	// sizeofDiagReq is the size of struct inet_diag_req_v2.
+	sizeofDiagReq = 56
+	// sizeofDiagMsg is the size of struct inet_diag_msg.
+	sizeofDiagMsg = 72
+)
+
+// diagSocket returns the first socket of network, over IPv4 or IPv6, that
+// match accepts, asking the kernel over NETLINK_SOCK_DIAG. The kernel only
+// returns the sockets with local port sport and remote port dport, where
+// zero matches any port, so no other socket is read or parsed.
+func diagSocket(network string, sport, dport uint16, match func(socket) bool) (socket, error) {
+	proto := uint8(unix.IPPROTO_TCP)
+	if network == router.NetworkUDP {
+		proto = unix.IPPROTO_UDP
+	}
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return socket{}, fmt.Errorf("process: open sock_diag: %w", err)
+	}
+	defer unix.Close(fd)
+	buf := make([]byte, 32<<10)
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		s, ok, err := diagDump(fd, buf, diagRequest(family, proto, sport, dport), match)
+		if err != nil {
+			return socket{}, fmt.Errorf("process: sock_diag: %w", err)
+		}
+		if ok {
+			return s, nil
+		}
+	}
+	return socket{}, ErrNotFound
+}
+
+// diagDump sends req and reads the dump it answers until match accepts a
+// socket or the dump ends. The rest of a matched dump is discarded with
+// the netlink socket.
+func diagDump(fd int, buf, req []byte, match func(socket) bool) (socket, bool, error) {
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return socket{}, false, err
+	}
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return socket{}, false, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return socket{}, false, err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return socket{}, false, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+						return socket{}, false, syscall.Errno(errno)
+					}
+				}
+				return socket{}, false, nil
+			case unix.SOCK_DIAG_BY_FAMILY:
+				// Sockets in TIME_WAIT have no inode, and no owner.
+				if s, ok := parseDiagMsg(m.Data); ok && s.inode != 0 && match(s) {
+					return s, true, nil
+				}
+			}
+		}
+	}
+}
+
+// diagRequest builds a dump request, a struct nlmsghdr followed by a
+// struct inet_diag_req_v2, for the sockets of family and proto in any
+// state with local port sport and remote port dport.
+func diagRequest(family, proto uint8, sport, dport uint16) []byte {
+	b := make([]byte, unix.SizeofNlMsghdr+sizeofDiagReq)
+	binary.NativeEndian.PutUint32(b[0:], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:], unix.SOCK_DIAG_BY_FAMILY)
+	binary.NativeEndian.PutUint16(b[6:], unix.NLM_F_REQUEST|unix.NLM_F_DUMP)
+	req := b[unix.SizeofNlMsghdr:]
+	req[0] = family
+	req[1] = proto
+	binary.NativeEndian.PutUint32(req[4:], 0xffffffff)
+	// The ports of struct inet_diag_sockid are in network byte order.
+	binary.BigEndian.PutUint16(req[8:], sport)
+	binary.BigEndian.PutUint16(req[10:], dport)
+	return b
+}
+
+// parseDiagMsg parses a struct inet_diag_msg:
+//
+//	family, state, timer, retrans  u8
+//	id                             struct inet_diag_sockid (48 bytes)
+//	expires, rqueue, wqueue        u32
+//	uid, inode                     u32
+func parseDiagMsg(b []byte) (socket, bool) {
+	if len(b) < sizeofDiagMsg {
+		return socket{}, false
+	}
+	id := b[4:52]
+	n := 4
+	switch b[0] {
+	case unix.AF_INET:
+	case unix.AF_INET6:
+		n = 16
+	default:
+		return socket{}, false
+	}
+	local, _ := netip.AddrFromSlice(id[4 : 4+n])
+	remote, _ := netip.AddrFromSlice(id[20 : 20+n])
+	return socket{
+		local:  netip.AddrPortFrom(local.Unmap(), binary.BigEndian.Uint16(id[0:])),
+		remote: netip.AddrPortFrom(remote.Unmap(), binary.BigEndian.Uint16(id[2:])),
+		uid:    int(binary.NativeEndian.Uint32(b[64:])),
+		inode:  uint64(binary.NativeEndian.Uint32(b[68:])),
+	}, true
+}
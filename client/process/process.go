@@ -0,0 +1,177 @@
+// Package process finds the local process that opened a connection to the
+// client, for process-based routing.
+package process
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/client/router"
+)
+
+var (
+	ErrUnsupported = errors.New("process: finding processes is not supported on this platform")
+	ErrNotFound    = errors.New("process: no process owns the connection")
+)
+
+const (
+	// connTTL is how long the owner of a connection is cached, so the
+	// streams of one connection and quick reconnects skip the lookup.
+	connTTL = 5 * time.Second
+	// procTTL is how long a process's name and path are cached.
+	procTTL = 30 * time.Second
+	// maxHot is the number of recently found processes checked before
+	// scanning all of them.
+	maxHot = 16
+	// sweepSize is the cache size from which expired entries are dropped.
+	sweepSize = 1024
+)
+
+// Finder finds the owners of local connections. Results are cached, and
+// the sockets of the processes found last are remembered, so most lookups
+// don't scan any process. A Finder is safe for concurrent use.
+type Finder struct {
+	mu    sync.Mutex
+	conns map[connKey]connEntry
+	procs map[int]procEntry
+	// hot lists the PIDs found last, most recent first.
+	hot []int
+	// sockets holds the socket inodes each hot PID had open when its
+	// descriptors were last read.
+	sockets map[int]map[uint64]struct{}
+	now     func() time.Time
+}
+
+type connKey struct {
+	network          string
+	src, dst, target netip.AddrPort
+}
+
+type connEntry struct {
+	proc    *router.Process
+	err     error
+	expires time.Time
+}
+
+type procEntry struct {
+	proc    router.Process
+	expires time.Time
+}
+
+func NewFinder() *Finder {
+	return &Finder{
+		conns:   make(map[connKey]connEntry),
+		procs:   make(map[int]procEntry),
+		sockets: make(map[int]map[uint64]struct{}),
+		now:     time.Now,
+	}
+}
+
+// Find returns the process owning the local connection over network
+// ("tcp" or "udp") from src to dst, a listener of the client. When the
+// connection comes from the client itself, as in TUN mode where the
+// tun2socks engine relays the connections of other programs, Find instead
+// returns the owner of the connection to target, the requested destination,
+// if it is a valid address.
+func (f *Finder) Find(network string, src, dst, target netip.AddrPort) (*router.Process, error) {
+	key := connKey{network: network, src: unmap(src), dst: unmap(dst), target: unmap(target)}
+	f.mu.Lock()
+	if e, ok := f.conns[key]; ok && f.now().Before(e.expires) {
+		f.mu.Unlock()
+		return e.proc, e.err
+	}
+	f.mu.Unlock()
+
+	proc, err := f.lookup(key)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.conns) >= sweepSize {
+		now := f.now()
+		for k, e := range f.conns {
+			if !now.Before(e.expires) {
+				delete(f.conns, k)
+			}
+		}
+	}
+	f.conns[key] = connEntry{proc: proc, err: err, expires: f.now().Add(connTTL)}
+	return proc, err
+}
+
+// hotPIDs returns a copy of the recently found PIDs.
+func (f *Finder) hotPIDs() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.hot)
+}
+
+// markHot moves pid to the front of the recently found PIDs.
+func (f *Finder) markHot(pid int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i := slices.Index(f.hot, pid); i >= 0 {
+		f.hot = slices.Delete(f.hot, i, i+1)
+	} else if len(f.hot) == maxHot {
+		delete(f.sockets, f.hot[maxHot-1])
+		f.hot = f.hot[:maxHot-1]
+	}
+	f.hot = slices.Insert(f.hot, 0, pid)
+}
+
+// cachedOwner returns the hot PID last seen holding the socket inode.
+func (f *Finder) cachedOwner(inode uint64) (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, pid := range f.hot {
+		if _, ok := f.sockets[pid][inode]; ok {
+			return pid, true
+		}
+	}
+	return 0, false
+}
+
+// cacheSockets records the socket inodes pid has open, if pid is hot.
+func (f *Finder) cacheSockets(pid int, inodes map[uint64]struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if slices.Contains(f.hot, pid) {
+		f.sockets[pid] = inodes
+	}
+}
+
+// cachedProcess returns the cached details of pid.
+func (f *Finder) cachedProcess(pid int) (router.Process, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.procs[pid]
+	if !ok || !f.now().Before(e.expires) {
+		return router.Process{}, false
+	}
+	return e.proc, true
+}
+
+func (f *Finder) cacheProcess(p router.Process) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.procs) >= sweepSize {
+		now := f.now()
+		for pid, e := range f.procs {
+			if !now.Before(e.expires) {
+				delete(f.procs, pid)
+			}
+		}
+	}
+	f.procs[p.PID] = procEntry{proc: p, expires: f.now().Add(procTTL)}
+}
+
+// unmap returns ap with an IPv4-mapped IPv6 address turned into IPv4, so
+// dual-stack sockets compare equal to IPv4 ones.
+func unmap(ap netip.AddrPort) netip.AddrPort {
+	if !ap.IsValid() {
+		return ap
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
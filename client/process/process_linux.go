@@ -0,0 +1,271 @@
+//go:build linux
+
+package process
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/nange/easyss/v3/client/router"
+)
+
+// Supported reports whether finding processes works on this platform.
+const Supported = true
+
+// procRoot is where the proc filesystem is mounted.
+const procRoot = "/proc"
+
+// socket is a row of /proc/net/{tcp,udp}{,6}.
+type socket struct {
+	local, remote netip.AddrPort
+	uid           int
+	inode         uint64
+}
+
+// lookup finds the owner of the connection key describes: the socket,
+// then the process holding it open in /proc/<pid>/fd.
+func (f *Finder) lookup(key connKey) (*router.Process, error) {
+	var s socket
+	var err error
+	if key.network == router.NetworkUDP {
+		// UDP ASSOCIATE clients often use unconnected sockets bound to the
+		// wildcard address.
+		s, err = findSocket(key.network, key.src.Port(), 0, func(s socket) bool {
+			return s.local.Port() == key.src.Port() &&
+				(s.local.Addr() == key.src.Addr() || s.local.Addr().IsUnspecified())
+		})
+	} else {
+		s, err = findSocket(key.network, key.src.Port(), key.dst.Port(), func(s socket) bool {
+			return s.local == key.src && s.remote == key.dst
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	proc, err := f.owner(s)
+	if err != nil {
+		return nil, err
+	}
+	if proc.PID == os.Getpid() && key.target.IsValid() && !key.target.Addr().IsUnspecified() {
+		s, err := findSocket(key.network, 0, key.target.Port(), func(s socket) bool {
+			return s.remote == key.target && !s.local.Addr().IsLoopback()
+		})
+		if err != nil {
+			return nil, err
+		}
+		if proc, err = f.owner(s); err != nil {
+			return nil, err
+		}
+	}
+	return &proc, nil
+}
+
+// findSocket returns the first socket of network, over IPv4 or IPv6, with
+// local port sport and remote port dport, zero matching any, that match
+// accepts. It asks the kernel over sock_diag, and reads /proc/net on
+// kernels without it.
+func findSocket(network string, sport, dport uint16, match func(socket) bool) (socket, error) {
+	s, err := diagSocket(network, sport, dport, match)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		return s, err
+	}
+	return procSocket(network, match)
+}
+
+// procSocket is findSocket reading /proc/net/{tcp,udp}{,6}.
+func procSocket(network string, match func(socket) bool) (socket, error) {
+	for _, name := range []string{network, network + "6"} {
+		file, err := os.Open(filepath.Join(procRoot, "net", name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return socket{}, err
+		}
+		s, ok, err := scanSockets(file, match)
+		_ = file.Close()
+		if err != nil {
+			return socket{}, fmt.Errorf("process: read /proc/net/%s: %w", name, err)
+		}
+		if ok {
+			return s, nil
+		}
+	}
+	return socket{}, ErrNotFound
+}
+
+func scanSockets(file *os.File, match func(socket) bool) (socket, bool, error) {
+	sc := bufio.NewScanner(file)
+	for sc.Scan() {
+		s, ok := parseSocketLine(sc.Text())
+		// Sockets in TIME_WAIT have no inode, and no owner.
+		if ok && s.inode != 0 && match(s) {
+			return s, true, nil
+		}
+	}
+	return socket{}, false, sc.Err()
+}
+
+// parseSocketLine parses a row of /proc/net/tcp and the like:
+//
+//	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+//	 0: 0100007F:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000   101        0 20950 ...
+func parseSocketLine(line string) (socket, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 10 {
+		return socket{}, false
+	}
+	local, err := parseSocketAddr(fields[1])
+	if err != nil {
+		return socket{}, false
+	}
+	remote, err := parseSocketAddr(fields[2])
+	if err != nil {
+		return socket{}, false
+	}
+	uid, err := strconv.Atoi(fields[7])
+	if err != nil {
+		return socket{}, false
+	}
+	inode, err := strconv.ParseUint(fields[9], 10, 64)
+	if err != nil {
+		return socket{}, false
+	}
+	return socket{local: local, remote: remote, uid: uid, inode: inode}, true
+}
+
+// parseSocketAddr parses an address like "0100007F:0035". The kernel
+// prints each 32-bit word of the IP in host byte order and the port as a
+// number.
+func parseSocketAddr(s string) (netip.AddrPort, error) {
+	host, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	b, err := hex.DecodeString(host)
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		binary.NativeEndian.PutUint32(b[i:], binary.BigEndian.Uint32(b[i:]))
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	p, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	return netip.AddrPortFrom(addr.Unmap(), uint16(p)), nil
+}
+
+// owner returns the process holding s open.
+func (f *Finder) owner(s socket) (router.Process, error) {
+	pid, err := f.findPID(s)
+	if err != nil {
+		return router.Process{}, err
+	}
+	f.markHot(pid)
+	if p, ok := f.cachedProcess(pid); ok {
+		return p, nil
+	}
+	p := router.Process{PID: pid, UID: s.uid}
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		p.Name = strings.TrimSpace(string(comm))
+	}
+	// Reading the executable of another user's process needs privileges;
+	// the name is enough for most rules.
+	if exe, err := os.Readlink(filepath.Join(dir, "exe")); err == nil {
+		p.Path = strings.TrimSuffix(exe, " (deleted)")
+	}
+	if p.Name == "" && p.Path != "" {
+		p.Name = filepath.Base(p.Path)
+	}
+	f.cacheProcess(p)
+	return p, nil
+}
+
+// findPID returns the process with a descriptor of s open. The sockets the
+// processes found last had open are checked first, then the descriptors of
+// those processes are read again, then those of the processes running as
+// the socket's user, then all others.
+func (f *Finder) findPID(s socket) (int, error) {
+	if pid, ok := f.cachedOwner(s.inode); ok {
+		return pid, nil
+	}
+	hot := f.hotPIDs()
+	for _, pid := range hot {
+		inodes := socketInodes(pid)
+		f.cacheSockets(pid, inodes)
+		if _, ok := inodes[s.inode]; ok {
+			return pid, nil
+		}
+	}
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return 0, err
+	}
+	found := func(pid int) bool {
+		inodes := socketInodes(pid)
+		if _, ok := inodes[s.inode]; !ok {
+			return false
+		}
+		f.markHot(pid)
+		f.cacheSockets(pid, inodes)
+		return true
+	}
+	var others []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() || slices.Contains(hot, pid) {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != s.uid {
+				others = append(others, pid)
+				continue
+			}
+		}
+		if found(pid) {
+			return pid, nil
+		}
+	}
+	for _, pid := range others {
+		if found(pid) {
+			return pid, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+// socketInodes returns the inodes of the sockets pid has open.
+func socketInodes(pid int) map[uint64]struct{} {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid), "fd")
+	fds, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	inodes := make(map[uint64]struct{})
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join(dir, fd.Name()))
+		if err != nil {
+			continue
+		}
+		if v, ok := strings.CutPrefix(target, "socket:["); ok {
+			if inode, err := strconv.ParseUint(strings.TrimSuffix(v, "]"), 10, 64); err == nil {
+				inodes[inode] = struct{}{}
+			}
+		}
+	}
+	return inodes
+}
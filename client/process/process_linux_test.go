@@ -0,0 +1,176 @@
+//go:build linux
+
+package process
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+)
+
+func TestParseSocketLine(t *testing.T) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("sample rows are from a little-endian host")
+	}
+	tests := []struct {
+		line string
+		want socket
+		ok   bool
+	}{
+		{
+			"   0: 0100007F:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000   101        0 20950 1 0000000000000000 100 0 0 10 0",
+			socket{local: netip.MustParseAddrPort("127.0.0.1:53"), remote: netip.MustParseAddrPort("0.0.0.0:0"), uid: 101, inode: 20950},
+			true,
+		},
+		{
+			"   1: 0100007F:C5A2 0100007F:07F2 01 00000000:00000000 00:00000000 00000000  1000        0 81234 1 0000000000000000 20 4 30 10 -1",
+			socket{local: netip.MustParseAddrPort("127.0.0.1:50594"), remote: netip.MustParseAddrPort("127.0.0.1:2034"), uid: 1000, inode: 81234},
+			true,
+		},
+		{
+			// An IPv4-mapped address in /proc/net/tcp6 reads as IPv4.
+			"   2: 0000000000000000FFFF00000100007F:C5A3 0000000000000000FFFF00000100007F:07F2 01 00000000:00000000 00:00000000 00000000  1000        0 81235 1",
+			socket{local: netip.MustParseAddrPort("127.0.0.1:50595"), remote: netip.MustParseAddrPort("127.0.0.1:2034"), uid: 1000, inode: 81235},
+			true,
+		},
+		{
+			"   3: 00000000000000000000000001000000:0016 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 17000 1",
+			socket{local: netip.MustParseAddrPort("[::1]:22"), remote: netip.MustParseAddrPort("[::]:0"), uid: 0, inode: 17000},
+			true,
+		},
+		{"  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode", socket{}, false},
+		{"", socket{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseSocketLine(tt.line)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseSocketLine(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// dialPair returns the client and server addresses of a new loopback TCP
+// connection, closed when the test ends.
+func dialPair(tb testing.TB, ln net.Listener) (src, dst netip.AddrPort) {
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	accepted, err := ln.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { accepted.Close() })
+	return accepted.RemoteAddr().(*net.TCPAddr).AddrPort(), accepted.LocalAddr().(*net.TCPAddr).AddrPort()
+}
+
+func listen(tb testing.TB) net.Listener {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		tb.Skip("no /proc/net/tcp:", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+func TestDiagSocket(t *testing.T) {
+	ln := listen(t)
+	src, dst := dialPair(t, ln)
+	match := func(s socket) bool { return s.local == src && s.remote == dst }
+	want, err := procSocket("tcp", match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := diagSocket("tcp", src.Port(), dst.Port(), match)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		t.Skip("sock_diag unavailable:", err)
+	}
+	if err != nil || got != want {
+		t.Errorf("diagSocket = %+v, %v, want %+v from /proc/net/tcp", got, err, want)
+	}
+	if _, err := diagSocket("tcp", 1, dst.Port(), match); err != ErrNotFound {
+		t.Errorf("diagSocket of a missing connection: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestFindOwnConnection(t *testing.T) {
+	ln := listen(t)
+	src, dst := dialPair(t, ln)
+
+	f := NewFinder()
+	proc, err := f.Find("tcp", src, dst, netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proc.PID != os.Getpid() || proc.Name == "" {
+		t.Errorf("Find = %+v, want this process (pid %d)", proc, os.Getpid())
+	}
+	if again, err := f.Find("tcp", src, dst, netip.AddrPort{}); err != nil || again != proc {
+		t.Errorf("second Find = %+v, %v, want the cached %+v", again, err, proc)
+	}
+	if _, err := f.Find("tcp", netip.MustParseAddrPort("127.0.0.1:1"), dst, netip.AddrPort{}); err != ErrNotFound {
+		t.Errorf("Find of a missing connection: err = %v, want ErrNotFound", err)
+	}
+
+	// A connection the process opened before the last lookup is found
+	// among its remembered sockets.
+	src2, dst2 := dialPair(t, ln)
+	s, err := findSocket("tcp", src2.Port(), dst2.Port(), func(s socket) bool { return s.local == src2 && s.remote == dst2 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.sockets[proc.PID] = socketInodes(proc.PID)
+	if pid, ok := f.cachedOwner(s.inode); !ok || pid != proc.PID {
+		t.Errorf("cachedOwner = %d, %v, want %d, true", pid, ok, proc.PID)
+	}
+}
+
+// BenchmarkFind measures finding the owner of a new connection, which
+// misses the connection cache.
+func BenchmarkFind(b *testing.B) {
+	ln := listen(b)
+	f := NewFinder()
+	var keys []connKey
+	for range 64 {
+		src, dst := dialPair(b, ln)
+		keys = append(keys, connKey{network: "tcp", src: src, dst: dst})
+	}
+	i := 0
+	for b.Loop() {
+		if _, err := f.lookup(keys[i%len(keys)]); err != nil {
+			b.Fatal(err)
+		}
+		i++
+	}
+}
+
+// BenchmarkFindSocket compares finding a socket over sock_diag with
+// reading /proc/net.
+func BenchmarkFindSocket(b *testing.B) {
+	ln := listen(b)
+	for range 256 {
+		dialPair(b, ln)
+	}
+	src, dst := dialPair(b, ln)
+	match := func(s socket) bool { return s.local == src && s.remote == dst }
+	b.Run("sock_diag", func(b *testing.B) {
+		if _, err := diagSocket("tcp", src.Port(), dst.Port(), match); err != nil {
+			b.Skip("sock_diag unavailable:", err)
+		}
+		for b.Loop() {
+			_, _ = diagSocket("tcp", src.Port(), dst.Port(), match)
+		}
+	})
+	b.Run("proc_net", func(b *testing.B) {
+		for b.Loop() {
+			_, _ = procSocket("tcp", match)
+		}
+	})
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package process
+
+import "github.com/nange/easyss/v3/client/router"
+
+// Supported reports whether finding processes works on this platform.
+const Supported = false
+
+// lookup is not supported: finding processes reads /proc.
+func (f *Finder) lookup(connKey) (*router.Process, error) {
+	return nil, ErrUnsupported
+}
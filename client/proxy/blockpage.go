@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/stats"
+)
+
+var blockPage = template.Must(template.New("block").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Blocked: {{.Host}}</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto">
+<h1>Blocked</h1>
+<p>Easyss blocked the request to <b>{{.Host}}</b>{{if .Port}} port {{.Port}}{{end}}.</p>
+<p>Rule: {{.Rule}}</p>
+</body>
+</html>
+`))
+
+// serveBlocked answers a request the router blocked with a 403 page
+// explaining the rule that blocked it.
+func serveBlocked(w http.ResponseWriter, tr router.Trace) {
+	rule := blockRule(tr)
+	log.Info("[HTTP-PROXY] blocked", "host", tr.Host, "port", tr.Port, "rule", rule)
+	stats.RecordBlockedConnection()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	_ = blockPage.Execute(w, struct {
+		Host string
+		Port int
+		Rule string
+	}{tr.Host, tr.Port, rule})
+}
+
+// blockRule describes the check of tr that blocked the request.
+func blockRule(tr router.Trace) string {
+	var rule string
+	switch tr.Source {
+	case router.SourceCustomBlock:
+		rule = "custom block list"
+	case router.SourcePolicyRule:
+		rule = "routing.rules[" + tr.Name + "]"
+	case router.SourceRuleSet:
+		rule = "rule set " + tr.Name
+	case router.SourceGeoSite:
+		rule = "geosite " + tr.Name
+	default:
+		rule = tr.Source
+	}
+	if tr.Entry != "" {
+		rule += ", entry " + strconv.Quote(tr.Entry)
+	}
+	if tr.Line > 0 {
+		rule += " at " + tr.File + ":" + strconv.Itoa(tr.Line)
+	}
+	return rule
+}
@@ -5,8 +5,6 @@ import (
 	"runtime"
 	"testing"
 	"time"
-
-	"github.com/nange/easyss/v3/protocol"
 )
 
 // TestSocks5CloseRacingStart guards against closing a socks5 server right
@@ -28,7 +26,7 @@ func TestSocks5CloseRacingStart(t *testing.T) {
 		l.Close()
 
 		h := newTestStreamHandler(&mockTransport{})
-		srv, err := NewSocks5Server(addr, "", "", h, nil, "", protocol.MethodAES256GCM, true, 10*time.Second, 30*time.Second, nil)
+		srv, err := NewSocks5Server(addr, "", "", h, nil, true, 10*time.Second, 30*time.Second, nil)
 		if err != nil {
 			t.Fatalf("NewSocks5Server #%d: %v", i, err)
 		}
@@ -10,6 +10,9 @@ import (
 	"testing"
 
 	"github.com/miekg/dns"
+	"github.com/nange/easyss/v3/client/balancer"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/shaper"
 	"github.com/nange/easyss/v3/util"
 )
 
@@ -172,7 +175,12 @@ func TestParseAddress(t *testing.T) {
 }
 
 func TestIsServerDomain(t *testing.T) {
-	s := &Socks5Server{serverDomain: "mysite.net"}
+	mysite := balancer.NewUpstream("a", &mockTransport{}, nil, protocol.MethodAES256GCM, 1)
+	mysite.Domain = "mysite.net"
+	other := balancer.NewUpstream("b", &mockTransport{}, nil, protocol.MethodAES256GCM, 1)
+	other.Domain = "other.example"
+	b, _ := balancer.New("", 0, mysite, other)
+	s := &Socks5Server{handler: NewBalancedStreamHandler(b, shaper.Config{}, 0)}
 	tests := []struct {
 		name   string
 		domain string
@@ -181,6 +189,7 @@ func TestIsServerDomain(t *testing.T) {
 		{"完全匹配", "mysite.net", true},
 		{"大小写不敏感", "MySite.NET", true},
 		{"带尾点", "mysite.net.", false}, // handleDNS 已 TrimSuffix
+		{"其他服务器", "Other.Example", true},
 		{"其他域名", "example.com", false},
 		{"子域名", "sub.mysite.net", false},
 	}
@@ -192,8 +201,8 @@ func TestIsServerDomain(t *testing.T) {
 		})
 	}
 
-	empty := &Socks5Server{serverDomain: ""}
-	if empty.isServerDomain("mysite.net") {
-		t.Error("isServerDomain should be false when serverDomain is empty")
+	ipOnly := &Socks5Server{handler: NewStreamHandler(&mockTransport{}, nil, protocol.MethodAES256GCM, shaper.Config{}, 0)}
+	if ipOnly.isServerDomain("mysite.net") || ipOnly.isServerDomain("") {
+		t.Error("isServerDomain should be false when no server has a domain")
 	}
 }
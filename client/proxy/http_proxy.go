@@ -4,20 +4,24 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nange/easyss/v3/client/router"
 	"github.com/nange/easyss/v3/config"
 	"github.com/nange/easyss/v3/log"
-	"github.com/nange/easyss/v3/protocol"
 	"github.com/nange/easyss/v3/stats"
+	"github.com/nange/easyss/v3/util"
 	"github.com/nange/easyss/v3/util/bytespool"
 	"github.com/txthinking/socks5"
 )
@@ -41,7 +45,6 @@ type HTTPProxyServer struct {
 	timeout    time.Duration
 	handler    *StreamHandler
 	router     *router.Router
-	method     protocol.Method
 	dial       func(context.Context, string, string) (net.Conn, error)
 	rp         *httputil.ReverseProxy
 	server     *http.Server
@@ -50,8 +53,65 @@ type HTTPProxyServer struct {
 	// TUN helper support (macOS): config served at GET /tun.
 	tunCfg *TunConfig
 	tunMu  sync.RWMutex
+
+	reload atomic.Pointer[ReloadFunc]
+	// reloading counts the /reload requests running their ReloadFunc.
+	reloading atomic.Int32
+}
+
+// ReloadFunc reloads the client configuration and returns the changed
+// settings that need a restart to take effect.
+type ReloadFunc func() (restartRequired []string, err error)
+
+// ReloadResult is the JSON body of a successful POST /reload.
+type ReloadResult struct {
+	RestartRequired []string `json:"restart_required"`
+}
+
+// RouteExplanation is the JSON body of GET /route/explain: the router's
+// trace for the host, and for each address it resolves to the trace of a
+// connection made to that IP, as in TUN mode.
+type RouteExplanation struct {
+	router.Trace
+	Addresses    []router.Trace `json:"addresses,omitempty"`
+	ResolveError string         `json:"resolve_error,omitempty"`
+}
+
+// RuleList is the JSON body of GET /rules: the file and entries of a
+// custom list.
+type RuleList struct {
+	List    string             `json:"list"`
+	File    string             `json:"file,omitempty"`
+	Entries []router.ListEntry `json:"entries"`
+}
+
+// RuleEditResult is the JSON body of a successful POST or DELETE /rules.
+// Changed is false if the list already had, or did not have, the entry.
+type RuleEditResult struct {
+	Changed bool `json:"changed"`
+}
+
+// LearnedList is the JSON body of GET /learned: the domains learned
+// routing saw fail direct, promoted to the proxy once they have Expires.
+type LearnedList struct {
+	Enabled bool                   `json:"enabled"`
+	Domains []router.LearnedDomain `json:"domains"`
+}
+
+// LearnedClearResult is the JSON body of DELETE /learned.
+type LearnedClearResult struct {
+	Cleared int `json:"cleared"`
 }
 
+// APIHeader must be set, to any value, on the requests that change state
+// through the local API: POST /reload, POST and DELETE /rules and DELETE
+// /learned.
+const APIHeader = "X-Easyss-Api"
+
+// explainResolveTimeout bounds the lookup of the host GET /route/explain
+// explains.
+const explainResolveTimeout = 5 * time.Second
+
 // TunConfig is the configuration served to the TUN helper via GET /tun.
 type TunConfig struct {
 	Socks5Addr     string `json:"socks5_addr"`
@@ -68,7 +128,7 @@ type TunConfig struct {
 	MTU            int    `json:"mtu"`
 }
 
-func NewHTTPProxyServer(listenAddr, socksAddr, username, password string, timeout time.Duration, handler *StreamHandler, rt *router.Router, method protocol.Method, dial func(context.Context, string, string) (net.Conn, error)) (*HTTPProxyServer, error) {
+func NewHTTPProxyServer(listenAddr, socksAddr, username, password string, timeout time.Duration, handler *StreamHandler, rt *router.Router, dial func(context.Context, string, string) (net.Conn, error)) (*HTTPProxyServer, error) {
 	if socksAddr == "" {
 		return nil, fmt.Errorf("http proxy requires a local socks5 address")
 	}
@@ -93,7 +153,6 @@ func NewHTTPProxyServer(listenAddr, socksAddr, username, password string, timeou
 		timeout:    timeout,
 		handler:    handler,
 		router:     rt,
-		method:     method,
 		dial:       dial,
 	}
 	s.rp = s.newReverseProxy()
@@ -156,6 +215,31 @@ func (s *HTTPProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Serve /reload to reload the configuration file, from this host only.
+	if r.URL.Host == "" && r.URL.Path == "/reload" {
+		s.handleReload(w, r)
+		return
+	}
+
+	// Serve /route/explain to explain routing decisions, from this host only.
+	if r.URL.Host == "" && r.URL.Path == "/route/explain" {
+		s.handleRouteExplain(w, r)
+		return
+	}
+
+	// Serve /rules to edit the custom lists, from this host only.
+	if r.URL.Host == "" && r.URL.Path == "/rules" {
+		s.handleRules(w, r)
+		return
+	}
+
+	// Serve /learned to inspect and clear learned routing, from this host
+	// only.
+	if r.URL.Host == "" && r.URL.Path == "/learned" {
+		s.handleLearned(w, r)
+		return
+	}
+
 	// Serve /tun for TUN configuration (macOS helper).
 	if r.URL.Host == "" && r.URL.Path == "/tun" {
 		if r.Method == http.MethodGet {
@@ -173,18 +257,36 @@ func (s *HTTPProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// With bind_all, clients on other hosts must not reach the services
+	// of this one, such as the local API, through the proxy.
+	if host, _, _ := net.SplitHostPort(requestTarget(r)); loopbackHost(host) && !fromLoopback(r.RemoteAddr) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	if r.Method == http.MethodConnect {
 		s.handleConnect(w, r)
 		return
 	}
 
+	// The SOCKS5 server routes the forwarded request too, but would refuse
+	// a blocked one with a bare error; answer it here with the block page.
+	if s.router != nil {
+		host, portStr, _ := net.SplitHostPort(requestTarget(r))
+		port, _ := strconv.Atoi(portStr)
+		if tr := s.router.Explain(router.Conn{Network: router.NetworkTCP, Host: host, Port: port}); tr.Rule == router.HostRuleBlock {
+			serveBlocked(w, tr)
+			return
+		}
+	}
+
 	log.Info("[HTTP-PROXY] forwarding via SOCKS5", "host", r.Host, "method", r.Method)
 	s.rp.ServeHTTP(w, r)
 }
 
 func (s *HTTPProxyServer) serveStats(w http.ResponseWriter) {
 	snap := stats.Collect()
-	snap.TransportStats = s.handler.Transport().Stats()
+	snap.TransportStats = s.handler.TransportStats()
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(snap); err != nil {
@@ -192,6 +294,221 @@ func (s *HTTPProxyServer) serveStats(w http.ResponseWriter) {
 	}
 }
 
+// checkLocalAPI reports whether r may use the local API, answering it with
+// an error if not. Only this host may, and not through a web page: a
+// request with an Origin header is refused, and one changing state must
+// carry APIHeader, which a page can't send cross-origin without a CORS
+// preflight that is never granted.
+func checkLocalAPI(w http.ResponseWriter, r *http.Request) bool {
+	if !fromLoopback(r.RemoteAddr) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if r.Header.Get("Origin") != "" {
+		http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+		return false
+	}
+	if r.Method != http.MethodGet && r.Header.Get(APIHeader) == "" {
+		http.Error(w, "Missing "+APIHeader+" header", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// SetReloadFunc sets the function POST /reload runs; nil disables the
+// endpoint.
+func (s *HTTPProxyServer) SetReloadFunc(fn ReloadFunc) {
+	if fn == nil {
+		s.reload.Store(nil)
+		return
+	}
+	s.reload.Store(&fn)
+}
+
+func (s *HTTPProxyServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkLocalAPI(w, r) {
+		return
+	}
+	fn := s.reload.Load()
+	if fn == nil {
+		http.Error(w, "Reload not available", http.StatusServiceUnavailable)
+		return
+	}
+	s.reloading.Add(1)
+	pending, err := (*fn)()
+	s.reloading.Add(-1)
+	if err != nil {
+		log.Warn("[HTTP-PROXY] reload", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ReloadResult{RestartRequired: pending}); err != nil {
+		log.Warn("[HTTP-PROXY] encode reload result", "err", err)
+	}
+}
+
+// handleRouteExplain serves
+// GET /route/explain?host=H[&port=P][&network=N][&process=PROC], PROC
+// being a program name, an executable path or "uid:N".
+func (s *HTTPProxyServer) handleRouteExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkLocalAPI(w, r) {
+		return
+	}
+	if s.router == nil {
+		http.Error(w, "Router not available", http.StatusServiceUnavailable)
+		return
+	}
+	host := strings.TrimSuffix(strings.ToLower(r.URL.Query().Get("host")), ".")
+	if host == "" {
+		http.Error(w, "Missing host", http.StatusBadRequest)
+		return
+	}
+	port := 0
+	if p := r.URL.Query().Get("port"); p != "" {
+		var err error
+		if port, err = strconv.Atoi(p); err != nil || port < 0 || port > 65535 {
+			http.Error(w, "Invalid port", http.StatusBadRequest)
+			return
+		}
+	}
+
+	network := strings.ToLower(r.URL.Query().Get("network"))
+	switch network {
+	case "", router.NetworkTCP, router.NetworkUDP, router.NetworkICMP:
+	default:
+		http.Error(w, "Invalid network", http.StatusBadRequest)
+		return
+	}
+
+	conn := router.Conn{Network: network, Host: host, Port: port}
+	if proc := r.URL.Query().Get("process"); proc != "" {
+		conn.Process = &router.Process{UID: -1}
+		if uid, ok := strings.CutPrefix(proc, "uid:"); ok {
+			var err error
+			if conn.Process.UID, err = strconv.Atoi(uid); err != nil || conn.Process.UID < 0 {
+				http.Error(w, "Invalid process", http.StatusBadRequest)
+				return
+			}
+		} else if strings.ContainsAny(proc, `/\`) {
+			conn.Process.Path, conn.Process.Name = proc, filepath.Base(proc)
+		} else {
+			conn.Process.Name = proc
+		}
+	}
+
+	res := RouteExplanation{Trace: s.router.Explain(conn)}
+	if !util.IsIP(host) {
+		ctx, cancel := context.WithTimeout(r.Context(), explainResolveTimeout)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil {
+			res.ResolveError = err.Error()
+		}
+		for _, addr := range addrs {
+			conn.Host = addr.IP.String()
+			res.Addresses = append(res.Addresses, s.router.Explain(conn))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Warn("[HTTP-PROXY] encode route explanation", "err", err)
+	}
+}
+
+// handleRules serves GET /rules?list=L to list the entries of a custom
+// list, and POST and DELETE /rules?list=L&entry=E to add and remove one.
+func (s *HTTPProxyServer) handleRules(w http.ResponseWriter, r *http.Request) {
+	if !checkLocalAPI(w, r) {
+		return
+	}
+	if s.router == nil {
+		http.Error(w, "Router not available", http.StatusServiceUnavailable)
+		return
+	}
+	list := r.URL.Query().Get("list")
+	entry := r.URL.Query().Get("entry")
+
+	var res any
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		rl := RuleList{List: list}
+		if rl.File, err = s.router.CustomListFile(list); err == nil {
+			rl.Entries, err = s.router.CustomEntries(list)
+		}
+		res = rl
+	case http.MethodPost:
+		var changed bool
+		changed, err = s.router.AddCustomEntry(list, entry)
+		res = RuleEditResult{Changed: changed}
+	case http.MethodDelete:
+		var changed bool
+		changed, err = s.router.RemoveCustomEntry(list, entry)
+		res = RuleEditResult{Changed: changed}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case errors.Is(err, router.ErrUnknownList), errors.Is(err, router.ErrInvalidEntry):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, router.ErrNoListFile):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		log.Warn("[HTTP-PROXY] edit rules", "list", list, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Warn("[HTTP-PROXY] encode rules result", "err", err)
+	}
+}
+
+// handleLearned serves /learned: GET lists the learned domains and DELETE
+// forgets them all, or only the domain parameter if set.
+func (s *HTTPProxyServer) handleLearned(w http.ResponseWriter, r *http.Request) {
+	if !checkLocalAPI(w, r) {
+		return
+	}
+	if s.router == nil {
+		http.Error(w, "Router not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var res any
+	switch r.Method {
+	case http.MethodGet:
+		res = LearnedList{Enabled: s.router.Learning(), Domains: s.router.LearnedDomains()}
+	case http.MethodDelete:
+		n, err := s.router.ClearLearned(r.URL.Query().Get("domain"))
+		if err != nil {
+			log.Warn("[HTTP-PROXY] clear learned domains", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res = LearnedClearResult{Cleared: n}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Warn("[HTTP-PROXY] encode learned domains", "err", err)
+	}
+}
+
 // SetTunConfig stores the TUN configuration served at GET /tun.
 // Called before spawning the TUN helper on macOS.
 func (s *HTTPProxyServer) SetTunConfig(cfg *TunConfig) {
@@ -258,6 +575,23 @@ func (s *HTTPProxyServer) isSelfTarget(r *http.Request) bool {
 	return ip.IsLoopback() || local
 }
 
+// loopbackHost reports whether host names this host's loopback interface.
+func loopbackHost(host string) bool {
+	if strings.EqualFold(strings.TrimSuffix(host, "."), "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// fromLoopback reports whether addr, a client's host:port, is on this
+// host's loopback interface.
+func fromLoopback(addr string) bool {
+	host, _, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 const localIPsCacheTTL = 60 * time.Second
 
 var localIPsCache = struct {
@@ -314,20 +648,22 @@ func (s *HTTPProxyServer) authOK(r *http.Request) bool {
 
 func (s *HTTPProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 	target := connectTarget(r)
-	host, _, err := net.SplitHostPort(target)
+	host, portStr, err := net.SplitHostPort(target)
 	if err != nil {
 		http.Error(w, "Bad CONNECT target", http.StatusBadRequest)
 		return
 	}
 
-	rule := router.HostRuleProxy
+	decision := router.Decision{Rule: router.HostRuleProxy}
+	port, _ := strconv.Atoi(portStr)
+	conn := router.Conn{Network: router.NetworkTCP, Host: host, Port: port}
 	if s.router != nil {
-		rule = s.router.MatchHostRule(host)
-	}
-	if rule == router.HostRuleBlock {
-		log.Info("[HTTP-PROXY] CONNECT blocked", "target", target)
-		http.Error(w, "Forbidden", http.StatusForbidden)
-		return
+		tr := s.router.Explain(conn)
+		if tr.Rule == router.HostRuleBlock {
+			serveBlocked(w, tr)
+			return
+		}
+		decision = tr.Decision
 	}
 
 	rc := http.NewResponseController(w)
@@ -339,8 +675,12 @@ func (s *HTTPProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 	}
 	defer hijConn.Close() //nolint:errcheck
 
-	if rule == router.HostRuleDirect {
+	if decision.Rule == router.HostRuleDirect {
 		log.Info("[HTTP-PROXY] CONNECT direct", "target", target)
+		if s.router != nil && s.handler != nil && s.router.Learning() {
+			s.directConnectLearning(hijConn, target, conn)
+			return
+		}
 		remote, err := s.directConnect(target)
 		if err != nil {
 			log.Warn("[HTTP-PROXY] direct CONNECT", "target", target, "err", err)
@@ -372,8 +712,13 @@ func (s *HTTPProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 	if err := writeConnectEstablished(hijConn, target); err != nil {
 		return
 	}
-	log.Info("[HTTP-PROXY] CONNECT proxy", "target", target)
-	if err := s.handler.OpenTCPStream(context.Background(), target, s.method, hijConn); err != nil {
+	log.Info("[HTTP-PROXY] CONNECT proxy", "target", target, "outbound", decision.Outbound)
+	s.openProxyStream(hijConn, target, decision.Outbound)
+}
+
+// openProxyStream relays conn to target through the tunnel of outbound.
+func (s *HTTPProxyServer) openProxyStream(conn net.Conn, target, outbound string) {
+	if err := s.handler.OpenTCPStream(router.WithOutbound(context.Background(), outbound), target, conn); err != nil {
 		if isTransientStreamError(err) {
 			log.Debug("[HTTP-PROXY] CONNECT closed", "target", target, "err", err)
 			return
@@ -382,6 +727,43 @@ func (s *HTTPProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// directConnectLearning connects the hijacked CONNECT conn to target
+// directly under learned routing, retrying it through the proxy when the
+// direct path fails and the router counts the failure of c.
+func (s *HTTPProxyServer) directConnectLearning(conn net.Conn, target string, c router.Conn) {
+	remote, err := s.directConnect(target)
+	if err != nil {
+		if !s.router.RecordDirectFailure(c) {
+			log.Warn("[HTTP-PROXY] direct CONNECT", "target", target, "err", err)
+			return
+		}
+		log.Info("[HTTP-PROXY] direct CONNECT failed, retrying through proxy", "target", target, "err", err)
+		if err := writeConnectEstablished(conn, target); err != nil {
+			return
+		}
+		s.openProxyStream(conn, target, "")
+		return
+	}
+	defer remote.Close() //nolint:errcheck
+	if err := writeConnectEstablished(conn, target); err != nil {
+		return
+	}
+	replay, err := relayDirectProbe(remote, conn)
+	if err == nil {
+		s.router.RecordDirectSuccess(c.Host)
+		return
+	}
+	if errors.Is(err, errNotProbed) {
+		return
+	}
+	if !s.router.RecordDirectFailure(c) || replay == nil {
+		log.Info("[HTTP-PROXY] direct CONNECT failed", "target", target, "err", err)
+		return
+	}
+	log.Info("[HTTP-PROXY] direct CONNECT failed, retrying through proxy", "target", target, "err", err)
+	s.openProxyStream(replay, target, "")
+}
+
 func writeConnectEstablished(conn net.Conn, target string) error {
 	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
 		log.Warn("[HTTP-PROXY] write CONNECT response", "target", target, "err", err)
@@ -404,6 +786,22 @@ func (s *HTTPProxyServer) dialSOCKS5(target string) (net.Conn, error) {
 	return client.Dial("tcp", target)
 }
 
+// requestTarget returns the host:port a plain HTTP proxy request is for.
+func requestTarget(r *http.Request) string {
+	target := r.URL.Host
+	if target == "" {
+		target = r.Host
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		port := "80"
+		if r.URL.Scheme == "https" {
+			port = "443"
+		}
+		target = net.JoinHostPort(strings.Trim(target, "[]"), port)
+	}
+	return target
+}
+
 func connectTarget(r *http.Request) string {
 	target := r.URL.Host
 	if target == "" {
@@ -440,13 +838,30 @@ func parseBasicAuth(auth string) (username, password string, ok bool) {
 	return username, password, ok
 }
 
+// Close stops the server, waiting up to five seconds for running requests
+// to finish. While a /reload runs, which may be the caller, it only waits
+// for the listener to close and lets the requests finish in the background:
+// the /reload is only answered after Close returns.
 func (s *HTTPProxyServer) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.server != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		return s.server.Shutdown(ctx)
-	}
-	return nil
+	if s.server == nil {
+		return nil
+	}
+	if s.reloading.Load() > 0 {
+		// Shutdown runs the OnShutdown functions once it closed the
+		// listener.
+		closed := make(chan struct{})
+		s.server.RegisterOnShutdown(func() { close(closed) })
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = s.server.Shutdown(ctx)
+		}()
+		<-closed
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
 }
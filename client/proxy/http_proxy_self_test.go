@@ -1,10 +1,20 @@
 package proxy
 
 import (
+	"encoding/json"
+	"errors"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/stats"
 )
 
 func TestIsSelfTarget(t *testing.T) {
@@ -57,3 +67,320 @@ func TestIsSelfTarget_LocalInterfaceIP(t *testing.T) {
 		t.Errorf("isSelfTarget(%s:9090) should be false (different port)", local)
 	}
 }
+
+func TestServeReload(t *testing.T) {
+	s := &HTTPProxyServer{}
+	serve := func(method, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/reload", nil)
+		r.RemoteAddr = remote
+		r.Header.Set(APIHeader, "1")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(http.MethodPost, "127.0.0.1:5000"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without reload func: status %d", w.Code)
+	}
+
+	calls := 0
+	s.SetReloadFunc(func() ([]string, error) {
+		calls++
+		return []string{"timeout"}, nil
+	})
+	if w := serve(http.MethodGet, "127.0.0.1:5000"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d", w.Code)
+	}
+	if w := serve(http.MethodPost, "192.0.2.7:5000"); w.Code != http.StatusForbidden {
+		t.Errorf("remote client: status %d", w.Code)
+	}
+	if calls != 0 {
+		t.Fatalf("reload ran %d times for rejected requests", calls)
+	}
+
+	w := serve(http.MethodPost, "[::1]:5000")
+	var res ReloadResult
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, decode: %v", w.Code, err)
+	}
+	if !slices.Equal(res.RestartRequired, []string{"timeout"}) {
+		t.Errorf("restart_required = %v", res.RestartRequired)
+	}
+
+	s.SetReloadFunc(func() ([]string, error) { return nil, errors.New("bad config") })
+	if w := serve(http.MethodPost, "127.0.0.1:5000"); w.Code != http.StatusInternalServerError {
+		t.Errorf("failed reload: status %d", w.Code)
+	}
+}
+
+func TestReloadClosingOwnServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	s := &HTTPProxyServer{listenAddr: addr}
+	// The reload closes the server answering it, as a reload changing
+	// the http proxy's settings does.
+	s.SetReloadFunc(func() ([]string, error) { return nil, s.Close() })
+	go s.Start() //nolint:errcheck
+
+	var resp *http.Response
+	start := time.Now()
+	for resp == nil {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/reload", nil)
+		req.Header.Set(APIHeader, "1")
+		if resp, err = http.DefaultClient.Do(req); err != nil {
+			if time.Since(start) > 2*time.Second {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("reload answered after %v, waiting on its own request", d)
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("listener still open after the reload closed the server")
+	}
+}
+
+func TestServeRouteExplain(t *testing.T) {
+	s := &HTTPProxyServer{}
+	serve := func(target, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("/route/explain?host=localhost", "127.0.0.1:5000"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without router: status %d", w.Code)
+	}
+	rt, err := router.New(router.Config{ProxyRule: router.ProxyRuleAuto, Rules: []router.Rule{
+		{Outbound: router.OutboundBlock, Processes: []string{"/usr/bin/curl"}},
+		{Outbound: "jp", Hosts: []string{"8.8.8.8"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.router = rt
+	if w := serve("/route/explain?host=8.8.8.8", "192.0.2.7:5000"); w.Code != http.StatusForbidden {
+		t.Errorf("remote client: status %d", w.Code)
+	}
+	for _, target := range []string{"/route/explain", "/route/explain?host=a.com&port=x", "/route/explain?host=a.com&port=70000", "/route/explain?host=a.com&network=sctp", "/route/explain?host=a.com&process=uid:-1"} {
+		if w := serve(target, "127.0.0.1:5000"); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", target, w.Code)
+		}
+	}
+
+	w := serve("/route/explain?host=8.8.8.8&port=53&network=udp", "[::1]:5000")
+	var res RouteExplanation
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, decode: %v", w.Code, err)
+	}
+	if res.Rule != router.HostRuleProxy || res.Outbound != "jp" || res.Source != router.SourcePolicyRule || res.Port != 53 || res.Network != router.NetworkUDP {
+		t.Errorf("explanation = %+v", res)
+	}
+	if len(res.Addresses) != 0 {
+		t.Errorf("an IP host was resolved: %+v", res.Addresses)
+	}
+
+	w = serve("/route/explain?host=8.8.8.8&process=/usr/bin/curl", "127.0.0.1:5000")
+	res = RouteExplanation{}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Rule != router.HostRuleBlock || res.Process == nil || res.Process.Name != "curl" || res.Entry != "/usr/bin/curl" {
+		t.Errorf("explanation for curl = %+v", res)
+	}
+
+	// localhost resolves without network access.
+	w = serve("/route/explain?host=localhost", "127.0.0.1:5000")
+	res = RouteExplanation{}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Source != router.SourceLAN || (len(res.Addresses) == 0 && res.ResolveError == "") {
+		t.Errorf("localhost explanation = %+v", res)
+	}
+}
+
+func TestServeRules(t *testing.T) {
+	directFile := filepath.Join(t.TempDir(), "direct.txt")
+	if err := os.WriteFile(directFile, []byte("# lan services\nnas.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := router.New(router.Config{ProxyRule: router.ProxyRuleAuto, DirectFile: directFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &HTTPProxyServer{router: rt}
+	serve := func(method, target, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = remote
+		r.Header.Set(APIHeader, "1")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(http.MethodPost, "/rules?list=direct&entry=example.org", "192.0.2.7:5000"); w.Code != http.StatusForbidden {
+		t.Errorf("remote client: status %d", w.Code)
+	}
+
+	// A web page can POST to the proxy without a preflight, but not with
+	// APIHeader, and the browser adds Origin.
+	r := httptest.NewRequest(http.MethodPost, "/rules?list=direct&entry=*", nil)
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("POST without %s: status %d", APIHeader, w.Code)
+	}
+	r.Header.Set(APIHeader, "1")
+	r.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("cross-origin POST: status %d", w.Code)
+	}
+	if entries, err := rt.CustomEntries("direct"); err != nil || len(entries) != 1 {
+		t.Fatalf("rejected requests changed the list: %+v, %v", entries, err)
+	}
+
+	w = serve(http.MethodPost, "/rules?list=direct&entry=example.org", "127.0.0.1:5000")
+	var edit RuleEditResult
+	if err := json.NewDecoder(w.Body).Decode(&edit); err != nil || w.Code != http.StatusOK || !edit.Changed {
+		t.Fatalf("add: status %d, %+v, %v", w.Code, edit, err)
+	}
+	if rt.MatchHostRule("www.example.org") != router.HostRuleDirect {
+		t.Error("added entry not applied")
+	}
+
+	w = serve(http.MethodGet, "/rules?list=direct", "127.0.0.1:5000")
+	var list RuleList
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("list: status %d, %v", w.Code, err)
+	}
+	if list.File != directFile || len(list.Entries) != 2 || list.Entries[1].Entry != "example.org" || list.Entries[1].Line != 3 {
+		t.Errorf("list = %+v", list)
+	}
+
+	w = serve(http.MethodDelete, "/rules?list=direct&entry=nas.test", "127.0.0.1:5000")
+	edit = RuleEditResult{}
+	if err := json.NewDecoder(w.Body).Decode(&edit); err != nil || !edit.Changed {
+		t.Errorf("remove: status %d, %+v, %v", w.Code, edit, err)
+	}
+
+	for _, tt := range []struct {
+		method, target string
+		want           int
+	}{
+		{http.MethodPost, "/rules?list=nope&entry=a.test", http.StatusBadRequest},
+		{http.MethodPost, "/rules?list=direct&entry=regexp:(", http.StatusBadRequest},
+		{http.MethodPost, "/rules?list=proxy&entry=a.test", http.StatusConflict},
+		{http.MethodPut, "/rules?list=direct&entry=a.test", http.StatusMethodNotAllowed},
+	} {
+		if w := serve(tt.method, tt.target, "[::1]:5000"); w.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+}
+
+func TestServeBlocked(t *testing.T) {
+	rt, err := router.New(router.Config{ProxyRule: router.ProxyRuleAuto, Rules: []router.Rule{
+		{Outbound: router.OutboundBlock, Hosts: []string{"ads.test"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &HTTPProxyServer{listenAddr: "127.0.0.1:8080", router: rt}
+
+	before := stats.Collect().BlockedConnections
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "http://x.ads.test/banner.png", nil),
+		httptest.NewRequest(http.MethodConnect, "x.ads.test:443", nil),
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		body := w.Body.String()
+		if w.Code != http.StatusForbidden || !strings.Contains(body, "x.ads.test") || !strings.Contains(body, "routing.rules[0]") {
+			t.Errorf("%s %s: status %d, body %q", r.Method, r.URL, w.Code, body)
+		}
+	}
+	if got := stats.Collect().BlockedConnections - before; got != 2 {
+		t.Errorf("blocked connections counted %d, want 2", got)
+	}
+}
+
+func TestServeLearned(t *testing.T) {
+	rt, err := router.New(router.Config{ProxyRule: router.ProxyRuleAuto, Learn: router.LearnConfig{Enabled: true, Failures: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &HTTPProxyServer{router: rt}
+	serve := func(method, target, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = remote
+		r.Header.Set(APIHeader, "1")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	for _, host := range []string{"a.cn", "b.cn"} {
+		if !rt.RecordDirectFailure(router.Conn{Host: host}) {
+			t.Fatalf("failure of %s not counted", host)
+		}
+	}
+
+	if w := serve(http.MethodGet, "/learned", "192.0.2.7:5000"); w.Code != http.StatusForbidden {
+		t.Errorf("remote client: status %d", w.Code)
+	}
+	w := serve(http.MethodGet, "/learned", "127.0.0.1:5000")
+	var list LearnedList
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("list: status %d, %v", w.Code, err)
+	}
+	if !list.Enabled || len(list.Domains) != 2 || list.Domains[0].Domain != "a.cn" || list.Domains[0].Expires.IsZero() {
+		t.Errorf("list = %+v", list)
+	}
+
+	w = serve(http.MethodDelete, "/learned?domain=a.cn", "[::1]:5000")
+	var res LearnedClearResult
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || res.Cleared != 1 {
+		t.Errorf("clear a.cn: status %d, %+v, %v", w.Code, res, err)
+	}
+	if rt.MatchHostRule("a.cn") != router.HostRuleDirect || rt.MatchHostRule("b.cn") != router.HostRuleProxy {
+		t.Error("clearing one domain did not forget just it")
+	}
+	w = serve(http.MethodDelete, "/learned", "127.0.0.1:5000")
+	res = LearnedClearResult{}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || res.Cleared != 1 {
+		t.Errorf("clear all: status %d, %+v, %v", w.Code, res, err)
+	}
+	if w := serve(http.MethodPost, "/learned", "127.0.0.1:5000"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d", w.Code)
+	}
+}
+
+func TestServeLoopbackTargetFromRemote(t *testing.T) {
+	s := &HTTPProxyServer{}
+	for _, target := range []string{"http://127.0.0.1:8080/rules?list=direct&entry=*", "http://localhost:8080/reload"} {
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		r.RemoteAddr = "192.0.2.7:5000"
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s from a remote client: status %d", target, w.Code)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/util/bytespool"
+	"github.com/txthinking/socks5"
+)
+
+const (
+	// directAnswerTimeout bounds the wait for the remote to answer the TLS
+	// handshake of a direct connection under learned routing.
+	directAnswerTimeout = 10 * time.Second
+	// directReplayLimit is how much of what the client sent is kept to
+	// replay through the proxy if the direct connection fails.
+	directReplayLimit = 64 << 10
+)
+
+var (
+	// errNoAnswer is the failure of a direct connection the remote closed,
+	// reset or left unanswered before sending anything.
+	errNoAnswer = errors.New("direct connection failed before the remote answered")
+	// errNotProbed is returned for a direct connection the remote closed
+	// before answering anything but a TLS handshake, which says nothing
+	// about whether the direct path works.
+	errNotProbed = errors.New("direct connection closed before the remote answered")
+)
+
+// firstFlight records the TLS handshake the client sends until the remote
+// answers.
+type firstFlight struct {
+	mu       sync.Mutex
+	data     []byte
+	overflow bool
+	answered bool
+	// plain is set when the client started with anything but a TLS
+	// handshake; nothing is recorded then.
+	plain bool
+}
+
+// record keeps b while the remote has not answered and arms the answer
+// timeout of rc when the client starts a TLS handshake.
+func (f *firstFlight) record(b []byte, rc net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.answered || f.plain {
+		return
+	}
+	if len(f.data) == 0 {
+		// A plain request may legitimately wait long for its answer, as
+		// a long poll does, so only a handshake is timed.
+		if !isTLSHandshake(b) {
+			f.plain = true
+			return
+		}
+		_ = rc.SetReadDeadline(time.Now().Add(directAnswerTimeout))
+	}
+	if len(f.data)+len(b) > directReplayLimit {
+		f.overflow = true
+	}
+	if !f.overflow {
+		f.data = append(f.data, b...)
+	}
+}
+
+// answer marks the remote as answered, disarming the answer timeout of rc.
+func (f *firstFlight) answer(rc net.Conn) {
+	f.mu.Lock()
+	f.answered = true
+	f.mu.Unlock()
+	_ = rc.SetReadDeadline(time.Time{})
+}
+
+// relayDirectProbe relays c and the direct connection rc like relayTCP,
+// watching for the remote to fail before it answers a TLS handshake from
+// c: to close or reset the connection, or to stay silent for
+// directAnswerTimeout. It then stops relaying and returns errNoAnswer with
+// a conn replaying the handshake, which the remote cannot have acted on,
+// or nil if it is longer than directReplayLimit. Anything else c starts
+// with is relayed without a timeout, and if the remote closes it before
+// answering, relayDirectProbe returns errNotProbed.
+func relayDirectProbe(rc, c net.Conn) (net.Conn, error) {
+	ff := &firstFlight{}
+	upDone := make(chan struct{})
+	go func() {
+		defer close(upDone)
+		buf := bytespool.Get(config.TCPStreamBufferSize)
+		defer bytespool.MustPut(buf)
+		for {
+			n, err := c.Read(buf)
+			if n > 0 {
+				ff.record(buf[:n], rc)
+				if _, err := rc.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					return // stopped by the probe
+				}
+				if cw, ok := rc.(interface{ CloseWrite() error }); ok {
+					_ = cw.CloseWrite()
+				}
+				return
+			}
+		}
+	}()
+
+	buf := bytespool.Get(config.TCPStreamBufferSize)
+	defer bytespool.MustPut(buf)
+	var result error
+	n, err := rc.Read(buf)
+	if n == 0 && err != nil {
+		ff.mu.Lock()
+		sent, plain := len(ff.data) > 0 || ff.overflow, ff.plain
+		ff.mu.Unlock()
+		if sent {
+			// Stop reading c, so it can be replayed from where it is.
+			_ = c.SetReadDeadline(time.Now())
+			<-upDone
+			_ = c.SetReadDeadline(time.Time{})
+			if ff.overflow {
+				return nil, errNoAnswer
+			}
+			return &replayConn{Conn: c, data: ff.data}, errNoAnswer
+		}
+		if plain {
+			result = errNotProbed
+		}
+	}
+
+	ff.answer(rc)
+	if n > 0 {
+		if _, err := c.Write(buf[:n]); err == nil {
+			_, _ = io.Copy(c, rc)
+		}
+	}
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+	<-upDone
+	return nil, result
+}
+
+// isTLSHandshake reports whether data starts with a TLS handshake record.
+func isTLSHandshake(data []byte) bool {
+	return len(data) >= 3 && data[0] == 0x16 && data[1] == 0x03
+}
+
+// replayConn is a net.Conn whose reads return data before reading Conn.
+type replayConn struct {
+	net.Conn
+	data []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.data) > 0 {
+		n := copy(b, c.data)
+		c.data = c.data[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *replayConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// directTCPLearning connects c to target directly under learned routing.
+// If the direct path fails, the router records the failure of conn and,
+// when it counts and the connection can be replayed, c is retried through
+// the proxy.
+func (s *Socks5Server) directTCPLearning(c net.Conn, r *socks5.Request, target string, conn router.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout)
+	rc, err := s.directDialContext(ctx, "tcp", directTarget(c, target))
+	cancel()
+	if err != nil {
+		if !s.router.RecordDirectFailure(conn) {
+			_ = s.replyError(c, r, socks5.RepHostUnreachable)
+			return err
+		}
+		log.Info("[TCP_DIRECT] connect failed, retrying through proxy", "target", target, "err", err)
+		return s.proxyTCP(c, r, target, "")
+	}
+	defer rc.Close() //nolint:errcheck
+
+	if err := s.replyConnected(c, r, rc.LocalAddr(), socks5.RepHostUnreachable); err != nil {
+		return err
+	}
+	replay, err := relayDirectProbe(rc, c)
+	if err == nil || errors.Is(err, errNotProbed) {
+		if err == nil {
+			s.router.RecordDirectSuccess(conn.Host)
+		}
+		log.Debug("[TCP_DIRECT] relay finished", "target", target)
+		return nil
+	}
+	if !s.router.RecordDirectFailure(conn) || replay == nil {
+		log.Info("[TCP_DIRECT] failed", "target", target, "err", err)
+		return nil
+	}
+	log.Info("[TCP_DIRECT] failed, retrying through proxy", "target", target, "err", err)
+	return s.openProxyStream(replay, target, "")
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+func TestRelayDirectProbe(t *testing.T) {
+	hello := []byte{0x16, 0x03, 0x01, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	tests := []struct {
+		name    string
+		first   []byte
+		answer  bool
+		wantErr error
+		replay  bool
+	}{
+		{"answered", hello, true, nil, false},
+		{"reset tls handshake", hello, false, errNoAnswer, true},
+		// A plain request is relayed without a timeout and its failures
+		// are not counted.
+		{"answered plain request", []byte("GET / HTTP/1.1\r\n\r\n"), true, nil, false},
+		{"reset plain request", []byte("GET / HTTP/1.1\r\n\r\n"), false, errNotProbed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, local := tcpPair(t)
+			rc, remote := tcpPair(t)
+			go func() {
+				buf := make([]byte, len(tt.first))
+				if _, err := io.ReadFull(remote, buf); err != nil {
+					return
+				}
+				if tt.answer {
+					remote.Write([]byte("welcome"))
+				}
+				remote.Close()
+			}()
+			if _, err := client.Write(tt.first); err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan struct{})
+			var replay net.Conn
+			var err error
+			go func() {
+				defer close(done)
+				replay, err = relayDirectProbe(rc, local)
+			}()
+			if !tt.replay {
+				// The relay ends once both sides have closed.
+				want := ""
+				if tt.answer {
+					want = "welcome"
+				}
+				if got, _ := io.ReadAll(client); string(got) != want {
+					t.Errorf("client read %q, want %q", got, want)
+				}
+				client.Close()
+			}
+			<-done
+
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if (replay != nil) != tt.replay {
+				t.Fatalf("replay = %v, want one: %v", replay, tt.replay)
+			}
+			if replay == nil {
+				return
+			}
+			client.Write([]byte("more"))
+			client.Close()
+			got, _ := io.ReadAll(replay)
+			if want := append(bytes.Clone(tt.first), "more"...); !bytes.Equal(got, want) {
+				t.Errorf("replayed %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -65,7 +65,7 @@ func newTestStreamHandler(tr transport.Transport) *StreamHandler {
 	for i := range key {
 		key[i] = byte(i + 1)
 	}
-	return NewStreamHandler(tr, key, shaper.Config{}, 0)
+	return NewStreamHandler(tr, key, protocol.MethodAES256GCM, shaper.Config{}, 0)
 }
 
 func TestOpenAndBootstrap_SuccessFirstTry(t *testing.T) {
@@ -76,7 +76,7 @@ func TestOpenAndBootstrap_SuccessFirstTry(t *testing.T) {
 	}
 	h := newTestStreamHandler(tr)
 
-	bs, err := h.openAndBootstrap(context.Background(), "/v3/tcp", protocol.ProtoTCP, "example.com:443", protocol.MethodAES256GCM, nil)
+	bs, err := h.openAndBootstrap(context.Background(), "/v3/tcp", protocol.ProtoTCP, "example.com:443", nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -98,7 +98,7 @@ func TestOpenAndBootstrap_RetryOnErrClosedPipe(t *testing.T) {
 	}
 	h := newTestStreamHandler(tr)
 
-	bs, err := h.openAndBootstrap(context.Background(), "/v3/tcp", protocol.ProtoTCP, "example.com:443", protocol.MethodAES256GCM, nil)
+	bs, err := h.openAndBootstrap(context.Background(), "/v3/tcp", protocol.ProtoTCP, "example.com:443", nil)
 	if err != nil {
 		t.Fatalf("expected success after retry, got: %v", err)
 	}
@@ -120,7 +120,7 @@ func TestOpenAndBootstrap_NoRetryOnNonClosedPipeErr(t *testing.T) {
 	}
 	h := newTestStreamHandler(tr)
 
-	_, err := h.openAndBootstrap(context.Background(), "/v3/tcp", protocol.ProtoTCP, "example.com:443", protocol.MethodAES256GCM, nil)
+	_, err := h.openAndBootstrap(context.Background(), "/v3/tcp", protocol.ProtoTCP, "example.com:443", nil)
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
@@ -141,7 +141,7 @@ func TestOpenAndBootstrap_AllRetriesFail(t *testing.T) {
 	}
 	h := newTestStreamHandler(tr)
 
-	_, err := h.openAndBootstrap(context.Background(), "/v3/tcp", protocol.ProtoTCP, "example.com:443", protocol.MethodAES256GCM, nil)
+	_, err := h.openAndBootstrap(context.Background(), "/v3/tcp", protocol.ProtoTCP, "example.com:443", nil)
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
@@ -160,7 +160,7 @@ func TestOpenAndBootstrap_OpenFailureNoRetry(t *testing.T) {
 	}
 	h := newTestStreamHandler(tr)
 
-	_, err := h.openAndBootstrap(context.Background(), "/v3/tcp", protocol.ProtoTCP, "example.com:443", protocol.MethodAES256GCM, nil)
+	_, err := h.openAndBootstrap(context.Background(), "/v3/tcp", protocol.ProtoTCP, "example.com:443", nil)
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
@@ -200,7 +200,7 @@ func TestOpenAndBootstrap_FreshSaltPerAttempt(t *testing.T) {
 	wrapped := &saltCapturingTransport{inner: tr}
 	h := newTestStreamHandler(wrapped)
 
-	bs, err := h.openAndBootstrap(context.Background(), "/v3/tcp", protocol.ProtoTCP, "example.com:443", protocol.MethodAES256GCM, nil)
+	bs, err := h.openAndBootstrap(context.Background(), "/v3/tcp", protocol.ProtoTCP, "example.com:443", nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
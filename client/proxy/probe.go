@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/nange/easyss/v3/client/balancer"
+	"github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/protocol"
+)
+
+var errProbeRejected = errors.New("probe target rejected by server")
+
+// Probe opens a real /v3/tcp stream through u to target, which must speak
+// HTTP, and returns the time from opening the stream until the first
+// response bytes arrive. It exercises the whole path: transport, handshake
+// keys and the server's dial to the target.
+func (h *StreamHandler) Probe(ctx context.Context, u *balancer.Upstream, target string) (time.Duration, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return 0, fmt.Errorf("probe target: %w", err)
+	}
+	req := "HEAD / HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n\r\n"
+
+	start := time.Now()
+	bs, err := h.bootstrapOn(ctx, u, config.EndpointTCP, protocol.ProtoTCP, target,
+		[]protocol.Frame{protocol.NewFrameDATA([]byte(req))})
+	if err != nil {
+		return 0, err
+	}
+	defer bs.stream.Close() //nolint:errcheck
+	stop := context.AfterFunc(ctx, func() { _ = bs.stream.Close() })
+	defer stop()
+
+	aadS2C := crypto.BuildAAD(config.EndpointTCP, bs.salt, "s2c", "session", bs.method)
+	s2cEnc, s2cCounter, err := bs.sk.Encryptor("s2c", "session", bs.method)
+	if err != nil {
+		return 0, fmt.Errorf("s2c encryptor: %w", err)
+	}
+	dr := crypto.NewDecryptedReader(bs.stream, aadS2C, s2cEnc, s2cCounter)
+
+	for first := true; ; first = false {
+		frame, err := dr.ReadFrame()
+		if first {
+			err = classifyFirstReadError(err)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, err
+		}
+		switch frame.Type {
+		case protocol.FrameDATA:
+			return time.Since(start), nil
+		case protocol.FrameRST:
+			return 0, errProbeRejected
+		case protocol.FrameFIN:
+			return 0, fmt.Errorf("probe target closed without a response")
+		}
+	}
+}
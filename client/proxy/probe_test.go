@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/client/balancer"
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/shaper"
+	"github.com/nange/easyss/v3/transport"
+)
+
+type pipeStream struct{ net.Conn }
+
+func (s pipeStream) CloseWrite() error { return nil }
+
+// probeServerTransport plays the server side of a /v3/tcp stream: it checks
+// the handshake and answers with reply, or never answers if reply is nil.
+// With allowed set, it closes streams asking for another method.
+type probeServerTransport struct {
+	key     []byte
+	reply   *protocol.Frame
+	target  chan string
+	allowed protocol.Method
+}
+
+func (p *probeServerTransport) Open(ctx context.Context, req transport.OpenRequest) (transport.Stream, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close() //nolint:errcheck
+		salt, _ := base64.RawURLEncoding.DecodeString(req.Salt)
+		sk, err := crypto.NewStreamKeys(p.key, salt, req.Endpoint)
+		if err != nil {
+			return
+		}
+		first, err := sk.ReadFirstRecord(server)
+		if err != nil {
+			return
+		}
+		p.target <- first.Handshake.Target
+		method := first.Handshake.Method
+		if p.allowed != 0 && method != p.allowed {
+			return
+		}
+		if p.reply == nil {
+			_, _ = io.Copy(io.Discard, server)
+			return
+		}
+		enc, counter, _ := sk.Encryptor("s2c", "session", method)
+		rw := crypto.NewRecordWriter(server, enc, counter, crypto.BuildAAD(req.Endpoint, salt, "s2c", "session", method))
+		_ = rw.WriteRecord(protocol.EncodeFrames([]protocol.Frame{*p.reply}))
+		rw.Flush()
+	}()
+	return pipeStream{client}, nil
+}
+
+func (p *probeServerTransport) CloseIdle()                      {}
+func (p *probeServerTransport) Stats() transport.TransportStats { return transport.TransportStats{} }
+func (p *probeServerTransport) Close() error                    { return nil }
+
+func TestProbe(t *testing.T) {
+	key := make([]byte, 32)
+	data := protocol.NewFrameDATA([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	rst := protocol.NewFrameRST()
+	h := NewStreamHandler(&mockTransport{}, key, protocol.MethodAES256GCM, shaper.Config{}, 0)
+
+	tr := &probeServerTransport{key: key, reply: &data, target: make(chan string, 1)}
+	rtt, err := h.Probe(context.Background(), balancer.NewUpstream("a", tr, key, protocol.MethodAES256GCM, 1), "www.gstatic.com:80")
+	if err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if rtt <= 0 {
+		t.Errorf("rtt = %v, want > 0", rtt)
+	}
+	if got := <-tr.target; got != "www.gstatic.com:80" {
+		t.Errorf("handshake target = %q", got)
+	}
+
+	// The upstream's own method is used, not the handler's.
+	tr = &probeServerTransport{key: key, reply: &data, target: make(chan string, 1), allowed: protocol.MethodChaCha20Poly1305}
+	if _, err := h.Probe(context.Background(), balancer.NewUpstream("chacha", tr, key, protocol.MethodChaCha20Poly1305, 1), "www.gstatic.com:80"); err != nil {
+		t.Errorf("probe with the upstream's method: %v", err)
+	}
+
+	tr = &probeServerTransport{key: key, reply: &rst, target: make(chan string, 1)}
+	if _, err := h.Probe(context.Background(), balancer.NewUpstream("b", tr, key, protocol.MethodAES256GCM, 1), "www.gstatic.com:80"); !errors.Is(err, errProbeRejected) {
+		t.Errorf("err = %v, want errProbeRejected", err)
+	}
+
+	tr = &probeServerTransport{key: key, target: make(chan string, 1)}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := h.Probe(ctx, balancer.NewUpstream("c", tr, key, protocol.MethodAES256GCM, 1), "www.gstatic.com:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want deadline exceeded", err)
+	}
+
+	if _, err := h.Probe(context.Background(), balancer.NewUpstream("d", tr, key, protocol.MethodAES256GCM, 1), "no-port"); err == nil || !strings.Contains(err.Error(), "probe target") {
+		t.Errorf("err = %v, want probe target error", err)
+	}
+}
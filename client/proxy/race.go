@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/stats"
+	"github.com/nange/easyss/v3/util/bytespool"
+	"github.com/txthinking/socks5"
+)
+
+// raceFirstFlightWait is how long a raced connection waits for the client
+// to send its first bytes, which decide whether the paths race on the TLS
+// handshake or on connect.
+const raceFirstFlightWait = 50 * time.Millisecond
+
+// raceDialer opens one path of a race.
+type raceDialer func(ctx context.Context) (net.Conn, error)
+
+// raceResult is a path that finished its part of a race.
+type raceResult struct {
+	conn   net.Conn
+	direct bool
+	// answer is what the remote sent in reply to a raced TLS hello.
+	answer []byte
+	err    error
+}
+
+// raceTCP replies success to the request r and connects c to target both
+// directly and through the proxy, relaying c through the path that wins.
+// The winner routes host until the race TTL passes.
+func (s *Socks5Server) raceTCP(c net.Conn, r *socks5.Request, target, host string) error {
+	if err := s.replyConnected(c, r, c.LocalAddr(), socks5.RepServerFailure); err != nil {
+		log.Error("[TCP_RACE] reply", "err", err)
+		return err
+	}
+	first, err := readFirstFlight(c)
+	if err != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout)
+	defer cancel()
+	direct := func(ctx context.Context) (net.Conn, error) {
+		return s.directDialContext(ctx, "tcp", directTarget(c, target))
+	}
+	proxied := func(ctx context.Context) (net.Conn, error) {
+		return s.handler.DialTunnel(ctx, s.handler.upstream(ctx), target)
+	}
+	res, err := raceDial(ctx, first, s.router.RaceHeadStart(), direct, proxied)
+	if err != nil {
+		log.Error("[TCP_RACE] both paths failed", "target", target, "err", err)
+		return err
+	}
+	defer res.conn.Close() //nolint:errcheck
+
+	s.router.RecordRaceWinner(host, res.direct)
+	if !res.direct {
+		stats.RecordTCPConnection()
+	}
+	log.Info("[TCP_RACE] won", "target", target, "direct", res.direct)
+	if len(res.answer) > 0 {
+		if _, err := c.Write(res.answer); err != nil {
+			return nil
+		}
+	} else if len(first) > 0 {
+		if _, err := res.conn.Write(first); err != nil {
+			return nil
+		}
+	}
+	relayTCP(res.conn, c)
+	log.Debug("[TCP_RACE] relay finished", "target", target)
+	return nil
+}
+
+// readFirstFlight returns what c sends within raceFirstFlightWait, which
+// is nothing for protocols where the server speaks first. A TLS record is
+// read whole, waiting up to sniffTimeout for the rest once it started: a
+// large hello, as with post-quantum key shares, may arrive in pieces, as
+// tun2socks delivers it.
+func readFirstFlight(c net.Conn) ([]byte, error) {
+	buf := bytespool.Get(config.TCPStreamBufferSize)
+	defer bytespool.MustPut(buf)
+	var data []byte
+	_ = c.SetReadDeadline(time.Now().Add(raceFirstFlightWait))
+	defer c.SetReadDeadline(time.Time{}) //nolint:errcheck
+	for {
+		n, err := c.Read(buf)
+		if n > 0 && len(data) == 0 && tlsRecordPending(buf[:n]) {
+			_ = c.SetReadDeadline(time.Now().Add(sniffTimeout))
+		}
+		data = append(data, buf[:n]...)
+		if err != nil {
+			if len(data) == 0 && !errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, err
+			}
+			return data, nil
+		}
+		if !tlsRecordPending(data) {
+			return data, nil
+		}
+	}
+}
+
+// tlsRecordLen returns the length, header included, of the TLS handshake
+// record data starts with, or 0 if data does not start with one.
+func tlsRecordLen(data []byte) int {
+	if len(data) < 5 || !isTLSHandshake(data) {
+		return 0
+	}
+	return 5 + int(binary.BigEndian.Uint16(data[3:5]))
+}
+
+// tlsRecordPending reports whether data starts a TLS handshake record it
+// does not hold in full.
+func tlsRecordPending(data []byte) bool {
+	if len(data) < 5 {
+		return len(data) > 0 && data[0] == 0x16 && (len(data) < 2 || data[1] == 0x03)
+	}
+	return tlsRecordLen(data) > len(data)
+}
+
+// raceDial races the direct path, which starts at once, against the
+// proxied one, which starts after headStart or as soon as the direct path
+// fails. If first is a whole TLS hello record and nothing more, it is sent
+// on both paths and the first to answer wins; otherwise, as first is unsafe
+// to send twice or too short to be answered, the first to connect wins and
+// first is left for the caller to send. ctx bounds the dials; once a path
+// wins, the loser's dial or handshake is cancelled and its connection, if
+// it has one, closed.
+func raceDial(ctx context.Context, first []byte, headStart time.Duration, direct, proxied raceDialer) (raceResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	handshake := len(first) > 0 && tlsRecordLen(first) == len(first)
+	results := make(chan raceResult, 2)
+	run := func(dial raceDialer, isDirect bool) {
+		res := raceResult{direct: isDirect}
+		res.conn, res.err = dial(ctx)
+		if res.err == nil && handshake {
+			res.answer, res.err = raceHandshake(ctx, res.conn, first)
+			if res.err != nil {
+				res.conn.Close() //nolint:errcheck
+			}
+		}
+		results <- res
+	}
+
+	go run(direct, true)
+	timer := time.NewTimer(headStart)
+	defer timer.Stop()
+	started, pending := false, 1
+	startProxied := func() {
+		if !started {
+			started = true
+			pending++
+			go run(proxied, false)
+		}
+	}
+	var errs []error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			startProxied()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					go func() {
+						if loser := <-results; loser.err == nil {
+							loser.conn.Close() //nolint:errcheck
+						}
+					}()
+				}
+				return res, nil
+			}
+			errs = append(errs, res.err)
+			startProxied()
+		}
+	}
+	return raceResult{}, errors.Join(errs...)
+}
+
+// raceHandshake sends the TLS hello to rc and returns the first bytes of
+// the answer, failing if rc closes, resets or stays silent for
+// directAnswerTimeout, or ctx is cancelled.
+func raceHandshake(ctx context.Context, rc net.Conn, hello []byte) ([]byte, error) {
+	_ = rc.SetReadDeadline(time.Now().Add(directAnswerTimeout))
+	stop := context.AfterFunc(ctx, func() {
+		_ = rc.SetDeadline(time.Now())
+	})
+	defer stop()
+	if _, err := rc.Write(hello); err != nil {
+		return nil, err
+	}
+	buf := bytespool.Get(config.TCPStreamBufferSize)
+	defer bytespool.MustPut(buf)
+	n, err := rc.Read(buf)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if n == 0 {
+		if err == nil {
+			err = errNoAnswer
+		}
+		return nil, err
+	}
+	_ = rc.SetReadDeadline(time.Time{})
+	return append([]byte(nil), buf[:n]...), nil
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRaceDial(t *testing.T) {
+	hello := []byte{0x16, 0x03, 0x01, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	refused := errors.New("refused")
+
+	// path returns a dialer connected to a remote answering hello with
+	// answer, or closing without answer if it is empty, after delay.
+	path := func(delay time.Duration, answer string, err error) raceDialer {
+		return func(ctx context.Context) (net.Conn, error) {
+			time.Sleep(delay)
+			if err != nil {
+				return nil, err
+			}
+			local, remote := tcpPair(t)
+			go func() {
+				buf := make([]byte, len(hello))
+				if _, err := io.ReadFull(remote, buf); err != nil {
+					return
+				}
+				if answer == "" {
+					remote.Close()
+					return
+				}
+				remote.Write([]byte(answer))
+			}()
+			return local, nil
+		}
+	}
+
+	tests := []struct {
+		name      string
+		first     []byte
+		direct    raceDialer
+		proxied   raceDialer
+		winDirect bool
+		answer    string
+		err       bool
+	}{
+		{"direct within head start", hello, path(0, "direct", nil), path(0, "proxy", nil), true, "direct", false},
+		{"direct slower", hello, path(300*time.Millisecond, "direct", nil), path(0, "proxy", nil), false, "proxy", false},
+		{"direct refused", hello, path(0, "", refused), path(0, "proxy", nil), false, "proxy", false},
+		{"direct reset on hello", hello, path(0, "", nil), path(0, "proxy", nil), false, "proxy", false},
+		{"connect only", []byte("GET / HTTP/1.1\r\n\r\n"), path(0, "", nil), path(0, "", nil), true, "", false},
+		// Racing a truncated hello would leave both paths waiting for
+		// the rest of it.
+		{"truncated hello", hello[:7], path(0, "", nil), path(0, "", nil), true, "", false},
+		{"both fail", hello, path(0, "", refused), path(0, "", refused), false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := raceDial(context.Background(), tt.first, 100*time.Millisecond, tt.direct, tt.proxied)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.conn.Close()
+			if res.direct != tt.winDirect {
+				t.Errorf("direct = %v, want %v", res.direct, tt.winDirect)
+			}
+			if string(res.answer) != tt.answer {
+				t.Errorf("answer = %q, want %q", res.answer, tt.answer)
+			}
+		})
+	}
+}
+
+func TestRaceDialReleasesLoser(t *testing.T) {
+	hello := []byte{0x16, 0x03, 0x01, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	// direct connects after 50ms, well after the proxied path started,
+	// to a remote answering hello.
+	direct := func(ctx context.Context) (net.Conn, error) {
+		time.Sleep(50 * time.Millisecond)
+		local, remote := tcpPair(t)
+		go func() {
+			buf := make([]byte, len(hello))
+			if _, err := io.ReadFull(remote, buf); err == nil {
+				remote.Write([]byte("direct"))
+			}
+		}()
+		return local, nil
+	}
+
+	t.Run("dial", func(t *testing.T) {
+		released := make(chan struct{})
+		proxied := func(ctx context.Context) (net.Conn, error) {
+			<-ctx.Done()
+			close(released)
+			return nil, ctx.Err()
+		}
+		res, err := raceDial(context.Background(), nil, 0, direct, proxied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.conn.Close()
+		select {
+		case <-released:
+		case <-time.After(time.Second):
+			t.Fatal("losing dial not cancelled")
+		}
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+		closed := make(chan struct{})
+		// The proxied remote reads the hello and never answers.
+		proxied := func(ctx context.Context) (net.Conn, error) {
+			local, remote := tcpPair(t)
+			go func() {
+				io.Copy(io.Discard, remote)
+				close(closed)
+			}()
+			return local, nil
+		}
+		res, err := raceDial(context.Background(), hello, 0, direct, proxied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.conn.Close()
+		if !res.direct {
+			t.Fatal("proxied path won")
+		}
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("losing handshake not cancelled")
+		}
+	})
+}
+
+func TestReadFirstFlight(t *testing.T) {
+	hello := append([]byte{0x16, 0x03, 0x01, 0x07, 0x00}, bytes.Repeat([]byte{'h'}, 0x700)...)
+	tests := []struct {
+		name   string
+		pieces [][]byte
+		want   []byte
+	}{
+		// Together the pieces arrive after raceFirstFlightWait.
+		{"hello in pieces", [][]byte{hello[:2], hello[2:600], hello[600:1200], hello[1200:]}, hello},
+		{"truncated hello", [][]byte{hello[:600]}, hello[:600]},
+		{"plain request", [][]byte{[]byte("GET / HTTP/1.1\r\n\r\n")}, []byte("GET / HTTP/1.1\r\n\r\n")},
+		{"server speaks first", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, local := tcpPair(t)
+			go func() {
+				for _, p := range tt.pieces {
+					client.Write(p)
+					time.Sleep(20 * time.Millisecond)
+				}
+			}()
+			got, err := readFirstFlight(local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("read %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
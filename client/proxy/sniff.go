@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/nange/easyss/v3/client/sniff"
+	"github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/util/bytespool"
+	"github.com/txthinking/socks5"
+)
+
+const (
+	// sniffTimeout bounds the wait for the first bytes of a connection to
+	// an IP, which protocols where the server speaks first never send.
+	sniffTimeout = 100 * time.Millisecond
+	// sniffLimit is how much of a connection is read to find its domain,
+	// a whole TLS record.
+	sniffLimit = 5 + 1<<14
+)
+
+// SetSniffing makes the server sniff the domain of connections requested
+// for an IP, as tun2socks requests them, from their first bytes: the TLS
+// server name or HTTP Host of TCP connections, the server name of QUIC
+// Initial packets. The domain is routed and sent to the server in place of
+// the IP; direct connections still go to the IP.
+func (s *Socks5Server) SetSniffing(on bool) {
+	s.sniffing.Store(on)
+}
+
+// sniffedConn is a connection whose request was answered before its first
+// bytes were read to sniff its domain; it replays them. A failure replied
+// to it later resets it.
+type sniffedConn struct {
+	*replayConn
+	// addr is the IP address the connection was requested for.
+	addr string
+}
+
+// abort resets c in place of the reply rep it can no longer be sent, so
+// the client sees the connection fail rather than close cleanly.
+func (c *sniffedConn) abort(rep byte) {
+	log.Info("[SNIFF] connection reset", "target", c.addr, "rep", rep)
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		_ = tc.SetLinger(0)
+	}
+	_ = c.Close()
+}
+
+// directTarget returns the address to connect c to directly: the address
+// it was requested for if its domain was sniffed, else target.
+func directTarget(c net.Conn, target string) string {
+	if sc, ok := c.(*sniffedConn); ok {
+		return sc.addr
+	}
+	return target
+}
+
+// sniffTCP answers the request r for target, an IP address, and sniffs
+// the domain of c from what it sends first. It returns the domain, empty if
+// none was found, and c replaying what was read.
+func (s *Socks5Server) sniffTCP(c net.Conn, r *socks5.Request, target string) (string, net.Conn, error) {
+	if err := s.replyConnected(c, r, c.LocalAddr(), socks5.RepServerFailure); err != nil {
+		return "", nil, err
+	}
+	buf := bytespool.Get(config.TCPStreamBufferSize)
+	defer bytespool.MustPut(buf)
+	var data []byte
+	domain := ""
+	_ = c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	for len(data) < sniffLimit {
+		n, err := c.Read(buf)
+		data = append(data, buf[:n]...)
+		if n > 0 {
+			d, serr := sniff.Domain(data)
+			if !errors.Is(serr, sniff.ErrIncomplete) {
+				domain = d
+				break
+			}
+		}
+		if err != nil {
+			if len(data) == 0 && !errors.Is(err, os.ErrDeadlineExceeded) {
+				_ = c.SetReadDeadline(time.Time{})
+				return "", nil, err
+			}
+			break
+		}
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	if s.isServerDomain(domain) {
+		domain = ""
+	}
+	if domain != "" {
+		log.Debug("[SNIFF] tcp", "target", target, "domain", domain)
+	}
+	return domain, &sniffedConn{replayConn: &replayConn{Conn: c, data: data}, addr: target}, nil
+}
+
+// sniffedFlow is the domain sniffed from the first datagram of a UDP flow.
+type sniffedFlow struct {
+	domain string
+	// seen is when the flow last sent a datagram, in Unix nanoseconds.
+	seen atomic.Int64
+}
+
+// sniffUDP returns the domain of the UDP flow key, sniffed from its first
+// datagram data if it is a QUIC Initial packet; it is empty if none was
+// found.
+func (s *Socks5Server) sniffUDP(key, dst string, data []byte) string {
+	now := time.Now().UnixNano()
+	s.udpMu.RLock()
+	f, ok := s.sniffedUDP[key]
+	s.udpMu.RUnlock()
+	if ok {
+		f.seen.Store(now)
+		return f.domain
+	}
+
+	f = &sniffedFlow{}
+	if domain, err := sniff.QUICServerName(data); err == nil && !s.isServerDomain(domain) {
+		f.domain = domain
+		log.Debug("[SNIFF] quic", "target", dst, "domain", domain)
+	}
+	f.seen.Store(now)
+	s.udpMu.Lock()
+	if prev, ok := s.sniffedUDP[key]; ok {
+		f = prev
+	} else {
+		s.sniffedUDP[key] = f
+	}
+	s.udpMu.Unlock()
+	return f.domain
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/log"
+	"github.com/txthinking/socks5"
+)
+
+func TestSniffTCP(t *testing.T) {
+	const request = "GET / HTTP/1.1\r\nHost: Example.com\r\n\r\n"
+	tests := []struct {
+		name   string
+		send   string
+		domain string
+	}{
+		{"http", request, "example.com"},
+		{"server speaks first", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, c := tcpPair(t)
+			s := &Socks5Server{}
+			r := &socks5.Request{Atyp: socks5.ATYPIPv4}
+			go func() {
+				reply := make([]byte, 10) // IPv4 reply
+				if _, err := io.ReadFull(client, reply); err != nil {
+					return
+				}
+				if tt.send != "" {
+					client.Write([]byte(tt.send))
+					client.Close()
+				}
+			}()
+
+			domain, conn, err := s.sniffTCP(c, r, "93.184.215.14:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if domain != tt.domain {
+				t.Errorf("domain = %q, want %q", domain, tt.domain)
+			}
+			if got := directTarget(conn, "example.com:80"); got != "93.184.215.14:80" {
+				t.Errorf("direct target = %q", got)
+			}
+			client.Close()
+			data, _ := io.ReadAll(conn)
+			if string(data) != tt.send {
+				t.Errorf("replayed %q, want %q", data, tt.send)
+			}
+		})
+	}
+}
+
+func TestSniffedBlock(t *testing.T) {
+	blockFile := filepath.Join(t.TempDir(), "block.txt")
+	if err := os.WriteFile(blockFile, []byte("198.51.100.7\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := router.New(router.Config{ProxyRule: router.ProxyRuleAuto, BlockFile: blockFile, Rules: []router.Rule{
+		{Outbound: router.OutboundBlock, Hosts: []string{"blocked.test"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Socks5Server{router: rt}
+	s.SetSniffing(true)
+
+	var buf bytes.Buffer
+	prev := log.Logger()
+	log.SetLogger(slog.New(log.TextHandler(&buf, slog.LevelInfo)))
+	t.Cleanup(func() { log.SetLogger(prev) })
+
+	// handle runs the request for ip:80 and returns the reply code.
+	handle := func(ip net.IP, send string) (net.Conn, byte) {
+		client, c := tcpPair(t)
+		r := socks5.NewRequest(socks5.CmdConnect, socks5.ATYPIPv4, ip.To4(), []byte{0, 80})
+		done := make(chan struct{})
+		// Like the socks5 server, close the connection once handled.
+		go func() {
+			s.TCPHandle(nil, c.(*net.TCPConn), r)
+			c.Close()
+			close(done)
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		reply := make([]byte, 10) // IPv4 reply
+		if _, err := io.ReadFull(client, reply); err != nil {
+			t.Fatal(err)
+		}
+		if send != "" {
+			client.Write([]byte(send))
+		}
+		<-done
+		return client, reply[1]
+	}
+
+	t.Run("sniffed domain", func(t *testing.T) {
+		buf.Reset()
+		client, rep := handle(net.IPv4(93, 184, 215, 14), "GET / HTTP/1.1\r\nHost: blocked.test\r\n\r\n")
+		if rep != socks5.RepSuccess {
+			t.Fatalf("reply = %d, want the success sent before sniffing", rep)
+		}
+		if _, err := client.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+			t.Errorf("read after block = %v, want connection reset", err)
+		}
+		for _, want := range []string{"[TCP_BLOCK] blocked", "host=blocked.test", "[SNIFF] connection reset"} {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("log lacks %q:\n%s", want, buf.String())
+			}
+		}
+	})
+
+	t.Run("blocked ip", func(t *testing.T) {
+		// The IP is blocked whatever its domain: no sniff, a plain reply.
+		_, rep := handle(net.IPv4(198, 51, 100, 7), "")
+		if rep != socks5.RepNotAllowed {
+			t.Errorf("reply = %d, want %d", rep, socks5.RepNotAllowed)
+		}
+	})
+}
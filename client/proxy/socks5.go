@@ -3,15 +3,18 @@ package proxy
 import (
 	"context"
 	"io"
+	"log/slog"
 	"net"
-	"strings"
+	"net/netip"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/nange/easyss/v3/client/process"
 	"github.com/nange/easyss/v3/client/router"
 	"github.com/nange/easyss/v3/log"
-	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/stats"
 	"github.com/nange/easyss/v3/util"
 	"github.com/txthinking/socks5"
 
@@ -24,8 +27,6 @@ type Socks5Server struct {
 	handler           *StreamHandler
 	router            *router.Router
 	dnsCache          *easydns.Cache
-	serverDomain      string
-	method            protocol.Method
 	disableQUIC       bool
 	directDialContext func(context.Context, string, string) (net.Conn, error)
 	dialTimeout       time.Duration
@@ -34,13 +35,23 @@ type Socks5Server struct {
 	udpExch        map[string]*UDPExchange
 	udpInflight    map[string]*udpExchangeFactory
 	directUDP      map[string]net.Conn
+	sniffedUDP     map[string]*sniffedFlow
 	quit           chan struct{}
 	closeOnce      sync.Once
 	udpIdleTimeout time.Duration
 	started        atomic.Bool
+
+	procs    atomic.Pointer[processLookup]
+	sniffing atomic.Bool
+}
+
+// processLookup is how the server finds the local process of connections.
+type processLookup struct {
+	finder *process.Finder
+	always bool
 }
 
-func NewSocks5Server(listenAddr, username, password string, handler *StreamHandler, rt *router.Router, serverDomain string, method protocol.Method, disableQUIC bool, dialTimeout, udpIdleTimeout time.Duration, directDialContext func(context.Context, string, string) (net.Conn, error)) (*Socks5Server, error) {
+func NewSocks5Server(listenAddr, username, password string, handler *StreamHandler, rt *router.Router, disableQUIC bool, dialTimeout, udpIdleTimeout time.Duration, directDialContext func(context.Context, string, string) (net.Conn, error)) (*Socks5Server, error) {
 	if dialTimeout <= 0 {
 		dialTimeout = 10 * time.Second
 	}
@@ -50,24 +61,20 @@ func NewSocks5Server(listenAddr, username, password string, handler *StreamHandl
 	if directDialContext == nil {
 		directDialContext = defaultDirectDialContext
 	}
-	if net.ParseIP(serverDomain) != nil {
-		serverDomain = ""
-	}
 	s := &Socks5Server{
 		handler:           handler,
 		router:            rt,
-		dnsCache:          easydns.NewCache(serverDomain),
-		serverDomain:      serverDomain,
-		method:            method,
 		disableQUIC:       disableQUIC,
 		directDialContext: directDialContext,
 		dialTimeout:       dialTimeout,
 		udpExch:           make(map[string]*UDPExchange),
 		udpInflight:       make(map[string]*udpExchangeFactory),
 		directUDP:         make(map[string]net.Conn),
+		sniffedUDP:        make(map[string]*sniffedFlow),
 		quit:              make(chan struct{}),
 		udpIdleTimeout:    udpIdleTimeout,
 	}
+	s.dnsCache = easydns.NewCache(s.isServerDomain)
 	srv, err := socks5.NewClassicServer(listenAddr, "127.0.0.1", username, password, 0, 0)
 	if err != nil {
 		return nil, err
@@ -76,6 +83,50 @@ func NewSocks5Server(listenAddr, username, password string, handler *StreamHandl
 	return s, nil
 }
 
+// SetProcessFinder makes the server look up the local process of each
+// connection with f, for process routing rules and the logs: for every
+// connection if always, or else only while the router has process rules.
+// A nil f turns lookups off.
+func (s *Socks5Server) SetProcessFinder(f *process.Finder, always bool) {
+	if f == nil {
+		s.procs.Store(nil)
+		return
+	}
+	s.procs.Store(&processLookup{finder: f, always: always})
+}
+
+// findProcess returns the local process of a connection over network from
+// src to dst, a listener of the server, requesting target. It returns nil
+// if the process is unknown or not needed.
+func (s *Socks5Server) findProcess(network string, src, dst net.Addr, target string) *router.Process {
+	pl := s.procs.Load()
+	if pl == nil || !pl.always && !s.router.HasProcessRules() {
+		return nil
+	}
+	srcAP, err := netip.ParseAddrPort(src.String())
+	if err != nil {
+		return nil
+	}
+	dstAP, _ := netip.ParseAddrPort(dst.String())
+	// A domain target leaves targetAP invalid.
+	targetAP, _ := netip.ParseAddrPort(target)
+	p, err := pl.finder.Find(network, srcAP, dstAP, targetAP)
+	if err != nil {
+		log.Debug("[SOCKS5] find process", "network", network, "local", src.String(), "err", err)
+		return nil
+	}
+	return p
+}
+
+// processAttr names p in a log line; it is empty, and left out of the
+// line, if p is unknown.
+func processAttr(p *router.Process) slog.Attr {
+	if p == nil {
+		return slog.Attr{}
+	}
+	return slog.String("process", p.Name)
+}
+
 func defaultDirectDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	dialer := &net.Dialer{
 		KeepAlive: 30 * time.Second,
@@ -89,13 +140,13 @@ func (s *Socks5Server) PrePopulateDNS(domain, dnsServer string, requireIPv4 bool
 	return s.dnsCache.PrePopulate(domain, dnsServer, requireIPv4)
 }
 
-// isServerDomain reports whether the given domain is the proxy server's own
-// hostname. DNS queries for it must never take the proxied path: resolving
+// isServerDomain reports whether the given domain is the hostname of one of
+// the proxy servers, as they are now. DNS queries for it must never take the proxied path: resolving
 // the server domain would require opening a tunnel stream, which in turn
 // needs to dial the server domain — a circular dependency that deadlocks
 // (especially after system sleep/wake when cached entries may have expired).
 func (s *Socks5Server) isServerDomain(domain string) bool {
-	return s.serverDomain != "" && strings.EqualFold(domain, s.serverDomain)
+	return s.handler != nil && s.handler.balancer.IsServerDomain(domain)
 }
 
 // MarkStarted records that Start is about to be called. It must be called
@@ -208,7 +259,7 @@ func (s *Socks5Server) TCPHandle(srv *socks5.Server, c *net.TCPConn, r *socks5.R
 	}
 
 	target := r.Address()
-	host, _, err := net.SplitHostPort(target)
+	host, portStr, err := net.SplitHostPort(target)
 	if err != nil {
 		log.Error("[SOCKS5] parse target", "target", target, "err", err)
 		return s.replyError(c, r, socks5.RepServerFailure)
@@ -219,80 +270,125 @@ func (s *Socks5Server) TCPHandle(srv *socks5.Server, c *net.TCPConn, r *socks5.R
 		return s.replyError(c, r, socks5.RepNotAllowed)
 	}
 
+	// With bind_all, clients on other hosts must not reach the services of
+	// this one, such as the local API of the HTTP proxy, through the proxy.
+	if loopbackHost(host) && !fromLoopback(c.RemoteAddr().String()) {
+		log.Warn("[SOCKS5] loopback target rejected for a remote client", "target", target, "client", c.RemoteAddr().String())
+		return s.replyError(c, r, socks5.RepNotAllowed)
+	}
+
 	local := c.RemoteAddr().String()
-	rule := s.router.MatchHostRule(host)
-	switch rule {
+	port, _ := strconv.Atoi(portStr)
+	proc := s.findProcess(router.NetworkTCP, c.RemoteAddr(), c.LocalAddr(), target)
+	rconn := router.Conn{Network: router.NetworkTCP, Host: host, Port: port, Process: proc}
+	var conn net.Conn = c
+	sniffed := ""
+	// Sniffing answers the request before it is routed, so it is only done
+	// when the domain can change the route.
+	if s.sniffing.Load() && util.IsIP(host) && s.router.SniffMatters(rconn) {
+		domain, sc, err := s.sniffTCP(c, r, target)
+		if err != nil {
+			return nil
+		}
+		conn, sniffed = sc, domain
+	}
+	var decision router.Decision
+	if sniffed != "" {
+		rconn.Host = sniffed
+		decision = s.router.RouteSniffed(rconn, host)
+		host, target = sniffed, net.JoinHostPort(sniffed, portStr)
+	} else {
+		decision = s.router.Route(rconn)
+	}
+	switch decision.Rule {
 	case router.HostRuleBlock:
-		log.Info("[TCP_BLOCK] blocked", "host", host, "target", target, "local", local)
-		return s.replyError(c, r, socks5.RepNotAllowed)
+		log.Info("[TCP_BLOCK] blocked", "host", host, "target", target, "local", local, processAttr(proc))
+		stats.RecordBlockedConnection()
+		return s.replyError(conn, r, socks5.RepNotAllowed)
 	case router.HostRuleDirect:
-		log.Info("[TCP_DIRECT]", "target", target, "local", local)
-		rc, err := s.directTCPConnect(c, r, target)
+		log.Info("[TCP_DIRECT]", "target", target, "local", local, processAttr(proc))
+		if s.router.Learning() {
+			return s.directTCPLearning(conn, r, target, rconn)
+		}
+		rc, err := s.directTCPConnect(conn, r, target)
 		if err != nil {
 			log.Error("[TCP_DIRECT] connect", "target", target, "err", err)
 			return err
 		}
 		defer rc.Close() //nolint:errcheck
-		relayTCP(rc, c)
+		relayTCP(rc, conn)
 		log.Debug("[TCP_DIRECT] relay finished", "target", target)
 		return nil
 	case router.HostRuleProxy:
-		log.Info("[TCP_PROXY]", "target", target, "local", local)
-		a, bindAddr, bindPort, err := socks5.ParseAddress(c.LocalAddr().String())
-		if err != nil {
-			log.Error("[TCP_PROXY] parse local addr", "err", err)
-			return s.replyError(c, r, socks5.RepServerFailure)
-		}
-		if a == socks5.ATYPDomain {
-			bindAddr = bindAddr[1:]
-		}
-		p := socks5.NewReply(socks5.RepSuccess, a, bindAddr, bindPort)
-		if _, err := p.WriteTo(c); err != nil {
-			log.Error("[TCP_PROXY] reply", "err", err)
-			return err
-		}
-		err = s.handler.OpenTCPStream(context.Background(), target, s.method, c)
-		if err != nil {
-			if isTransientStreamError(err) {
-				log.Debug("[TCP_PROXY] closed", "target", target, "err", err)
-				return nil
-			}
-			log.Error("[TCP_PROXY] stream", "target", target, "err", err)
-		} else {
-			log.Debug("[TCP_PROXY] stream finished", "target", target)
-		}
-		return err
+		log.Info("[TCP_PROXY]", "target", target, "local", local, "outbound", decision.Outbound, processAttr(proc))
+		return s.proxyTCP(conn, r, target, decision.Outbound)
+	case router.HostRuleRace:
+		log.Info("[TCP_RACE]", "target", target, "local", local, processAttr(proc))
+		return s.raceTCP(conn, r, target, host)
 	}
 
 	return nil
 }
 
+// proxyTCP replies success to the request r and relays c to target
+// through the tunnel of outbound.
+func (s *Socks5Server) proxyTCP(c net.Conn, r *socks5.Request, target, outbound string) error {
+	if err := s.replyConnected(c, r, c.LocalAddr(), socks5.RepServerFailure); err != nil {
+		log.Error("[TCP_PROXY] reply", "err", err)
+		return err
+	}
+	return s.openProxyStream(c, target, outbound)
+}
+
+// openProxyStream relays c to target through the tunnel of outbound.
+func (s *Socks5Server) openProxyStream(c net.Conn, target, outbound string) error {
+	err := s.handler.OpenTCPStream(router.WithOutbound(context.Background(), outbound), target, c)
+	if err != nil {
+		if isTransientStreamError(err) {
+			log.Debug("[TCP_PROXY] closed", "target", target, "err", err)
+			return nil
+		}
+		log.Error("[TCP_PROXY] stream", "target", target, "err", err)
+	} else {
+		log.Debug("[TCP_PROXY] stream finished", "target", target)
+	}
+	return err
+}
+
 func (s *Socks5Server) directTCPConnect(c net.Conn, r *socks5.Request, target string) (net.Conn, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout)
 	defer cancel()
 
-	rc, err := s.directDialContext(ctx, "tcp", target)
+	rc, err := s.directDialContext(ctx, "tcp", directTarget(c, target))
 	if err != nil {
 		_ = s.replyError(c, r, socks5.RepHostUnreachable)
 		return nil, err
 	}
-
-	a, bindAddr, bindPort, err := socks5.ParseAddress(rc.LocalAddr().String())
-	if err != nil {
+	if err := s.replyConnected(c, r, rc.LocalAddr(), socks5.RepHostUnreachable); err != nil {
 		rc.Close() //nolint:errcheck
-		_ = s.replyError(c, r, socks5.RepHostUnreachable)
 		return nil, err
 	}
+	return rc, nil
+}
+
+// replyConnected replies success to the request r with the bound address
+// bind, or rep if bind cannot be encoded. A sniffed connection was already
+// answered.
+func (s *Socks5Server) replyConnected(c net.Conn, r *socks5.Request, bind net.Addr, rep byte) error {
+	if _, ok := c.(*sniffedConn); ok {
+		return nil
+	}
+	a, bindAddr, bindPort, err := socks5.ParseAddress(bind.String())
+	if err != nil {
+		_ = s.replyError(c, r, rep)
+		return err
+	}
 	if a == socks5.ATYPDomain {
 		bindAddr = bindAddr[1:]
 	}
 	p := socks5.NewReply(socks5.RepSuccess, a, bindAddr, bindPort)
-	if _, err := p.WriteTo(c); err != nil {
-		rc.Close() //nolint:errcheck
-		return nil, err
-	}
-
-	return rc, nil
+	_, err = p.WriteTo(c)
+	return err
 }
 
 func (s *Socks5Server) UDPHandle(srv *socks5.Server, addr *net.UDPAddr, d *socks5.Datagram) error {
@@ -300,6 +396,10 @@ func (s *Socks5Server) UDPHandle(srv *socks5.Server, addr *net.UDPAddr, d *socks
 }
 
 func (s *Socks5Server) replyError(c net.Conn, r *socks5.Request, rep byte) error {
+	if sc, ok := c.(*sniffedConn); ok {
+		sc.abort(rep)
+		return nil
+	}
 	var p *socks5.Reply
 	if r.Atyp == socks5.ATYPIPv4 || r.Atyp == socks5.ATYPDomain {
 		p = socks5.NewReply(rep, socks5.ATYPIPv4, []byte{0, 0, 0, 0}, []byte{0, 0})
@@ -347,6 +447,11 @@ func (s *Socks5Server) cleanupLoop() {
 					delete(s.udpExch, key)
 				}
 			}
+			for key, f := range s.sniffedUDP {
+				if time.Since(time.Unix(0, f.seen.Load())) > s.udpIdleTimeout {
+					delete(s.sniffedUDP, key)
+				}
+			}
 			s.udpMu.Unlock()
 		case <-s.quit:
 			return
@@ -12,6 +12,8 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/nange/easyss/v3/client/balancer"
+	"github.com/nange/easyss/v3/client/router"
 	"github.com/nange/easyss/v3/config"
 	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/log"
@@ -36,52 +38,90 @@ var ErrServerRejectedHandshake = errors.New("handshake rejected by server")
 var errLocalConnClosed = errors.New("local connection closed")
 
 type StreamHandler struct {
-	transport         transport.Transport
-	masterKey         []byte
-	shaperCfg         shaper.Config
+	balancer          *balancer.Balancer
+	shaperCfg         atomic.Pointer[shaper.Config]
 	streamIdleTimeout time.Duration
 }
 
-func NewStreamHandler(tr transport.Transport, masterKey []byte, shaperCfg shaper.Config, streamIdleTimeout time.Duration) *StreamHandler {
+// NewStreamHandler returns a handler that opens every stream on tr with
+// method.
+func NewStreamHandler(tr transport.Transport, masterKey []byte, method protocol.Method, shaperCfg shaper.Config, streamIdleTimeout time.Duration) *StreamHandler {
+	b, _ := balancer.New("", 0, balancer.NewUpstream("", tr, masterKey, method, 1))
+	return NewBalancedStreamHandler(b, shaperCfg, streamIdleTimeout)
+}
+
+// NewBalancedStreamHandler returns a handler that asks b for the server of
+// each new stream, so a server switch never touches running streams.
+func NewBalancedStreamHandler(b *balancer.Balancer, shaperCfg shaper.Config, streamIdleTimeout time.Duration) *StreamHandler {
 	if streamIdleTimeout <= 0 {
 		streamIdleTimeout = 300 * time.Second
 	}
-	return &StreamHandler{
-		transport:         tr,
-		masterKey:         masterKey,
-		shaperCfg:         shaperCfg,
+	h := &StreamHandler{
+		balancer:          b,
 		streamIdleTimeout: streamIdleTimeout,
 	}
+	h.shaperCfg.Store(&shaperCfg)
+	return h
+}
+
+// SetShaperConfig changes the shaper settings of streams opened afterwards.
+func (h *StreamHandler) SetShaperConfig(cfg shaper.Config) {
+	h.shaperCfg.Store(&cfg)
+}
+
+func (h *StreamHandler) shaperConfig() shaper.Config {
+	return *h.shaperCfg.Load()
+}
+
+// upstream returns the server a stream opened with ctx should use: the
+// outbound a policy rule attached to ctx, or the balancer's pick.
+func (h *StreamHandler) upstream(ctx context.Context) *balancer.Upstream {
+	if name := router.OutboundFrom(ctx); name != "" {
+		if u := h.balancer.Lookup(name); u != nil {
+			return u
+		}
+		log.Warn("[STREAM] unknown outbound, using default server", "outbound", name)
+	}
+	return h.balancer.Pick()
 }
 
-func (h *StreamHandler) Transport() transport.Transport {
-	return h.transport
+// TransportStats returns the transport stats summed over all servers.
+func (h *StreamHandler) TransportStats() transport.TransportStats {
+	return h.balancer.Stats()
 }
 
-func (h *StreamHandler) OpenTCPStream(ctx context.Context, target string, method protocol.Method, localConn net.Conn) error {
+func (h *StreamHandler) OpenTCPStream(ctx context.Context, target string, localConn net.Conn) error {
 	stats.RecordTCPConnection()
-	return h.openStream(ctx, config.EndpointTCP, protocol.ProtoTCP, target, method, localConn)
+	return h.openStream(ctx, config.EndpointTCP, protocol.ProtoTCP, target, localConn)
 }
 
-func (h *StreamHandler) OpenUDPStream(ctx context.Context, target string, method protocol.Method, localConn net.Conn) error {
-	return h.openStream(ctx, config.EndpointUDP, protocol.ProtoUDP, target, method, localConn)
+func (h *StreamHandler) OpenUDPStream(ctx context.Context, target string, localConn net.Conn) error {
+	return h.openStream(ctx, config.EndpointUDP, protocol.ProtoUDP, target, localConn)
 }
 
-func (h *StreamHandler) OpenICMPStream(ctx context.Context, target string, echoPayload []byte, method protocol.Method) ([]byte, error) {
-	return h.icmpStream(ctx, config.EndpointICMP, protocol.ProtoICMP, target, echoPayload, method)
+func (h *StreamHandler) OpenICMPStream(ctx context.Context, target string, echoPayload []byte) ([]byte, error) {
+	return h.icmpStream(ctx, config.EndpointICMP, protocol.ProtoICMP, target, echoPayload)
 }
 
 type bootstrapSession struct {
 	stream transport.Stream
 	sk     *crypto.StreamKeys
 	salt   []byte
+	// method is the session cipher of the stream's server.
+	method protocol.Method
+}
+
+func (h *StreamHandler) openAndBootstrap(ctx context.Context, endpoint string, proto protocol.Proto, target string, extraFrames []protocol.Frame) (*bootstrapSession, error) {
+	return h.bootstrapOn(ctx, h.upstream(ctx), endpoint, proto, target, extraFrames)
 }
 
-func (h *StreamHandler) openAndBootstrap(ctx context.Context, endpoint string, proto protocol.Proto, target string, method protocol.Method, extraFrames []protocol.Frame) (*bootstrapSession, error) {
+// bootstrapOn opens a stream to upstream u and writes the handshake record,
+// which asks for u's method.
+func (h *StreamHandler) bootstrapOn(ctx context.Context, u *balancer.Upstream, endpoint string, proto protocol.Proto, target string, extraFrames []protocol.Frame) (*bootstrapSession, error) {
 	hsFrame := protocol.NewFrameHANDSHAKE(protocol.Handshake{
 		Version: protocol.Version3,
 		Proto:   proto,
-		Method:  method,
+		Method:  u.Method,
 		Target:  target,
 	})
 	frames := append([]protocol.Frame{hsFrame}, extraFrames...)
@@ -103,7 +143,7 @@ func (h *StreamHandler) openAndBootstrap(ctx context.Context, endpoint string, p
 		}
 		saltB64 := base64.RawURLEncoding.EncodeToString(salt)
 
-		stream, err := h.transport.Open(ctx, transport.OpenRequest{
+		stream, err := u.Transport.Open(ctx, transport.OpenRequest{
 			Endpoint:     endpoint,
 			Salt:         saltB64,
 			HighPriority: isInteractivePort(target),
@@ -112,7 +152,7 @@ func (h *StreamHandler) openAndBootstrap(ctx context.Context, endpoint string, p
 			return nil, fmt.Errorf("transport open: %w", err)
 		}
 
-		sk, err := crypto.NewStreamKeys(h.masterKey, salt, endpoint)
+		sk, err := crypto.NewStreamKeys(u.MasterKey, salt, endpoint)
 		if err != nil {
 			stream.Close() //nolint:errcheck
 			return nil, fmt.Errorf("stream keys: %w", err)
@@ -136,7 +176,7 @@ func (h *StreamHandler) openAndBootstrap(ctx context.Context, endpoint string, p
 		}
 		rw.Flush()
 
-		return &bootstrapSession{stream: stream, sk: sk, salt: salt}, nil
+		return &bootstrapSession{stream: stream, sk: sk, salt: salt, method: u.Method}, nil
 	}
 
 	// Unreachable: the loop always returns inside the body.
@@ -164,10 +204,10 @@ func classifyFirstReadError(err error) error {
 	return err
 }
 
-func (h *StreamHandler) icmpStream(ctx context.Context, endpoint string, proto protocol.Proto, target string, echoPayload []byte, method protocol.Method) ([]byte, error) {
+func (h *StreamHandler) icmpStream(ctx context.Context, endpoint string, proto protocol.Proto, target string, echoPayload []byte) ([]byte, error) {
 	log.Debug("[STREAM] icmp open", "endpoint", endpoint, "target", target)
 
-	bs, err := h.openAndBootstrap(ctx, endpoint, proto, target, method, []protocol.Frame{
+	bs, err := h.openAndBootstrap(ctx, endpoint, proto, target, []protocol.Frame{
 		protocol.NewFrameDATA(echoPayload),
 	})
 	if err != nil {
@@ -177,8 +217,8 @@ func (h *StreamHandler) icmpStream(ctx context.Context, endpoint string, proto p
 	log.Debug("[STREAM] merged ICMP echo payload into bootstrap record", "bytes", len(echoPayload))
 	defer bs.stream.Close() //nolint:errcheck
 
-	aadS2C := crypto.BuildAAD(endpoint, bs.salt, "s2c", "session", method)
-	s2cEnc, s2cCounter, err := bs.sk.Encryptor("s2c", "session", method)
+	aadS2C := crypto.BuildAAD(endpoint, bs.salt, "s2c", "session", bs.method)
+	s2cEnc, s2cCounter, err := bs.sk.Encryptor("s2c", "session", bs.method)
 	if err != nil {
 		return nil, fmt.Errorf("s2c encryptor: %w", err)
 	}
@@ -203,7 +243,7 @@ func (h *StreamHandler) icmpStream(ctx context.Context, endpoint string, proto p
 	return frame.Payload, nil
 }
 
-func (h *StreamHandler) openStream(ctx context.Context, endpoint string, proto protocol.Proto, target string, method protocol.Method, localConn net.Conn) error {
+func (h *StreamHandler) openStream(ctx context.Context, endpoint string, proto protocol.Proto, target string, localConn net.Conn) error {
 	log.Debug("[STREAM] opening", "endpoint", endpoint, "target", target)
 
 	var extraFrames []protocol.Frame
@@ -219,7 +259,7 @@ func (h *StreamHandler) openStream(ctx context.Context, endpoint string, proto p
 		bytespool.MustPut(buf)
 	}
 
-	bs, err := h.openAndBootstrap(ctx, endpoint, proto, target, method, extraFrames)
+	bs, err := h.openAndBootstrap(ctx, endpoint, proto, target, extraFrames)
 	if err != nil {
 		log.Error("[STREAM] bootstrap", "endpoint", endpoint, "target", target, "err", err)
 		return err
@@ -227,19 +267,19 @@ func (h *StreamHandler) openStream(ctx context.Context, endpoint string, proto p
 	stream := bs.stream
 	log.Debug("[STREAM] handshake sent", "target", target)
 
-	aadSession := crypto.BuildAAD(endpoint, bs.salt, "c2s", "session", method)
-	sessionEnc, sessionCounter, err := bs.sk.Encryptor("c2s", "session", method)
+	aadSession := crypto.BuildAAD(endpoint, bs.salt, "c2s", "session", bs.method)
+	sessionEnc, sessionCounter, err := bs.sk.Encryptor("c2s", "session", bs.method)
 	if err != nil {
 		stream.Close() //nolint:errcheck
 		return fmt.Errorf("session encryptor: %w", err)
 	}
 	sessionWriter := crypto.NewRecordWriter(stream, sessionEnc, sessionCounter, aadSession)
 
-	txShaper := shaper.New(sessionWriter, h.shaperCfg)
+	txShaper := shaper.New(sessionWriter, h.shaperConfig())
 	defer txShaper.Close() //nolint:errcheck
 
-	aadS2C := crypto.BuildAAD(endpoint, bs.salt, "s2c", "session", method)
-	s2cEnc, s2cCounter, err := bs.sk.Encryptor("s2c", "session", method)
+	aadS2C := crypto.BuildAAD(endpoint, bs.salt, "s2c", "session", bs.method)
+	s2cEnc, s2cCounter, err := bs.sk.Encryptor("s2c", "session", bs.method)
 	if err != nil {
 		stream.Close() //nolint:errcheck
 		return fmt.Errorf("s2c encryptor: %w", err)
@@ -458,7 +498,7 @@ type UDPExchange struct {
 	closeOnce sync.Once
 }
 
-func (h *StreamHandler) OpenUDPExchange(ctx context.Context, target string, method protocol.Method, firstPayload []byte) (*UDPExchange, error) {
+func (h *StreamHandler) OpenUDPExchange(ctx context.Context, target string, firstPayload []byte) (*UDPExchange, error) {
 	stats.RecordUDPAssociation()
 	log.Debug("[UDP_EXCHANGE] opening", "target", target)
 
@@ -468,23 +508,23 @@ func (h *StreamHandler) OpenUDPExchange(ctx context.Context, target string, meth
 		log.Debug("[UDP_EXCHANGE] merged first DATAGRAM into bootstrap record", "bytes", len(firstPayload))
 	}
 
-	bs, err := h.openAndBootstrap(ctx, config.EndpointUDP, protocol.ProtoUDP, target, method, extraFrames)
+	bs, err := h.openAndBootstrap(ctx, config.EndpointUDP, protocol.ProtoUDP, target, extraFrames)
 	if err != nil {
 		log.Error("[UDP_EXCHANGE] bootstrap", "target", target, "err", err)
 		return nil, err
 	}
 	stream := bs.stream
 
-	aadC2S := crypto.BuildAAD(config.EndpointUDP, bs.salt, "c2s", "session", method)
-	c2sEnc, c2sCounter, err := bs.sk.Encryptor("c2s", "session", method)
+	aadC2S := crypto.BuildAAD(config.EndpointUDP, bs.salt, "c2s", "session", bs.method)
+	c2sEnc, c2sCounter, err := bs.sk.Encryptor("c2s", "session", bs.method)
 	if err != nil {
 		stream.Close() //nolint:errcheck
 		return nil, fmt.Errorf("c2s session encryptor: %w", err)
 	}
 	c2sWriter := crypto.NewRecordWriter(stream, c2sEnc, c2sCounter, aadC2S)
 
-	aadS2C := crypto.BuildAAD(config.EndpointUDP, bs.salt, "s2c", "session", method)
-	s2cEnc, s2cCounter, err := bs.sk.Encryptor("s2c", "session", method)
+	aadS2C := crypto.BuildAAD(config.EndpointUDP, bs.salt, "s2c", "session", bs.method)
+	s2cEnc, s2cCounter, err := bs.sk.Encryptor("s2c", "session", bs.method)
 	if err != nil {
 		stream.Close() //nolint:errcheck
 		return nil, fmt.Errorf("s2c session encryptor: %w", err)
@@ -497,7 +537,7 @@ func (h *StreamHandler) OpenUDPExchange(ctx context.Context, target string, meth
 	// flushes: bursts of datagrams are merged into a single encrypted
 	// record, while the idle-triggered timer keeps interaction latency
 	// bounded at ~1ms for sparse traffic (DNS, games).
-	udpShaperCfg := h.shaperCfg
+	udpShaperCfg := h.shaperConfig()
 	udpShaperCfg.BatchWindowMS = 1
 	ue := &UDPExchange{
 		stream: stream,
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/client/balancer"
+	"github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/shaper"
+	"github.com/nange/easyss/v3/transport"
+)
+
+// DialTunnel opens a /v3/tcp stream through u to target and returns it as a
+// net.Conn carrying target's byte stream. It lets a whole client stack (uTLS,
+// HTTP/2, record crypto) for a second server run inside a stream to the
+// first one.
+//
+// The stream outlives ctx, which only bounds the bootstrap: cancelling ctx
+// aborts a bootstrap in progress, so a dial that lost a race stops at once.
+func (h *StreamHandler) DialTunnel(ctx context.Context, u *balancer.Upstream, target string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// The transport may tie the stream to the context it was opened with,
+	// so it gets one that ctx cancels only until the bootstrap is done.
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	abort := context.AfterFunc(ctx, cancel)
+	bs, err := h.bootstrapOn(streamCtx, u, config.EndpointTCP, protocol.ProtoTCP, target, nil)
+	if !abort() {
+		if err == nil {
+			bs.stream.Close() //nolint:errcheck
+		}
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	aadC2S := crypto.BuildAAD(config.EndpointTCP, bs.salt, "c2s", "session", bs.method)
+	c2sEnc, c2sCounter, err := bs.sk.Encryptor("c2s", "session", bs.method)
+	if err != nil {
+		bs.stream.Close() //nolint:errcheck
+		cancel()
+		return nil, fmt.Errorf("session encryptor: %w", err)
+	}
+	aadS2C := crypto.BuildAAD(config.EndpointTCP, bs.salt, "s2c", "session", bs.method)
+	s2cEnc, s2cCounter, err := bs.sk.Encryptor("s2c", "session", bs.method)
+	if err != nil {
+		bs.stream.Close() //nolint:errcheck
+		cancel()
+		return nil, fmt.Errorf("s2c encryptor: %w", err)
+	}
+
+	c := &tunnelConn{
+		stream: bs.stream,
+		cancel: cancel,
+		tx:     shaper.New(crypto.NewRecordWriter(bs.stream, c2sEnc, c2sCounter, aadC2S), h.shaperConfig()),
+		rx:     crypto.NewDecryptedReader(bs.stream, aadS2C, s2cEnc, s2cCounter),
+		local:  tunnelAddr(u.Name),
+		remote: tunnelAddr(target),
+	}
+	return c, nil
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "easyss" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// tunnelConn adapts a bootstrapped /v3/tcp stream to net.Conn. Deadlines are
+// coarse: once one expires the stream is closed, which is what the TLS and
+// HTTP/2 layers above rely on them for.
+type tunnelConn struct {
+	stream transport.Stream
+	// cancel releases the context the stream was opened with.
+	cancel context.CancelFunc
+	tx     shaper.Shaper
+	rx     *crypto.DecryptedReader
+	local  net.Addr
+	remote net.Addr
+
+	readMu  sync.Mutex
+	pending []byte
+	first   bool
+	readErr error
+
+	mu        sync.Mutex
+	timers    [2]*time.Timer // read, write
+	expired   bool
+	closeOnce sync.Once
+	finOnce   sync.Once
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		frame, err := c.rx.ReadFrame()
+		if !c.first {
+			c.first = true
+			err = classifyFirstReadError(err)
+		}
+		if err != nil {
+			c.readErr = c.deadlineErr(err)
+			continue
+		}
+		switch frame.Type {
+		case protocol.FrameDATA:
+			c.pending = frame.Payload
+		case protocol.FrameFIN:
+			c.readErr = io.EOF
+		case protocol.FrameRST:
+			c.readErr = ErrStreamReset
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *tunnelConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), config.TCPStreamBufferSize)]
+		if err := c.tx.PushData(chunk); err != nil {
+			return written, c.deadlineErr(err)
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// CloseWrite sends FIN; the peer sees EOF once the buffered data is read.
+func (c *tunnelConn) CloseWrite() error {
+	var err error
+	c.finOnce.Do(func() {
+		if err = c.tx.PushFrame(protocol.NewFrameFIN()); err == nil {
+			err = c.tx.Flush()
+		}
+	})
+	return err
+}
+
+func (c *tunnelConn) Close() error {
+	c.closeOnce.Do(func() {
+		_ = c.CloseWrite()
+		_ = c.tx.Close()
+		_ = c.stream.Close()
+		c.cancel()
+		c.mu.Lock()
+		for _, t := range c.timers {
+			if t != nil {
+				t.Stop()
+			}
+		}
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr  { return c.local }
+func (c *tunnelConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error  { return c.setDeadline(0, t) }
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error { return c.setDeadline(1, t) }
+
+func (c *tunnelConn) setDeadline(i int, t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timers[i] != nil {
+		c.timers[i].Stop()
+		c.timers[i] = nil
+	}
+	if t.IsZero() {
+		return nil
+	}
+	c.timers[i] = time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		c.expired = true
+		c.mu.Unlock()
+		_ = c.stream.Close()
+	})
+	return nil
+}
+
+// deadlineErr reports errors caused by an expired deadline as
+// os.ErrDeadlineExceeded, like a socket would.
+func (c *tunnelConn) deadlineErr(err error) error {
+	c.mu.Lock()
+	expired := c.expired
+	c.mu.Unlock()
+	if expired && !errors.Is(err, io.EOF) {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
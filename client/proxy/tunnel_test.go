@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/client/balancer"
+	"github.com/nange/easyss/v3/crypto"
+	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/shaper"
+	"github.com/nange/easyss/v3/transport"
+)
+
+// echoServerTransport plays the server side of a /v3/tcp stream and echoes
+// every DATA frame back until FIN.
+type echoServerTransport struct {
+	key    []byte
+	target chan string
+}
+
+func (e *echoServerTransport) Open(ctx context.Context, req transport.OpenRequest) (transport.Stream, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close() //nolint:errcheck
+		salt, _ := base64.RawURLEncoding.DecodeString(req.Salt)
+		sk, err := crypto.NewStreamKeys(e.key, salt, req.Endpoint)
+		if err != nil {
+			return
+		}
+		first, err := sk.ReadFirstRecord(server)
+		if err != nil {
+			return
+		}
+		e.target <- first.Handshake.Target
+		method := first.Handshake.Method
+		c2sEnc, c2sCounter, _ := sk.Encryptor("c2s", "session", method)
+		dr := crypto.NewDecryptedReader(server, crypto.BuildAAD(req.Endpoint, salt, "c2s", "session", method), c2sEnc, c2sCounter)
+		s2cEnc, s2cCounter, _ := sk.Encryptor("s2c", "session", method)
+		rw := crypto.NewRecordWriter(server, s2cEnc, s2cCounter, crypto.BuildAAD(req.Endpoint, salt, "s2c", "session", method))
+		for {
+			frame, err := dr.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch frame.Type {
+			case protocol.FrameDATA:
+				if rw.WriteRecord(protocol.EncodeFrames([]protocol.Frame{protocol.NewFrameDATA(frame.Payload)})) != nil {
+					return
+				}
+				rw.Flush()
+			case protocol.FrameFIN:
+				_ = rw.WriteRecord(protocol.EncodeFrames([]protocol.Frame{protocol.NewFrameFIN()}))
+				rw.Flush()
+				return
+			}
+		}
+	}()
+	return pipeStream{client}, nil
+}
+
+func (e *echoServerTransport) CloseIdle()                      {}
+func (e *echoServerTransport) Stats() transport.TransportStats { return transport.TransportStats{} }
+func (e *echoServerTransport) Close() error                    { return nil }
+
+func TestDialTunnel(t *testing.T) {
+	key := make([]byte, 32)
+	tr := &echoServerTransport{key: key, target: make(chan string, 1)}
+	h := NewStreamHandler(tr, key, protocol.MethodAES256GCM, shaper.Config{}, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := h.DialTunnel(ctx, balancer.NewUpstream("entry", tr, key, protocol.MethodAES256GCM, 1), "exit.example.com:443")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	// The tunnel must outlive the dial context.
+	cancel()
+	if got := <-tr.target; got != "exit.example.com:443" {
+		t.Errorf("handshake target = %q", got)
+	}
+	if got := conn.RemoteAddr().String(); got != "exit.example.com:443" {
+		t.Errorf("RemoteAddr = %q", got)
+	}
+
+	msg := []byte("client hello")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != string(msg) {
+		t.Errorf("echo = %q, want %q", buf, msg)
+	}
+
+	if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatalf("close write: %v", err)
+	}
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Errorf("read after FIN = %v, want EOF", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("close: %v", err)
+	}
+
+	done, cancelDone := context.WithCancel(context.Background())
+	cancelDone()
+	if _, err := h.DialTunnel(done, balancer.NewUpstream("entry", tr, key, protocol.MethodAES256GCM, 1), "exit.example.com:443"); err == nil {
+		t.Error("expected error for a cancelled context")
+	}
+}
+
+// stalledTransport never finishes opening a stream until its context ends.
+type stalledTransport struct{}
+
+func (stalledTransport) Open(ctx context.Context, req transport.OpenRequest) (transport.Stream, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (stalledTransport) CloseIdle()                      {}
+func (stalledTransport) Stats() transport.TransportStats { return transport.TransportStats{} }
+func (stalledTransport) Close() error                    { return nil }
+
+func TestDialTunnelCancelled(t *testing.T) {
+	key := make([]byte, 32)
+	h := NewStreamHandler(stalledTransport{}, key, protocol.MethodAES256GCM, shaper.Config{}, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.DialTunnel(ctx, balancer.NewUpstream("entry", stalledTransport{}, key, protocol.MethodAES256GCM, 1), "exit.example.com:443")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %v, want deadline exceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("bootstrap not aborted with its context")
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"errors"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/nange/easyss/v3/client/config"
+	easydns "github.com/nange/easyss/v3/client/dns"
 	"github.com/nange/easyss/v3/client/router"
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/protocol"
@@ -52,6 +54,7 @@ func (s *Socks5Server) handleDNS(srv *socks5.Server, clientAddr *net.UDPAddr, d
 	rule := s.router.MatchHostRule(domain)
 	if rule == router.HostRuleBlock {
 		log.Info("[DNS_BLOCK] blocked", "domain", domain, "qtype", qtype)
+		stats.RecordBlockedDNSQuery()
 		return responseBlockedDNSMsg(srv.UDPConn, clientAddr, msg, d.Address())
 	}
 
@@ -110,11 +113,11 @@ func (s *Socks5Server) directDNSQuery(srv *socks5.Server, clientAddr *net.UDPAdd
 			for _, ans := range resp.Answer {
 				switch a := ans.(type) {
 				case *dns.A:
-					s.router.AddDirectIP(a.A.String())
+					s.router.AddDirectIP(a.A.String(), domain)
 				case *dns.AAAA:
-					s.router.AddDirectIP(a.AAAA.String())
+					s.router.AddDirectIP(a.AAAA.String(), domain)
 				case *dns.CNAME:
-					s.router.AddDirectDomain(strings.TrimSuffix(a.Target, "."))
+					s.router.AddDirectDomain(strings.TrimSuffix(a.Target, "."), domain)
 				}
 			}
 		}
@@ -145,7 +148,7 @@ func (s *Socks5Server) proxyDNSQuery(srv *socks5.Server, clientAddr *net.UDPAddr
 	dst := config.ProxyDNSServer
 	key := clientAddr.String() + "_" + dst
 
-	ue, created, err := s.getOrCreateUDPExchange(key, dst, d.Data)
+	ue, created, err := s.getOrCreateUDPExchange(context.Background(), key, dst, d.Data)
 	if err != nil {
 		log.Error("[UDP_PROXY] open exchange", "dst", dst, "err", err)
 		return err
@@ -181,7 +184,7 @@ type udpExchangeFactory struct {
 // the exchange already existed, firstPayload is ignored. If this call created
 // the exchange, created is true and the caller MUST NOT call ue.Send for the
 // first payload (it was already sent in the handshake).
-func (s *Socks5Server) getOrCreateUDPExchange(key, dst string, firstPayload []byte) (ue *UDPExchange, created bool, err error) {
+func (s *Socks5Server) getOrCreateUDPExchange(ctx context.Context, key, dst string, firstPayload []byte) (ue *UDPExchange, created bool, err error) {
 	s.udpMu.Lock()
 	if existing, ok := s.udpExch[key]; ok {
 		s.udpMu.Unlock()
@@ -196,7 +199,7 @@ func (s *Socks5Server) getOrCreateUDPExchange(key, dst string, firstPayload []by
 	s.udpInflight[key] = f
 	s.udpMu.Unlock()
 
-	ue, err = s.handler.OpenUDPExchange(context.Background(), dst, s.method, firstPayload)
+	ue, err = s.handler.OpenUDPExchange(ctx, dst, firstPayload)
 	f.ue, f.err = ue, err
 	close(f.done)
 
@@ -248,11 +251,11 @@ func (s *Socks5Server) receiveLoop(ue *UDPExchange, srv *socks5.Server, clientAd
 				for _, ans := range msg.Answer {
 					switch a := ans.(type) {
 					case *dns.A:
-						s.router.AddProxyIP(a.A.String())
+						s.router.AddProxyIP(a.A.String(), domain)
 					case *dns.AAAA:
-						s.router.AddProxyIP(a.AAAA.String())
+						s.router.AddProxyIP(a.AAAA.String(), domain)
 					case *dns.CNAME:
-						s.router.AddProxyDomain(strings.TrimSuffix(a.Target, "."))
+						s.router.AddProxyDomain(strings.TrimSuffix(a.Target, "."), domain)
 					}
 				}
 			}
@@ -276,22 +279,38 @@ func (s *Socks5Server) sendToClient(srv *socks5.Server, clientAddr *net.UDPAddr,
 }
 
 func (s *Socks5Server) handleRegularUDP(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, dst string) error {
-	host, _, err := net.SplitHostPort(dst)
+	host, portStr, err := net.SplitHostPort(dst)
 	if err != nil {
 		return err
 	}
 
-	rule := s.router.MatchHostRule(host)
-	switch rule {
+	port, _ := strconv.Atoi(portStr)
+	proc := s.findProcess(router.NetworkUDP, clientAddr, srv.UDPConn.LocalAddr(), dst)
+	// target is where the proxy sends the flow: the sniffed domain, if
+	// any, in place of the IP dst.
+	target := dst
+	sniffed := ""
+	if s.sniffing.Load() && util.IsIP(host) {
+		sniffed = s.sniffUDP(clientAddr.String()+"_"+dst, dst, d.Data)
+	}
+	var decision router.Decision
+	if sniffed != "" {
+		decision = s.router.RouteSniffed(router.Conn{Network: router.NetworkUDP, Host: sniffed, Port: port, Process: proc}, host)
+		host, target = sniffed, net.JoinHostPort(sniffed, portStr)
+	} else {
+		decision = s.router.Route(router.Conn{Network: router.NetworkUDP, Host: host, Port: port, Process: proc})
+	}
+	switch decision.Rule {
 	case router.HostRuleBlock:
-		log.Info("[UDP_BLOCK] blocked", "host", host, "target", dst)
+		log.Info("[UDP_BLOCK] blocked", "host", host, "target", dst, processAttr(proc))
+		stats.RecordBlockedConnection()
 		return nil
 	case router.HostRuleDirect:
-		log.Info("[UDP_DIRECT]", "target", dst)
+		log.Info("[UDP_DIRECT]", "target", target, processAttr(proc))
 		return s.directUDPRelay(srv, clientAddr, d, dst)
-	case router.HostRuleProxy:
-		log.Info("[UDP_PROXY]", "target", dst)
-		return s.proxyUDPRelay(srv, clientAddr, d, dst)
+	case router.HostRuleProxy, router.HostRuleRace:
+		log.Info("[UDP_PROXY]", "target", target, "outbound", decision.Outbound, processAttr(proc))
+		return s.proxyUDPRelay(srv, clientAddr, d, dst, target, decision.Outbound)
 	}
 	return nil
 }
@@ -342,10 +361,13 @@ func (s *Socks5Server) directUDPRelay(srv *socks5.Server, clientAddr *net.UDPAdd
 	return err
 }
 
-func (s *Socks5Server) proxyUDPRelay(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, dst string) error {
+// proxyUDPRelay relays the datagrams of clientAddr to dst through the
+// tunnel of outbound, which sends them to target: dst, or the domain
+// sniffed from the flow.
+func (s *Socks5Server) proxyUDPRelay(srv *socks5.Server, clientAddr *net.UDPAddr, d *socks5.Datagram, dst, target, outbound string) error {
 	key := clientAddr.String() + "_" + dst
 
-	ue, created, err := s.getOrCreateUDPExchange(key, dst, d.Data)
+	ue, created, err := s.getOrCreateUDPExchange(router.WithOutbound(context.Background(), outbound), key, target, d.Data)
 	if err != nil {
 		log.Error("[UDP_PROXY] open exchange", "dst", dst, "err", err)
 		return err
@@ -384,11 +406,7 @@ func responseDNSMsg(conn *net.UDPConn, addr *net.UDPAddr, msg *dns.Msg, dst stri
 }
 
 func responseBlockedDNSMsg(conn *net.UDPConn, addr *net.UDPAddr, msg *dns.Msg, dst string) error {
-	msg.Response = true
-	msg.Answer = nil
-	msg.Ns = nil
-	msg.Extra = nil
-	return responseDNSMsg(conn, addr, msg, dst)
+	return responseDNSMsg(conn, addr, easydns.BlockedReply(msg), dst)
 }
 
 func ParseAddress(address string) (a byte, addr []byte, port []byte, err error) {
@@ -0,0 +1,261 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/util"
+)
+
+// Custom lists the rule editing API manages.
+const (
+	ListDirect = "direct"
+	ListProxy  = "proxy"
+	ListBlock  = "block"
+)
+
+var (
+	ErrUnknownList  = errors.New("router: unknown list")
+	ErrNoListFile   = errors.New("router: no file configured for the list")
+	ErrInvalidEntry = errors.New("router: invalid entry")
+)
+
+// ListEntry is an entry of a custom list and its line in the list's file.
+type ListEntry struct {
+	Entry string `json:"entry"`
+	Line  int    `json:"line"`
+}
+
+// CustomListFile returns the file of the custom list, "" if none is
+// configured.
+func (r *Router) CustomListFile(list string) (string, error) {
+	r.customMu.RLock()
+	defer r.customMu.RUnlock()
+	switch list {
+	case ListDirect:
+		return r.cfg.DirectFile, nil
+	case ListProxy:
+		return r.cfg.ProxyFile, nil
+	case ListBlock:
+		return r.cfg.BlockFile, nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnknownList, list)
+}
+
+// CustomEntries returns the entries of the custom list in file order.
+// Comments, and the addresses learned from DNS answers, are left out.
+func (r *Router) CustomEntries(list string) ([]ListEntry, error) {
+	file, err := r.CustomListFile(list)
+	if err != nil || file == "" {
+		return nil, err
+	}
+	lines, err := util.ReadFileLines(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ListEntry
+	for i, line := range lines {
+		if line = strings.TrimSpace(line); line != "" && !isRuleComment(line) {
+			entries = append(entries, ListEntry{Entry: line, Line: i + 1})
+		}
+	}
+	return entries, nil
+}
+
+// AddCustomEntry adds entry to the custom list, appending it to the list's
+// file, and applies it to new connections right away. It reports false if
+// the list already has the entry.
+func (r *Router) AddCustomEntry(list, entry string) (bool, error) {
+	entry = strings.TrimSpace(entry)
+	return r.editCustomList(list, entry, func(lines []string, key string) ([]string, bool) {
+		for _, line := range lines {
+			if k, ok := customEntryKey(line); ok && k == key {
+				return lines, false
+			}
+		}
+		return append(lines, entry), true
+	})
+}
+
+// RemoveCustomEntry removes entry from the custom list, deleting the lines
+// holding it from the list's file and keeping comments and other lines as
+// they are. It reports false if the list has no such entry.
+func (r *Router) RemoveCustomEntry(list, entry string) (bool, error) {
+	entry = strings.TrimSpace(entry)
+	return r.editCustomList(list, entry, func(lines []string, key string) ([]string, bool) {
+		kept := lines[:0:0]
+		for _, line := range lines {
+			if k, ok := customEntryKey(line); ok && k == key {
+				continue
+			}
+			kept = append(kept, line)
+		}
+		return kept, len(kept) != len(lines)
+	})
+}
+
+// editCustomList validates entry, rewrites the list's file with edit and
+// installs the list read back from the new lines.
+func (r *Router) editCustomList(list, entry string, edit func(lines []string, key string) ([]string, bool)) (bool, error) {
+	key, err := validateCustomEntry(entry)
+	if err != nil {
+		return false, err
+	}
+	file, err := r.CustomListFile(list)
+	if err != nil {
+		return false, err
+	}
+	if file == "" {
+		return false, fmt.Errorf("%w %q", ErrNoListFile, list)
+	}
+
+	// Edits read and rewrite the whole file, so they must not interleave.
+	r.editMu.Lock()
+	defer r.editMu.Unlock()
+	lines, err := util.ReadFileLines(file)
+	if err != nil {
+		return false, err
+	}
+	lines, changed := edit(lines, key)
+	if !changed {
+		return false, nil
+	}
+	if err := writeListFile(file, lines); err != nil {
+		return false, fmt.Errorf("router: write %s: %w", file, err)
+	}
+
+	set := parseCustomList(lines)
+	r.customMu.Lock()
+	r.replaceCustomList(list, set)
+	r.customMu.Unlock()
+	log.Info("[ROUTER] custom list edited", "list", list, "entry", entry, "file", file)
+	return true, nil
+}
+
+// validateCustomEntry checks entry is a valid custom list entry and
+// returns the key it matches by.
+func validateCustomEntry(entry string) (string, error) {
+	if entry == "" || strings.ContainsAny(entry, "\r\n") || isRuleComment(entry) {
+		return "", fmt.Errorf("%w %q", ErrInvalidEntry, entry)
+	}
+	if strings.HasPrefix(entry, "geoip:") || strings.HasPrefix(entry, "geosite:") {
+		return "", fmt.Errorf("%w %q: custom lists take no geoip/geosite entries", ErrInvalidEntry, entry)
+	}
+	set := newHostSet()
+	if err := set.add(entry, 0); err != nil {
+		return "", fmt.Errorf("%w %q: %v", ErrInvalidEntry, entry, err)
+	}
+	for key := range set.sources {
+		return key, nil
+	}
+	return "", fmt.Errorf("%w %q", ErrInvalidEntry, entry)
+}
+
+// customEntryKey returns the key of a list file line, which is false for
+// blank lines, comments and invalid entries.
+func customEntryKey(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || isRuleComment(line) {
+		return "", false
+	}
+	key, err := validateCustomEntry(line)
+	return key, err == nil
+}
+
+// parseCustomList reads the lines of a custom list file. Invalid
+// regexp/glob entries and comments are skipped.
+func parseCustomList(lines []string) *hostSet {
+	set := newHostSet()
+	for i, line := range lines {
+		if line = strings.TrimSpace(line); line != "" && !isRuleComment(line) {
+			_ = set.add(line, i+1)
+		}
+	}
+	return set
+}
+
+// replaceCustomList installs set as the custom list, keeping the addresses
+// and domains the direct and proxy lists learned from the DNS answers for
+// the domains set still matches, directly or through a kept CNAME target.
+// The caller holds customMu.
+func (r *Router) replaceCustomList(list string, set *hostSet) {
+	if list == ListBlock {
+		r.customBlock = set
+		return
+	}
+	direct := list == ListDirect
+	learned := r.learnedProxy
+	if direct {
+		learned = r.learnedDirect
+	}
+	kept := make(map[string]map[string]struct{})
+	for changed := true; changed; {
+		changed = false
+		for from, entries := range learned {
+			if _, ok := kept[from]; ok {
+				continue
+			}
+			if _, ok := set.matchEntry(from, nil); !ok {
+				continue
+			}
+			kept[from], changed = entries, true
+			for entry := range entries {
+				if util.IsIP(entry) {
+					set.ips[entry] = struct{}{}
+				} else {
+					set.domains.insert(entry)
+				}
+			}
+		}
+	}
+	if direct {
+		r.customDirectIPs = set.ips
+		r.customDirectCIDRIPs = set.cidrs
+		r.customDirectDomains = set.domains
+		r.customDirectRegexps = set.regexps
+		r.customDirectSources = set.sources
+		r.learnedDirect = kept
+		return
+	}
+	r.customProxyIPs = set.ips
+	r.customProxyCIDRIPs = set.cidrs
+	r.customProxyDomains = set.domains
+	r.customProxyRegexps = set.regexps
+	r.customProxySources = set.sources
+	r.learnedProxy = kept
+}
+
+// writeListFile replaces file with lines through a temporary file, so the
+// client and editors never see a partial list. The file keeps its mode.
+func writeListFile(file string, lines []string) error {
+	mode := os.FileMode(0o644)
+	if fi, err := os.Stat(file); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close() //nolint:errcheck
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close() //nolint:errcheck
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
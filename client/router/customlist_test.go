@@ -0,0 +1,157 @@
+package router
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestEditCustomList(t *testing.T) {
+	dir := t.TempDir()
+	directFile := filepath.Join(dir, "direct.txt")
+	if err := os.WriteFile(directFile, []byte("# office hosts\nintranet.test\n\n*.corp.test\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(Config{ProxyRule: ProxyRuleProxy, DirectFile: directFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// proxy_rule proxy skips the custom lists; auto consults them.
+	r.SetProxyRule(ProxyRuleAuto)
+	r.AddDirectIP("198.51.100.9", "intranet.test")
+	r.AddDirectDomain("cdn.learned.test", "intranet.test")
+
+	if added, err := r.AddCustomEntry(ListDirect, " example.org "); err != nil || !added {
+		t.Fatalf("AddCustomEntry = %v, %v", added, err)
+	}
+	if added, err := r.AddCustomEntry(ListDirect, "example.org"); err != nil || added {
+		t.Errorf("adding a duplicate = %v, %v", added, err)
+	}
+	if r.MatchHostRule("www.example.org") != HostRuleDirect {
+		t.Error("added entry not applied")
+	}
+	if tr := r.Explain(Conn{Host: "www.example.org"}); tr.Source != SourceCustomDirect || tr.File != directFile || tr.Line != 5 {
+		t.Errorf("trace of the added entry = %+v", tr)
+	}
+
+	if removed, err := r.RemoveCustomEntry(ListDirect, "*.corp.test"); err != nil || !removed {
+		t.Fatalf("RemoveCustomEntry = %v, %v", removed, err)
+	}
+	if removed, err := r.RemoveCustomEntry(ListDirect, "missing.test"); err != nil || removed {
+		t.Errorf("removing a missing entry = %v, %v", removed, err)
+	}
+	if r.MatchHostRule("a.corp.test") == HostRuleDirect {
+		t.Error("removed entry still applied")
+	}
+	if r.MatchHostRule("198.51.100.9") != HostRuleDirect {
+		t.Error("learned address dropped by an edit")
+	}
+	if r.MatchHostRule("img.cdn.learned.test") != HostRuleDirect {
+		t.Error("learned domain dropped by an edit")
+	}
+
+	data, err := os.ReadFile(directFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# office hosts\nintranet.test\n\nexample.org\n"; string(data) != want {
+		t.Errorf("file = %q, want %q", data, want)
+	}
+	if fi, err := os.Stat(directFile); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("file mode changed: %v, %v", fi.Mode(), err)
+	}
+	entries, err := r.CustomEntries(ListDirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []ListEntry{{"intranet.test", 2}, {"example.org", 4}}; !slices.Equal(entries, want) {
+		t.Errorf("CustomEntries = %+v, want %+v", entries, want)
+	}
+
+	if _, err := r.AddCustomEntry(ListProxy, "google.com"); !errors.Is(err, ErrNoListFile) {
+		t.Errorf("list without file: err = %v", err)
+	}
+	if _, err := r.AddCustomEntry("other", "google.com"); !errors.Is(err, ErrUnknownList) {
+		t.Errorf("unknown list: err = %v", err)
+	}
+	for _, entry := range []string{"", "# note", "regexp:(", "geoip:JP", "a.test\nb.test"} {
+		if _, err := r.AddCustomEntry(ListDirect, entry); err == nil {
+			t.Errorf("AddCustomEntry(%q) succeeded", entry)
+		}
+	}
+}
+
+func TestEditCustomListDropsLearned(t *testing.T) {
+	directFile := filepath.Join(t.TempDir(), "direct.txt")
+	if err := os.WriteFile(directFile, []byte("a.test\nb.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(Config{ProxyRule: ProxyRuleAuto, DirectFile: directFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// www.a.test is a CNAME of a.cdn.test, whose own answer is learned
+	// through it.
+	r.AddDirectIP("198.51.100.1", "www.a.test")
+	r.AddDirectDomain("a.cdn.test", "www.a.test")
+	r.AddDirectIP("198.51.100.2", "a.cdn.test")
+	r.AddDirectIP("198.51.100.3", "b.test")
+
+	if removed, err := r.RemoveCustomEntry(ListDirect, "a.test"); err != nil || !removed {
+		t.Fatalf("RemoveCustomEntry = %v, %v", removed, err)
+	}
+	for _, host := range []string{"198.51.100.1", "198.51.100.2", "a.cdn.test"} {
+		if r.MatchHostRule(host) == HostRuleDirect {
+			t.Errorf("%s learned from a removed domain still direct", host)
+		}
+	}
+	if r.MatchHostRule("198.51.100.3") != HostRuleDirect {
+		t.Error("address learned from a kept domain dropped")
+	}
+}
+
+func TestCustomBlockList(t *testing.T) {
+	dir := t.TempDir()
+	blockFile := filepath.Join(dir, "block.txt")
+	if err := os.WriteFile(blockFile, []byte("# ads\n*.ads.test\n203.0.113.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(Config{ProxyRule: ProxyRuleDirect, BlockFile: blockFile, Rules: []Rule{
+		{Outbound: OutboundDirect, Hosts: []string{"ads.test"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The block list applies whatever the proxy rule, before policy rules.
+	for _, host := range []string{"x.ads.test", "203.0.113.5"} {
+		if r.MatchHostRule(host) != HostRuleBlock {
+			t.Errorf("%s not blocked", host)
+		}
+	}
+	if tr := r.Explain(Conn{Host: "x.ads.test"}); tr.Source != SourceCustomBlock || tr.Entry != "*.ads.test" || tr.File != blockFile || tr.Line != 2 {
+		t.Errorf("trace = %+v", tr)
+	}
+	if r.MatchHostRule("example.org") != HostRuleDirect {
+		t.Error("unlisted host blocked")
+	}
+
+	if added, err := r.AddCustomEntry(ListBlock, "tracker.test"); err != nil || !added {
+		t.Fatalf("AddCustomEntry = %v, %v", added, err)
+	}
+	if r.MatchHostRule("a.tracker.test") != HostRuleBlock {
+		t.Error("added block entry not applied")
+	}
+
+	if err := r.Reload(Config{ProxyRule: ProxyRuleDirect}); err != nil {
+		t.Fatal(err)
+	}
+	if r.MatchHostRule("x.ads.test") != HostRuleDirect {
+		t.Error("block list kept after reloading without block_file")
+	}
+	if _, err := r.AddCustomEntry(ListBlock, "tracker.test"); !errors.Is(err, ErrNoListFile) {
+		t.Errorf("block list without file: err = %v", err)
+	}
+}
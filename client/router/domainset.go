@@ -0,0 +1,308 @@
+package router
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// domainTrie is a set of domains stored as a trie of their labels from the
+// TLD down, so matching a domain and all of its parents costs one lookup
+// per label however large the set is. The edges of all nodes share one map
+// to keep the per-node overhead of 200k-entry lists low.
+type domainTrie struct {
+	edges map[trieEdge]uint32
+	// end reports for each node, the root being 0, whether a domain of the
+	// set ends there.
+	end  []bool
+	size int
+}
+
+type trieEdge struct {
+	parent uint32
+	label  string
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{edges: make(map[trieEdge]uint32), end: []bool{false}}
+}
+
+// insert adds domain to the set.
+func (t *domainTrie) insert(domain string) {
+	node := uint32(0)
+	for end := len(domain); end >= 0; {
+		i := strings.LastIndexByte(domain[:end], '.')
+		edge := trieEdge{parent: node, label: domain[i+1 : end]}
+		next, ok := t.edges[edge]
+		if !ok {
+			next = uint32(len(t.end))
+			t.edges[edge] = next
+			t.end = append(t.end, false)
+		}
+		node, end = next, i
+	}
+	if !t.end[node] {
+		t.end[node] = true
+		t.size++
+	}
+}
+
+// Len returns the number of domains in the set.
+func (t *domainTrie) Len() int {
+	return t.size
+}
+
+// has reports whether domain itself is in the set.
+func (t *domainTrie) has(domain string) bool {
+	got, ok := t.match(domain, false)
+	return ok && got == domain
+}
+
+// match returns domain if it is in the set, or else with matchSub its
+// longest parent domain in the set. Bare TLDs never match as parents, like
+// with util.SubDomains.
+func (t *domainTrie) match(domain string, matchSub bool) (string, bool) {
+	if t == nil || domain == "" {
+		return "", false
+	}
+	node := uint32(0)
+	best, found := "", false
+	for end, depth := len(domain), 1; end >= 0; depth++ {
+		i := strings.LastIndexByte(domain[:end], '.')
+		next, ok := t.edges[trieEdge{parent: node, label: domain[i+1 : end]}]
+		if !ok {
+			break
+		}
+		node, end = next, i
+		if !t.end[node] {
+			continue
+		}
+		if end < 0 {
+			return domain, true
+		}
+		if matchSub && depth >= 2 {
+			best, found = domain[end+1:], true
+		}
+	}
+	return best, found
+}
+
+// regexSet matches a string against many regexps in one pass over it: an
+// Aho-Corasick automaton finds which of the literals the patterns require
+// occur in the string, and only the patterns owning them, plus those
+// without a required literal, are run. The automaton is built on the first
+// match; patterns must all be added before that.
+type regexSet struct {
+	patterns []*regexp.Regexp
+
+	once sync.Once
+	lits *literalMatcher
+	// byLiteral maps a literal of lits to the patterns requiring it;
+	// always lists the patterns without a required literal.
+	byLiteral [][]int
+	always    []int
+}
+
+func newRegexSet(patterns ...*regexp.Regexp) *regexSet {
+	return &regexSet{patterns: patterns}
+}
+
+func (s *regexSet) add(re *regexp.Regexp) {
+	s.patterns = append(s.patterns, re)
+}
+
+// Len returns the number of patterns in the set.
+func (s *regexSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.patterns)
+}
+
+// match returns the first pattern, in the order they were added, that
+// matches str.
+func (s *regexSet) match(str string) (*regexp.Regexp, bool) {
+	if s.Len() == 0 {
+		return nil, false
+	}
+	s.once.Do(s.build)
+
+	var buf [16]int
+	candidates := append(buf[:0], s.always...)
+	candidates = s.lits.appendMatches(candidates, str, s.byLiteral)
+	slices.Sort(candidates)
+	for i, p := range candidates {
+		if i > 0 && p == candidates[i-1] {
+			continue
+		}
+		if re := s.patterns[p]; re.MatchString(str) {
+			return re, true
+		}
+	}
+	return nil, false
+}
+
+func (s *regexSet) build() {
+	ids := make(map[string]int)
+	var literals []string
+	for p, re := range s.patterns {
+		lit := requiredLiteral(re)
+		if lit == "" {
+			s.always = append(s.always, p)
+			continue
+		}
+		id, ok := ids[lit]
+		if !ok {
+			id = len(literals)
+			ids[lit] = id
+			literals = append(literals, lit)
+			s.byLiteral = append(s.byLiteral, nil)
+		}
+		s.byLiteral[id] = append(s.byLiteral[id], p)
+	}
+	s.lits = newLiteralMatcher(literals)
+}
+
+// requiredLiteral returns the longest literal every match of re contains,
+// or "" if there is none.
+func requiredLiteral(re *regexp.Regexp) string {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	return longestLiteral(parsed.Simplify())
+}
+
+func longestLiteral(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return ""
+		}
+		return string(re.Rune)
+	case syntax.OpCapture, syntax.OpPlus:
+		return longestLiteral(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return longestLiteral(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		best := ""
+		for _, sub := range re.Sub {
+			if lit := longestLiteral(sub); len(lit) > len(best) {
+				best = lit
+			}
+		}
+		return best
+	}
+	return ""
+}
+
+// literalMatcher is an Aho-Corasick automaton finding which of a set of
+// literals occur in a string. State 0 is the root.
+type literalMatcher struct {
+	// next maps a state and input byte, as state<<8|byte, to the next state.
+	next map[uint64]int32
+	fail []int32
+	// dict links a state to the nearest state on its fail chain that ends
+	// a literal, or to 0.
+	dict []int32
+	// ends lists the literals ending at each state.
+	ends [][]int32
+}
+
+func newLiteralMatcher(literals []string) *literalMatcher {
+	m := &literalMatcher{
+		next: make(map[uint64]int32),
+		fail: []int32{0},
+		dict: []int32{0},
+		ends: [][]int32{nil},
+	}
+	children := [][]int32{nil}
+	for id, lit := range literals {
+		state := int32(0)
+		for i := 0; i < len(lit); i++ {
+			key := transKey(state, lit[i])
+			next, ok := m.next[key]
+			if !ok {
+				next = int32(len(m.fail))
+				m.next[key] = next
+				m.fail = append(m.fail, 0)
+				m.dict = append(m.dict, 0)
+				m.ends = append(m.ends, nil)
+				children = append(children, nil)
+				children[state] = append(children[state], next)
+			}
+			state = next
+		}
+		m.ends[state] = append(m.ends[state], int32(id))
+	}
+
+	// Link the states breadth first, so a state's fail target, which is
+	// shallower, is always linked before it.
+	label := make([]byte, len(m.fail))
+	for key, state := range m.next {
+		label[state] = byte(key)
+	}
+	queue := slices.Clone(children[0])
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, child := range children[parent] {
+			queue = append(queue, child)
+			if parent == 0 {
+				continue
+			}
+			f := m.fail[parent]
+			for {
+				if next, ok := m.next[transKey(f, label[child])]; ok {
+					m.fail[child] = next
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = m.fail[f]
+			}
+			if target := m.fail[child]; len(m.ends[target]) > 0 {
+				m.dict[child] = target
+			} else {
+				m.dict[child] = m.dict[target]
+			}
+		}
+	}
+	return m
+}
+
+func transKey(state int32, b byte) uint64 {
+	return uint64(state)<<8 | uint64(b)
+}
+
+// appendMatches appends the entries of byLiteral for every literal
+// occurring in s to dst.
+func (m *literalMatcher) appendMatches(dst []int, s string, byLiteral [][]int) []int {
+	if len(m.fail) == 1 {
+		return dst
+	}
+	state := int32(0)
+	for i := 0; i < len(s); i++ {
+		for {
+			if next, ok := m.next[transKey(state, s[i])]; ok {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = m.fail[state]
+		}
+		for o := state; o != 0; o = m.dict[o] {
+			for _, id := range m.ends[o] {
+				dst = append(dst, byLiteral[id]...)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,186 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/nange/easyss/v3/util"
+)
+
+func TestDomainTrie(t *testing.T) {
+	domains := []string{"example.com", "a.b.example.com", "cn", "co.uk", "localhost"}
+	trie := newDomainTrie()
+	ref := make(map[string]struct{})
+	for _, d := range append(domains, "example.com") {
+		trie.insert(d)
+		ref[d] = struct{}{}
+	}
+	if trie.Len() != len(domains) {
+		t.Errorf("Len() = %d, want %d", trie.Len(), len(domains))
+	}
+
+	// Reference semantics: the domain itself, then its parents longest
+	// first, excluding the bare TLD.
+	want := func(domain string, matchSub bool) (string, bool) {
+		if _, ok := ref[domain]; ok {
+			return domain, true
+		}
+		if matchSub {
+			for _, sub := range util.SubDomains(domain) {
+				if _, ok := ref[sub]; ok {
+					return sub, true
+				}
+			}
+		}
+		return "", false
+	}
+	for _, host := range []string{
+		"example.com", "www.example.com", "x.a.b.example.com", "b.example.com",
+		"baidu.cn", "cn", "bbc.co.uk", "localhost", "com", "example.org", "", "a.localhost",
+	} {
+		for _, matchSub := range []bool{false, true} {
+			gotEntry, gotOK := trie.match(host, matchSub)
+			wantEntry, wantOK := want(host, matchSub)
+			if gotEntry != wantEntry || gotOK != wantOK {
+				t.Errorf("match(%q, %v) = %q, %v, want %q, %v", host, matchSub, gotEntry, gotOK, wantEntry, wantOK)
+			}
+		}
+	}
+	if !trie.has("a.b.example.com") || trie.has("b.example.com") {
+		t.Error("has does not match exact domains only")
+	}
+}
+
+func TestRegexSet(t *testing.T) {
+	var patterns []*regexp.Regexp
+	for _, p := range []string{
+		`^.*\.baidu\.com$`,
+		`(?i)^WWW\.`,
+		`^(foo|bar)\d+\.net$`,
+		`ads?\.`,
+		`^.*\.baidu\.com$`,
+		`tracker{2,}`,
+	} {
+		patterns = append(patterns, regexp.MustCompile(p))
+	}
+	for _, glob := range []string{"*taobao*", "*.google.*"} {
+		re, err := util.GlobToRegexp(glob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patterns = append(patterns, re)
+	}
+	set := newRegexSet(patterns...)
+
+	for _, host := range []string{
+		"www.baidu.com", "map.baidu.com", "baidu.com", "WWW.example.com", "foo12.net", "baz1.net",
+		"ad.example.com", "ads.example.com", "trackerr.io", "tracker.io", "item.taobao.com",
+		"www.google.co.jp", "google.com", "",
+	} {
+		var want *regexp.Regexp
+		for _, re := range patterns {
+			if re.MatchString(host) {
+				want = re
+				break
+			}
+		}
+		got, ok := set.match(host)
+		if got != want || ok != (want != nil) {
+			t.Errorf("match(%q) = %v, %v, want %v", host, got, ok, want)
+		}
+	}
+
+	var empty *regexSet
+	if _, ok := empty.match("example.com"); ok || empty.Len() != 0 {
+		t.Error("nil set matched")
+	}
+}
+
+func TestRequiredLiteral(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{`^.*\.baidu\.com$`, ".baidu.com"},
+		{`^(foo|bar)\d+\.net$`, ".net"},
+		{`(?i)^www\.`, ""},
+		{`a|b`, ""},
+		{`(google)+`, "google"},
+		{`x*`, ""},
+	}
+	for _, tt := range tests {
+		if got := requiredLiteral(regexp.MustCompile(tt.pattern)); got != tt.want {
+			t.Errorf("requiredLiteral(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+// geoSiteData returns a GeoSite list of n domains and n/100 regexps.
+func geoSiteData(n int) []byte {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "site%d.example%d.com\n", i, i%97)
+		if i%100 == 0 {
+			fmt.Fprintf(&b, "regexp:^.*\\.cdn%d\\.net$\n", i)
+		}
+	}
+	return []byte(b.String())
+}
+
+// BenchmarkGeoSiteMatch shows the cost of a lookup staying flat as the
+// list grows.
+func BenchmarkGeoSiteMatch(b *testing.B) {
+	for _, n := range []int{1_000, 10_000, 100_000, 200_000} {
+		gs := NewGeoSite(geoSiteData(n))
+		b.Run(fmt.Sprintf("miss/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				gs.FullMatch("img.static.www.unlisted-site.org")
+			}
+		})
+		b.Run(fmt.Sprintf("hit/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				gs.FullMatch("a.b.site7.example7.com")
+			}
+		})
+	}
+}
+
+// BenchmarkRegexSet compares the regex set with testing every pattern.
+func BenchmarkRegexSet(b *testing.B) {
+	const host = "img.static.www.unlisted-site.org"
+	for _, n := range []int{10, 100, 1_000, 10_000} {
+		set := newRegexSet()
+		for i := 0; i < n; i++ {
+			re, _ := util.GlobToRegexp(fmt.Sprintf("*.domain%d.*", i))
+			set.add(re)
+		}
+		set.match("")
+		b.Run(fmt.Sprintf("set/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				set.match(host)
+			}
+		})
+		if n > 1_000 {
+			continue
+		}
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, re := range set.patterns {
+					if re.MatchString(host) {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func newTestTrie(domains ...string) *domainTrie {
+	t := newDomainTrie()
+	for _, d := range domains {
+		t.insert(d)
+	}
+	return t
+}
@@ -0,0 +1,139 @@
+package router
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Trace sources: the check of Route that made a decision.
+const (
+	// SourceProxyRule is the proxy rule itself: proxy_rule direct or proxy,
+	// or the fallback for hosts nothing else matched.
+	SourceProxyRule    = "proxy_rule"
+	SourceCustomBlock  = "custom_block"
+	SourceLAN          = "lan"
+	SourcePolicyRule   = "policy_rule"
+	SourceRuleSet      = "rule_set"
+	SourceCustomDirect = "custom_direct"
+	SourceCustomProxy  = "custom_proxy"
+	SourceLearned      = "learned"
+	SourceGeoSite      = "geosite"
+	SourceGeoIP        = "geoip"
+	SourceTLD          = "tld"
+	// SourceRace is racing, Name the path a recent race picked if any.
+	SourceRace = "race"
+)
+
+// Trace explains a routing decision: the check that made it and, for list
+// and rule matches, the entry that matched and where it is defined.
+type Trace struct {
+	Network string `json:"network,omitempty"`
+	Host    string `json:"host"`
+	Port    int    `json:"port,omitempty"`
+	// Process is the local program the connection came from, if known.
+	Process *Process `json:"process,omitempty"`
+	Decision
+	// Source is one of the Source constants. Name qualifies it: the proxy
+	// rule, the policy rule index, the rule set, the GeoSite category or
+	// the country.
+	Source string `json:"source"`
+	Name   string `json:"name,omitempty"`
+	// Entry is the list entry or rule that matched, as written.
+	Entry string `json:"entry,omitempty"`
+	// File and Line locate Entry; Line is 0 for entries not read from a
+	// file line, such as inline policy rule hosts or learned entries.
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+}
+
+// entrySource is where a hostSet entry was read from.
+type entrySource struct {
+	entry string
+	line  int
+}
+
+// Explain returns the decision Route makes for c, with a trace of the
+// check that made it.
+func (r *Router) Explain(c Conn) Trace {
+	tr := &Trace{Network: c.Network, Host: c.Host, Port: c.Port, Process: c.Process}
+	tr.Decision = r.route(c, tr)
+	return *tr
+}
+
+// record sets the source of t; a nil t records nothing, so matching can
+// trace without cost when no trace is wanted.
+func (t *Trace) record(source, name string) {
+	if t == nil {
+		return
+	}
+	t.Source, t.Name = source, name
+}
+
+// setEntry records the matched entry of a list without a file.
+func (t *Trace) setEntry(entry string) {
+	if t != nil {
+		t.Entry = entry
+	}
+}
+
+// recordEntry records the matched entry key of a list read from file,
+// looking up its text and line in sources.
+func (t *Trace) recordEntry(key, file string, sources map[string]entrySource) {
+	if t == nil {
+		return
+	}
+	t.Entry = key
+	if src, ok := sources[key]; ok {
+		t.Entry = src.entry
+		if src.line > 0 {
+			t.File, t.Line = file, src.line
+		}
+	}
+}
+
+func (h HostRule) String() string {
+	switch h {
+	case HostRuleProxy:
+		return "proxy"
+	case HostRuleDirect:
+		return "direct"
+	case HostRuleBlock:
+		return "block"
+	case HostRuleRace:
+		return "race"
+	}
+	return "HostRule(" + strconv.Itoa(int(h)) + ")"
+}
+
+// MarshalText encodes h by name, so decisions read well as JSON.
+func (h HostRule) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// UnmarshalText decodes a name produced by MarshalText.
+func (h *HostRule) UnmarshalText(text []byte) error {
+	for _, rule := range []HostRule{HostRuleProxy, HostRuleDirect, HostRuleBlock, HostRuleRace} {
+		if rule.String() == string(text) {
+			*h = rule
+			return nil
+		}
+	}
+	return fmt.Errorf("router: unknown host rule %q", text)
+}
+
+// String returns the configuration name of p, as ParseProxyRule reads it.
+func (p ProxyRule) String() string {
+	switch p {
+	case ProxyRuleAuto:
+		return "auto"
+	case ProxyRuleReverseAuto:
+		return "reverse_auto"
+	case ProxyRuleProxy:
+		return "proxy"
+	case ProxyRuleDirect:
+		return "direct"
+	case ProxyRuleAutoBlock:
+		return "auto_block"
+	}
+	return "ProxyRule(" + strconv.Itoa(int(p)) + ")"
+}
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	directFile := write("direct.txt", "# comment\n\nexample.org\n*.glob.test\n")
+	proxyFile := write("proxy.txt", "10.1.0.0/16\n")
+	ruleFile := write("rule.txt", "\nstreaming.test\n")
+
+	rs, err := ParseRuleSet("rules.list", []byte("payload:\n  - DOMAIN-KEYWORD,ads\n  - DST-PORT,8443,jp\n"), "REJECT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(Config{
+		ProxyRule:  ProxyRuleAutoBlock,
+		DirectFile: directFile,
+		ProxyFile:  proxyFile,
+		Rules: []Rule{
+			{Outbound: OutboundDirect, Hosts: []string{"inline.test"}},
+			{Outbound: "us", File: ruleFile},
+		},
+		RuleSets: []*RuleSet{rs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		port int
+		want Trace
+	}{
+		{"192.168.1.1", 0, Trace{Decision: Decision{Rule: HostRuleDirect}, Source: SourceLAN}},
+		{"inline.test", 0, Trace{Decision: Decision{Rule: HostRuleDirect}, Source: SourcePolicyRule, Name: "0", Entry: "inline.test"}},
+		{"www.streaming.test", 0, Trace{Decision: Decision{Rule: HostRuleProxy, Outbound: "us"}, Source: SourcePolicyRule, Name: "1", Entry: "streaming.test", File: ruleFile, Line: 2}},
+		{"ads.example.com", 0, Trace{Decision: Decision{Rule: HostRuleBlock}, Source: SourceRuleSet, Name: "rules.list", Entry: "DOMAIN-KEYWORD,ads", File: "rules.list", Line: 2}},
+		{"game.example.com", 8443, Trace{Decision: Decision{Rule: HostRuleProxy, Outbound: "jp"}, Source: SourceRuleSet, Name: "rules.list", Entry: "DST-PORT,8443", File: "rules.list", Line: 3}},
+		{"www.example.org", 0, Trace{Decision: Decision{Rule: HostRuleDirect}, Source: SourceCustomDirect, Entry: "example.org", File: directFile, Line: 3}},
+		{"a.glob.test", 0, Trace{Decision: Decision{Rule: HostRuleDirect}, Source: SourceCustomDirect, Entry: "*.glob.test", File: directFile, Line: 4}},
+		{"10.1.2.3", 0, Trace{Decision: Decision{Rule: HostRuleDirect}, Source: SourceLAN}},
+		{"www.baidu.com", 0, Trace{Decision: Decision{Rule: HostRuleDirect}, Source: SourceGeoSite, Name: GeoSiteDirect, Entry: "baidu.com"}},
+		{"news.sina.cn", 0, Trace{Decision: Decision{Rule: HostRuleDirect}, Source: SourceTLD, Name: "CN", Entry: ".cn"}},
+		{"114.114.114.114", 0, Trace{Decision: Decision{Rule: HostRuleDirect}, Source: SourceGeoIP, Name: "CN"}},
+		{"www.google.com", 0, Trace{Decision: Decision{Rule: HostRuleProxy}, Source: SourceProxyRule, Name: "auto_block"}},
+	}
+	for _, tt := range tests {
+		tt.want.Host, tt.want.Port = tt.host, tt.port
+		got := r.Explain(Conn{Host: tt.host, Port: tt.port})
+		if got != tt.want {
+			t.Errorf("Explain(%q, %d) = %+v, want %+v", tt.host, tt.port, got, tt.want)
+		}
+		if d := r.MatchPort(tt.host, tt.port); d != got.Decision {
+			t.Errorf("MatchPort(%q, %d) = %+v, Explain decided %+v", tt.host, tt.port, d, got.Decision)
+		}
+	}
+
+	r.SetProxyRule(ProxyRuleReverseAuto)
+	if got := r.Explain(Conn{Host: "www.google.com"}); got.Rule != HostRuleDirect || got.Source != SourceProxyRule || got.Name != "reverse_auto" {
+		t.Errorf("reverse_auto foreign host: %+v", got)
+	}
+	if got := r.Explain(Conn{Host: "www.baidu.com"}); got.Rule != HostRuleProxy || got.Source != SourceGeoSite {
+		t.Errorf("reverse_auto local host: %+v", got)
+	}
+
+	// Traces travel as JSON with the rule by name.
+	data, err := json.Marshal(r.Explain(Conn{Network: NetworkTCP, Host: "ads.example.com"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back Trace
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Rule != HostRuleBlock || back.Line != 2 {
+		t.Errorf("round trip of %s = %+v", data, back)
+	}
+}
@@ -0,0 +1,142 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nange/easyss/v3/assets"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/util"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// DefaultCountry is the country the auto proxy rules treat as local when
+// none is configured.
+const DefaultCountry = "CN"
+
+// GeoSite categories the proxy rules use: the domains of the local country,
+// and the domains auto_block blocks.
+const (
+	GeoSiteDirect = "direct"
+	GeoSiteBlock  = "block"
+)
+
+// geoCloseDelay is how long geo data replaced by a reload stays open, for
+// the lookups that loaded it just before the swap.
+var geoCloseDelay = time.Minute
+
+// geoData is the GeoIP database, local country and GeoSite categories a
+// router matches against. It is replaced as a whole on reload.
+type geoData struct {
+	db      *geoip2.Reader
+	country string
+	sites   map[string]*GeoSite
+	// closed is set once db is closed.
+	closed atomic.Bool
+}
+
+// loadGeoData opens cfg's GeoIP file and GeoSite directory. Without them
+// the embedded mainland China data is used; categories missing from the
+// directory fall back to the embedded direct and block lists.
+func loadGeoData(cfg Config) (*geoData, error) {
+	g := &geoData{
+		country: strings.ToUpper(cfg.Country),
+		sites: map[string]*GeoSite{
+			GeoSiteDirect: NewGeoSite(assets.GeoSiteDirect),
+			GeoSiteBlock:  NewGeoSite(assets.GeoSiteBlock),
+		},
+	}
+	if g.country == "" {
+		g.country = DefaultCountry
+	}
+
+	var err error
+	if cfg.GeoIPFile != "" {
+		g.db, err = geoip2.Open(cfg.GeoIPFile)
+	} else {
+		g.db, err = geoip2.FromBytes(assets.GeoIPCNPrivate)
+		if err == nil && g.country != DefaultCountry {
+			log.Warn("[ROUTER] the built-in GeoIP data only knows CN, set a GeoIP file", "country", g.country)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("router: geoip: %w", err)
+	}
+
+	if cfg.GeoSiteDir != "" {
+		files, err := filepath.Glob(filepath.Join(cfg.GeoSiteDir, "*.txt"))
+		if err != nil {
+			g.close()
+			return nil, fmt.Errorf("router: geosite: %w", err)
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				g.close()
+				return nil, fmt.Errorf("router: geosite: %w", err)
+			}
+			category := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".txt"))
+			g.sites[category] = NewGeoSite(data)
+		}
+	}
+	return g, nil
+}
+
+// close unmaps the GeoIP database; g must not be used afterwards.
+func (g *geoData) close() {
+	_ = g.db.Close()
+	g.closed.Store(true)
+}
+
+// site returns the GeoSite category name, or nil if there is none.
+func (g *geoData) site(name string) *GeoSite {
+	return g.sites[strings.ToLower(name)]
+}
+
+// inCountry reports whether ip belongs to the country with ISO code
+// country; LAN and PRIVATE stand for private and loopback addresses.
+func (g *geoData) inCountry(ip net.IP, country string) bool {
+	if country == "LAN" || country == "PRIVATE" {
+		return util.IsLANIP(ip.String())
+	}
+	c, err := g.db.Country(ip)
+	if err != nil {
+		return false
+	}
+	return c.Country.IsoCode == country
+}
+
+// inSite reports whether domain is in the GeoSite category name. Unknown
+// categories match nothing.
+func (g *geoData) inSite(domain, name string) bool {
+	gs := g.site(name)
+	return gs != nil && gs.FullMatch(domain)
+}
+
+// warnUnknownGeoSites logs the GeoSite categories the policy rules and rule
+// sets reference but g does not have.
+func (g *geoData) warnUnknownGeoSites(rules []policyRule, ruleSets []*RuleSet) {
+	var names []string
+	for _, pr := range rules {
+		if pr.hosts != nil {
+			names = append(names, pr.hosts.geoSites...)
+		}
+	}
+	for _, rs := range ruleSets {
+		for _, rule := range rs.rules {
+			if rule.kind == ruleGeoSite {
+				names = append(names, rule.value)
+			}
+		}
+	}
+	for _, name := range names {
+		if g.site(name) == nil {
+			log.Warn("[ROUTER] unknown geosite category, it matches nothing", "category", name)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package router
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nange/easyss/v3/assets"
+)
+
+func TestGeoDataFiles(t *testing.T) {
+	dir := t.TempDir()
+	geoIPFile := filepath.Join(dir, "Country.mmdb")
+	if err := os.WriteFile(geoIPFile, assets.GeoIPCNPrivate, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	siteDir := filepath.Join(dir, "geosite")
+	if err := os.Mkdir(siteDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		"direct.txt":  "example.de\n",
+		"Netflix.txt": "netflix.com\nfull:nflxvideo.net\n",
+	} {
+		if err := os.WriteFile(filepath.Join(siteDir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rs, err := ParseRuleSet("rules", []byte("GEOSITE,netflix,jp\nGEOIP,CN,REJECT\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(Config{
+		ProxyRule:  ProxyRuleAuto,
+		Country:    "de",
+		GeoIPFile:  geoIPFile,
+		GeoSiteDir: siteDir,
+		Rules:      []Rule{{Outbound: "us", Hosts: []string{"geosite:unknown", "geoip:cn"}}},
+		RuleSets:   []*RuleSet{rs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want Decision
+	}{
+		// The local country decides what auto sends direct.
+		{"www.example.de", Decision{Rule: HostRuleDirect}},
+		{"shop.de", Decision{Rule: HostRuleDirect}},
+		{"baidu.cn", Decision{Rule: HostRuleProxy}},
+		// The on-disk direct category replaces the embedded one.
+		{"www.baidu.com", Decision{Rule: HostRuleProxy}},
+		{"www.netflix.com", Decision{Rule: HostRuleProxy, Outbound: "jp"}},
+		{"nflxvideo.net", Decision{Rule: HostRuleProxy, Outbound: "jp"}},
+		{"114.114.114.114", Decision{Rule: HostRuleProxy, Outbound: "us"}},
+	}
+	for _, tt := range tests {
+		if got := r.Match(tt.host); got != tt.want {
+			t.Errorf("Match(%q) = %+v, want %+v", tt.host, got, tt.want)
+		}
+	}
+
+	// Reload switches back to the embedded data.
+	if err := r.Reload(Config{ProxyRule: ProxyRuleAuto}); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.MatchHostRule("www.baidu.com"); got != HostRuleDirect {
+		t.Errorf("after reload www.baidu.com = %d, want direct", got)
+	}
+	if got := r.MatchHostRule("www.example.de"); got != HostRuleProxy {
+		t.Errorf("after reload www.example.de = %d, want proxy", got)
+	}
+
+	if err := r.Reload(Config{GeoIPFile: filepath.Join(dir, "missing.mmdb")}); err == nil {
+		t.Error("expected error for a missing GeoIP file")
+	}
+	if got := r.MatchHostRule("www.baidu.com"); got != HostRuleDirect {
+		t.Error("failed reload changed the geo data")
+	}
+}
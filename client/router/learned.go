@@ -0,0 +1,279 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/util"
+)
+
+// Learned routing defaults.
+const (
+	DefaultLearnFailures = 2
+	DefaultLearnTTL      = 7 * 24 * time.Hour
+	// learnFailureWindow is how long a direct failure counts towards
+	// promoting its domain; older failures are forgotten.
+	learnFailureWindow = time.Hour
+)
+
+// LearnConfig enables learned routing: domains the automatic rules send
+// direct whose direct connections fail are routed through the proxy.
+type LearnConfig struct {
+	Enabled bool
+	// File persists the learned domains across restarts; empty keeps them
+	// in memory only.
+	File string
+	// Failures is how many direct failures within an hour promote a domain
+	// to the proxy, DefaultLearnFailures if 0.
+	Failures int
+	// TTL is how long a promoted domain goes through the proxy,
+	// DefaultLearnTTL if 0.
+	TTL time.Duration
+}
+
+func (c LearnConfig) failures() int {
+	if c.Failures <= 0 {
+		return DefaultLearnFailures
+	}
+	return c.Failures
+}
+
+func (c LearnConfig) ttl() time.Duration {
+	if c.TTL <= 0 {
+		return DefaultLearnTTL
+	}
+	return c.TTL
+}
+
+// LearnedDomain is a domain whose direct connections failed.
+type LearnedDomain struct {
+	Domain      string    `json:"domain"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	// Expires is when the domain stops going through the proxy; it is zero
+	// while the domain has failed fewer times than the promotion threshold.
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// promoted reports whether d goes through the proxy at now.
+func (d LearnedDomain) promoted(now time.Time) bool {
+	return !d.Expires.IsZero() && now.Before(d.Expires)
+}
+
+// learnedSet holds the learned domains.
+type learnedSet struct {
+	mu      sync.Mutex
+	cfg     LearnConfig
+	domains map[string]LearnedDomain
+	// saveMu orders the writes of the file, so an older snapshot never
+	// replaces a newer one.
+	saveMu sync.Mutex
+}
+
+// loadLearned reads the promoted domains persisted in file; a missing file
+// is an empty list.
+func loadLearned(file string) (map[string]LearnedDomain, error) {
+	domains := make(map[string]LearnedDomain)
+	if file == "" {
+		return domains, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return domains, nil
+	}
+	if err != nil {
+		return domains, err
+	}
+	var list []LearnedDomain
+	if err := json.Unmarshal(data, &list); err != nil {
+		return domains, fmt.Errorf("router: parse %s: %w", file, err)
+	}
+	now := time.Now()
+	for _, d := range list {
+		if d.promoted(now) {
+			domains[d.Domain] = d
+		}
+	}
+	return domains, nil
+}
+
+// setLearnConfig applies cfg, reading the learned domains again if the
+// file changed.
+func (r *Router) setLearnConfig(cfg LearnConfig) error {
+	r.learned.mu.Lock()
+	defer r.learned.mu.Unlock()
+	if r.learned.domains != nil && cfg.File == r.learned.cfg.File {
+		r.learned.cfg = cfg
+		return nil
+	}
+	domains, err := loadLearned(cfg.File)
+	r.learned.cfg = cfg
+	r.learned.domains = domains
+	return err
+}
+
+// Learning reports whether learned routing is enabled.
+func (r *Router) Learning() bool {
+	r.learned.mu.Lock()
+	defer r.learned.mu.Unlock()
+	return r.learned.cfg.Enabled
+}
+
+// matchLearned reports whether host is a promoted learned domain,
+// recording the match in tr unless it is nil.
+func (r *Router) matchLearned(host string, tr *Trace) bool {
+	r.learned.mu.Lock()
+	d, ok := r.learned.domains[host]
+	if ok && !d.promoted(time.Now()) {
+		ok = false
+		if !d.Expires.IsZero() {
+			delete(r.learned.domains, host)
+		}
+	}
+	ok = ok && r.learned.cfg.Enabled
+	r.learned.mu.Unlock()
+	if ok {
+		tr.record(SourceLearned, "")
+		tr.setEntry(host)
+	}
+	return ok
+}
+
+// RecordDirectFailure records that a direct connection for c failed: it
+// was refused, reset or unanswered. It reports whether the failure counts,
+// in which case the connection may be retried through the proxy: learning
+// is enabled, c is for a domain, and the automatic rules, not a list or
+// rule, sent it direct. The domain goes through the proxy once it failed
+// as often as configured within an hour.
+func (r *Router) RecordDirectFailure(c Conn) bool {
+	if !r.Learning() || c.Host == "" || util.IsIP(c.Host) {
+		return false
+	}
+	tr := r.Explain(c)
+	if tr.Rule != HostRuleDirect {
+		return false
+	}
+	switch tr.Source {
+	case SourceGeoSite, SourceGeoIP, SourceTLD:
+	case SourceProxyRule:
+		// reverse_auto sends foreign hosts direct; proxy_rule direct is
+		// meant.
+		if tr.Name == ProxyRuleDirect.String() {
+			return false
+		}
+	default:
+		return false
+	}
+
+	now := time.Now()
+	r.learned.mu.Lock()
+	d := r.learned.domains[c.Host]
+	if now.Sub(d.LastFailure) > learnFailureWindow {
+		d.Failures = 0
+	}
+	d.Domain = c.Host
+	d.Expires = time.Time{}
+	d.Failures++
+	d.LastFailure = now
+	promoted := d.Failures >= r.learned.cfg.failures()
+	if promoted {
+		d.Expires = now.Add(r.learned.cfg.ttl())
+	}
+	r.learned.domains[c.Host] = d
+	r.learned.mu.Unlock()
+
+	if promoted {
+		log.Info("[ROUTER] learned proxy domain", "domain", c.Host, "failures", d.Failures, "expires", d.Expires)
+		_ = r.saveLearned()
+	} else {
+		log.Info("[ROUTER] direct failure", "domain", c.Host, "failures", d.Failures)
+	}
+	return true
+}
+
+// RecordDirectSuccess records that a direct connection to host worked,
+// forgetting the failures of a domain not yet promoted.
+func (r *Router) RecordDirectSuccess(host string) {
+	r.learned.mu.Lock()
+	if d, ok := r.learned.domains[host]; ok && d.Expires.IsZero() {
+		delete(r.learned.domains, host)
+	}
+	r.learned.mu.Unlock()
+}
+
+// LearnedDomains returns the learned domains, promoted or not, sorted by
+// domain. Expired domains are left out.
+func (r *Router) LearnedDomains() []LearnedDomain {
+	now := time.Now()
+	r.learned.mu.Lock()
+	var list []LearnedDomain
+	for _, d := range r.learned.domains {
+		if d.Expires.IsZero() || d.promoted(now) {
+			list = append(list, d)
+		}
+	}
+	r.learned.mu.Unlock()
+	slices.SortFunc(list, func(a, b LearnedDomain) int { return strings.Compare(a.Domain, b.Domain) })
+	return list
+}
+
+// ClearLearned forgets the learned domains, or only domain if it is not
+// empty, so they are routed by the other rules again. It returns how many
+// domains were forgotten.
+func (r *Router) ClearLearned(domain string) (int, error) {
+	r.learned.mu.Lock()
+	n := len(r.learned.domains)
+	if domain == "" {
+		clear(r.learned.domains)
+	} else {
+		delete(r.learned.domains, domain)
+	}
+	n -= len(r.learned.domains)
+	r.learned.mu.Unlock()
+	if n == 0 {
+		return 0, nil
+	}
+	log.Info("[ROUTER] learned domains cleared", "domain", domain, "count", n)
+	return n, r.saveLearned()
+}
+
+// saveLearned writes the promoted domains to the learned file, if any.
+func (r *Router) saveLearned() error {
+	r.learned.saveMu.Lock()
+	defer r.learned.saveMu.Unlock()
+
+	now := time.Now()
+	r.learned.mu.Lock()
+	file := r.learned.cfg.File
+	var list []LearnedDomain
+	for _, domain := range slices.Sorted(maps.Keys(r.learned.domains)) {
+		if d := r.learned.domains[domain]; d.promoted(now) {
+			list = append(list, d)
+		}
+	}
+	r.learned.mu.Unlock()
+	if file == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		data = []byte("[]")
+	}
+	if err := writeListFile(file, []string{string(data)}); err != nil {
+		log.Error("[ROUTER] save learned domains", "file", file, "err", err)
+		return fmt.Errorf("router: write %s: %w", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package router
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLearnedProxy(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "learned.json")
+	directFile := filepath.Join(dir, "direct.txt")
+	if err := os.WriteFile(directFile, []byte("intranet.cn\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{ProxyRule: ProxyRuleAuto, DirectFile: directFile, Learn: LearnConfig{Enabled: true, File: file, TTL: time.Hour}}
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Conn{Network: NetworkTCP, Host: "blocked.cn", Port: 443}
+	if r.MatchHostRule(c.Host) != HostRuleDirect {
+		t.Fatal("country TLD domain not direct")
+	}
+	for _, other := range []Conn{{Host: "intranet.cn"}, {Host: "1.2.3.4"}, {Host: "www.google.com"}} {
+		if r.RecordDirectFailure(other) {
+			t.Errorf("failure of %s counted", other.Host)
+		}
+	}
+
+	if !r.RecordDirectFailure(c) {
+		t.Fatal("direct failure not counted")
+	}
+	r.RecordDirectSuccess(c.Host)
+	if got := r.LearnedDomains(); len(got) != 0 {
+		t.Errorf("failures kept after a success: %+v", got)
+	}
+	r.RecordDirectFailure(c)
+	if r.MatchHostRule(c.Host) != HostRuleDirect {
+		t.Error("promoted after one failure")
+	}
+	r.RecordDirectFailure(c)
+	if tr := r.Explain(c); tr.Rule != HostRuleProxy || tr.Source != SourceLearned || tr.Entry != c.Host {
+		t.Errorf("trace after two failures = %+v", tr)
+	}
+	if r.RecordDirectFailure(c) {
+		t.Error("failure of a promoted domain counted")
+	}
+
+	// The promoted domain survives a restart.
+	r2, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r2.LearnedDomains()
+	if len(got) != 1 || got[0].Domain != c.Host || got[0].Failures != 2 || time.Until(got[0].Expires) > time.Hour {
+		t.Errorf("learned domains after restart = %+v", got)
+	}
+
+	if n, err := r2.ClearLearned(""); n != 1 || err != nil {
+		t.Errorf("ClearLearned = %d, %v", n, err)
+	}
+	if r2.MatchHostRule(c.Host) != HostRuleDirect {
+		t.Error("cleared domain still proxied")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "[]\n" {
+		t.Errorf("file after clearing = %q, %v", data, err)
+	}
+
+	cfg.Learn.Enabled = false
+	if err := r.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if r.MatchHostRule(c.Host) != HostRuleDirect || r.RecordDirectFailure(c) {
+		t.Error("learning applied while disabled")
+	}
+}
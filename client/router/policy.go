@@ -0,0 +1,418 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/util"
+)
+
+// Outbounds a policy rule may name besides a server profile.
+const (
+	OutboundDirect = "direct"
+	OutboundBlock  = "block"
+)
+
+// Networks a connection is matched on.
+const (
+	NetworkTCP  = "tcp"
+	NetworkUDP  = "udp"
+	NetworkICMP = "icmp"
+)
+
+// Rule sends hosts matching any entry of Hosts or of the lines in File to
+// Outbound: a server profile name, OutboundDirect or OutboundBlock. Entries
+// use the same syntax as the custom direct/proxy files, plus "geoip:JP" and
+// "geosite:netflix" for a country or a GeoSite category.
+//
+// Ports ("22", "8000-8999"), Network and Processes further restrict the
+// rule to connections to one of those ports, over that network and opened
+// by one of those processes: a program name ("git"), an executable path
+// ("/usr/bin/curl") or a user id ("uid:1000"). A rule with any of them but
+// no Hosts and File matches every host.
+type Rule struct {
+	Outbound  string
+	Hosts     []string
+	File      string
+	Ports     []string
+	Network   string
+	Processes []string
+}
+
+// Decision is the routing result for a host. Outbound names the server a
+// proxied host must use, or is empty when the default server selection
+// applies.
+type Decision struct {
+	Rule     HostRule `json:"rule"`
+	Outbound string   `json:"outbound,omitempty"`
+}
+
+type outboundKey struct{}
+
+// WithOutbound returns a copy of ctx carrying the server a Decision named,
+// for the stream handler to open the connection on. An empty name leaves
+// ctx unchanged.
+func WithOutbound(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, outboundKey{}, name)
+}
+
+// OutboundFrom returns the server name stored by WithOutbound, or "".
+func OutboundFrom(ctx context.Context) string {
+	name, _ := ctx.Value(outboundKey{}).(string)
+	return name
+}
+
+// hostSet matches hosts against IPs, CIDRs, domains (with subdomains),
+// regexp/glob patterns, GeoIP countries and GeoSite categories.
+type hostSet struct {
+	ips      map[string]struct{}
+	cidrs    []*net.IPNet
+	domains  *domainTrie
+	regexps  *regexSet
+	geoIPs   []string
+	geoSites []string
+	// sources maps the key matchEntry returns to the entry as written and
+	// its line.
+	sources map[string]entrySource
+}
+
+func newHostSet() *hostSet {
+	return &hostSet{
+		ips:     make(map[string]struct{}),
+		domains: newDomainTrie(),
+		regexps: newRegexSet(),
+		sources: make(map[string]entrySource),
+	}
+}
+
+// add classifies entry the same way the custom direct/proxy files are.
+// line is its 1-based line in the file it was read from, or 0.
+func (s *hostSet) add(entry string, line int) error {
+	var key string
+	if country, ok := strings.CutPrefix(entry, "geoip:"); ok {
+		country = strings.ToUpper(country)
+		s.geoIPs = append(s.geoIPs, country)
+		key = "geoip:" + country
+	} else if category, ok := strings.CutPrefix(entry, "geosite:"); ok {
+		category = strings.ToLower(category)
+		s.geoSites = append(s.geoSites, category)
+		key = "geosite:" + category
+	} else if strings.HasPrefix(entry, "regexp:") {
+		re, err := regexp.Compile(entry[7:])
+		if err != nil {
+			return err
+		}
+		s.regexps.add(re)
+		key = re.String()
+	} else if strings.Contains(entry, "*") {
+		re, err := util.GlobToRegexp(entry)
+		if err != nil {
+			return err
+		}
+		s.regexps.add(re)
+		key = re.String()
+	} else if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+		s.cidrs = append(s.cidrs, ipnet)
+		key = ipnet.String()
+	} else if util.IsIP(entry) {
+		s.ips[entry] = struct{}{}
+		key = entry
+	} else {
+		s.domains.insert(entry)
+		key = entry
+	}
+	if _, dup := s.sources[key]; !dup {
+		s.sources[key] = entrySource{entry: entry, line: line}
+	}
+	return nil
+}
+
+func (s *hostSet) match(host string, geo *geoData) bool {
+	_, ok := s.matchEntry(host, geo)
+	return ok
+}
+
+// matchEntry returns the key of the first entry matching host: the IP,
+// CIDR, domain or pattern, or "geoip:XX"/"geosite:name".
+func (s *hostSet) matchEntry(host string, geo *geoData) (string, bool) {
+	if util.IsIP(host) {
+		if _, ok := s.ips[host]; ok {
+			return host, true
+		}
+		ip := net.ParseIP(host)
+		for _, cidr := range s.cidrs {
+			if cidr.Contains(ip) {
+				return cidr.String(), true
+			}
+		}
+		for _, country := range s.geoIPs {
+			if geo.inCountry(ip, country) {
+				return "geoip:" + country, true
+			}
+		}
+		return "", false
+	}
+	if domain, ok := s.domains.match(host, true); ok {
+		return domain, true
+	}
+	if re, ok := s.regexps.match(host); ok {
+		return re.String(), true
+	}
+	for _, category := range s.geoSites {
+		if geo.inSite(host, category) {
+			return "geosite:" + category, true
+		}
+	}
+	return "", false
+}
+
+// policyRule is a compiled Rule. A nil hosts matches every host.
+type policyRule struct {
+	outbound string
+	file     string
+	hosts    *hostSet
+	ports    []portRange
+	network  string
+	// procs is nil for rules matching any process.
+	procs *processSet
+}
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	lo, hi int
+}
+
+// matchConn reports whether the rule's port, network and process
+// conditions allow c, returning the matched process entry if any. Unknown
+// ports, networks and processes only pass rules without the condition.
+func (pr *policyRule) matchConn(c Conn) (string, bool) {
+	if pr.network != "" && pr.network != c.Network {
+		return "", false
+	}
+	if len(pr.ports) > 0 && !slices.ContainsFunc(pr.ports, func(p portRange) bool {
+		return c.Port >= p.lo && c.Port <= p.hi
+	}) {
+		return "", false
+	}
+	if pr.procs == nil {
+		return "", true
+	}
+	return pr.procs.matchEntry(c.Process)
+}
+
+// parseNetwork validates a rule's network, case-insensitively.
+func parseNetwork(s string) (string, error) {
+	switch n := strings.ToLower(s); n {
+	case "", NetworkTCP, NetworkUDP, NetworkICMP:
+		return n, nil
+	}
+	return "", fmt.Errorf("unknown network %q", s)
+}
+
+func compileRules(rules []Rule) ([]policyRule, error) {
+	out := make([]policyRule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Outbound == "" {
+			return nil, fmt.Errorf("router: rule %d has no outbound", i)
+		}
+		pr := policyRule{outbound: rule.Outbound, file: rule.File}
+		for _, p := range rule.Ports {
+			lo, hi, err := parsePortRange(strings.TrimSpace(p))
+			if err != nil {
+				return nil, fmt.Errorf("router: rule %d: %w", i, err)
+			}
+			pr.ports = append(pr.ports, portRange{lo: lo, hi: hi})
+		}
+		network, err := parseNetwork(rule.Network)
+		if err != nil {
+			return nil, fmt.Errorf("router: rule %d: %w", i, err)
+		}
+		pr.network = network
+		for _, e := range rule.Processes {
+			if e = strings.TrimSpace(e); e == "" {
+				continue
+			}
+			if pr.procs == nil {
+				pr.procs = newProcessSet()
+			}
+			if err := pr.procs.add(e); err != nil {
+				return nil, fmt.Errorf("router: rule %d process %q: %w", i, e, err)
+			}
+		}
+		if len(rule.Hosts) == 0 && rule.File == "" && (len(pr.ports) > 0 || pr.network != "" || pr.procs != nil) {
+			out = append(out, pr)
+			continue
+		}
+		set := newHostSet()
+		for _, e := range rule.Hosts {
+			if e = strings.TrimSpace(e); e == "" {
+				continue
+			}
+			if err := set.add(e, 0); err != nil {
+				return nil, fmt.Errorf("router: rule %d entry %q: %w", i, e, err)
+			}
+		}
+		if rule.File != "" {
+			lines, err := util.ReadFileLines(rule.File)
+			if err != nil {
+				return nil, fmt.Errorf("router: rule %d: %w", i, err)
+			}
+			for n, e := range lines {
+				if e = strings.TrimSpace(e); e == "" {
+					continue
+				}
+				if err := set.add(e, n+1); err != nil {
+					return nil, fmt.Errorf("router: rule %d entry %q: %w", i, e, err)
+				}
+			}
+		}
+		pr.hosts = set
+		out = append(out, pr)
+	}
+	return out, nil
+}
+
+// Outbounds returns the server names referenced by the policy rules and
+// the rule sets.
+func (r *Router) Outbounds() []string {
+	r.customMu.RLock()
+	defer r.customMu.RUnlock()
+	return r.cfg.Outbounds()
+}
+
+// Outbounds returns the server names referenced by cfg's policy rules and
+// rule sets.
+func (cfg Config) Outbounds() []string {
+	var names []string
+	for _, rule := range cfg.Rules {
+		if rule.Outbound != OutboundDirect && rule.Outbound != OutboundBlock {
+			names = append(names, rule.Outbound)
+		}
+	}
+	for _, rs := range cfg.RuleSets {
+		names = append(names, rs.Outbounds()...)
+	}
+	return names
+}
+
+// Match returns the routing decision for host when its port and network
+// are unknown.
+func (r *Router) Match(host string) Decision {
+	return r.MatchConn("", host, 0)
+}
+
+// MatchPort returns the routing decision for host and port when the
+// network is unknown.
+func (r *Router) MatchPort(host string, port int) Decision {
+	return r.MatchConn("", host, port)
+}
+
+// MatchConn returns the routing decision for a connection over network
+// (a Network constant) to host and port, whose process is unknown.
+func (r *Router) MatchConn(network, host string, port int) Decision {
+	return r.Route(Conn{Network: network, Host: host, Port: port})
+}
+
+// Route returns the routing decision for c. Policy rules, then rule sets,
+// are checked in order after the LAN and global direct checks; hosts
+// nothing matches fall back to the proxy rule handling. Port, network and
+// process conditions never match an unknown port (0), network ("") or
+// process (nil).
+func (r *Router) Route(c Conn) Decision {
+	return r.route(c, nil)
+}
+
+// SniffMatters reports whether the domain of c, a connection to an IP
+// address, can change how it is routed: it cannot if the IP is on the
+// custom block list or the LAN, or if every connection goes direct.
+func (r *Router) SniffMatters(c Conn) bool {
+	tr := r.Explain(c)
+	switch tr.Source {
+	case SourceCustomBlock, SourceLAN:
+		return false
+	case SourceProxyRule:
+		return tr.Name != ProxyRuleDirect.String()
+	}
+	return true
+}
+
+// RouteSniffed returns the routing decision for c, a connection to the IP
+// addr whose domain, c.Host, was sniffed from its first bytes. The domain
+// decides unless only the proxy rule's fallback places it; the IP decides
+// then if anything but the fallback places it, so a domain the geo data
+// misses still follows GeoIP and the IP lists.
+func (r *Router) RouteSniffed(c Conn, addr string) Decision {
+	tr := r.Explain(c)
+	if tr.Source != SourceProxyRule && (tr.Source != SourceRace || tr.Name != "") {
+		return tr.Decision
+	}
+	c.Host = addr
+	if ipTr := r.Explain(c); ipTr.Source != SourceProxyRule {
+		return ipTr.Decision
+	}
+	return tr.Decision
+}
+
+// route implements Route, recording the deciding check in tr unless it is
+// nil.
+func (r *Router) route(c Conn, tr *Trace) Decision {
+	host := c.Host
+	if r.matchCustomBlock(host, tr) {
+		return Decision{Rule: HostRuleBlock}
+	}
+	rule := ProxyRule(r.proxyRule.Load())
+	if rule == ProxyRuleDirect {
+		tr.record(SourceProxyRule, rule.String())
+		return Decision{Rule: HostRuleDirect}
+	}
+	if r.isLANHost(host) {
+		tr.record(SourceLAN, "")
+		return Decision{Rule: HostRuleDirect}
+	}
+	r.customMu.RLock()
+	rules, ruleSets := r.rules, r.ruleSets
+	r.customMu.RUnlock()
+	geo := r.geo.Load()
+	for i := range rules {
+		pr := &rules[i]
+		procKey, ok := pr.matchConn(c)
+		if !ok {
+			continue
+		}
+		key := ""
+		if pr.hosts != nil {
+			if key, ok = pr.hosts.matchEntry(host, geo); !ok {
+				continue
+			}
+		}
+		log.Info("[ROUTER] policy rule matched", "host", host, "network", c.Network, "port", c.Port, "outbound", pr.outbound)
+		tr.record(SourcePolicyRule, strconv.Itoa(i))
+		if pr.hosts != nil {
+			tr.recordEntry(key, pr.file, pr.hosts.sources)
+		} else {
+			tr.setEntry(procKey)
+		}
+		switch pr.outbound {
+		case OutboundDirect:
+			return Decision{Rule: HostRuleDirect}
+		case OutboundBlock:
+			return Decision{Rule: HostRuleBlock}
+		}
+		return Decision{Rule: HostRuleProxy, Outbound: pr.outbound}
+	}
+	for _, rs := range ruleSets {
+		if d, ok := rs.match(geo, c, tr); ok {
+			return d
+		}
+	}
+	return Decision{Rule: r.matchProxyRule(host, rule, tr)}
+}
@@ -0,0 +1,311 @@
+package router
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMatchPolicyRules(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "jp.txt")
+	if err := os.WriteFile(file, []byte("abema.tv\n\n203.0.113.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(Config{
+		ProxyRule: ProxyRuleAuto,
+		Rules: []Rule{
+			{Outbound: "jp", Hosts: []string{"*.dmm.com"}, File: file},
+			{Outbound: OutboundBlock, Hosts: []string{"ads.example.com"}},
+			{Outbound: OutboundDirect, Hosts: []string{"example.com"}},
+			{Outbound: "us", Hosts: []string{"example.com", "regexp:^api\\.example\\.org$"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want Decision
+	}{
+		{"abema.tv", Decision{Rule: HostRuleProxy, Outbound: "jp"}},
+		{"www.abema.tv", Decision{Rule: HostRuleProxy, Outbound: "jp"}},
+		{"video.dmm.com", Decision{Rule: HostRuleProxy, Outbound: "jp"}},
+		{"203.0.113.9", Decision{Rule: HostRuleProxy, Outbound: "jp"}},
+		{"ads.example.com", Decision{Rule: HostRuleBlock}},
+		// First match wins: the direct rule shadows the later "us" entry.
+		{"www.example.com", Decision{Rule: HostRuleDirect}},
+		{"api.example.org", Decision{Rule: HostRuleProxy, Outbound: "us"}},
+		// LAN hosts never reach the policy rules.
+		{"192.168.1.1", Decision{Rule: HostRuleDirect}},
+		// Unmatched hosts fall back to the proxy rule.
+		{"google.com", Decision{Rule: HostRuleProxy}},
+		{"baidu.cn", Decision{Rule: HostRuleDirect}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := r.Match(tt.host); got != tt.want {
+				t.Errorf("Match(%q) = %+v, want %+v", tt.host, got, tt.want)
+			}
+			if got := r.MatchHostRule(tt.host); got != tt.want.Rule {
+				t.Errorf("MatchHostRule(%q) = %d, want %d", tt.host, got, tt.want.Rule)
+			}
+		})
+	}
+
+	if got := r.Outbounds(); !slices.Equal(got, []string{"jp", "us"}) {
+		t.Errorf("Outbounds = %v", got)
+	}
+
+	r.SetProxyRule(ProxyRuleDirect)
+	if got := r.Match("abema.tv"); got != (Decision{Rule: HostRuleDirect}) {
+		t.Errorf("global direct should override policy rules, got %+v", got)
+	}
+}
+
+func TestCompileRulesErrors(t *testing.T) {
+	if _, err := New(Config{Rules: []Rule{{Hosts: []string{"example.com"}}}}); err == nil {
+		t.Error("expected error for rule without outbound")
+	}
+	if _, err := New(Config{Rules: []Rule{{Outbound: "jp", Hosts: []string{"regexp:("}}}}); err == nil {
+		t.Error("expected error for invalid regexp")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	direct := filepath.Join(dir, "direct.txt")
+	if err := os.WriteFile(direct, []byte("old.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(Config{
+		ProxyRule:  ProxyRuleProxy,
+		DirectFile: direct,
+		Rules:      []Rule{{Outbound: "jp", Hosts: []string{"abema.tv"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(direct, []byte("new.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(d time.Duration) { geoCloseDelay = d }(geoCloseDelay)
+	geoCloseDelay = 0
+	old := r.geo.Load()
+	if err := r.Reload(Config{
+		ProxyRule:  ProxyRuleAuto,
+		DirectFile: direct,
+		Rules:      []Rule{{Outbound: "us", Hosts: []string{"netflix.com"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if r.ProxyRule() != ProxyRuleAuto {
+		t.Errorf("ProxyRule = %d after reload", r.ProxyRule())
+	}
+	// The replaced GeoIP database is closed after the grace period.
+	deadline := time.Now().Add(time.Second)
+	for !old.closed.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("replaced GeoIP database not closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := old.db.Country(net.ParseIP("1.2.3.4")); err == nil {
+		t.Error("lookup on the closed GeoIP database succeeded")
+	}
+	if !r.IsCustomDirectDomain("new.example.com") || r.IsCustomDirectDomain("old.example.com") {
+		t.Error("direct file not reloaded")
+	}
+	if got := r.Match("abema.tv"); got.Outbound != "" {
+		t.Errorf("removed rule still matches: %+v", got)
+	}
+	if got := r.Outbounds(); !slices.Equal(got, []string{"us"}) {
+		t.Errorf("Outbounds = %v", got)
+	}
+
+	// A failed reload leaves the router as it was.
+	if err := r.Reload(Config{ProxyRule: ProxyRuleDirect, Rules: []Rule{{Hosts: []string{"example.com"}}}}); err == nil {
+		t.Fatal("expected error for rule without outbound")
+	}
+	if r.ProxyRule() != ProxyRuleAuto || !r.IsCustomDirectDomain("new.example.com") {
+		t.Error("failed reload changed the router")
+	}
+}
+
+func TestMatchConnPortsAndNetwork(t *testing.T) {
+	rs, err := ParseRuleSet("net", []byte("NETWORK,icmp,DIRECT\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(Config{
+		ProxyRule: ProxyRuleProxy,
+		Rules: []Rule{
+			{Outbound: OutboundDirect, Ports: []string{"22"}},
+			{Outbound: OutboundBlock, Network: "UDP", Ports: []string{"443"}},
+			{Outbound: "jp", Hosts: []string{"203.0.113.0/24"}, Ports: []string{"443", "8000-8999"}},
+		},
+		RuleSets: []*RuleSet{rs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		network string
+		host    string
+		port    int
+		want    Decision
+	}{
+		{NetworkTCP, "github.com", 22, Decision{Rule: HostRuleDirect}},
+		{NetworkUDP, "www.youtube.com", 443, Decision{Rule: HostRuleBlock}},
+		{NetworkTCP, "www.youtube.com", 443, Decision{Rule: HostRuleProxy}},
+		{NetworkTCP, "203.0.113.5", 443, Decision{Rule: HostRuleProxy, Outbound: "jp"}},
+		{NetworkTCP, "203.0.113.5", 8080, Decision{Rule: HostRuleProxy, Outbound: "jp"}},
+		{NetworkTCP, "203.0.113.5", 80, Decision{Rule: HostRuleProxy}},
+		{NetworkICMP, "8.8.8.8", 0, Decision{Rule: HostRuleDirect}},
+		// Unknown ports and networks never match port or network conditions.
+		{"", "www.youtube.com", 443, Decision{Rule: HostRuleProxy}},
+		{"", "github.com", 0, Decision{Rule: HostRuleProxy}},
+	}
+	for _, tt := range tests {
+		if got := r.MatchConn(tt.network, tt.host, tt.port); got != tt.want {
+			t.Errorf("MatchConn(%q, %q, %d) = %+v, want %+v", tt.network, tt.host, tt.port, got, tt.want)
+		}
+	}
+
+	for _, rule := range []Rule{
+		{Outbound: "jp", Ports: []string{"0"}},
+		{Outbound: "jp", Ports: []string{"9-1"}},
+		{Outbound: "jp", Network: "sctp"},
+	} {
+		if _, err := New(Config{Rules: []Rule{rule}}); err == nil {
+			t.Errorf("expected error for %+v", rule)
+		}
+	}
+}
+
+func TestRouteProcesses(t *testing.T) {
+	rs, err := ParseRuleSet("proc", []byte("PROCESS-NAME,wget,REJECT\nPROCESS-PATH,/opt/tools/fetch,jp\nUID,1001,DIRECT\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(Config{
+		ProxyRule: ProxyRuleAuto,
+		Rules: []Rule{
+			{Outbound: OutboundDirect, Processes: []string{"git", "ssh"}},
+			{Outbound: "hk", Processes: []string{"curl"}, Hosts: []string{"baidu.com"}},
+			{Outbound: "us", Processes: []string{"/usr/bin/curl", "uid:1002"}},
+		},
+		RuleSets: []*RuleSet{rs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.HasProcessRules() {
+		t.Error("HasProcessRules() = false")
+	}
+
+	git := &Process{PID: 10, Name: "git", Path: "/usr/bin/git", UID: 1000}
+	curl := &Process{PID: 11, Name: "curl", Path: "/usr/bin/curl", UID: 1000}
+	// comm is truncated to 15 bytes; the executable's name still matches.
+	long := &Process{PID: 12, Name: "wget-with-a-lon", Path: "/usr/local/bin/wget", UID: 1000}
+	fetch := &Process{PID: 13, Name: "fetch", Path: "/opt/tools/fetch", UID: 1000}
+	other := &Process{PID: 14, Name: "python3", UID: 1001}
+	byUID := &Process{PID: 15, Name: "node", UID: 1002}
+	tests := []struct {
+		host string
+		proc *Process
+		want Decision
+	}{
+		{"github.com", git, Decision{Rule: HostRuleDirect}},
+		{"www.baidu.com", curl, Decision{Rule: HostRuleProxy, Outbound: "hk"}},
+		{"www.google.com", curl, Decision{Rule: HostRuleProxy, Outbound: "us"}},
+		{"www.google.com", long, Decision{Rule: HostRuleBlock}},
+		{"www.google.com", fetch, Decision{Rule: HostRuleProxy, Outbound: "jp"}},
+		{"www.google.com", other, Decision{Rule: HostRuleDirect}},
+		{"www.google.com", byUID, Decision{Rule: HostRuleProxy, Outbound: "us"}},
+		// An unknown process never matches process conditions.
+		{"github.com", nil, Decision{Rule: HostRuleProxy}},
+		{"www.baidu.com", nil, Decision{Rule: HostRuleDirect}},
+	}
+	for _, tt := range tests {
+		if got := r.Route(Conn{Network: NetworkTCP, Host: tt.host, Port: 443, Process: tt.proc}); got != tt.want {
+			t.Errorf("Route(%q, %+v) = %+v, want %+v", tt.host, tt.proc, got, tt.want)
+		}
+	}
+	if tr := r.Explain(Conn{Host: "github.com", Process: git}); tr.Source != SourcePolicyRule || tr.Entry != "git" {
+		t.Errorf("Explain for git = %+v", tr)
+	}
+
+	if _, err := New(Config{Rules: []Rule{{Outbound: "jp", Processes: []string{"uid:x"}}}}); err == nil {
+		t.Error("expected error for an invalid uid")
+	}
+	if err := r.Reload(Config{ProxyRule: ProxyRuleAuto}); err != nil {
+		t.Fatal(err)
+	}
+	if r.HasProcessRules() {
+		t.Error("HasProcessRules() = true after reloading without process rules")
+	}
+}
+
+func TestSniffMatters(t *testing.T) {
+	blockFile := filepath.Join(t.TempDir(), "block.txt")
+	if err := os.WriteFile(blockFile, []byte("203.0.113.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(Config{ProxyRule: ProxyRuleAuto, BlockFile: blockFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"8.8.8.8":       true,
+		"203.0.113.5":   false,
+		"192.168.1.10":  false,
+		"114.114.114.1": true,
+	} {
+		if got := r.SniffMatters(Conn{Network: NetworkTCP, Host: addr, Port: 443}); got != want {
+			t.Errorf("SniffMatters(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	r.SetProxyRule(ProxyRuleDirect)
+	if r.SniffMatters(Conn{Network: NetworkTCP, Host: "8.8.8.8", Port: 443}) {
+		t.Error("sniffing matters with proxy_rule direct")
+	}
+}
+
+func TestRouteSniffed(t *testing.T) {
+	r, err := New(Config{
+		ProxyRule: ProxyRuleAuto,
+		Rules:     []Rule{{Outbound: "jp", Hosts: []string{"abema.tv"}}},
+		Race:      RaceConfig{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		domain, addr string
+		want         Decision
+	}{
+		// The domain decides when a rule or the geo data places it.
+		{"abema.tv", "114.114.114.114", Decision{Rule: HostRuleProxy, Outbound: "jp"}},
+		{"www.baidu.com", "8.8.8.8", Decision{Rule: HostRuleDirect}},
+		// An unplaced domain follows the GeoIP of its address.
+		{"unknown.example", "114.114.114.114", Decision{Rule: HostRuleDirect}},
+		// Unplaced both ways, the domain is raced.
+		{"unknown.example", "8.8.8.8", Decision{Rule: HostRuleRace}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain+"@"+tt.addr, func(t *testing.T) {
+			c := Conn{Network: NetworkTCP, Host: tt.domain, Port: 443}
+			if got := r.RouteSniffed(c, tt.addr); got != tt.want {
+				t.Errorf("RouteSniffed = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
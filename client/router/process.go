@@ -0,0 +1,108 @@
+package router
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Process is the local program that opened a connection.
+type Process struct {
+	PID int `json:"pid"`
+	// Name is the program name the system reports, which Linux truncates
+	// to 15 bytes; Path is the full path of its executable, if known.
+	Name string `json:"name"`
+	Path string `json:"path,omitempty"`
+	// UID is the user the process runs as, or -1 if unknown.
+	UID int `json:"uid"`
+}
+
+// Conn is a connection to route. Network, Port and Process may be unknown
+// ("", 0 and nil); conditions on them then never match.
+type Conn struct {
+	Network string
+	Host    string
+	Port    int
+	Process *Process
+}
+
+// processSet matches processes by program name, executable path or user
+// id, written "curl", "/usr/bin/curl" and "uid:1000".
+type processSet struct {
+	names map[string]struct{}
+	paths map[string]struct{}
+	uids  map[int]struct{}
+}
+
+func newProcessSet() *processSet {
+	return &processSet{
+		names: make(map[string]struct{}),
+		paths: make(map[string]struct{}),
+		uids:  make(map[int]struct{}),
+	}
+}
+
+// add classifies entry: "uid:N" is a user id, an entry containing a path
+// separator an executable path and anything else a program name.
+func (s *processSet) add(entry string) error {
+	if uid, ok := strings.CutPrefix(entry, "uid:"); ok {
+		n, err := strconv.Atoi(uid)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid uid %q", uid)
+		}
+		s.uids[n] = struct{}{}
+		return nil
+	}
+	if strings.ContainsAny(entry, `/\`) {
+		s.paths[filepath.Clean(entry)] = struct{}{}
+		return nil
+	}
+	s.names[entry] = struct{}{}
+	return nil
+}
+
+// matchEntry returns the entry matching p, as add read it. A nil p, an
+// unknown process, never matches.
+func (s *processSet) matchEntry(p *Process) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	if p.Path != "" {
+		if _, ok := s.paths[p.Path]; ok {
+			return p.Path, true
+		}
+		// The executable's base name is not truncated like Name.
+		if base := filepath.Base(p.Path); base != p.Name {
+			if _, ok := s.names[base]; ok {
+				return base, true
+			}
+		}
+	}
+	if _, ok := s.names[p.Name]; ok {
+		return p.Name, true
+	}
+	if _, ok := s.uids[p.UID]; ok {
+		return "uid:" + strconv.Itoa(p.UID), true
+	}
+	return "", false
+}
+
+// HasProcessRules reports whether a policy rule or rule set matches on the
+// process of a connection, so callers can skip finding it otherwise.
+func (r *Router) HasProcessRules() bool {
+	return r.processRules.Load()
+}
+
+// updateProcessRules recomputes HasProcessRules; the caller holds customMu
+// or owns r exclusively.
+func (r *Router) updateProcessRules() {
+	uses := false
+	for _, pr := range r.rules {
+		uses = uses || pr.procs != nil
+	}
+	for _, rs := range r.ruleSets {
+		uses = uses || rs.usesProcess()
+	}
+	r.processRules.Store(uses)
+}
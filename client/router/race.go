@@ -0,0 +1,125 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/util"
+)
+
+// Race defaults.
+const (
+	DefaultRaceHeadStart = 200 * time.Millisecond
+	DefaultRaceTTL       = time.Hour
+	// raceSweepSize is the number of cached winners past which expired
+	// ones are swept when a new winner is recorded.
+	raceSweepSize = 1024
+)
+
+// RaceConfig enables racing: the domains the auto rules cannot place, and
+// would send through the proxy for lack of data, are connected both
+// directly and through the proxy, and the faster path is kept for TTL.
+type RaceConfig struct {
+	Enabled bool
+	// HeadStart is how long the direct path runs alone before the proxied
+	// one starts, DefaultRaceHeadStart if 0.
+	HeadStart time.Duration
+	// TTL is how long the winner of a race routes its domain,
+	// DefaultRaceTTL if 0.
+	TTL time.Duration
+}
+
+// raceWinner is the path that won the race of a domain.
+type raceWinner struct {
+	direct  bool
+	expires time.Time
+}
+
+// raceSet caches the winners of the races by domain.
+type raceSet struct {
+	mu      sync.Mutex
+	cfg     RaceConfig
+	winners map[string]raceWinner
+}
+
+// setRaceConfig applies cfg, keeping the cached winners while racing
+// stays enabled.
+func (r *Router) setRaceConfig(cfg RaceConfig) {
+	r.race.mu.Lock()
+	defer r.race.mu.Unlock()
+	r.race.cfg = cfg
+	if !cfg.Enabled || r.race.winners == nil {
+		r.race.winners = make(map[string]raceWinner)
+	}
+}
+
+// RaceHeadStart returns the head start of the direct path in a race.
+func (r *Router) RaceHeadStart() time.Duration {
+	r.race.mu.Lock()
+	defer r.race.mu.Unlock()
+	if r.race.cfg.HeadStart <= 0 {
+		return DefaultRaceHeadStart
+	}
+	return r.race.cfg.HeadStart
+}
+
+// matchRace decides a host the auto rules send through the proxy for lack
+// of data: it is raced if racing is enabled and host is a domain, unless a
+// recent race already picked its path. The decision is recorded in tr
+// unless it is nil; ok is false if host is not raced.
+func (r *Router) matchRace(host string, tr *Trace) (rule HostRule, ok bool) {
+	if util.IsIP(host) {
+		return 0, false
+	}
+	r.race.mu.Lock()
+	enabled := r.race.cfg.Enabled
+	w, cached := r.race.winners[host]
+	if cached && time.Now().After(w.expires) {
+		delete(r.race.winners, host)
+		cached = false
+	}
+	r.race.mu.Unlock()
+	switch {
+	case !enabled:
+		return 0, false
+	case !cached:
+		tr.record(SourceRace, "")
+		return HostRuleRace, true
+	case w.direct:
+		tr.record(SourceRace, HostRuleDirect.String())
+		return HostRuleDirect, true
+	}
+	tr.record(SourceRace, HostRuleProxy.String())
+	return HostRuleProxy, true
+}
+
+// RecordRaceWinner records the path that won the race of host, which
+// routes it until the race TTL passes.
+func (r *Router) RecordRaceWinner(host string, direct bool) {
+	now := time.Now()
+	r.race.mu.Lock()
+	if !r.race.cfg.Enabled {
+		r.race.mu.Unlock()
+		return
+	}
+	ttl := r.race.cfg.TTL
+	if ttl <= 0 {
+		ttl = DefaultRaceTTL
+	}
+	if len(r.race.winners) >= raceSweepSize {
+		for domain, w := range r.race.winners {
+			if now.After(w.expires) {
+				delete(r.race.winners, domain)
+			}
+		}
+	}
+	r.race.winners[host] = raceWinner{direct: direct, expires: now.Add(ttl)}
+	r.race.mu.Unlock()
+
+	winner := HostRuleProxy
+	if direct {
+		winner = HostRuleDirect
+	}
+	log.Info("[ROUTER] race winner", "host", host, "winner", winner, "ttl", ttl)
+}
@@ -0,0 +1,44 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRace(t *testing.T) {
+	r, err := New(Config{ProxyRule: ProxyRuleAuto, Race: RaceConfig{Enabled: true, TTL: time.Hour}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr := r.Explain(Conn{Host: "unknown.example"}); tr.Rule != HostRuleRace || tr.Source != SourceRace || tr.Name != "" {
+		t.Errorf("trace of an unplaced domain = %+v", tr)
+	}
+	for _, host := range []string{"8.8.8.8", "www.baidu.com", "localhost"} {
+		if r.MatchHostRule(host) == HostRuleRace {
+			t.Errorf("%s raced", host)
+		}
+	}
+
+	r.RecordRaceWinner("unknown.example", true)
+	if tr := r.Explain(Conn{Host: "unknown.example"}); tr.Rule != HostRuleDirect || tr.Source != SourceRace || tr.Name != "direct" {
+		t.Errorf("trace after a direct win = %+v", tr)
+	}
+	r.RecordRaceWinner("other.example", false)
+	if r.MatchHostRule("other.example") != HostRuleProxy {
+		t.Error("proxy winner not applied")
+	}
+
+	r.race.mu.Lock()
+	r.race.winners["unknown.example"] = raceWinner{direct: true, expires: time.Now().Add(-time.Second)}
+	r.race.mu.Unlock()
+	if r.MatchHostRule("unknown.example") != HostRuleRace {
+		t.Error("expired winner still applied")
+	}
+
+	if err := r.Reload(Config{ProxyRule: ProxyRuleAuto}); err != nil {
+		t.Fatal(err)
+	}
+	if r.MatchHostRule("other.example") != HostRuleProxy || r.MatchHostRule("unknown.example") != HostRuleProxy {
+		t.Error("raced with racing disabled")
+	}
+}
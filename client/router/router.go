@@ -7,11 +7,10 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/nange/easyss/v3/assets"
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/util"
-	"github.com/oschwald/geoip2-golang"
 )
 
 type HostRule int
@@ -20,6 +19,10 @@ const (
 	HostRuleProxy HostRule = iota
 	HostRuleDirect
 	HostRuleBlock
+	// HostRuleRace connects both directly and through the proxy and keeps
+	// the faster path; see RaceConfig. Callers that cannot race use the
+	// proxy.
+	HostRuleRace
 )
 
 type ProxyRule int
@@ -69,15 +72,16 @@ func ParseIPV6Rule(s string) IPV6Rule {
 }
 
 type GeoSite struct {
-	domain       map[string]struct{}
+	domain       *domainTrie
 	fullDomain   map[string]struct{}
-	regexpDomain []*regexp.Regexp
+	regexpDomain *regexSet
 }
 
 func NewGeoSite(data []byte) *GeoSite {
 	gs := &GeoSite{
-		domain:     make(map[string]struct{}),
-		fullDomain: make(map[string]struct{}),
+		domain:       newDomainTrie(),
+		fullDomain:   make(map[string]struct{}),
+		regexpDomain: newRegexSet(),
 	}
 
 	lines := bytes.Split(data, []byte("\n"))
@@ -95,43 +99,40 @@ func NewGeoSite(data []byte) *GeoSite {
 			if err != nil {
 				continue
 			}
-			gs.regexpDomain = append(gs.regexpDomain, re)
+			gs.regexpDomain.add(re)
 			continue
 		}
-		gs.domain[string(line)] = struct{}{}
+		gs.domain.insert(string(line))
 	}
 
 	return gs
 }
 
 func (gs *GeoSite) SimpleMatch(domain string, matchSub bool) bool {
-	if _, ok := gs.fullDomain[domain]; ok {
-		return true
-	}
-	if _, ok := gs.domain[domain]; ok {
-		return true
-	}
-	if matchSub {
-		subs := util.SubDomains(domain)
-		for _, sub := range subs {
-			if _, ok := gs.domain[sub]; ok {
-				return true
-			}
-		}
-	}
-	return false
+	_, ok := gs.matchEntry(domain, matchSub, false)
+	return ok
 }
 
 func (gs *GeoSite) FullMatch(domain string) bool {
-	if gs.SimpleMatch(domain, true) {
-		return true
+	_, ok := gs.matchEntry(domain, true, true)
+	return ok
+}
+
+// matchEntry returns the list line matching domain, checking parent
+// domains if matchSub is set and regexps if matchRegexp is.
+func (gs *GeoSite) matchEntry(domain string, matchSub, matchRegexp bool) (string, bool) {
+	if _, ok := gs.fullDomain[domain]; ok {
+		return "full:" + domain, true
 	}
-	for _, re := range gs.regexpDomain {
-		if re.MatchString(domain) {
-			return true
+	if entry, ok := gs.domain.match(domain, matchSub); ok {
+		return entry, true
+	}
+	if matchRegexp {
+		if re, ok := gs.regexpDomain.match(domain); ok {
+			return "regexp:" + re.String(), true
 		}
 	}
-	return false
+	return "", false
 }
 
 type Config struct {
@@ -139,9 +140,23 @@ type Config struct {
 	IPV6Rule        IPV6Rule
 	DirectFile      string
 	ProxyFile       string
+	BlockFile       string
 	DirectDNSServer string
 	IPV6NetWorking  bool
 	ServerIPV6      string
+	// Country is the ISO code of the country the auto proxy rules treat as
+	// local, DefaultCountry if empty.
+	Country string
+	// GeoIPFile is a MaxMind country mmdb and GeoSiteDir a directory of
+	// <category>.txt domain lists, replacing the embedded data.
+	GeoIPFile  string
+	GeoSiteDir string
+	Rules      []Rule
+	// RuleSets are checked in order after Rules and before the custom
+	// direct/proxy lists.
+	RuleSets []*RuleSet
+	Learn    LearnConfig
+	Race     RaceConfig
 }
 
 type Router struct {
@@ -150,246 +165,315 @@ type Router struct {
 	proxyRule atomic.Int32
 	ipv6Rule  atomic.Int32
 
-	geoIPDB       *geoip2.Reader
-	geoSiteDirect *GeoSite
-	geoSiteBlock  *GeoSite
+	geo atomic.Pointer[geoData]
+	// processRules caches HasProcessRules.
+	processRules atomic.Bool
 
+	// customMu guards the policy rules, the rule sets and the custom lists,
+	// which Reload swaps.
 	customMu            sync.RWMutex
+	rules               []policyRule
+	ruleSets            []*RuleSet
 	customDirectIPs     map[string]struct{}
 	customDirectCIDRIPs []*net.IPNet
-	customDirectDomains map[string]struct{}
-	customDirectRegexps []*regexp.Regexp
+	customDirectDomains *domainTrie
+	customDirectRegexps *regexSet
 	customProxyIPs      map[string]struct{}
 	customProxyCIDRIPs  []*net.IPNet
-	customProxyDomains  map[string]struct{}
-	customProxyRegexps  []*regexp.Regexp
+	customProxyDomains  *domainTrie
+	customProxyRegexps  *regexSet
+	// learnedDirect and learnedProxy map each domain the custom direct and
+	// proxy lists learned from to the addresses and CNAME targets its DNS
+	// answers added, so an edit of a list drops those of the domains it no
+	// longer has.
+	learnedDirect map[string]map[string]struct{}
+	learnedProxy  map[string]map[string]struct{}
+	// customDirectSources and customProxySources locate the custom list
+	// entries in their files for Explain.
+	customDirectSources map[string]entrySource
+	customProxySources  map[string]entrySource
+	// customBlock is the custom block list, checked before anything else.
+	customBlock *hostSet
+	// editMu serializes the edits of the custom list files.
+	editMu sync.Mutex
+
+	learned learnedSet
+	race    raceSet
 }
 
 func New(cfg Config) (*Router, error) {
-	db, err := geoip2.FromBytes(assets.GeoIPCNPrivate)
+	geo, err := loadGeoData(cfg)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := compileRules(cfg.Rules)
 	if err != nil {
+		geo.close()
 		return nil, err
 	}
 
 	r := &Router{
-		cfg:           cfg,
-		geoIPDB:       db,
-		geoSiteDirect: NewGeoSite(assets.GeoSiteDirect),
-		geoSiteBlock:  NewGeoSite(assets.GeoSiteBlock),
+		cfg:      cfg,
+		rules:    rules,
+		ruleSets: cfg.RuleSets,
 	}
+	r.updateProcessRules()
+	r.geo.Store(geo)
+	geo.warnUnknownGeoSites(rules, cfg.RuleSets)
 	r.proxyRule.Store(int32(cfg.ProxyRule))
 	r.ipv6Rule.Store(int32(cfg.IPV6Rule))
 
-	if err := r.loadCustomIPDomains(); err != nil {
+	direct, proxy, block, err := loadCustomLists(cfg.DirectFile, cfg.ProxyFile, cfg.BlockFile)
+	if err != nil {
 		log.Error("[ROUTER] load custom ip/domains", "err", err)
 	}
+	r.setCustomLists(direct, proxy, block)
+	if err := r.setLearnConfig(cfg.Learn); err != nil {
+		log.Error("[ROUTER] load learned domains", "err", err)
+	}
+	r.setRaceConfig(cfg.Race)
 
 	return r, nil
 }
 
-func (r *Router) loadCustomIPDomains() error {
-	r.customDirectIPs = make(map[string]struct{})
-	r.customDirectDomains = make(map[string]struct{})
-	r.customProxyIPs = make(map[string]struct{})
-	r.customProxyDomains = make(map[string]struct{})
+// Reload replaces the proxy rule, the geo data, the custom direct/proxy/block
+// lists, the policy rules and the rule sets with those of cfg. Everything is
+// loaded before anything is swapped, so on error the router is unchanged.
+// The IPv6 settings are kept; entries learned at runtime through the Add
+// methods are dropped with the old lists. Learned proxy domains are kept
+// unless the learned file changes.
+func (r *Router) Reload(cfg Config) error {
+	geo, err := loadGeoData(cfg)
+	if err != nil {
+		return err
+	}
+	rules, err := compileRules(cfg.Rules)
+	if err != nil {
+		geo.close()
+		return err
+	}
+	direct, proxy, block, err := loadCustomLists(cfg.DirectFile, cfg.ProxyFile, cfg.BlockFile)
+	if err != nil {
+		geo.close()
+		return err
+	}
 
-	if r.cfg.DirectFile != "" {
-		entries, err := util.ReadFileLinesMap(r.cfg.DirectFile)
-		if err != nil {
-			return err
-		}
-		for k := range entries {
-			if strings.HasPrefix(k, "regexp:") {
-				re, err := regexp.Compile(k[7:])
-				if err == nil {
-					r.customDirectRegexps = append(r.customDirectRegexps, re)
-				}
-				continue
-			}
-			if strings.Contains(k, "*") {
-				re, err := util.GlobToRegexp(k)
-				if err == nil {
-					r.customDirectRegexps = append(r.customDirectRegexps, re)
-				}
-				continue
-			}
-			_, ipnet, err := net.ParseCIDR(k)
-			if err == nil && ipnet != nil {
-				r.customDirectCIDRIPs = append(r.customDirectCIDRIPs, ipnet)
-				continue
-			}
-			if util.IsIP(k) {
-				r.customDirectIPs[k] = struct{}{}
-				continue
-			}
-			r.customDirectDomains[k] = struct{}{}
-		}
+	r.customMu.Lock()
+	r.cfg.DirectFile = cfg.DirectFile
+	r.cfg.ProxyFile = cfg.ProxyFile
+	r.cfg.BlockFile = cfg.BlockFile
+	r.cfg.Rules = cfg.Rules
+	r.cfg.RuleSets = cfg.RuleSets
+	r.cfg.Country = cfg.Country
+	r.cfg.GeoIPFile = cfg.GeoIPFile
+	r.cfg.GeoSiteDir = cfg.GeoSiteDir
+	r.rules = rules
+	r.ruleSets = cfg.RuleSets
+	r.updateProcessRules()
+	r.setCustomLists(direct, proxy, block)
+	r.customMu.Unlock()
+	if old := r.geo.Swap(geo); old != nil {
+		time.AfterFunc(geoCloseDelay, old.close)
+	}
+	geo.warnUnknownGeoSites(rules, cfg.RuleSets)
+	r.proxyRule.Store(int32(cfg.ProxyRule))
+	// The learned domains are a cache: failing to read them is no reason
+	// to reject the configuration.
+	if err := r.setLearnConfig(cfg.Learn); err != nil {
+		log.Error("[ROUTER] load learned domains", "err", err)
 	}
+	r.setRaceConfig(cfg.Race)
 
-	if r.cfg.ProxyFile != "" {
-		entries, err := util.ReadFileLinesMap(r.cfg.ProxyFile)
-		if err != nil {
-			return err
+	log.Info("[ROUTER] reloaded", "policy_rules", len(rules), "rule_sets", len(cfg.RuleSets), "direct_file", cfg.DirectFile, "proxy_file", cfg.ProxyFile, "block_file", cfg.BlockFile)
+	return nil
+}
+
+// loadCustomLists reads the custom direct, proxy and block files. Invalid
+// regexp/glob entries and comments are skipped. On error the lists read so
+// far are returned along with it.
+func loadCustomLists(directFile, proxyFile, blockFile string) (direct, proxy, block *hostSet, err error) {
+	direct, proxy, block = newHostSet(), newHostSet(), newHostSet()
+	for _, l := range []struct {
+		file string
+		set  **hostSet
+	}{{directFile, &direct}, {proxyFile, &proxy}, {blockFile, &block}} {
+		if l.file == "" {
+			continue
 		}
-		for k := range entries {
-			if strings.HasPrefix(k, "regexp:") {
-				re, err := regexp.Compile(k[7:])
-				if err == nil {
-					r.customProxyRegexps = append(r.customProxyRegexps, re)
-				}
-				continue
-			}
-			if strings.Contains(k, "*") {
-				re, err := util.GlobToRegexp(k)
-				if err == nil {
-					r.customProxyRegexps = append(r.customProxyRegexps, re)
-				}
-				continue
-			}
-			_, ipnet, err := net.ParseCIDR(k)
-			if err == nil && ipnet != nil {
-				r.customProxyCIDRIPs = append(r.customProxyCIDRIPs, ipnet)
-				continue
-			}
-			if util.IsIP(k) {
-				r.customProxyIPs[k] = struct{}{}
-				continue
-			}
-			r.customProxyDomains[k] = struct{}{}
+		lines, err := util.ReadFileLines(l.file)
+		if err != nil {
+			return direct, proxy, block, err
 		}
+		*l.set = parseCustomList(lines)
 	}
+	return direct, proxy, block, nil
+}
 
-	return nil
+// setCustomLists installs the custom lists; the caller holds customMu or
+// owns r exclusively.
+func (r *Router) setCustomLists(direct, proxy, block *hostSet) {
+	r.customDirectIPs = direct.ips
+	r.customDirectCIDRIPs = direct.cidrs
+	r.customDirectDomains = direct.domains
+	r.customDirectRegexps = direct.regexps
+	r.customProxyIPs = proxy.ips
+	r.customProxyCIDRIPs = proxy.cidrs
+	r.customProxyDomains = proxy.domains
+	r.customProxyRegexps = proxy.regexps
+	r.customDirectSources = direct.sources
+	r.customProxySources = proxy.sources
+	r.customBlock = block
+	r.learnedDirect, r.learnedProxy = nil, nil
 }
 
+// MatchHostRule is Match without the outbound a policy rule may name.
 func (r *Router) MatchHostRule(host string) HostRule {
-	rule := ProxyRule(r.proxyRule.Load())
-	if rule == ProxyRuleDirect || r.isLANHost(host) {
-		return HostRuleDirect
-	}
+	return r.Match(host).Rule
+}
+
+// matchProxyRule applies the proxy rule and the custom and geo lists to a
+// host that is neither LAN nor matched by a policy rule or rule set,
+// recording the deciding check in tr unless it is nil.
+func (r *Router) matchProxyRule(host string, rule ProxyRule, tr *Trace) HostRule {
 	if rule == ProxyRuleProxy {
+		tr.record(SourceProxyRule, rule.String())
 		return HostRuleProxy
 	}
-	if r.hostMatchCustomDirect(host) {
+	if r.matchCustom(host, true, tr) {
 		return HostRuleDirect
 	}
-	if r.hostMatchCustomProxy(host) {
+	if r.matchCustom(host, false, tr) {
+		return HostRuleProxy
+	}
+	if r.matchLearned(host, tr) {
 		return HostRuleProxy
 	}
+	geo := r.geo.Load()
 	if rule == ProxyRuleAutoBlock && !util.IsIP(host) {
-		if r.geoSiteDirect.SimpleMatch(host, false) {
-			return HostRuleDirect
+		if gs := geo.site(GeoSiteDirect); gs != nil {
+			if entry, ok := gs.matchEntry(host, false, false); ok {
+				tr.record(SourceGeoSite, GeoSiteDirect)
+				tr.setEntry(entry)
+				return HostRuleDirect
+			}
 		}
-		if r.geoSiteBlock.SimpleMatch(host, true) {
-			return HostRuleBlock
+		if gs := geo.site(GeoSiteBlock); gs != nil {
+			if entry, ok := gs.matchEntry(host, true, false); ok {
+				tr.record(SourceGeoSite, GeoSiteBlock)
+				tr.setEntry(entry)
+				return HostRuleBlock
+			}
 		}
 	}
-	if rule == ProxyRuleReverseAuto && !r.hostAtCN(host) {
+	atHome := geo.traceHome(host, tr)
+	if rule == ProxyRuleReverseAuto && !atHome {
+		tr.record(SourceProxyRule, rule.String())
 		return HostRuleDirect
 	}
-	if rule != ProxyRuleReverseAuto && r.hostAtCN(host) {
+	if rule != ProxyRuleReverseAuto && atHome {
 		return HostRuleDirect
 	}
+	if rule != ProxyRuleReverseAuto {
+		if decided, ok := r.matchRace(host, tr); ok {
+			return decided
+		}
+		tr.record(SourceProxyRule, rule.String())
+	}
 	return HostRuleProxy
 }
 
 func (r *Router) hostMatchCustomDirect(host string) bool {
+	return r.matchCustom(host, true, nil)
+}
+
+func (r *Router) hostMatchCustomProxy(host string) bool {
+	return r.matchCustom(host, false, nil)
+}
+
+// matchCustom reports whether host is in the custom direct list, or the
+// custom proxy list if direct is false, recording the match in tr unless it
+// is nil.
+func (r *Router) matchCustom(host string, direct bool, tr *Trace) bool {
 	r.customMu.RLock()
 	defer r.customMu.RUnlock()
 
-	if util.IsIP(host) {
-		if _, ok := r.customDirectIPs[host]; ok {
-			log.Info("[ROUTER] custom direct ip matched", "host", host)
-			return true
-		}
-		for _, cidr := range r.customDirectCIDRIPs {
-			if cidr.Contains(net.ParseIP(host)) {
-				log.Info("[ROUTER] custom direct cidr matched", "host", host, "cidr", cidr.String())
-				return true
-			}
-		}
-	} else {
-		if _, ok := r.customDirectDomains[host]; ok {
-			log.Info("[ROUTER] custom direct domain matched", "host", host)
-			return true
-		}
-		subs := util.SubDomains(host)
-		for _, sub := range subs {
-			if _, ok := r.customDirectDomains[sub]; ok {
-				log.Info("[ROUTER] custom direct subdomain matched", "host", host, "subdomain", sub)
-				return true
-			}
-		}
-		for _, re := range r.customDirectRegexps {
-			if re.MatchString(host) {
-				log.Info("[ROUTER] custom direct regexp matched", "host", host, "pattern", re.String())
-				return true
-			}
-		}
+	kind, source, file := "proxy", SourceCustomProxy, r.cfg.ProxyFile
+	set := hostSet{ips: r.customProxyIPs, cidrs: r.customProxyCIDRIPs, domains: r.customProxyDomains, regexps: r.customProxyRegexps, sources: r.customProxySources}
+	if direct {
+		kind, source, file = "direct", SourceCustomDirect, r.cfg.DirectFile
+		set = hostSet{ips: r.customDirectIPs, cidrs: r.customDirectCIDRIPs, domains: r.customDirectDomains, regexps: r.customDirectRegexps, sources: r.customDirectSources}
+	}
+	key, ok := set.matchEntry(host, nil)
+	if !ok {
+		return false
 	}
-	return false
+	log.Info("[ROUTER] custom "+kind+" matched", "host", host, "entry", key)
+	tr.record(source, "")
+	tr.recordEntry(key, file, set.sources)
+	return true
 }
 
-func (r *Router) hostMatchCustomProxy(host string) bool {
+// matchCustomBlock reports whether host is in the custom block list,
+// recording the match in tr unless it is nil.
+func (r *Router) matchCustomBlock(host string, tr *Trace) bool {
 	r.customMu.RLock()
-	defer r.customMu.RUnlock()
-
-	if util.IsIP(host) {
-		if _, ok := r.customProxyIPs[host]; ok {
-			log.Info("[ROUTER] custom proxy ip matched", "host", host)
-			return true
-		}
-		for _, cidr := range r.customProxyCIDRIPs {
-			if cidr.Contains(net.ParseIP(host)) {
-				log.Info("[ROUTER] custom proxy cidr matched", "host", host, "cidr", cidr.String())
-				return true
-			}
-		}
-	} else {
-		if _, ok := r.customProxyDomains[host]; ok {
-			log.Info("[ROUTER] custom proxy domain matched", "host", host)
-			return true
-		}
-		subs := util.SubDomains(host)
-		for _, sub := range subs {
-			if _, ok := r.customProxyDomains[sub]; ok {
-				log.Info("[ROUTER] custom proxy subdomain matched", "host", host, "subdomain", sub)
-				return true
-			}
-		}
-		for _, re := range r.customProxyRegexps {
-			if re.MatchString(host) {
-				log.Info("[ROUTER] custom proxy regexp matched", "host", host, "pattern", re.String())
-				return true
-			}
-		}
+	set, file := r.customBlock, r.cfg.BlockFile
+	r.customMu.RUnlock()
+	if set == nil {
+		return false
 	}
-	return false
+	key, ok := set.matchEntry(host, nil)
+	if !ok {
+		return false
+	}
+	log.Info("[ROUTER] custom block matched", "host", host, "entry", key)
+	tr.record(SourceCustomBlock, "")
+	tr.recordEntry(key, file, set.sources)
+	return true
 }
 
-func (r *Router) hostAtCN(host string) bool {
+// hostAtHome reports whether host is in the local country: by GeoIP for
+// IPs, and by country code TLD or the direct GeoSite category for domains.
+func (g *geoData) hostAtHome(host string) bool {
+	return g.traceHome(host, nil)
+}
+
+// traceHome is hostAtHome, recording the check that placed host in the
+// local country in tr unless it is nil.
+func (g *geoData) traceHome(host string, tr *Trace) bool {
 	if host == "" {
 		return false
 	}
 	if util.IsIP(host) {
-		return r.ipAtCN(host)
+		if !g.ipAtHome(host) {
+			return false
+		}
+		tr.record(SourceGeoIP, g.country)
+		return true
 	}
-	if strings.HasSuffix(host, ".cn") {
+	if tld := "." + strings.ToLower(g.country); strings.HasSuffix(host, tld) {
+		tr.record(SourceTLD, g.country)
+		tr.setEntry(tld)
 		return true
 	}
-	return r.geoSiteDirect.FullMatch(host)
+	gs := g.site(GeoSiteDirect)
+	if gs == nil {
+		return false
+	}
+	entry, ok := gs.matchEntry(host, true, true)
+	if ok {
+		tr.record(SourceGeoSite, GeoSiteDirect)
+		tr.setEntry(entry)
+	}
+	return ok
 }
 
-func (r *Router) ipAtCN(ip string) bool {
+func (g *geoData) ipAtHome(ip string) bool {
 	_ip := net.ParseIP(ip)
 	if _ip == nil {
 		return false
 	}
-	country, err := r.geoIPDB.Country(_ip)
-	if err != nil {
-		return false
-	}
-	return country.Country.IsoCode == "CN"
+	return g.inCountry(_ip, g.country)
 }
 
 func (r *Router) isLANHost(host string) bool {
@@ -399,53 +483,63 @@ func (r *Router) isLANHost(host string) bool {
 	return util.IsLANIP(host)
 }
 
-// AddDirectIP adds an IP to the custom direct IP set (thread-safe).
-func (r *Router) AddDirectIP(ip string) {
+// AddDirectIP adds an IP from the DNS answer for domain from to the custom
+// direct IP set (thread-safe).
+func (r *Router) AddDirectIP(ip, from string) {
 	r.customMu.Lock()
 	r.customDirectIPs[ip] = struct{}{}
+	r.learnedDirect = addLearned(r.learnedDirect, from, ip)
 	r.customMu.Unlock()
 }
 
-// AddProxyIP adds an IP to the custom proxy IP set (thread-safe).
-func (r *Router) AddProxyIP(ip string) {
+// AddProxyIP adds an IP from the DNS answer for domain from to the custom
+// proxy IP set (thread-safe).
+func (r *Router) AddProxyIP(ip, from string) {
 	r.customMu.Lock()
 	r.customProxyIPs[ip] = struct{}{}
+	r.learnedProxy = addLearned(r.learnedProxy, from, ip)
 	r.customMu.Unlock()
 }
 
-// AddDirectDomain adds a domain to the custom direct domain set (thread-safe).
-func (r *Router) AddDirectDomain(domain string) {
+// AddDirectDomain adds a CNAME target from the DNS answer for domain from to
+// the custom direct domain set (thread-safe).
+func (r *Router) AddDirectDomain(domain, from string) {
 	r.customMu.Lock()
-	r.customDirectDomains[domain] = struct{}{}
+	r.customDirectDomains.insert(domain)
+	r.learnedDirect = addLearned(r.learnedDirect, from, domain)
 	r.customMu.Unlock()
 }
 
-// AddProxyDomain adds a domain to the custom proxy domain set (thread-safe).
-func (r *Router) AddProxyDomain(domain string) {
+// AddProxyDomain adds a CNAME target from the DNS answer for domain from to
+// the custom proxy domain set (thread-safe).
+func (r *Router) AddProxyDomain(domain, from string) {
 	r.customMu.Lock()
-	r.customProxyDomains[domain] = struct{}{}
+	r.customProxyDomains.insert(domain)
+	r.learnedProxy = addLearned(r.learnedProxy, from, domain)
 	r.customMu.Unlock()
 }
 
+func addLearned(learned map[string]map[string]struct{}, from, entry string) map[string]map[string]struct{} {
+	if learned == nil {
+		learned = make(map[string]map[string]struct{})
+	}
+	if learned[from] == nil {
+		learned[from] = make(map[string]struct{})
+	}
+	learned[from][entry] = struct{}{}
+	return learned
+}
+
 // IsCustomDirectDomain checks whether a domain is in the custom direct domain list
 // (including subdomain matching and regexp/glob rules).
 func (r *Router) IsCustomDirectDomain(domain string) bool {
 	r.customMu.RLock()
 	defer r.customMu.RUnlock()
-	if _, ok := r.customDirectDomains[domain]; ok {
+	if _, ok := r.customDirectDomains.match(domain, true); ok {
 		return true
 	}
-	for _, sub := range util.SubDomains(domain) {
-		if _, ok := r.customDirectDomains[sub]; ok {
-			return true
-		}
-	}
-	for _, re := range r.customDirectRegexps {
-		if re.MatchString(domain) {
-			return true
-		}
-	}
-	return false
+	_, ok := r.customDirectRegexps.match(domain)
+	return ok
 }
 
 // IsCustomProxyDomain checks whether a domain is in the custom proxy domain list
@@ -453,20 +547,11 @@ func (r *Router) IsCustomDirectDomain(domain string) bool {
 func (r *Router) IsCustomProxyDomain(domain string) bool {
 	r.customMu.RLock()
 	defer r.customMu.RUnlock()
-	if _, ok := r.customProxyDomains[domain]; ok {
+	if _, ok := r.customProxyDomains.match(domain, true); ok {
 		return true
 	}
-	for _, sub := range util.SubDomains(domain) {
-		if _, ok := r.customProxyDomains[sub]; ok {
-			return true
-		}
-	}
-	for _, re := range r.customProxyRegexps {
-		if re.MatchString(domain) {
-			return true
-		}
-	}
-	return false
+	_, ok := r.customProxyRegexps.match(domain)
+	return ok
 }
 
 func (r *Router) ShouldIPV6Disable() bool {
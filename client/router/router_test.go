@@ -98,7 +98,7 @@ regexp:^.*\.test\.com$
 	}
 
 	// 验证 domain 条目
-	if _, ok := gs.domain["example.com"]; !ok {
+	if !gs.domain.has("example.com") {
 		t.Error("expected example.com in domain map")
 	}
 	// 验证 full 条目
@@ -106,13 +106,13 @@ regexp:^.*\.test\.com$
 		t.Error("expected www.example.com in fullDomain map")
 	}
 	// 验证 regexp 条目
-	if len(gs.regexpDomain) != 1 {
-		t.Fatalf("expected 1 regexp entry, got %d", len(gs.regexpDomain))
+	if gs.regexpDomain.Len() != 1 {
+		t.Fatalf("expected 1 regexp entry, got %d", gs.regexpDomain.Len())
 	}
 
 	// 验证空行被跳过
-	if len(gs.domain) != 1 {
-		t.Errorf("expected 1 domain entry, got %d", len(gs.domain))
+	if gs.domain.Len() != 1 {
+		t.Errorf("expected 1 domain entry, got %d", gs.domain.Len())
 	}
 }
 
@@ -120,8 +120,8 @@ func TestNewGeoSite_InvalidRegexp(t *testing.T) {
 	// 无效正则表达式应被静默跳过
 	data := []byte(`regexp:[invalid`)
 	gs := NewGeoSite(data)
-	if len(gs.regexpDomain) != 0 {
-		t.Errorf("expected 0 regexp entries, got %d", len(gs.regexpDomain))
+	if gs.regexpDomain.Len() != 0 {
+		t.Errorf("expected 0 regexp entries, got %d", gs.regexpDomain.Len())
 	}
 }
 
@@ -299,8 +299,8 @@ func TestRouter_AddDirectIP(t *testing.T) {
 		customDirectIPs: make(map[string]struct{}),
 	}
 
-	r.AddDirectIP("1.2.3.4")
-	r.AddDirectIP("::1")
+	r.AddDirectIP("1.2.3.4", "example.test")
+	r.AddDirectIP("::1", "example.test")
 
 	r.customMu.RLock()
 	defer r.customMu.RUnlock()
@@ -320,8 +320,8 @@ func TestRouter_AddProxyIP(t *testing.T) {
 		customProxyIPs: make(map[string]struct{}),
 	}
 
-	r.AddProxyIP("10.0.0.1")
-	r.AddProxyIP("fd00::1")
+	r.AddProxyIP("10.0.0.1", "example.test")
+	r.AddProxyIP("fd00::1", "example.test")
 
 	r.customMu.RLock()
 	defer r.customMu.RUnlock()
@@ -338,52 +338,49 @@ func TestRouter_AddProxyIP(t *testing.T) {
 
 func TestRouter_AddDirectDomain(t *testing.T) {
 	r := &Router{
-		customDirectDomains: make(map[string]struct{}),
+		customDirectDomains: newDomainTrie(),
 	}
 
-	r.AddDirectDomain("cdn.example.com")
-	r.AddDirectDomain("cdn2.example.com")
+	r.AddDirectDomain("cdn.example.com", "example.test")
+	r.AddDirectDomain("cdn2.example.com", "example.test")
 
 	r.customMu.RLock()
 	defer r.customMu.RUnlock()
-	if _, ok := r.customDirectDomains["cdn.example.com"]; !ok {
+	if !r.customDirectDomains.has("cdn.example.com") {
 		t.Error("expected cdn.example.com in customDirectDomains")
 	}
-	if _, ok := r.customDirectDomains["cdn2.example.com"]; !ok {
+	if !r.customDirectDomains.has("cdn2.example.com") {
 		t.Error("expected cdn2.example.com in customDirectDomains")
 	}
-	if len(r.customDirectDomains) != 2 {
-		t.Errorf("expected 2 entries, got %d", len(r.customDirectDomains))
+	if r.customDirectDomains.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", r.customDirectDomains.Len())
 	}
 }
 
 func TestRouter_AddProxyDomain(t *testing.T) {
 	r := &Router{
-		customProxyDomains: make(map[string]struct{}),
+		customProxyDomains: newDomainTrie(),
 	}
 
-	r.AddProxyDomain("google.com")
-	r.AddProxyDomain("youtube.com")
+	r.AddProxyDomain("google.com", "example.test")
+	r.AddProxyDomain("youtube.com", "example.test")
 
 	r.customMu.RLock()
 	defer r.customMu.RUnlock()
-	if _, ok := r.customProxyDomains["google.com"]; !ok {
+	if !r.customProxyDomains.has("google.com") {
 		t.Error("expected google.com in customProxyDomains")
 	}
-	if _, ok := r.customProxyDomains["youtube.com"]; !ok {
+	if !r.customProxyDomains.has("youtube.com") {
 		t.Error("expected youtube.com in customProxyDomains")
 	}
-	if len(r.customProxyDomains) != 2 {
-		t.Errorf("expected 2 entries, got %d", len(r.customProxyDomains))
+	if r.customProxyDomains.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", r.customProxyDomains.Len())
 	}
 }
 
 func TestRouter_IsCustomDirectDomain(t *testing.T) {
 	r := &Router{
-		customDirectDomains: map[string]struct{}{
-			"example.com": {},
-			"test.cn":     {},
-		},
+		customDirectDomains: newTestTrie("example.com", "test.cn"),
 	}
 
 	tests := []struct {
@@ -412,10 +409,7 @@ func TestRouter_IsCustomDirectDomain(t *testing.T) {
 
 func TestRouter_IsCustomProxyDomain(t *testing.T) {
 	r := &Router{
-		customProxyDomains: map[string]struct{}{
-			"google.com":  {},
-			"youtube.com": {},
-		},
+		customProxyDomains: newTestTrie("google.com", "youtube.com"),
 	}
 
 	tests := []struct {
@@ -462,8 +456,8 @@ func TestRouter_AddIPAfterMatch(t *testing.T) {
 	}
 
 	// 动态添加
-	r.AddDirectIP("1.2.3.4")
-	r.AddProxyIP("5.6.7.8")
+	r.AddDirectIP("1.2.3.4", "example.test")
+	r.AddProxyIP("5.6.7.8", "example.test")
 
 	// 添加后应匹配
 	if !r.hostMatchCustomDirect("1.2.3.4") {
@@ -474,7 +468,7 @@ func TestRouter_AddIPAfterMatch(t *testing.T) {
 	}
 }
 
-func TestRouter_hostAtCN(t *testing.T) {
+func TestRouter_hostAtHome(t *testing.T) {
 	// 构造带有内部 GeoIP 数据库的 Router（域名和 IP 判断）
 	r, err := New(Config{})
 	if err != nil {
@@ -494,9 +488,9 @@ func TestRouter_hostAtCN(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.host, func(t *testing.T) {
-			got := r.hostAtCN(tt.host)
+			got := r.geo.Load().hostAtHome(tt.host)
 			if got != tt.want {
-				t.Errorf("hostAtCN(%q) = %v, want %v", tt.host, got, tt.want)
+				t.Errorf("hostAtHome(%q) = %v, want %v", tt.host, got, tt.want)
 			}
 		})
 	}
@@ -550,23 +544,23 @@ func TestRouter_RegexpAndGlobCustomDomain(t *testing.T) {
 	r := &Router{
 		customDirectIPs:     make(map[string]struct{}),
 		customDirectCIDRIPs: nil,
-		customDirectDomains: make(map[string]struct{}),
+		customDirectDomains: newDomainTrie(),
 		customDirectRegexps: nil,
 		customProxyIPs:      make(map[string]struct{}),
 		customProxyCIDRIPs:  nil,
-		customProxyDomains:  make(map[string]struct{}),
+		customProxyDomains:  newDomainTrie(),
 		customProxyRegexps:  nil,
 	}
 	r.proxyRule.Store(int32(ProxyRuleAuto))
 
 	// 手动添加 regexp 和 glob 规则（模拟 loadCustomIPDomains 的行为）
 	directRe1, _ := regexp.Compile(`^.*\.baidu\.com$`) // regexp: 前缀
-	directRe2, _ := util.GlobToRegexp("*taobao*")           // glob 通配符
-	r.customDirectRegexps = append(r.customDirectRegexps, directRe1, directRe2)
+	directRe2, _ := util.GlobToRegexp("*taobao*")      // glob 通配符
+	r.customDirectRegexps = newRegexSet(directRe1, directRe2)
 
-	proxyRe1, _ := util.GlobToRegexp("*google*")            // glob 通配符
+	proxyRe1, _ := util.GlobToRegexp("*google*")       // glob 通配符
 	proxyRe2, _ := regexp.Compile(`^.*\.youtube\..*$`) // regexp: 前缀
-	r.customProxyRegexps = append(r.customProxyRegexps, proxyRe1, proxyRe2)
+	r.customProxyRegexps = newRegexSet(proxyRe1, proxyRe2)
 
 	// === 测试 hostMatchCustomDirect ===
 	directTests := []struct {
@@ -672,13 +666,13 @@ func TestRouter_RegexpInvalidSkips(t *testing.T) {
 	// 验证无效的正则表达式被静默跳过（与 NewGeoSite 行为一致）
 	invalidRe, _ := regexp.Compile(`^valid$`) // 末尾加一个无效的不会被添加
 	r := &Router{
-		customDirectRegexps: []*regexp.Regexp{invalidRe},
+		customDirectRegexps: newRegexSet(invalidRe),
 		customDirectIPs:     make(map[string]struct{}),
 		customDirectCIDRIPs: nil,
-		customDirectDomains: make(map[string]struct{}),
+		customDirectDomains: newDomainTrie(),
 		customProxyIPs:      make(map[string]struct{}),
 		customProxyCIDRIPs:  nil,
-		customProxyDomains:  make(map[string]struct{}),
+		customProxyDomains:  newDomainTrie(),
 		customProxyRegexps:  nil,
 	}
 	r.proxyRule.Store(int32(ProxyRuleAuto))
@@ -0,0 +1,372 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nange/easyss/v3/log"
+)
+
+// Rule set line types, as used by Clash and Surge rule lists.
+const (
+	ruleDomain        = "DOMAIN"
+	ruleDomainSuffix  = "DOMAIN-SUFFIX"
+	ruleDomainKeyword = "DOMAIN-KEYWORD"
+	ruleIPCIDR        = "IP-CIDR"
+	ruleIPCIDR6       = "IP-CIDR6"
+	ruleGeoIP         = "GEOIP"
+	ruleGeoSite       = "GEOSITE"
+	ruleDstPort       = "DST-PORT"
+	ruleNetwork       = "NETWORK"
+	ruleProcessName   = "PROCESS-NAME"
+	ruleProcessPath   = "PROCESS-PATH"
+	ruleUID           = "UID"
+	ruleMatch         = "MATCH"
+	ruleFinal         = "FINAL"
+	// ruleHostList holds a whole easyss direct/proxy style list.
+	ruleHostList = "HOST-LIST"
+)
+
+// Rule set formats: Clash/Surge rules, or an easyss host list in the
+// direct_file syntax whose entries all take the set's outbound.
+const (
+	FormatRules = "rules"
+	FormatList  = "list"
+)
+
+// RuleSet is an ordered list of Clash/Surge style rules such as
+// "DOMAIN-SUFFIX,google.com,PROXY". The first rule matching a host decides
+// its route.
+type RuleSet struct {
+	Name  string
+	rules []setRule
+}
+
+// setRule is one parsed rule set line.
+type setRule struct {
+	kind     string
+	value    string
+	cidr     *net.IPNet
+	portLo   int
+	portHi   int
+	hosts    *hostSet
+	procs    *processSet
+	decision Decision
+	// line is the rule's 1-based line in the rule set.
+	line int
+}
+
+// LoadRuleSet reads a rule set file in format, FormatRules if empty.
+func LoadRuleSet(file, format, outbound string) (*RuleSet, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("router: rule set %s: %w", file, err)
+	}
+	return ParseRuleSetFormat(file, data, format, outbound)
+}
+
+// ParseRuleSetFormat parses data with ParseRuleSet or ParseHostList
+// depending on format, FormatRules if empty.
+func ParseRuleSetFormat(name string, data []byte, format, outbound string) (*RuleSet, error) {
+	switch format {
+	case "", FormatRules:
+		return ParseRuleSet(name, data, outbound)
+	case FormatList:
+		return ParseHostList(name, data, outbound)
+	}
+	return nil, fmt.Errorf("router: rule set %s: unknown format %q", name, format)
+}
+
+// ParseHostList parses a list in the custom direct/proxy file syntax into a
+// rule set whose single rule sends every entry to outbound.
+func ParseHostList(name string, data []byte, outbound string) (*RuleSet, error) {
+	if outbound == "" {
+		return nil, fmt.Errorf("router: rule set %s: host list needs an outbound", name)
+	}
+	set := newHostSet()
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		s := strings.TrimSpace(string(line))
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		if err := set.add(s, i+1); err != nil {
+			return nil, fmt.Errorf("router: rule set %s line %d: %w", name, i+1, err)
+		}
+	}
+	return &RuleSet{Name: name, rules: []setRule{{
+		kind:     ruleHostList,
+		hosts:    set,
+		decision: actionDecision(outbound),
+	}}}, nil
+}
+
+// ParseRuleSet parses a rule list in Clash or Surge format: one
+// "TYPE,VALUE[,ACTION][,no-resolve]" rule per line, optionally as a YAML
+// "payload:" or "rules:" list. ACTION is DIRECT, REJECT (and its variants),
+// PROXY for the default server selection, or a server name; lines without
+// one use outbound, which takes the same values. Comments and rule types
+// the router does not know are skipped.
+func ParseRuleSet(name string, data []byte, outbound string) (*RuleSet, error) {
+	rs := &RuleSet{Name: name}
+	skipped := 0
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		s := strings.TrimSpace(string(line))
+		if s == "" || s == "payload:" || s == "rules:" || isRuleComment(s) {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(s, "- "); ok {
+			s = strings.Trim(strings.TrimSpace(rest), `'"`)
+		}
+		rule, ok, err := parseSetRule(s, outbound)
+		if err != nil {
+			return nil, fmt.Errorf("router: rule set %s line %d: %w", name, i+1, err)
+		}
+		if !ok {
+			skipped++
+			continue
+		}
+		rule.line = i + 1
+		rs.rules = append(rs.rules, rule)
+	}
+	if skipped > 0 {
+		log.Warn("[ROUTER] rule set has unsupported rules", "rule_set", name, "skipped", skipped)
+	}
+	return rs, nil
+}
+
+func isRuleComment(s string) bool {
+	return strings.HasPrefix(s, "#") || strings.HasPrefix(s, "//") || strings.HasPrefix(s, ";")
+}
+
+// parseSetRule parses one rule; ok is false for rule types that are not
+// supported.
+func parseSetRule(s, outbound string) (rule setRule, ok bool, err error) {
+	fields := strings.Split(s, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	rule.kind = strings.ToUpper(fields[0])
+
+	var action string
+	if rule.kind == ruleMatch || rule.kind == ruleFinal {
+		rule.kind = ruleMatch
+		if len(fields) > 1 {
+			action = fields[1]
+		}
+	} else {
+		if len(fields) < 2 || fields[1] == "" {
+			return rule, false, fmt.Errorf("%q: missing value", s)
+		}
+		rule.value = fields[1]
+		// The trailing no-resolve option is implied: domains are never
+		// resolved to match IP rules.
+		if len(fields) > 2 && !strings.EqualFold(fields[2], "no-resolve") {
+			action = fields[2]
+		}
+	}
+	if action == "" {
+		action = outbound
+	}
+
+	switch rule.kind {
+	case ruleDomain, ruleDomainSuffix, ruleDomainKeyword:
+		rule.value = strings.ToLower(rule.value)
+	case ruleIPCIDR, ruleIPCIDR6:
+		_, rule.cidr, err = net.ParseCIDR(rule.value)
+		if err != nil {
+			return rule, false, err
+		}
+	case ruleGeoIP:
+		rule.value = strings.ToUpper(rule.value)
+	case ruleGeoSite:
+		rule.value = strings.ToLower(rule.value)
+	case ruleDstPort:
+		rule.portLo, rule.portHi, err = parsePortRange(rule.value)
+		if err != nil {
+			return rule, false, err
+		}
+	case ruleNetwork:
+		rule.value, err = parseNetwork(rule.value)
+		if err != nil {
+			return rule, false, err
+		}
+	case ruleProcessName, ruleProcessPath:
+		rule.procs = newProcessSet()
+		if rule.kind == ruleProcessName {
+			rule.procs.names[rule.value] = struct{}{}
+		} else {
+			rule.procs.paths[filepath.Clean(rule.value)] = struct{}{}
+		}
+	case ruleUID:
+		rule.procs = newProcessSet()
+		if err := rule.procs.add("uid:" + rule.value); err != nil {
+			return rule, false, err
+		}
+	case ruleMatch:
+	default:
+		return rule, false, nil
+	}
+
+	if action == "" {
+		return rule, false, fmt.Errorf("%q: no action", s)
+	}
+	rule.decision = actionDecision(action)
+	return rule, true, nil
+}
+
+// parsePortRange parses "443" or "8000-8999".
+func parsePortRange(s string) (lo, hi int, err error) {
+	loStr, hiStr, isRange := strings.Cut(s, "-")
+	if lo, err = strconv.Atoi(loStr); err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	hi = lo
+	if isRange {
+		if hi, err = strconv.Atoi(hiStr); err != nil {
+			return 0, 0, fmt.Errorf("invalid port %q", s)
+		}
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	return lo, hi, nil
+}
+
+// actionDecision maps a rule set action to a Decision. Actions other than
+// the Clash/Surge built-ins name a server.
+func actionDecision(action string) Decision {
+	switch strings.ToUpper(action) {
+	case "DIRECT":
+		return Decision{Rule: HostRuleDirect}
+	case "REJECT", "REJECT-DROP", "REJECT-TINYGIF", "REJECT-NO-DROP", "BLOCK":
+		return Decision{Rule: HostRuleBlock}
+	case "PROXY":
+		return Decision{Rule: HostRuleProxy}
+	}
+	return Decision{Rule: HostRuleProxy, Outbound: action}
+}
+
+// RuleSet returns the rule set called name, or nil.
+func (r *Router) RuleSet(name string) *RuleSet {
+	r.customMu.RLock()
+	defer r.customMu.RUnlock()
+	for _, rs := range r.ruleSets {
+		if rs.Name == name {
+			return rs
+		}
+	}
+	return nil
+}
+
+// ReplaceRuleSet swaps rs in for the rule set with the same name, keeping
+// its position. It reports false if there is no such set.
+func (r *Router) ReplaceRuleSet(rs *RuleSet) bool {
+	r.customMu.Lock()
+	defer r.customMu.Unlock()
+	i := slices.IndexFunc(r.ruleSets, func(cur *RuleSet) bool { return cur.Name == rs.Name })
+	if i < 0 {
+		return false
+	}
+	// Match reads the slice without the lock, so never modify it in place.
+	sets := slices.Clone(r.ruleSets)
+	sets[i] = rs
+	r.ruleSets = sets
+	r.cfg.RuleSets = sets
+	r.updateProcessRules()
+	return true
+}
+
+// Len returns the number of rules in the set.
+func (rs *RuleSet) Len() int {
+	return len(rs.rules)
+}
+
+// usesProcess reports whether a rule of the set matches on the process.
+func (rs *RuleSet) usesProcess() bool {
+	return slices.ContainsFunc(rs.rules, func(rule setRule) bool { return rule.procs != nil })
+}
+
+// Outbounds returns the server names the rule set's actions reference.
+func (rs *RuleSet) Outbounds() []string {
+	var names []string
+	for _, rule := range rs.rules {
+		if rule.decision.Outbound != "" {
+			names = append(names, rule.decision.Outbound)
+		}
+	}
+	return names
+}
+
+// match returns the decision of the first rule matching c, recording it
+// in tr unless tr is nil. IP rules only match IP hosts, DST-PORT rules
+// never match port 0, and NETWORK and process rules never match an unknown
+// network or process.
+func (rs *RuleSet) match(geo *geoData, c Conn, tr *Trace) (Decision, bool) {
+	ip := net.ParseIP(c.Host)
+	domain := ""
+	if ip == nil {
+		domain = strings.ToLower(c.Host)
+	}
+	for i := range rs.rules {
+		rule := &rs.rules[i]
+		if !rule.matches(geo, c, domain, ip) {
+			continue
+		}
+		log.Info("[ROUTER] rule set matched", "host", c.Host, "rule_set", rs.Name,
+			"type", rule.kind, "value", rule.value, "outbound", rule.decision.Outbound)
+		if tr != nil {
+			tr.record(SourceRuleSet, rs.Name)
+			if rule.kind == ruleHostList {
+				key, _ := rule.hosts.matchEntry(c.Host, geo)
+				tr.recordEntry(key, rs.Name, rule.hosts.sources)
+			} else {
+				tr.Entry, tr.File, tr.Line = rule.String(), rs.Name, rule.line
+			}
+		}
+		return rule.decision, true
+	}
+	return Decision{}, false
+}
+
+// String formats the rule as a rule set line without its action.
+func (rule *setRule) String() string {
+	if rule.kind == ruleMatch || rule.kind == ruleHostList {
+		return rule.kind
+	}
+	return rule.kind + "," + rule.value
+}
+
+func (rule *setRule) matches(geo *geoData, c Conn, domain string, ip net.IP) bool {
+	switch rule.kind {
+	case ruleDomain:
+		return domain != "" && domain == rule.value
+	case ruleDomainSuffix:
+		return domain != "" && (domain == rule.value || strings.HasSuffix(domain, "."+rule.value))
+	case ruleDomainKeyword:
+		return domain != "" && strings.Contains(domain, rule.value)
+	case ruleIPCIDR, ruleIPCIDR6:
+		return ip != nil && rule.cidr.Contains(ip)
+	case ruleGeoIP:
+		return ip != nil && geo.inCountry(ip, rule.value)
+	case ruleGeoSite:
+		return domain != "" && geo.inSite(domain, rule.value)
+	case ruleDstPort:
+		return c.Port >= rule.portLo && c.Port <= rule.portHi
+	case ruleNetwork:
+		return c.Network == rule.value
+	case ruleProcessName, ruleProcessPath, ruleUID:
+		_, ok := rule.procs.matchEntry(c.Process)
+		return ok
+	case ruleMatch:
+		return true
+	case ruleHostList:
+		return rule.hosts.match(c.Host, geo)
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package router
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseRuleSet(t *testing.T) {
+	data := []byte(`# Clash style
+rules:
+  - DOMAIN,exact.example.com,DIRECT
+  - DOMAIN-SUFFIX,google.com,jp
+  - 'DOMAIN-KEYWORD,ads,REJECT'
+  - IP-CIDR,203.0.113.0/24,DIRECT,no-resolve
+  - IP-CIDR6,2001:db8::/32,PROXY
+  - USER-AGENT,curl*,DIRECT
+  - GEOIP,CN,DIRECT
+  - DST-PORT,6881-6889,REJECT
+  - MATCH,us
+`)
+	rs, err := ParseRuleSet("test", data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Len() != 8 {
+		t.Errorf("Len = %d, want 8 (USER-AGENT skipped)", rs.Len())
+	}
+	if got := rs.Outbounds(); !slices.Equal(got, []string{"jp", "us"}) {
+		t.Errorf("Outbounds = %v", got)
+	}
+
+	r, err := New(Config{ProxyRule: ProxyRuleAuto, RuleSets: []*RuleSet{rs}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		port int
+		want Decision
+	}{
+		{"exact.example.com", 443, Decision{Rule: HostRuleDirect}},
+		{"sub.exact.example.com", 443, Decision{Rule: HostRuleProxy, Outbound: "us"}},
+		{"google.com", 443, Decision{Rule: HostRuleProxy, Outbound: "jp"}},
+		{"WWW.Google.com", 443, Decision{Rule: HostRuleProxy, Outbound: "jp"}},
+		{"notgoogle.com", 443, Decision{Rule: HostRuleProxy, Outbound: "us"}},
+		{"myads.example.org", 443, Decision{Rule: HostRuleBlock}},
+		{"203.0.113.7", 443, Decision{Rule: HostRuleDirect}},
+		{"2001:db8::1", 443, Decision{Rule: HostRuleProxy}},
+		{"114.114.114.114", 443, Decision{Rule: HostRuleDirect}},
+		{"8.8.8.8", 6881, Decision{Rule: HostRuleBlock}},
+		// An unknown port never matches DST-PORT rules.
+		{"8.8.8.8", 0, Decision{Rule: HostRuleProxy, Outbound: "us"}},
+		// LAN hosts never reach the rule sets.
+		{"192.168.1.1", 6881, Decision{Rule: HostRuleDirect}},
+	}
+	for _, tt := range tests {
+		if got := r.MatchPort(tt.host, tt.port); got != tt.want {
+			t.Errorf("MatchPort(%q, %d) = %+v, want %+v", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestParseRuleSetDefaultOutbound(t *testing.T) {
+	// Surge and Clash provider lists leave the action to the referencing rule.
+	data := []byte("payload:\n  - DOMAIN-SUFFIX,netflix.com\n  - IP-CIDR,198.51.100.0/24,no-resolve\n  - DOMAIN,direct.example.com,DIRECT\n")
+	rs, err := ParseRuleSet("surge", data, "jp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(Config{ProxyRule: ProxyRuleAuto, RuleSets: []*RuleSet{rs}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]Decision{
+		"www.netflix.com":    {Rule: HostRuleProxy, Outbound: "jp"},
+		"198.51.100.1":       {Rule: HostRuleProxy, Outbound: "jp"},
+		"direct.example.com": {Rule: HostRuleDirect},
+		"baidu.cn":           {Rule: HostRuleDirect},
+		"example.org":        {Rule: HostRuleProxy},
+	} {
+		if got := r.Match(host); got != want {
+			t.Errorf("Match(%q) = %+v, want %+v", host, got, want)
+		}
+	}
+
+	if _, err := ParseRuleSet("surge", data, ""); err == nil {
+		t.Error("expected error for rules without action or default outbound")
+	}
+}
+
+func TestParseRuleSetErrors(t *testing.T) {
+	for _, line := range []string{
+		"DOMAIN-SUFFIX,,DIRECT",
+		"IP-CIDR,300.0.0.0/8,DIRECT",
+		"DST-PORT,0,DIRECT",
+		"DST-PORT,90-80,DIRECT",
+		"MATCH",
+	} {
+		if _, err := ParseRuleSet("bad", []byte(line), ""); err == nil {
+			t.Errorf("ParseRuleSet(%q): expected error", line)
+		}
+	}
+}
+
+func TestRuleSetOrder(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "rules.list")
+	if err := os.WriteFile(file, []byte("DOMAIN-SUFFIX,example.com,REJECT\nMATCH,DIRECT\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := LoadRuleSet(file, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(Config{
+		ProxyRule: ProxyRuleProxy,
+		Rules:     []Rule{{Outbound: "jp", Hosts: []string{"api.example.com"}}},
+		RuleSets:  []*RuleSet{rs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Policy rules come before rule sets, and MATCH ends the lookup before
+	// the proxy rule applies.
+	if got := r.Match("api.example.com"); got != (Decision{Rule: HostRuleProxy, Outbound: "jp"}) {
+		t.Errorf("policy rule: got %+v", got)
+	}
+	if got := r.Match("www.example.com"); got != (Decision{Rule: HostRuleBlock}) {
+		t.Errorf("rule set: got %+v", got)
+	}
+	if got := r.Match("google.com"); got != (Decision{Rule: HostRuleDirect}) {
+		t.Errorf("MATCH: got %+v", got)
+	}
+
+	if err := r.Reload(Config{ProxyRule: ProxyRuleProxy}); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Match("www.example.com"); got != (Decision{Rule: HostRuleProxy}) {
+		t.Errorf("rule set kept after reload: got %+v", got)
+	}
+}
+
+func TestParseHostList(t *testing.T) {
+	data := []byte("# remote direct list\nexample.com\n*.corp.example.org\n10.1.0.0/16\n")
+	rs, err := ParseRuleSetFormat("direct", data, FormatList, "DIRECT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(Config{ProxyRule: ProxyRuleProxy, RuleSets: []*RuleSet{rs}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]HostRule{
+		"www.example.com":      HostRuleDirect,
+		"git.corp.example.org": HostRuleDirect,
+		"10.1.2.3":             HostRuleDirect,
+		"google.com":           HostRuleProxy,
+	} {
+		if got := r.MatchHostRule(host); got != want {
+			t.Errorf("MatchHostRule(%q) = %d, want %d", host, got, want)
+		}
+	}
+
+	if _, err := ParseRuleSetFormat("direct", data, FormatList, ""); err == nil {
+		t.Error("expected error for host list without outbound")
+	}
+	if _, err := ParseRuleSetFormat("direct", data, "yaml", "DIRECT"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestReplaceRuleSet(t *testing.T) {
+	first, err := ParseRuleSet("first", []byte("DOMAIN,a.example.com,REJECT"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &RuleSet{Name: "https://rules.example.com/list"}
+	r, err := New(Config{ProxyRule: ProxyRuleProxy, RuleSets: []*RuleSet{first, remote}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.RuleSet(remote.Name); got != remote {
+		t.Fatalf("RuleSet = %v", got)
+	}
+
+	next, err := ParseRuleSet(remote.Name, []byte("DOMAIN-SUFFIX,example.com,jp"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.ReplaceRuleSet(next) {
+		t.Fatal("ReplaceRuleSet = false")
+	}
+	// The replaced set keeps its position after first.
+	if got := r.Match("a.example.com"); got != (Decision{Rule: HostRuleBlock}) {
+		t.Errorf("first set: got %+v", got)
+	}
+	if got := r.Match("b.example.com"); got != (Decision{Rule: HostRuleProxy, Outbound: "jp"}) {
+		t.Errorf("replaced set: got %+v", got)
+	}
+	if got := r.Outbounds(); !slices.Equal(got, []string{"jp"}) {
+		t.Errorf("Outbounds = %v", got)
+	}
+
+	if r.ReplaceRuleSet(&RuleSet{Name: "unknown"}) {
+		t.Error("ReplaceRuleSet of an unknown set = true")
+	}
+}
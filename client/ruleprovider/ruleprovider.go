@@ -0,0 +1,365 @@
+// Package ruleprovider keeps the routing rule sets configured by URL up to
+// date: it loads them at startup, caches the last verified copy on disk and
+// refreshes them in the background, falling back to fetching through the
+// proxy when the direct fetch fails.
+package ruleprovider
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/log"
+)
+
+// maxBodySize bounds a rule list response.
+const maxBodySize = 32 << 20
+
+// DialFunc dials a connection for fetching rule lists.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ApplyFunc swaps a refreshed rule set into the running router.
+type ApplyFunc func(rs *router.RuleSet) error
+
+// Updater loads and refreshes the rule sets with a URL.
+type Updater struct {
+	sets     []config.RuleSetConfig
+	cacheDir string
+	timeout  time.Duration
+	direct   *http.Client
+	proxied  *http.Client
+
+	mu     sync.Mutex
+	loaded map[string]*router.RuleSet
+	// fetched records when each URL was last fetched, so Start does not
+	// refetch what Load just downloaded.
+	fetched map[string]time.Time
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// DefaultCacheDir returns the directory rule sets are cached in, or "" if
+// the user cache directory is unknown.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "easyss", "rules")
+}
+
+// New returns an Updater for the sets with a URL. Direct fetches dial with
+// dial, or the default dialer if nil; an empty cacheDir disables the disk
+// cache.
+func New(sets []config.RuleSetConfig, cacheDir string, timeout time.Duration, dial DialFunc) *Updater {
+	var remote []config.RuleSetConfig
+	for _, rs := range sets {
+		if rs.URL != "" {
+			remote = append(remote, rs)
+		}
+	}
+	return &Updater{
+		sets:     remote,
+		cacheDir: cacheDir,
+		timeout:  timeout,
+		direct:   newHTTPClient(timeout, dial),
+		loaded:   make(map[string]*router.RuleSet),
+		fetched:  make(map[string]time.Time),
+	}
+}
+
+func newHTTPClient(timeout time.Duration, dial DialFunc) *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = nil
+	if dial != nil {
+		tr.DialContext = dial
+	}
+	return &http.Client{Transport: tr, Timeout: timeout}
+}
+
+// Load reads every rule set before the client starts. The cached copy is
+// used when there is one, so startup does not wait for the network;
+// otherwise the list is fetched directly. Failures are logged and leave the
+// rule set empty until a refresh succeeds.
+func (u *Updater) Load(ctx context.Context) {
+	for _, sc := range u.sets {
+		rs, err := u.cached(sc)
+		if err != nil {
+			rs, err = u.Fetch(ctx, sc)
+		}
+		if err != nil {
+			log.Warn("[RULE_PROVIDER] load", "url", sc.URL, "err", err)
+			continue
+		}
+		u.mu.Lock()
+		u.loaded[sc.URL] = rs
+		u.mu.Unlock()
+		log.Info("[RULE_PROVIDER] loaded", "url", sc.URL, "rules", rs.Len())
+	}
+}
+
+// Start applies the rule sets Load read, then refreshes each one in the
+// background until Stop. Fetches that fail directly are retried through
+// proxyDial when it is not nil. Sets Load could not fetch, or took from the
+// cache, are refreshed right away.
+func (u *Updater) Start(apply ApplyFunc, proxyDial DialFunc) {
+	if proxyDial != nil {
+		u.proxied = newHTTPClient(u.timeout, proxyDial)
+	}
+	for _, sc := range u.sets {
+		u.mu.Lock()
+		rs := u.loaded[sc.URL]
+		u.mu.Unlock()
+		if rs == nil {
+			continue
+		}
+		if err := apply(rs); err != nil {
+			log.Warn("[RULE_PROVIDER] apply", "url", sc.URL, "err", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	u.cancel = cancel
+	for _, sc := range u.sets {
+		u.mu.Lock()
+		last := u.fetched[sc.URL]
+		u.mu.Unlock()
+		interval := sc.IntervalDuration()
+		if interval <= 0 && !last.IsZero() {
+			continue
+		}
+		wait := time.Duration(0)
+		if interval > 0 {
+			wait = max(time.Until(last.Add(interval)), 0)
+		}
+
+		u.wg.Go(func() {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-timer.C:
+				}
+				u.refresh(ctx, sc, apply)
+				if interval <= 0 {
+					return
+				}
+				timer.Reset(interval)
+			}
+		})
+	}
+}
+
+// Stop ends background refreshing.
+func (u *Updater) Stop() {
+	if u.cancel != nil {
+		u.cancel()
+	}
+	u.wg.Wait()
+}
+
+func (u *Updater) refresh(ctx context.Context, sc config.RuleSetConfig, apply ApplyFunc) {
+	rs, err := u.Fetch(ctx, sc)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Warn("[RULE_PROVIDER] refresh", "url", sc.URL, "err", err)
+		}
+		return
+	}
+	if err := apply(rs); err != nil {
+		log.Warn("[RULE_PROVIDER] apply", "url", sc.URL, "err", err)
+		return
+	}
+	u.mu.Lock()
+	u.loaded[sc.URL] = rs
+	u.mu.Unlock()
+	log.Info("[RULE_PROVIDER] rule set updated", "url", sc.URL, "rules", rs.Len())
+}
+
+// Fetch downloads, verifies and parses the rule set sc, and caches the list
+// on success. A failed direct fetch is retried through the proxy once Start
+// has provided one.
+func (u *Updater) Fetch(ctx context.Context, sc config.RuleSetConfig) (*router.RuleSet, error) {
+	body, sig, err := u.fetchVerified(ctx, u.direct, sc)
+	if err != nil && u.proxied != nil && ctx.Err() == nil {
+		log.Info("[RULE_PROVIDER] direct fetch failed, retrying through proxy", "url", sc.URL, "err", err)
+		body, sig, err = u.fetchVerified(ctx, u.proxied, sc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rs, err := router.ParseRuleSetFormat(sc.URL, body, sc.Format, sc.Outbound)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	u.fetched[sc.URL] = time.Now()
+	u.mu.Unlock()
+	if err := u.writeCache(sc.URL, body, sig); err != nil {
+		log.Warn("[RULE_PROVIDER] write cache", "url", sc.URL, "err", err)
+	}
+	return rs, nil
+}
+
+// fetchVerified downloads and verifies the list of sc, returning it and its
+// signature, nil if sc has no public_key.
+func (u *Updater) fetchVerified(ctx context.Context, client *http.Client, sc config.RuleSetConfig) (body, sig []byte, err error) {
+	body, err = get(ctx, client, sc.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := verifyChecksum(sc, body); err != nil {
+		return nil, nil, err
+	}
+	if sc.PublicKey == "" {
+		return body, nil, nil
+	}
+	sigURL := sc.SignatureURL
+	if sigURL == "" {
+		sigURL = sc.URL + ".sig"
+	}
+	sig, err = get(ctx, client, sigURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signature: %w", err)
+	}
+	if err := verifySignature(sc.PublicKey, body, sig); err != nil {
+		return nil, nil, err
+	}
+	return body, sig, nil
+}
+
+func get(ctx context.Context, client *http.Client, src string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+}
+
+func verifyChecksum(sc config.RuleSetConfig, body []byte) error {
+	if sc.SHA256 == "" {
+		return nil
+	}
+	sum := sha256.Sum256(body)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), sc.SHA256) {
+		return errors.New("sha256 checksum mismatch")
+	}
+	return nil
+}
+
+// verifySignature checks sig, a raw or base64 ed25519 signature, over body.
+func verifySignature(publicKey string, body, sig []byte) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid public_key: want a base64 ed25519 public key")
+	}
+	if len(sig) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+		if err != nil {
+			return errors.New("invalid signature encoding")
+		}
+		sig = decoded
+	}
+	if !ed25519.Verify(key, body, sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+func (u *Updater) cachePath(src string) string {
+	sum := sha256.Sum256([]byte(src))
+	return filepath.Join(u.cacheDir, hex.EncodeToString(sum[:8])+".rules")
+}
+
+// cached returns the cached copy of sc. Only verified lists are cached, but
+// the pinned checksum and the signature, kept next to the list, are checked
+// again in case sha256 or public_key changed since.
+func (u *Updater) cached(sc config.RuleSetConfig) (*router.RuleSet, error) {
+	if u.cacheDir == "" {
+		return nil, os.ErrNotExist
+	}
+	path := u.cachePath(sc.URL)
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChecksum(sc, body); err != nil {
+		return nil, err
+	}
+	if sc.PublicKey != "" {
+		sig, err := os.ReadFile(path + ".sig")
+		if err != nil {
+			return nil, fmt.Errorf("signature: %w", err)
+		}
+		if err := verifySignature(sc.PublicKey, body, sig); err != nil {
+			return nil, err
+		}
+	}
+	return router.ParseRuleSetFormat(sc.URL, body, sc.Format, sc.Outbound)
+}
+
+// writeCache caches body and its signature sig, if any, for src. The
+// signature is written first, so a crash in between leaves a list that
+// fails verification rather than one that passes with a stale signature.
+func (u *Updater) writeCache(src string, body, sig []byte) error {
+	if u.cacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(u.cacheDir, 0o700); err != nil {
+		return err
+	}
+	path := u.cachePath(src)
+	if sig != nil {
+		if err := writeFile(path+".sig", sig); err != nil {
+			return err
+		}
+	} else if err := os.Remove(path + ".sig"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return writeFile(path, body)
+}
+
+// writeFile replaces path with data atomically, so a crash never leaves a
+// truncated file behind.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
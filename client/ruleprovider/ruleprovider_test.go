@@ -0,0 +1,220 @@
+package ruleprovider
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/client/router"
+)
+
+func TestLoadAndRefresh(t *testing.T) {
+	var body atomic.Value
+	body.Store("DOMAIN-SUFFIX,example.com,REJECT\n")
+	var up atomic.Bool
+	up.Store(true)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(body.Load().(string)))
+	}))
+	defer ts.Close()
+
+	cacheDir := t.TempDir()
+	sets := []config.RuleSetConfig{{File: "local.list"}, {URL: ts.URL, Outbound: "PROXY"}}
+	u := New(sets, cacheDir, time.Second, nil)
+	u.Load(context.Background())
+	if rs := u.loaded[ts.URL]; rs == nil || rs.Len() != 1 {
+		t.Fatalf("loaded = %v", rs)
+	}
+
+	// A restart while the provider is unreachable uses the cache.
+	up.Store(false)
+	cached := New(sets, cacheDir, time.Second, nil)
+	cached.Load(context.Background())
+	if rs := cached.loaded[ts.URL]; rs == nil || rs.Len() != 1 {
+		t.Fatalf("loaded from cache = %v", rs)
+	}
+
+	r, err := router.New(router.Config{ProxyRule: router.ProxyRuleProxy, RuleSets: []*router.RuleSet{{Name: ts.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply := func(rs *router.RuleSet) error {
+		if !r.ReplaceRuleSet(rs) {
+			return errors.New("not configured")
+		}
+		return nil
+	}
+
+	up.Store(true)
+	body.Store("DOMAIN-SUFFIX,example.org\n")
+	u.refresh(context.Background(), sets[1], apply)
+	if got := r.MatchHostRule("www.example.org"); got != router.HostRuleProxy {
+		t.Errorf("refreshed rule: got %d", got)
+	}
+	if got := r.MatchHostRule("www.example.com"); got != router.HostRuleProxy {
+		t.Errorf("old rule still applies: got %d", got)
+	}
+
+	// A failed refresh keeps the current rules.
+	up.Store(false)
+	u.refresh(context.Background(), sets[1], func(*router.RuleSet) error {
+		t.Error("apply called after a failed fetch")
+		return nil
+	})
+}
+
+func TestStartAppliesLoaded(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("DOMAIN,blocked.example.com,REJECT\n"))
+	}))
+	defer ts.Close()
+
+	u := New([]config.RuleSetConfig{{URL: ts.URL, Interval: -1}}, "", time.Second, nil)
+	u.Load(context.Background())
+	applied := make(chan *router.RuleSet, 2)
+	u.Start(func(rs *router.RuleSet) error {
+		applied <- rs
+		return nil
+	}, nil)
+	defer u.Stop()
+
+	select {
+	case rs := <-applied:
+		if rs.Name != ts.URL || rs.Len() != 1 {
+			t.Errorf("applied %s with %d rules", rs.Name, rs.Len())
+		}
+	default:
+		t.Fatal("Start did not apply the loaded rule set")
+	}
+	// A freshly fetched set without refresh interval is not fetched again.
+	time.Sleep(50 * time.Millisecond)
+	if len(applied) != 0 {
+		t.Error("rule set refreshed despite a negative interval")
+	}
+}
+
+func TestFetchThroughProxy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("DOMAIN,example.com,DIRECT\n"))
+	}))
+	defer ts.Close()
+
+	failDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("blocked")
+	}
+	var proxied atomic.Int32
+	proxyDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		proxied.Add(1)
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+
+	sc := config.RuleSetConfig{URL: ts.URL}
+	u := New([]config.RuleSetConfig{sc}, "", time.Second, failDial)
+	if _, err := u.Fetch(context.Background(), sc); err == nil {
+		t.Fatal("expected error before a proxy is available")
+	}
+	u.Start(func(*router.RuleSet) error { return nil }, proxyDial)
+	u.Stop()
+	if _, err := u.Fetch(context.Background(), sc); err != nil {
+		t.Fatal(err)
+	}
+	if proxied.Load() == 0 {
+		t.Error("fetch did not go through the proxy")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	list := []byte("DOMAIN-SUFFIX,example.com,DIRECT\n")
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := ed25519.Sign(priv, list)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rules.list":
+			_, _ = w.Write(list)
+		case "/rules.list.sig":
+			_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString(sig)))
+		case "/raw.sig":
+			_, _ = w.Write(sig)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	sum := sha256.Sum256(list)
+	key := base64.StdEncoding.EncodeToString(pub)
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	src := ts.URL + "/rules.list"
+	tests := []struct {
+		name string
+		sc   config.RuleSetConfig
+		ok   bool
+	}{
+		{"checksum", config.RuleSetConfig{URL: src, SHA256: hex.EncodeToString(sum[:])}, true},
+		{"checksum mismatch", config.RuleSetConfig{URL: src, SHA256: hex.EncodeToString(make([]byte, 32))}, false},
+		{"signature", config.RuleSetConfig{URL: src, PublicKey: key}, true},
+		{"raw signature url", config.RuleSetConfig{URL: src, PublicKey: key, SignatureURL: ts.URL + "/raw.sig"}, true},
+		{"wrong key", config.RuleSetConfig{URL: src, PublicKey: base64.StdEncoding.EncodeToString(otherPub)}, false},
+		{"missing signature", config.RuleSetConfig{URL: src, PublicKey: key, SignatureURL: ts.URL + "/none.sig"}, false},
+		{"invalid key", config.RuleSetConfig{URL: src, PublicKey: "abc"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := t.TempDir()
+			u := New([]config.RuleSetConfig{tt.sc}, cacheDir, time.Second, nil)
+			_, err := u.Fetch(context.Background(), tt.sc)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Fetch err = %v, want ok %v", err, tt.ok)
+			}
+			// Only verified lists are cached.
+			if _, err := u.cached(tt.sc); (err == nil) != tt.ok {
+				t.Errorf("cached err = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+
+	// After a key rotation the cached list, signed with the old key, is
+	// rejected.
+	cacheDir := t.TempDir()
+	sc := config.RuleSetConfig{URL: src, PublicKey: key}
+	u := New([]config.RuleSetConfig{sc}, cacheDir, time.Second, nil)
+	if _, err := u.Fetch(context.Background(), sc); err != nil {
+		t.Fatal(err)
+	}
+	rotated := sc
+	rotated.PublicKey = base64.StdEncoding.EncodeToString(otherPub)
+	if _, err := u.cached(rotated); err == nil {
+		t.Error("cached list accepted with a rotated public_key")
+	}
+	entries, _ := os.ReadDir(cacheDir)
+	if len(entries) != 2 {
+		t.Errorf("cache dir has %d files, want the list and its signature", len(entries))
+	}
+	// Dropping public_key drops the signature with the next fetch.
+	sc.PublicKey = ""
+	if _, err := u.Fetch(context.Background(), sc); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 1 {
+		t.Errorf("cache dir has %d files, want only the list", len(entries))
+	}
+}
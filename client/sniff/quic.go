@@ -0,0 +1,263 @@
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	quicVersion1 = 0x00000001
+	quicVersion2 = 0x6b3343cf
+
+	frameTypePadding = 0x00
+	frameTypePing    = 0x01
+	frameTypeAck     = 0x02
+	frameTypeAckECN  = 0x03
+	frameTypeCrypto  = 0x06
+)
+
+// quicInitial holds how the Initial packets of a QUIC version are
+// protected (RFC 9001 section 5.2, RFC 9369 section 3.3).
+type quicInitial struct {
+	packetType byte
+	salt       []byte
+	keyLabel   string
+	ivLabel    string
+	hpLabel    string
+}
+
+var quicInitials = map[uint32]quicInitial{
+	quicVersion1: {
+		packetType: 0,
+		salt:       []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+		keyLabel:   "quic key",
+		ivLabel:    "quic iv",
+		hpLabel:    "quic hp",
+	},
+	quicVersion2: {
+		packetType: 1,
+		salt:       []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+		keyLabel:   "quicv2 key",
+		ivLabel:    "quicv2 iv",
+		hpLabel:    "quicv2 hp",
+	},
+}
+
+// QUICServerName returns the server name of the ClientHello carried by the
+// QUIC Initial packet, which starts packet, a UDP payload a client sent. A
+// ClientHello spanning several packets is only sniffed if the server name
+// is in the first one.
+func QUICServerName(packet []byte) (string, error) {
+	s := cryptobyte.String(packet)
+	var first byte
+	var version uint32
+	var dcid, scid, token cryptobyte.String
+	if !s.ReadUint8(&first) || first&0xc0 != 0xc0 || !s.ReadUint32(&version) {
+		return "", ErrNoDomain
+	}
+	initial, ok := quicInitials[version]
+	if !ok || (first>>4)&0x03 != initial.packetType {
+		return "", ErrNoDomain
+	}
+	var length uint64
+	if !s.ReadUint8LengthPrefixed(&dcid) || len(dcid) > 20 ||
+		!s.ReadUint8LengthPrefixed(&scid) ||
+		!readVarintPrefixed(&s, &token) ||
+		!readVarint(&s, &length) || length > uint64(len(s)) {
+		return "", ErrNoDomain
+	}
+	pnOffset := len(packet) - len(s)
+	payload, err := initial.open(packet[:pnOffset+int(length)], pnOffset, dcid)
+	if err != nil {
+		return "", ErrNoDomain
+	}
+	hello, err := cryptoStream(payload)
+	if err != nil {
+		return "", err
+	}
+	return clientHelloServerName(hello)
+}
+
+// open removes the protection of the Initial packet, whose packet number
+// starts at pnOffset, and returns its payload.
+func (q quicInitial) open(packet []byte, pnOffset int, dcid []byte) ([]byte, error) {
+	initialSecret, err := hkdf.Extract(sha256.New, dcid, q.salt)
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := expandLabel(initialSecret, "client in", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	key, err := expandLabel(clientSecret, q.keyLabel, 16)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := expandLabel(clientSecret, q.ivLabel, 12)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := expandLabel(clientSecret, q.hpLabel, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	// The header protection sample starts 4 bytes past the packet number.
+	if len(packet) < pnOffset+4+aes.BlockSize {
+		return nil, ErrNoDomain
+	}
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	header := slices.Clone(packet[:pnOffset+4])
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := range pnLen {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := slices.Clone(iv)
+	var pnBytes [8]byte
+	binary.BigEndian.PutUint64(pnBytes[:], pn)
+	for i, b := range pnBytes {
+		nonce[len(nonce)-8+i] ^= b
+	}
+	return aead.Open(nil, nonce, packet[pnOffset+pnLen:], header)
+}
+
+// expandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context.
+func expandLabel(secret []byte, label string, length int) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 " + label))
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	return hkdf.Expand(sha256.New, secret, string(b.BytesOrPanic()), length)
+}
+
+// cryptoStream returns the start of the crypto stream carried by the
+// CRYPTO frames of payload, which may come in any order.
+func cryptoStream(payload []byte) ([]byte, error) {
+	type fragment struct {
+		offset uint64
+		data   []byte
+	}
+	var fragments []fragment
+	s := cryptobyte.String(payload)
+	for !s.Empty() {
+		var typ uint64
+		if !readVarint(&s, &typ) {
+			return nil, ErrNoDomain
+		}
+		switch typ {
+		case frameTypePadding, frameTypePing:
+		case frameTypeAck, frameTypeAckECN:
+			if !skipAck(&s, typ == frameTypeAckECN) {
+				return nil, ErrNoDomain
+			}
+		case frameTypeCrypto:
+			var offset uint64
+			var data cryptobyte.String
+			if !readVarint(&s, &offset) || !readVarintPrefixed(&s, &data) {
+				return nil, ErrNoDomain
+			}
+			fragments = append(fragments, fragment{offset, data})
+		default:
+			// Other frames are not sent in a first Initial packet; stop at
+			// what was gathered.
+			s = nil
+		}
+	}
+
+	slices.SortFunc(fragments, func(a, b fragment) int {
+		switch {
+		case a.offset < b.offset:
+			return -1
+		case a.offset > b.offset:
+			return 1
+		}
+		return 0
+	})
+	var stream []byte
+	for _, f := range fragments {
+		end := f.offset + uint64(len(f.data))
+		if f.offset > uint64(len(stream)) {
+			break // a gap, in another packet
+		}
+		if end > uint64(len(stream)) {
+			stream = append(stream, f.data[uint64(len(stream))-f.offset:]...)
+		}
+	}
+	if len(stream) == 0 {
+		return nil, ErrNoDomain
+	}
+	return stream, nil
+}
+
+// skipAck skips the body of an ACK frame.
+func skipAck(s *cryptobyte.String, ecn bool) bool {
+	var largest, delay, count, first uint64
+	if !readVarint(s, &largest) || !readVarint(s, &delay) || !readVarint(s, &count) || !readVarint(s, &first) {
+		return false
+	}
+	for range count {
+		var gap, length uint64
+		if !readVarint(s, &gap) || !readVarint(s, &length) {
+			return false
+		}
+	}
+	if ecn {
+		var ect0, ect1, ce uint64
+		return readVarint(s, &ect0) && readVarint(s, &ect1) && readVarint(s, &ce)
+	}
+	return true
+}
+
+// readVarint reads a QUIC variable-length integer.
+func readVarint(s *cryptobyte.String, v *uint64) bool {
+	if len(*s) == 0 {
+		return false
+	}
+	n := 1 << ((*s)[0] >> 6)
+	var b []byte
+	if !s.ReadBytes(&b, n) {
+		return false
+	}
+	*v = uint64(b[0] & 0x3f)
+	for _, c := range b[1:] {
+		*v = *v<<8 | uint64(c)
+	}
+	return true
+}
+
+// readVarintPrefixed reads data prefixed with its length as a QUIC
+// variable-length integer.
+func readVarintPrefixed(s *cryptobyte.String, out *cryptobyte.String) bool {
+	var n uint64
+	if !readVarint(s, &n) || n > uint64(len(*s)) {
+		return false
+	}
+	return s.ReadBytes((*[]byte)(out), int(n))
+}
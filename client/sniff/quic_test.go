@@ -0,0 +1,106 @@
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// appendVarint appends v as a QUIC variable-length integer.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(v)|0x80000000)
+}
+
+// sealInitial returns a client Initial packet of version carrying frames,
+// padded to 1200 bytes.
+func sealInitial(t *testing.T, version uint32, frames []byte) []byte {
+	t.Helper()
+	q := quicInitials[version]
+	dcid := []byte{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+	for len(frames) < 1200-64 {
+		frames = append(frames, frameTypePadding)
+	}
+
+	header := []byte{0xc0 | q.packetType<<4}
+	header = binary.BigEndian.AppendUint32(header, version)
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, 0)       // scid
+	header = appendVarint(header, 0) // token
+	header = binary.BigEndian.AppendUint16(header, uint16(1+len(frames)+16)|0x4000)
+	pnOffset := len(header)
+	header = append(header, 0) // packet number
+
+	secret, _ := hkdf.Extract(sha256.New, dcid, q.salt)
+	clientSecret, _ := expandLabel(secret, "client in", sha256.Size)
+	key, _ := expandLabel(clientSecret, q.keyLabel, 16)
+	iv, _ := expandLabel(clientSecret, q.ivLabel, 12)
+	hp, _ := expandLabel(clientSecret, q.hpLabel, 16)
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	packet := aead.Seal(header, iv, frames, header)
+
+	hpBlock, _ := aes.NewCipher(hp)
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+	return packet
+}
+
+// cryptoFrame returns a CRYPTO frame carrying data at offset.
+func cryptoFrame(offset int, data []byte) []byte {
+	f := appendVarint([]byte{frameTypeCrypto}, uint64(offset))
+	f = appendVarint(f, uint64(len(data)))
+	return append(f, data...)
+}
+
+func TestQUICServerName(t *testing.T) {
+	// The handshake message, without the TLS record header.
+	hello := clientHello(t, "quic.example.com")[recordHeaderLen:]
+	half := len(hello) / 2
+
+	var shuffled []byte
+	shuffled = append(shuffled, frameTypePing)
+	shuffled = append(shuffled, cryptoFrame(half, hello[half:])...)
+	shuffled = append(shuffled, frameTypePadding, frameTypePadding)
+	shuffled = append(shuffled, cryptoFrame(0, hello[:half])...)
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   string
+		err    error
+	}{
+		{"v1", sealInitial(t, quicVersion1, cryptoFrame(0, hello)), "quic.example.com", nil},
+		{"v2", sealInitial(t, quicVersion2, cryptoFrame(0, hello)), "quic.example.com", nil},
+		{"shuffled frames", sealInitial(t, quicVersion1, shuffled), "quic.example.com", nil},
+		{"hello in next packet", sealInitial(t, quicVersion1, cryptoFrame(0, hello[:40])), "", ErrIncomplete},
+		{"short header", []byte{0x40, 1, 2, 3, 4, 5, 6, 7, 8}, "", ErrNoDomain},
+		{"unknown version", append([]byte{0xc0, 0xff, 0, 0, 0x1d}, make([]byte, 40)...), "", ErrNoDomain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := QUICServerName(tt.packet)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("QUICServerName() = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+
+	tampered := sealInitial(t, quicVersion1, cryptoFrame(0, hello))
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := QUICServerName(tampered); !errors.Is(err, ErrNoDomain) {
+		t.Errorf("tampered packet: err = %v, want ErrNoDomain", err)
+	}
+}
@@ -0,0 +1,205 @@
+// Package sniff extracts the domain a connection is for from its first
+// bytes: the server name of a TLS ClientHello, the Host header of an HTTP
+// request, or the server name in the ClientHello of a QUIC Initial packet.
+package sniff
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+var (
+	// ErrIncomplete means the data ends before the domain; more of the
+	// connection may reveal it.
+	ErrIncomplete = errors.New("sniff: incomplete data")
+	ErrNoDomain   = errors.New("sniff: no domain found")
+)
+
+// Domain returns the domain of the TLS ClientHello or HTTP request that
+// data, the first bytes a client sent on a TCP connection, starts with.
+func Domain(data []byte) (string, error) {
+	if len(data) > 0 && data[0] == recordTypeHandshake {
+		return TLSServerName(data)
+	}
+	return HTTPHost(data)
+}
+
+const (
+	recordTypeHandshake        = 0x16
+	handshakeTypeClientHello   = 0x01
+	extensionServerName        = 0x0000
+	serverNameTypeHostName     = 0x00
+	recordHeaderLen            = 5
+	handshakeHeaderLen         = 4
+	maxHandshakeFragmentLength = 1 << 14
+)
+
+// TLSServerName returns the server name of the TLS ClientHello that data
+// starts with.
+func TLSServerName(data []byte) (string, error) {
+	if len(data) < recordHeaderLen {
+		if len(data) > 0 && data[0] != recordTypeHandshake {
+			return "", ErrNoDomain
+		}
+		return "", ErrIncomplete
+	}
+	if data[0] != recordTypeHandshake || data[1] != 0x03 {
+		return "", ErrNoDomain
+	}
+	n := int(data[3])<<8 | int(data[4])
+	if n > maxHandshakeFragmentLength {
+		return "", ErrNoDomain
+	}
+	fragment := data[recordHeaderLen:]
+	complete := len(fragment) >= n
+	if complete {
+		fragment = fragment[:n]
+	}
+	name, err := clientHelloServerName(fragment)
+	if errors.Is(err, ErrIncomplete) && complete {
+		// A ClientHello split over several records is not worth the
+		// reassembly.
+		return "", ErrNoDomain
+	}
+	return name, err
+}
+
+// clientHelloServerName returns the server name of the ClientHello
+// handshake message msg starts with. msg may be truncated: the server name
+// is found as long as the extension is within it.
+func clientHelloServerName(msg []byte) (string, error) {
+	if len(msg) < handshakeHeaderLen {
+		return "", ErrIncomplete
+	}
+	if msg[0] != handshakeTypeClientHello {
+		return "", ErrNoDomain
+	}
+	n := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	body := msg[handshakeHeaderLen:]
+	complete := len(body) >= n
+	if complete {
+		body = body[:n]
+	}
+	// Running out of body is only an error once the whole message is
+	// there.
+	short := ErrIncomplete
+	if complete {
+		short = ErrNoDomain
+	}
+
+	s := cryptobyte.String(body)
+	var sessionID, cipherSuites, compression, extensions cryptobyte.String
+	if !s.Skip(2+32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compression) {
+		return "", short
+	}
+	var extLen uint16
+	if !s.ReadUint16(&extLen) {
+		return "", short
+	}
+	extensions = s
+	if len(extensions) > int(extLen) {
+		extensions = extensions[:extLen]
+	}
+	for !extensions.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&typ) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return "", short
+		}
+		if typ == extensionServerName {
+			return parseServerName(data)
+		}
+	}
+	return "", short
+}
+
+// parseServerName returns the host name in the data of a server_name
+// extension.
+func parseServerName(data cryptobyte.String) (string, error) {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) {
+		return "", ErrNoDomain
+	}
+	for !list.Empty() {
+		var typ uint8
+		var name cryptobyte.String
+		if !list.ReadUint8(&typ) || !list.ReadUint16LengthPrefixed(&name) {
+			return "", ErrNoDomain
+		}
+		if typ == serverNameTypeHostName {
+			return domainName(string(name))
+		}
+	}
+	return "", ErrNoDomain
+}
+
+// httpMethods are the methods an HTTP/1 request is recognised by.
+var httpMethods = []string{"GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "PATCH", "TRACE", "CONNECT"}
+
+// HTTPHost returns the host of the Host header of the HTTP/1 request data
+// starts with.
+func HTTPHost(data []byte) (string, error) {
+	sp := bytes.IndexByte(data, ' ')
+	if sp < 0 {
+		for _, m := range httpMethods {
+			if len(data) < len(m)+1 && strings.HasPrefix(m, string(data)) {
+				return "", ErrIncomplete
+			}
+		}
+		return "", ErrNoDomain
+	}
+	if !slices.Contains(httpMethods, string(data[:sp])) {
+		return "", ErrNoDomain
+	}
+
+	// Skip the request line.
+	eol := bytes.Index(data, []byte("\r\n"))
+	if eol < 0 {
+		return "", ErrIncomplete
+	}
+	rest := data[eol+2:]
+	for {
+		eol := bytes.Index(rest, []byte("\r\n"))
+		if eol < 0 {
+			return "", ErrIncomplete
+		}
+		if eol == 0 {
+			return "", ErrNoDomain // end of the headers
+		}
+		line := rest[:eol]
+		rest = rest[eol+2:]
+		key, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !strings.EqualFold(string(key), "Host") {
+			continue
+		}
+		host := strings.TrimSpace(string(value))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return domainName(host)
+	}
+}
+
+// domainName returns name as a lower case domain without the trailing
+// dot, or ErrNoDomain if it is an IP or not a valid host name.
+func domainName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" || len(name) > 253 || net.ParseIP(strings.Trim(name, "[]")) != nil {
+		return "", ErrNoDomain
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return "", ErrNoDomain
+		}
+	}
+	return name, nil
+}
@@ -0,0 +1,80 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+)
+
+// clientHello returns the first TLS record a client connecting to
+// serverName sends.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		_ = tls.Client(c, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		c.Close()
+	}()
+	buf := make([]byte, 1<<16)
+	n := 0
+	for n < recordHeaderLen || n < recordHeaderLen+(int(buf[3])<<8|int(buf[4])) {
+		m, err := s.Read(buf[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	return buf[:n]
+}
+
+func TestTLSServerName(t *testing.T) {
+	hello := clientHello(t, "www.Example.com")
+	noSNI := clientHello(t, "")
+	tests := []struct {
+		name string
+		data []byte
+		want string
+		err  error
+	}{
+		{"hello", hello, "www.example.com", nil},
+		{"truncated record", hello[:3], "", ErrIncomplete},
+		{"truncated hello", hello[:60], "", ErrIncomplete},
+		{"no server name", noSNI, "", ErrNoDomain},
+		{"not tls", []byte("SSH-2.0-OpenSSH_9.6\r\n"), "", ErrNoDomain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Domain(tt.data)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("Domain() = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestHTTPHost(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+		err  error
+	}{
+		{"host", "GET / HTTP/1.1\r\nUser-Agent: curl\r\nHost: Example.com\r\n\r\n", "example.com", nil},
+		{"host with port", "POST /x HTTP/1.1\r\nhost: example.com:8080\r\n\r\n", "example.com", nil},
+		{"ip host", "GET / HTTP/1.1\r\nHost: 1.2.3.4\r\n\r\n", "", ErrNoDomain},
+		{"no host", "GET / HTTP/1.0\r\nAccept: */*\r\n\r\n", "", ErrNoDomain},
+		{"partial headers", "GET / HTTP/1.1\r\nAccept: */*\r\n", "", ErrIncomplete},
+		{"partial method", "PO", "", ErrIncomplete},
+		{"not http", "SSH-2.0-OpenSSH_9.6\r\n", "", ErrNoDomain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Domain([]byte(tt.data))
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("Domain() = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
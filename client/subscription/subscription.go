@@ -0,0 +1,227 @@
+// Package subscription keeps the server profiles of the configured
+// subscriptions up to date: it loads them at startup, caches the last good
+// copy on disk and refreshes them in the background.
+package subscription
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/log"
+)
+
+// maxBodySize bounds a subscription response.
+const maxBodySize = 4 << 20
+
+// ApplyFunc switches the running client to a new server list and, on
+// success, makes it the config's server list.
+type ApplyFunc func(servers []*config.ServerProfile) error
+
+// Updater merges subscriptions into a client config.
+type Updater struct {
+	cfg      *config.ClientConfig
+	cacheDir string
+	client   *http.Client
+
+	mu      sync.Mutex
+	fetched map[string]time.Time
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// DefaultCacheDir returns the directory subscriptions are cached in, or ""
+// if the user cache directory is unknown.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "easyss", "subscriptions")
+}
+
+// New returns an Updater for cfg.Subscriptions. Fetches dial with dial, or
+// the default dialer if nil; an empty cacheDir disables the disk cache.
+func New(cfg *config.ClientConfig, cacheDir string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *Updater {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if dial != nil {
+		tr.DialContext = dial
+	}
+	return &Updater{
+		cfg:      cfg,
+		cacheDir: cacheDir,
+		client:   &http.Client{Transport: tr, Timeout: cfg.TimeoutDuration()},
+		fetched:  make(map[string]time.Time),
+	}
+}
+
+// Load merges every subscription into the config before the client starts.
+// The cached copy is used when there is one, so startup does not wait for
+// the network; otherwise the subscription is fetched. Failures are logged
+// and leave the subscription's servers out.
+func (u *Updater) Load(ctx context.Context) {
+	for _, sub := range u.cfg.Subscriptions {
+		servers, err := u.cached(sub.URL)
+		if err != nil {
+			servers, err = u.Fetch(ctx, sub.URL)
+		}
+		if err != nil {
+			log.Warn("[SUBSCRIPTION] load", "url", sub.URL, "err", err)
+			continue
+		}
+		u.cfg.MergeSubscription(sub.URL, servers)
+		log.Info("[SUBSCRIPTION] loaded", "url", sub.URL, "servers", len(servers))
+	}
+}
+
+// Start refreshes each subscription with a positive interval in the
+// background until Stop, passing changed server lists to apply.
+// Subscriptions Load took from the cache are refreshed right away.
+func (u *Updater) Start(apply ApplyFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	u.cancel = cancel
+	for _, sub := range u.cfg.Subscriptions {
+		interval := sub.IntervalDuration()
+		if interval <= 0 {
+			continue
+		}
+		u.mu.Lock()
+		last := u.fetched[sub.URL]
+		u.mu.Unlock()
+		wait := max(time.Until(last.Add(interval)), 0)
+
+		u.wg.Go(func() {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-timer.C:
+				}
+				u.refresh(ctx, sub.URL, apply)
+				timer.Reset(interval)
+			}
+		})
+	}
+}
+
+// Stop ends background refreshing.
+func (u *Updater) Stop() {
+	if u.cancel != nil {
+		u.cancel()
+	}
+	u.wg.Wait()
+}
+
+func (u *Updater) refresh(ctx context.Context, src string, apply ApplyFunc) {
+	servers, err := u.Fetch(ctx, src)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Warn("[SUBSCRIPTION] refresh", "url", src, "err", err)
+		}
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// Merge into copies so the live profiles are untouched if apply fails.
+	cur := u.cfg.ServerList()
+	next := &config.ClientConfig{Servers: make([]*config.ServerProfile, 0, len(cur))}
+	for _, s := range cur {
+		srv := *s
+		next.Servers = append(next.Servers, &srv)
+	}
+	if !next.MergeSubscription(src, servers) {
+		log.Debug("[SUBSCRIPTION] unchanged", "url", src)
+		return
+	}
+	if err := apply(next.Servers); err != nil {
+		log.Warn("[SUBSCRIPTION] apply", "url", src, "err", err)
+		return
+	}
+	log.Info("[SUBSCRIPTION] servers updated", "url", src, "servers", len(next.Servers))
+}
+
+// Fetch downloads and parses src, an http(s) URL or a local file path, and
+// caches the body on success.
+func (u *Updater) Fetch(ctx context.Context, src string) ([]*config.ServerProfile, error) {
+	body, err := u.read(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	servers, err := config.ParseServerList(body)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	u.fetched[src] = time.Now()
+	u.mu.Unlock()
+	if err := u.writeCache(src, body); err != nil {
+		log.Warn("[SUBSCRIPTION] write cache", "url", src, "err", err)
+	}
+	return servers, nil
+}
+
+func (u *Updater) read(ctx context.Context, src string) ([]byte, error) {
+	if !isRemote(src) {
+		return os.ReadFile(strings.TrimPrefix(src, "file://"))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+}
+
+func (u *Updater) cachePath(src string) string {
+	sum := sha256.Sum256([]byte(src))
+	return filepath.Join(u.cacheDir, hex.EncodeToString(sum[:8])+".txt")
+}
+
+func (u *Updater) cached(src string) ([]*config.ServerProfile, error) {
+	if u.cacheDir == "" {
+		return nil, os.ErrNotExist
+	}
+	body, err := os.ReadFile(u.cachePath(src))
+	if err != nil {
+		return nil, err
+	}
+	return config.ParseServerList(body)
+}
+
+func (u *Updater) writeCache(src string, body []byte) error {
+	if u.cacheDir == "" || !isRemote(src) {
+		return nil
+	}
+	if err := os.MkdirAll(u.cacheDir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(u.cachePath(src), body, 0o600)
+}
+
+func isRemote(src string) bool {
+	uu, err := url.Parse(src)
+	return err == nil && (uu.Scheme == "http" || uu.Scheme == "https")
+}
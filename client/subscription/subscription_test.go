@@ -0,0 +1,105 @@
+package subscription
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nange/easyss/v3/client/config"
+)
+
+func link(name, addr string) string {
+	return (&config.ServerProfile{Name: name, Address: addr, Port: 443, Password: "p", Method: "aes-256-gcm"}).Link()
+}
+
+func TestLoadAndRefresh(t *testing.T) {
+	var body atomic.Value
+	body.Store(link("jp", "jp.example.com") + "\n" + link("us", "us.example.com"))
+	var up atomic.Bool
+	up.Store(true)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(body.Load().(string)))
+	}))
+	defer ts.Close()
+
+	cacheDir := t.TempDir()
+	newCfg := func() *config.ClientConfig {
+		cfg := config.DefaultConfig()
+		cfg.Servers = []*config.ServerProfile{{Name: "home", Address: "home.example.com", Port: 443}}
+		cfg.Subscriptions = []config.Subscription{{URL: ts.URL}}
+		return cfg
+	}
+
+	cfg := newCfg()
+	u := New(cfg, cacheDir, nil)
+	u.Load(context.Background())
+	if got := strings.Join(cfg.ServerListAddrs(), ","); got != "home.example.com:443,jp.example.com:443,us.example.com:443" {
+		t.Fatalf("servers after load = %s", got)
+	}
+
+	// A restart while the subscription is unreachable uses the cache.
+	up.Store(false)
+	cached := newCfg()
+	New(cached, cacheDir, nil).Load(context.Background())
+	if len(cached.Servers) != 3 {
+		t.Errorf("servers from cache = %v", cached.ServerListAddrs())
+	}
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 1 {
+		t.Errorf("cache entries = %d, want 1", len(entries))
+	}
+
+	up.Store(true)
+	cfg.SetDefaultServerIndex(cfg.ServerIndex("us"))
+	body.Store(link("us", "us2.example.com"))
+	var applied []*config.ServerProfile
+	apply := func(servers []*config.ServerProfile) error {
+		applied = servers
+		cfg.Servers = servers
+		return nil
+	}
+	u.refresh(context.Background(), ts.URL, apply)
+	if got := strings.Join(cfg.ServerListAddrs(), ","); got != "home.example.com:443,us2.example.com:443" {
+		t.Fatalf("servers after refresh = %s", got)
+	}
+	if cfg.DefaultServer().Name != "us" {
+		t.Errorf("default = %q, want us", cfg.DefaultServer().Name)
+	}
+
+	applied = nil
+	u.refresh(context.Background(), ts.URL, apply)
+	if applied != nil {
+		t.Error("an unchanged subscription should not be applied")
+	}
+
+	up.Store(false)
+	u.refresh(context.Background(), ts.URL, apply)
+	if len(cfg.Servers) != 2 {
+		t.Error("a failed refresh must keep the current servers")
+	}
+}
+
+func TestLocalFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.txt")
+	if err := os.WriteFile(path, []byte(link("jp", "jp.example.com")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.DefaultConfig()
+	cfg.Subscriptions = []config.Subscription{{URL: "file://" + path}}
+	cacheDir := t.TempDir()
+	New(cfg, cacheDir, nil).Load(context.Background())
+	if len(cfg.Servers) != 1 || cfg.Servers[0].Name != "jp" {
+		t.Fatalf("servers = %v", cfg.ServerListAddrs())
+	}
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 0 {
+		t.Error("local subscriptions should not be cached")
+	}
+}
@@ -6,7 +6,6 @@ import (
 
 	"github.com/nange/easyss/v3/client/router"
 	"github.com/nange/easyss/v3/log"
-	"github.com/nange/easyss/v3/protocol"
 	"github.com/nange/easyss/v3/util/bytespool"
 	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
 	"gvisor.dev/gvisor/pkg/buffer"
@@ -19,22 +18,20 @@ import (
 )
 
 type ICMPProxy interface {
-	OpenICMPStream(ctx context.Context, target string, echoPayload []byte, method protocol.Method) (replyPayload []byte, err error)
+	OpenICMPStream(ctx context.Context, target string, echoPayload []byte) (replyPayload []byte, err error)
 }
 
 type ICMPHandler struct {
 	router *router.Router
 	proxy  ICMPProxy
-	method protocol.Method
 }
 
 func NewICMPHandler(rt *router.Router) *ICMPHandler {
 	return &ICMPHandler{router: rt}
 }
 
-func (h *ICMPHandler) SetProxy(proxy ICMPProxy, method protocol.Method) {
+func (h *ICMPHandler) SetProxy(proxy ICMPProxy) {
 	h.proxy = proxy
-	h.method = method
 }
 
 func (h *ICMPHandler) HandlePacket(pkt adapter.Packet) bool {
@@ -45,24 +42,24 @@ func (h *ICMPHandler) HandlePacket(pkt adapter.Packet) bool {
 	id := pkt.ID()
 	dstAddr := id.LocalAddress.String()
 
-	rule := h.router.MatchHostRule(dstAddr)
+	decision := h.router.MatchConn(router.NetworkICMP, dstAddr, 0)
 
-	switch rule {
+	switch decision.Rule {
 	case router.HostRuleDirect:
 		log.Info("[ICMP_DIRECT]", "dst", dstAddr)
 		return false
 	case router.HostRuleBlock:
 		log.Info("[ICMP_BLOCK] blocked", "dst", dstAddr)
 		return true
-	case router.HostRuleProxy:
-		log.Info("[ICMP_PROXY]", "dst", dstAddr)
-		return h.handleProxyICMP(pkt)
+	case router.HostRuleProxy, router.HostRuleRace:
+		log.Info("[ICMP_PROXY]", "dst", dstAddr, "outbound", decision.Outbound)
+		return h.handleProxyICMP(pkt, decision.Outbound)
 	default:
 		return false
 	}
 }
 
-func (h *ICMPHandler) handleProxyICMP(pkt adapter.Packet) bool {
+func (h *ICMPHandler) handleProxyICMP(pkt adapter.Packet, outbound string) bool {
 	if h.proxy == nil {
 		log.Debug("[TUN-ICMP] proxy not configured, falling back to direct")
 		return false
@@ -100,12 +97,12 @@ func (h *ICMPHandler) handleProxyICMP(pkt adapter.Packet) bool {
 	clonedID := pkt.ID()
 	clonedStack := pkt.Stack()
 
-	go h.processProxyICMP(clonedStack, clonedID, cloned)
+	go h.processProxyICMP(clonedStack, clonedID, cloned, outbound)
 
 	return true
 }
 
-func (h *ICMPHandler) processProxyICMP(s *stack.Stack, id stack.TransportEndpointID, pkt *stack.PacketBuffer) {
+func (h *ICMPHandler) processProxyICMP(s *stack.Stack, id stack.TransportEndpointID, pkt *stack.PacketBuffer, outbound string) {
 	defer pkt.DecRef()
 
 	netProto := pkt.NetworkProtocolNumber
@@ -141,10 +138,10 @@ func (h *ICMPHandler) processProxyICMP(s *stack.Stack, id stack.TransportEndpoin
 		dstAddr = ipHdr.DestinationAddress()
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(router.WithOutbound(context.Background(), outbound), 5*time.Second)
 	defer cancel()
 
-	replyPayload, err := h.proxy.OpenICMPStream(ctx, dstAddr.String(), echoBody, h.method)
+	replyPayload, err := h.proxy.OpenICMPStream(ctx, dstAddr.String(), echoBody)
 	if err != nil {
 		log.Debug("[TUN-ICMP] proxy icmp failed", "dst", dstAddr.String(), "err", err)
 		return
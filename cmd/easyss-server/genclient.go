@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	clientconfig "github.com/nange/easyss/v3/client/config"
+	sharedconfig "github.com/nange/easyss/v3/config"
+	"github.com/nange/easyss/v3/server/config"
+)
+
+// clientBundle is everything a client needs to connect to this server.
+type clientBundle struct {
+	Full   *clientconfig.ClientConfig
+	Simple *sharedconfig.SimpleConfig
+	Link   string
+}
+
+// runGenClient implements "easyss-server gen-client": it derives client
+// configs and a share link from the server config, so the two cannot drift.
+func runGenClient(args []string) int {
+	fs := flag.NewFlagSet("gen-client", flag.ContinueOnError)
+	var configFile, addr, name, format, outDir string
+	fs.StringVar(&configFile, "c", "config.json", "specify config file")
+	fs.StringVar(&addr, "addr", "", "address clients connect to, host or host:port (default: server.domain and the listen port)")
+	fs.StringVar(&name, "name", "", "server name in the client config and link")
+	fs.StringVar(&format, "format", "all", "what to print: all, full, simple or link")
+	fs.StringVar(&outDir, "o", "", "write client.json, client-simple.json and link.txt into this directory instead of printing")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	switch format {
+	case "all", "full", "simple", "link":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", format)
+		return 2
+	}
+
+	fileCfg, err := loadFileConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	b, err := genClient(fileCfg, addr, name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gen-client:", err)
+		return 1
+	}
+
+	full, _ := json.MarshalIndent(b.Full, "", "  ")
+	simple, _ := json.MarshalIndent(b.Simple, "", "  ")
+	if outDir != "" {
+		files := map[string][]byte{
+			"client.json":        full,
+			"client-simple.json": simple,
+			"link.txt":           []byte(b.Link),
+		}
+		if err := os.MkdirAll(outDir, 0o700); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for file, data := range files {
+			// The files contain the password.
+			if err := os.WriteFile(filepath.Join(outDir, file), append(data, '\n'), 0o600); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		fmt.Printf("client configs and link written to %s\n", outDir)
+		return 0
+	}
+	printClientBundle(os.Stdout, format, full, simple, b.Link)
+	return 0
+}
+
+func printClientBundle(w io.Writer, format string, full, simple []byte, link string) {
+	switch format {
+	case "full":
+		fmt.Fprintln(w, string(full))
+	case "simple":
+		fmt.Fprintln(w, string(simple))
+	case "link":
+		fmt.Fprintln(w, link)
+	default:
+		fmt.Fprintln(w, "# client config, full mode (easyss -c client.json)")
+		fmt.Fprintln(w, string(full))
+		fmt.Fprintln(w, "\n# client config, simple mode")
+		fmt.Fprintln(w, string(simple))
+		fmt.Fprintln(w, "\n# share link: easyss import-link '<link>', or encode it as a QR code")
+		fmt.Fprintln(w, link)
+	}
+}
+
+// genClient builds the client side of fc. addr overrides where clients
+// connect; the server domain then becomes the SNI. A certificate from
+// cert_path that does not verify against the system roots is pinned.
+func genClient(fc *config.FileConfig, addr, name string) (*clientBundle, error) {
+	cfg := fc.EffectiveServerConfig()
+	if cfg.Password == "" {
+		return nil, errors.New("server.password is empty")
+	}
+
+	host, port := cfg.Domain, listenPort(cfg.Listen)
+	if addr != "" {
+		h, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			h = strings.Trim(addr, "[]")
+		} else if port, err = strconv.Atoi(p); err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port in -addr %q", addr)
+		}
+		host = h
+	}
+	if host == "" {
+		return nil, errors.New("server.domain is empty, pass -addr")
+	}
+
+	srv := &clientconfig.ServerProfile{
+		Name:     name,
+		Address:  host,
+		Port:     port,
+		Password: cfg.Password,
+		Method:   cfg.GetAllowedMethods()[0],
+		Default:  true,
+	}
+	if cfg.Domain != "" && cfg.Domain != host {
+		srv.SNI = cfg.Domain
+	}
+	if cfg.CertPath != "" {
+		serverName := srv.SNI
+		if serverName == "" {
+			serverName = host
+		}
+		pin, err := certPinIfUntrusted(cfg.CertPath, serverName)
+		if err != nil {
+			return nil, err
+		}
+		srv.Pin = pin
+	}
+
+	full := clientconfig.DefaultConfig()
+	full.Servers = []*clientconfig.ServerProfile{srv}
+	if fc.Transport.Protocol != "" {
+		full.Transport.Protocol = fc.Transport.Protocol
+	}
+	if cfg.BatchWindowMS > 0 {
+		full.Shaper.BatchWindowMS = min(cfg.BatchWindowMS, 10)
+	}
+	if cfg.CoverBudgetRatio > 0 && cfg.CoverBudgetRatio <= 1 {
+		full.Shaper.CoverBudgetRatio = cfg.CoverBudgetRatio
+	}
+	if cfg.CoverBudgetCap > 0 {
+		full.Shaper.CoverBudgetCap = cfg.CoverBudgetCap
+	}
+	if fc.Timeout > 0 {
+		full.Timeout = fc.Timeout
+	}
+
+	simple := sharedconfig.NewSimpleConfig()
+	simple.Server = srv.Address
+	simple.ServerPort = srv.Port
+	simple.Password = srv.Password
+	simple.Method = srv.Method
+	simple.SN = srv.SNI
+	simple.Pin = srv.Pin
+	simple.Timeout = full.Timeout
+	simple.OutboundProto = "native"
+
+	return &clientBundle{Full: full, Simple: simple, Link: srv.Link()}, nil
+}
+
+// listenPort returns the port of a listen address, or 443.
+func listenPort(listen string) int {
+	_, p, err := net.SplitHostPort(listen)
+	if err != nil {
+		return 443
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 {
+		return 443
+	}
+	return port
+}
+
+// certPinIfUntrusted returns the pin of the leaf certificate in certPath if
+// clients could not verify it for serverName with the system roots, as with
+// self-signed certificates, and "" otherwise.
+func certPinIfUntrusted(certPath, serverName string) (string, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return "", fmt.Errorf("read certificate: %w", err)
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no certificate in %s", certPath)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	opts := x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates}
+	if _, err := certs[0].Verify(opts); err == nil {
+		return "", nil
+	}
+	return clientconfig.CertPin(certs[0].Raw), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	clientconfig "github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/server/config"
+)
+
+func writeSelfSignedCert(t *testing.T, host string) (string, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	return path, der
+}
+
+func TestGenClient(t *testing.T) {
+	fc := &config.FileConfig{
+		Server: config.ServerConfig{
+			Listen:           ":8443",
+			Domain:           "example.com",
+			Password:         "secret",
+			AllowedMethods:   []string{"chacha20-poly1305"},
+			BatchWindowMS:    5,
+			CoverBudgetRatio: 0.05,
+		},
+		Transport: config.TransportConfig{Protocol: "h2"},
+		Timeout:   60,
+	}
+
+	b, err := genClient(fc, "", "hk")
+	require.NoError(t, err)
+	srv := b.Full.Servers[0]
+	require.Equal(t, "example.com", srv.Address)
+	require.Equal(t, 8443, srv.Port)
+	require.Equal(t, "chacha20-poly1305", srv.Method)
+	require.Empty(t, srv.SNI)
+	require.Empty(t, srv.Pin, "certmagic certificates are publicly trusted")
+	require.Equal(t, 5, b.Full.Shaper.BatchWindowMS)
+	require.Equal(t, 0.05, b.Full.Shaper.CoverBudgetRatio)
+	require.Equal(t, 60, b.Full.Timeout)
+	require.Equal(t, "example.com", b.Simple.Server)
+	require.Equal(t, 8443, b.Simple.ServerPort)
+
+	linked, err := clientconfig.ParseLink(b.Link)
+	require.NoError(t, err)
+	require.Equal(t, "hk", linked.Name)
+	require.Equal(t, "secret", linked.Password)
+
+	// Clients reaching the server by IP use the domain as SNI.
+	b, err = genClient(fc, "203.0.113.7:443", "")
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.7", b.Full.Servers[0].Address)
+	require.Equal(t, 443, b.Full.Servers[0].Port)
+	require.Equal(t, "example.com", b.Full.Servers[0].SNI)
+	require.Equal(t, "example.com", b.Simple.SN)
+}
+
+func TestGenClientSelfSigned(t *testing.T) {
+	certPath, der := writeSelfSignedCert(t, "example.com")
+	fc := &config.FileConfig{Server: config.ServerConfig{
+		Listen:   ":443",
+		Domain:   "example.com",
+		Password: "secret",
+		CertPath: certPath,
+	}}
+	b, err := genClient(fc, "", "")
+	require.NoError(t, err)
+	require.Equal(t, clientconfig.CertPin(der), b.Full.Servers[0].Pin)
+	require.Equal(t, b.Full.Servers[0].Pin, b.Simple.Pin)
+
+	linked, err := clientconfig.ParseLink(b.Link)
+	require.NoError(t, err)
+	require.Equal(t, clientconfig.CertPin(der), linked.Pin)
+}
+
+func TestGenClientErrors(t *testing.T) {
+	_, err := genClient(&config.FileConfig{Server: config.ServerConfig{Domain: "example.com"}}, "", "")
+	require.Error(t, err, "password is required")
+
+	_, err = genClient(&config.FileConfig{Server: config.ServerConfig{Password: "secret"}}, "", "")
+	require.Error(t, err, "an address is required")
+
+	_, err = genClient(&config.FileConfig{Server: config.ServerConfig{Password: "secret", Domain: "example.com"}}, "example.com:x", "")
+	require.Error(t, err)
+}
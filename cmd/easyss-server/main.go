@@ -23,6 +23,15 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "probes":
+			os.Exit(runProbes(os.Args[2:]))
+		case "gen-client":
+			os.Exit(runGenClient(os.Args[2:]))
+		}
+	}
+
 	var printVer, showConfigExample bool
 	var configFile string
 	var pprofEnabled bool
@@ -43,19 +52,12 @@ func main() {
 		os.Exit(0)
 	}
 
-	data, err := os.ReadFile(configFile)
+	fileCfg, err := loadFileConfig(configFile)
 	if err != nil {
-		log.Error("[EASYSS-SERVER-V3] read config", "err", err)
-		os.Exit(1)
-	}
-
-	var cfg config.ServerConfig
-	var fileCfg config.FileConfig
-	if err := json.Unmarshal(data, &fileCfg); err != nil {
-		log.Error("[EASYSS-SERVER-V3] parse config", "err", err)
+		log.Error("[EASYSS-SERVER-V3] load config", "err", err)
 		os.Exit(1)
 	}
-	cfg = fileCfg.EffectiveServerConfig()
+	cfg := fileCfg.EffectiveServerConfig()
 	if pprofEnabled {
 		cfg.PprofEnabled = true
 	}
@@ -63,14 +65,11 @@ func main() {
 		fileCfg.Log.Level = "info"
 	}
 
-	// Resolve relative log file path to absolute based on executable directory.
-	if fileCfg.Log.FilePath != "" && !filepath.IsAbs(fileCfg.Log.FilePath) {
-		if dir := util.CurrentDir(); dir != "" {
-			fileCfg.Log.FilePath = filepath.Join(dir, fileCfg.Log.FilePath)
-		}
-	}
-
 	log.Init(fileCfg.Log.FilePath, fileCfg.Log.Level)
+	if err := log.SetPrivacy(fileCfg.Log.Privacy, fileCfg.Log.PrivacyKey); err != nil {
+		log.Error("[EASYSS-SERVER-V3] set log privacy", "err", err)
+		os.Exit(1)
+	}
 
 	log.Info("[EASYSS-SERVER-V3] " + version.String())
 
@@ -114,6 +113,33 @@ func main() {
 	os.Exit(0)
 }
 
+// loadFileConfig reads the server config file and resolves relative log file
+// paths to absolute ones based on the executable directory.
+func loadFileConfig(configFile string) (*config.FileConfig, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	var fileCfg config.FileConfig
+	if err := json.Unmarshal(data, &fileCfg); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	fileCfg.Log.FilePath = resolveLogPath(fileCfg.Log.FilePath)
+	fileCfg.Log.ProbeFilePath = resolveLogPath(fileCfg.Log.ProbeFilePath)
+	fileCfg.Log.AccessFilePath = resolveLogPath(fileCfg.Log.AccessFilePath)
+	return &fileCfg, nil
+}
+
+func resolveLogPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	if dir := util.CurrentDir(); dir != "" {
+		return filepath.Join(dir, path)
+	}
+	return path
+}
+
 func exampleV3ServerConfig() string {
 	cfg := config.FileConfig{
 		ConfigVersion: 3,
@@ -132,6 +158,10 @@ func exampleV3ServerConfig() string {
 			CoverBudgetRatio:     0.03,
 			CoverBudgetCap:       128 * 1024,
 			PprofEnabled:         false,
+			Egress: config.EgressConfig{
+				Sources:  nil,
+				Strategy: "fixed",
+			},
 		},
 		Transport: config.TransportConfig{
 			Protocol: "h2",
@@ -142,9 +172,17 @@ func exampleV3ServerConfig() string {
 			EnableUDP:     false,
 			AllHost:       false,
 		},
+		DNS: config.DNSConfig{
+			Servers:  nil,
+			Hosts:    nil,
+			Strategy: "happy_eyeballs",
+		},
 		Log: config.LogConfig{
-			Level:    "info",
-			FilePath: "easyss.log",
+			Level:          "info",
+			FilePath:       "easyss.log",
+			ProbeFilePath:  "",
+			AccessFilePath: "",
+			Privacy:        "off",
 		},
 		Timeout: 30,
 	}
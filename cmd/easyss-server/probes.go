@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nange/easyss/v3/server/probe"
+)
+
+// runProbes implements "easyss-server probes": it summarises the probe log
+// by reason and by source IP over a time window.
+func runProbes(args []string) int {
+	fs := flag.NewFlagSet("probes", flag.ContinueOnError)
+	var configFile, probeFile string
+	var since time.Duration
+	var top int
+	var asJSON bool
+	fs.StringVar(&configFile, "c", "config.json", "specify config file (used to locate the probe log)")
+	fs.StringVar(&probeFile, "f", "", "probe log file, overrides log.probe_file_path of the config")
+	fs.DurationVar(&since, "since", 24*time.Hour, "only count probes newer than this (0 for all)")
+	fs.IntVar(&top, "top", 20, "number of top sources to show (0 for all)")
+	fs.BoolVar(&asJSON, "json", false, "print the summary as JSON")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	if probeFile == "" {
+		fileCfg, err := loadFileConfig(configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		probeFile = fileCfg.Log.ProbeFilePath
+	}
+	if probeFile == "" {
+		fmt.Fprintln(os.Stderr, "probe log is not configured: set log.probe_file_path or pass -f")
+		return 1
+	}
+
+	var sinceTime time.Time
+	if since > 0 {
+		sinceTime = time.Now().Add(-since)
+	}
+	sum, err := probe.SummarizeFiles(probeFile, sinceTime, top)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "summarize probes:", err)
+		return 1
+	}
+
+	if asJSON {
+		b, _ := json.MarshalIndent(sum, "", "  ")
+		fmt.Println(string(b))
+		return 0
+	}
+	printProbeSummary(os.Stdout, sum)
+	return 0
+}
+
+func printProbeSummary(w io.Writer, sum probe.Summary) {
+	window := "all time"
+	if !sum.Since.IsZero() {
+		window = "since " + sum.Since.Format(time.DateTime)
+	}
+	fmt.Fprintf(w, "%d probes %s", sum.Total, window)
+	if sum.Skipped > 0 {
+		fmt.Fprintf(w, " (%d malformed lines skipped)", sum.Skipped)
+	}
+	fmt.Fprintln(w)
+	if sum.Total == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "\nReasons:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range sum.Reasons {
+		fmt.Fprintf(tw, "  %s\t%d\n", c.Key, c.Count)
+	}
+	_ = tw.Flush()
+
+	fmt.Fprintln(w, "\nTop sources:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  SOURCE\tCOUNT\tFIRST SEEN\tLAST SEEN\tREASONS")
+	for _, s := range sum.Sources {
+		reasons := make([]string, 0, len(s.Reasons))
+		for _, c := range s.Reasons {
+			reasons = append(reasons, fmt.Sprintf("%s=%d", c.Key, c.Count))
+		}
+		fmt.Fprintf(tw, "  %s\t%d\t%s\t%s\t%s\n", s.Source, s.Count,
+			s.FirstSeen.Format(time.DateTime), s.LastSeen.Format(time.DateTime), strings.Join(reasons, ","))
+	}
+	_ = tw.Flush()
+}
@@ -315,11 +315,11 @@ func newTestHarness(t *testing.T) *testHarness {
 			BudgetRatio: clientCfg.Shaper.CoverBudgetRatio,
 		},
 	}
-	handler := proxy.NewStreamHandler(cli.Transport(), cli.MasterKey(), shaperCfg, streamIdleTimeout)
+	handler := proxy.NewStreamHandler(cli.Transport(), cli.MasterKey(), method, shaperCfg, streamIdleTimeout)
 
 	// Start SOCKS5 proxy
 	socksAddr := testServerAddr + ":" + strconv.Itoa(testSocks5Port)
-	socksServer, err := proxy.NewSocks5Server(socksAddr, "", "", handler, cli.Router(), "", method, true, dialTimeout, udpIdleTimeout, cli.DialContext)
+	socksServer, err := proxy.NewSocks5Server(socksAddr, "", "", handler, cli.Router(), true, dialTimeout, udpIdleTimeout, cli.DialContext)
 	require.NoError(t, err)
 	h.socksServer = socksServer
 
@@ -333,7 +333,7 @@ func newTestHarness(t *testing.T) *testHarness {
 	// Start HTTP proxy
 	httpAddr := testServerAddr + ":" + strconv.Itoa(testHTTPPort)
 	socksProxyAddr := testServerAddr + ":" + strconv.Itoa(testSocks5Port)
-	httpProxy, err := proxy.NewHTTPProxyServer(httpAddr, socksProxyAddr, "", "", timeout, handler, cli.Router(), method, cli.DialContext)
+	httpProxy, err := proxy.NewHTTPProxyServer(httpAddr, socksProxyAddr, "", "", timeout, handler, cli.Router(), cli.DialContext)
 	require.NoError(t, err)
 	h.httpProxy = httpProxy
 
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/client/geodata"
+)
+
+// geodataTimeout bounds a whole "easyss update-geodata" run.
+const geodataTimeout = 10 * time.Minute
+
+// runUpdateGeoData implements "easyss update-geodata": it downloads the
+// GeoIP and GeoSite files routing.geodata configures and verifies their
+// checksums. The HTTPS_PROXY environment variable is honored.
+func runUpdateGeoData(args []string) int {
+	fs := flag.NewFlagSet("update-geodata", flag.ContinueOnError)
+	var configFile, geoIPFile, geoSiteDir string
+	fs.StringVar(&configFile, "c", "config.json", "specify config file")
+	fs.StringVar(&geoIPFile, "geoip-file", "", "write the GeoIP database here (default: routing.geodata.geoip_file)")
+	fs.StringVar(&geoSiteDir, "geosite-dir", "", "write the GeoSite lists here (default: routing.geodata.geosite_dir)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(resolveConfigFile(configFile))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "load config:", err)
+		return 1
+	}
+	gc := cfg.Routing.GeoData
+	if geoIPFile != "" {
+		gc.GeoIPFile = geoIPFile
+	}
+	if geoSiteDir != "" {
+		gc.GeoSiteDir = geoSiteDir
+	}
+	if gc.GeoIPFile == "" && gc.GeoSiteDir == "" {
+		fmt.Fprintln(os.Stderr, "set routing.geodata.geoip_file and/or routing.geodata.geosite_dir, or pass -geoip-file/-geosite-dir")
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), geodataTimeout)
+	defer cancel()
+	written, err := geodata.Update(ctx, &http.Client{}, gc)
+	for _, path := range written {
+		fmt.Println("updated", path)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "update geodata:", err)
+		return 1
+	}
+	fmt.Println("run \"easyss reload\" to apply the new data to a running client")
+	return 0
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/nange/easyss/v3/client/proxy"
+)
+
+const learnedUsage = "usage: easyss learned list [-c config.json]\n       easyss learned clear [-c config.json] [domain...]"
+
+// runLearned implements "easyss learned <command>": it lists the domains
+// learned routing moved to the proxy after their direct connections
+// failed, and clears them so the other rules route them again.
+func runLearned(args []string) int {
+	if len(args) == 0 || args[0] != "list" && args[0] != "clear" {
+		fmt.Fprintln(os.Stderr, learnedUsage)
+		return 2
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet("learned "+cmd, flag.ContinueOnError)
+	var configFile string
+	fs.StringVar(&configFile, "c", "config.json", "config file of the running client")
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if cmd == "list" && fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, learnedUsage)
+		return 2
+	}
+
+	if cmd == "list" {
+		resp, err := callLocalAPI(configFile, http.MethodGet, "/learned", 10*time.Second)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "learned list:", err)
+			return 1
+		}
+		defer resp.Body.Close() //nolint:errcheck
+		var res proxy.LearnedList
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			fmt.Fprintln(os.Stderr, "learned list:", err)
+			return 1
+		}
+		if !res.Enabled {
+			fmt.Fprintln(os.Stderr, "learned routing is disabled")
+		}
+		for _, d := range res.Domains {
+			state := "direct, " + fmt.Sprint(d.Failures) + " failures"
+			if !d.Expires.IsZero() {
+				state = "proxy until " + d.Expires.Local().Format(time.DateTime)
+			}
+			fmt.Printf("%s\t%s\t(last failure %s)\n", d.Domain, state, d.LastFailure.Local().Format(time.DateTime))
+		}
+		return 0
+	}
+
+	domains := fs.Args()
+	if len(domains) == 0 {
+		domains = []string{""}
+	}
+	code := 0
+	for _, domain := range domains {
+		path := "/learned"
+		if domain != "" {
+			path += "?" + url.Values{"domain": {domain}}.Encode()
+		}
+		resp, err := callLocalAPI(configFile, http.MethodDelete, path, 10*time.Second)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "learned clear:", err)
+			code = 1
+			continue
+		}
+		var res proxy.LearnedClearResult
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		_ = resp.Body.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "learned clear:", err)
+			code = 1
+			continue
+		}
+		fmt.Printf("cleared %d learned domains\n", res.Cleared)
+	}
+	return code
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nange/easyss/v3/client/config"
+)
+
+// runExportLink implements "easyss export-link": it prints easyss:// share
+// links for the servers of a config file.
+func runExportLink(args []string) int {
+	fs := flag.NewFlagSet("export-link", flag.ContinueOnError)
+	var configFile, name string
+	var all bool
+	fs.StringVar(&configFile, "c", "config.json", "specify config file")
+	fs.StringVar(&name, "name", "", "export the server with this name (default: the default server)")
+	fs.BoolVar(&all, "all", false, "export every server, one link per line")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "load config:", err)
+		return 1
+	}
+
+	var servers []*config.ServerProfile
+	switch {
+	case all:
+		servers = cfg.Servers
+	case name != "":
+		i := cfg.ServerIndex(name)
+		if i < 0 {
+			fmt.Fprintf(os.Stderr, "no server named %q\n", name)
+			return 1
+		}
+		servers = cfg.Servers[i : i+1]
+	default:
+		if srv := cfg.DefaultServer(); srv != nil {
+			servers = append(servers, srv)
+		}
+	}
+	if len(servers) == 0 {
+		fmt.Fprintln(os.Stderr, "no servers configured")
+		return 1
+	}
+	for _, srv := range servers {
+		fmt.Println(srv.Link())
+	}
+	return 0
+}
+
+// runImportLink implements "easyss import-link": it adds the servers of
+// easyss:// links to a config file, creating it if needed.
+func runImportLink(args []string) int {
+	fs := flag.NewFlagSet("import-link", flag.ContinueOnError)
+	var configFile string
+	var makeDefault bool
+	fs.StringVar(&configFile, "c", "config.json", "specify config file")
+	fs.BoolVar(&makeDefault, "default", false, "make the first imported server the default")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: easyss import-link [-c config.json] [-default] easyss://... [easyss://...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var servers []*config.ServerProfile
+	for _, link := range fs.Args() {
+		srv, err := config.ParseLink(link)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		servers = append(servers, srv)
+	}
+
+	cfg, err := config.LoadConfig(configFile)
+	if errors.Is(err, os.ErrNotExist) {
+		cfg, err = config.DefaultConfig(), nil
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "load config:", err)
+		return 1
+	}
+	cfg.ImportServers(servers...)
+	if makeDefault {
+		cfg.SetDefaultServerIndex(cfg.ServerIndex(servers[0].DisplayName()))
+	}
+	if err := config.SaveConfig(configFile, cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "save config:", err)
+		return 1
+	}
+	fmt.Printf("imported %d server(s) into %s\n", len(servers), configFile)
+	return 0
+}
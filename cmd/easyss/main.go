@@ -21,7 +21,6 @@ import (
 	sharedconfig "github.com/nange/easyss/v3/config"
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/pprof"
-	"github.com/nange/easyss/v3/protocol"
 	"github.com/nange/easyss/v3/runner"
 	"github.com/nange/easyss/v3/stats"
 	"github.com/nange/easyss/v3/util"
@@ -29,6 +28,25 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export-link":
+			os.Exit(runExportLink(os.Args[2:]))
+		case "import-link":
+			os.Exit(runImportLink(os.Args[2:]))
+		case "learned":
+			os.Exit(runLearned(os.Args[2:]))
+		case "reload":
+			os.Exit(runReload(os.Args[2:]))
+		case "route":
+			os.Exit(runRoute(os.Args[2:]))
+		case "rule":
+			os.Exit(runRule(os.Args[2:]))
+		case "update-geodata":
+			os.Exit(runUpdateGeoData(os.Args[2:]))
+		}
+	}
+
 	var printVer, showConfigExample, showConfigExampleSimple, daemon, disableTray, enableTun2socks, tunHelper bool
 	var configFile, cmdOutboundProto string
 	var pprofEnabled bool
@@ -64,6 +82,7 @@ func main() {
 	flag.StringVar(&sc.IPV6Rule, "ipv6-rule", "", "set the ipv6 rule(auto, enable, disable), default: auto")
 	flag.StringVar(&sc.DirectFile, "direct-file", "", "custom direct file (IPs/CIDRs/domains/regexps mixed, one per line; supports regexp: prefix and * glob)")
 	flag.StringVar(&sc.ProxyFile, "proxy-file", "", "custom proxy file (IPs/CIDRs/domains/regexps mixed, one per line; supports regexp: prefix and * glob)")
+	flag.StringVar(&sc.BlockFile, "block-file", "", "custom block file (IPs/CIDRs/domains/regexps mixed, one per line; supports regexp: prefix and * glob)")
 	flag.BoolVar(&pprofEnabled, "pprof", false, "enable pprof debug server on :6060")
 
 	flag.Parse()
@@ -88,17 +107,32 @@ func main() {
 		os.Exit(runTunHelper(tunHTTPAddr, tunFDSocket, logFile, sc.LogLevel))
 	}
 
-	if !filepath.IsAbs(configFile) {
-		if _, err := os.Stat(configFile); os.IsNotExist(err) {
+	configFile = resolveConfigFile(configFile)
+
+	if cmdOutboundProto != "" && cmdOutboundProto != "native" && cmdOutboundProto != "h2" {
+		log.Error("[EASYSS-V3] invalid outbound-proto", "value", cmdOutboundProto)
+		os.Exit(1)
+	}
+	// prepare applies the command line on top of a config; reloads of the
+	// config file go through it too.
+	prepare := func(cfg *config.ClientConfig) {
+		if cfg.Log.FilePath != "" && !filepath.IsAbs(cfg.Log.FilePath) {
 			if dir := util.CurrentDir(); dir != "" {
-				altPath := filepath.Join(dir, configFile)
-				if _, err := os.Stat(altPath); err == nil {
-					configFile = altPath
-				}
+				cfg.Log.FilePath = filepath.Join(dir, cfg.Log.FilePath)
 			}
 		}
+		if enableTun2socks {
+			cfg.Local.EnableTun2socks = true
+		}
+		if cmdOutboundProto != "" {
+			cfg.Transport.Protocol = "h2"
+		}
+		if pprofEnabled {
+			cfg.PprofEnabled = true
+		}
 	}
 
+	watchFile := true
 	cfg, err := config.LoadConfig(configFile)
 	if err != nil {
 		if sc.Server != "" && sc.Password != "" {
@@ -107,6 +141,7 @@ func main() {
 				log.Error("[EASYSS-V3] build config from args", "err", err)
 				os.Exit(1)
 			}
+			watchFile = false
 		} else {
 			log.Error("[EASYSS-V3] load config", "err", err)
 			os.Exit(1)
@@ -114,15 +149,14 @@ func main() {
 	} else {
 		config.ApplySimpleOverrides(cfg, sc)
 	}
-
-	if cfg.Log.FilePath != "" && !filepath.IsAbs(cfg.Log.FilePath) {
-		if dir := util.CurrentDir(); dir != "" {
-			cfg.Log.FilePath = filepath.Join(dir, cfg.Log.FilePath)
-		}
-	}
+	prepare(cfg)
 
 	log.Info("[EASYSS-V3] set log-level", "level", cfg.Log.Level)
 	log.Init(cfg.Log.FilePath, cfg.Log.Level)
+	if err := log.SetPrivacy(cfg.Log.Privacy, cfg.Log.PrivacyKey); err != nil {
+		log.Error("[EASYSS-V3] set log privacy", "err", err)
+		os.Exit(1)
+	}
 	log.Info("[EASYSS-V3] " + version.String())
 
 	// Make config file path absolute so that any elevated helper
@@ -133,22 +167,6 @@ func main() {
 		}
 	}
 
-	if enableTun2socks {
-		cfg.Local.EnableTun2socks = true
-	}
-	if cmdOutboundProto != "" {
-		switch cmdOutboundProto {
-		case "native", "h2":
-			cfg.Transport.Protocol = "h2"
-		default:
-			log.Error("[EASYSS-V3] invalid outbound-proto", "value", cmdOutboundProto)
-			os.Exit(1)
-		}
-	}
-	if pprofEnabled {
-		cfg.PprofEnabled = true
-	}
-
 	log.Info("[EASYSS-V3] config loaded",
 		"server", cfg.DefaultServerAddr(),
 		"socks_port", cfg.Local.SocksPort,
@@ -158,10 +176,33 @@ func main() {
 		"timeout", cfg.Timeout,
 	)
 
-	app := &App{cfg: cfg, configFile: configFile}
+	app := &App{cfg: cfg}
+	if watchFile {
+		app.configFile = configFile
+		app.prepare = func(next *config.ClientConfig) {
+			config.ApplySimpleOverrides(next, sc)
+			prepare(next)
+		}
+	}
 	runApp(disableTray, daemon, app)
 }
 
+// resolveConfigFile falls back to the executable's directory for a relative
+// config file that does not exist in the working directory.
+func resolveConfigFile(configFile string) string {
+	if !filepath.IsAbs(configFile) {
+		if _, err := os.Stat(configFile); os.IsNotExist(err) {
+			if dir := util.CurrentDir(); dir != "" {
+				altPath := filepath.Join(dir, configFile)
+				if _, err := os.Stat(altPath); err == nil {
+					return altPath
+				}
+			}
+		}
+	}
+	return configFile
+}
+
 func sigWait() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
@@ -170,11 +211,17 @@ func sigWait() {
 
 type App struct {
 	cfg        *config.ClientConfig
-	configFile string // absolute path to config file
+	configFile string // absolute path to config file, "" if not loaded from one
 	core       *runner.Core
 	tunMgr     *tun.Manager
 	pprofSrv   *http.Server
 
+	// prepare applies the command line to a reloaded config; onReload runs
+	// after each reload with the previous HTTP proxy port.
+	prepare   func(*config.ClientConfig)
+	onReload  func(prevHTTPPort int)
+	watchStop chan struct{}
+
 	statsCloser chan struct{}
 	statsOnce   sync.Once
 }
@@ -185,6 +232,11 @@ func (a *App) Start() error {
 		return err
 	}
 	a.core = core
+	if a.configFile != "" {
+		core.SetReloadFunc(a.Reload)
+		a.watchStop = make(chan struct{})
+		go a.watchConfig(a.watchStop)
+	}
 
 	if a.cfg.Local.EnableTun2socks {
 		// On macOS and Linux non-root, TUN is started via privilege
@@ -233,12 +285,8 @@ func (a *App) Start() error {
 				}
 				a.tunMgr = tun.New(tunCfg)
 
-				method := protocol.MethodFromString(a.cfg.DefaultServer().Method)
-				if method == 0 {
-					method = protocol.MethodAES256GCM
-				}
 				icmpHandler := tun.NewICMPHandler(a.core.Client.Router())
-				icmpHandler.SetProxy(a.core.StreamHandler, method)
+				icmpHandler.SetProxy(a.core.StreamHandler)
 				a.tunMgr.SetICMPHandler(icmpHandler)
 
 				go func() {
@@ -264,6 +312,10 @@ func (a *App) Stop() {
 	a.statsOnce.Do(func() {
 		close(a.statsCloser)
 	})
+	if a.watchStop != nil {
+		close(a.watchStop)
+		a.watchStop = nil
+	}
 
 	if a.tunMgr != nil {
 		a.tunMgr.Stop()
@@ -286,7 +338,7 @@ func (a *App) statsLoop() {
 				continue
 			}
 			snap := stats.Collect()
-			snap.TransportStats = a.core.Client.Transport().Stats()
+			snap.TransportStats = a.core.Client.TransportStats()
 			log.Info("[STATS]",
 				"uptime", snap.Uptime().Round(time.Second),
 				"conns", snap.Conns,
@@ -313,6 +365,8 @@ func (a *App) statsLoop() {
 				"dns(miss)", snap.DNSCacheMisses,
 				"dns(proxy)", snap.DNSProxyQueries,
 				"dns(direct)", snap.DNSDirectQueries,
+				"blocked", snap.BlockedConnections,
+				"dns(blocked)", snap.BlockedDNSQueries,
 				"padding", stats.HumanBytes(snap.PaddingBytes),
 				"records", snap.RecordsWritten,
 				"avg_rtt", snap.AvgRTT().Round(time.Millisecond),
@@ -346,6 +400,11 @@ func exampleV3Config() string {
 			CAPath:   "",
 			Default:  true,
 		}},
+		Failover: config.FailoverConfig{
+			Policy:        config.FailoverManual,
+			ProbeInterval: 30,
+			ProbeTarget:   config.DefaultProbeTarget,
+		},
 		Local: config.LocalConfig{
 			SocksPort:        2080,
 			HTTPPort:         3080,
@@ -375,6 +434,7 @@ func exampleV3Config() string {
 		Log: config.LogConfig{
 			Level:    "info",
 			FilePath: "easyss.log",
+			Privacy:  "off",
 		},
 		Timeout:      30,
 		AuthUsername: "",
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/client/proxy"
+	"github.com/nange/easyss/v3/log"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 2 * time.Second
+
+// Reload loads the config file again and applies it to the running core in
+// place. It returns the changed settings that need a restart.
+func (a *App) Reload() ([]string, error) {
+	if a.configFile == "" {
+		return nil, errors.New("not started from a config file")
+	}
+	core := a.core
+	if core == nil {
+		return nil, errors.New("not running")
+	}
+	next, err := config.LoadConfig(a.configFile)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+	if a.prepare != nil {
+		a.prepare(next)
+	}
+
+	prevSocks, prevHTTP := a.cfg.Local.SocksPort, a.cfg.Local.HTTPPort
+	pending, err := core.Reload(next)
+	if a.tunMgr != nil && a.cfg.Local.SocksPort != prevSocks {
+		// The TUN device forwards to the socks5 address it was started with.
+		pending = append(pending, "local.socks_port (tun2socks)")
+	}
+	if a.onReload != nil {
+		a.onReload(prevHTTP)
+	}
+	return pending, err
+}
+
+// watchConfig reloads the config file when it changes and on SIGHUP, until
+// stop is closed.
+func (a *App) watchConfig(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	last := fileVersion(a.configFile)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			log.Info("[EASYSS-V3] got SIGHUP, reloading config", "file", a.configFile)
+		case <-ticker.C:
+			v := fileVersion(a.configFile)
+			if v == last || v == "" {
+				continue
+			}
+			last = v
+			log.Info("[EASYSS-V3] config file changed, reloading", "file", a.configFile)
+		}
+		pending, err := a.Reload()
+		if err != nil {
+			log.Error("[EASYSS-V3] reload config", "err", err)
+			continue
+		}
+		if len(pending) > 0 {
+			log.Warn("[EASYSS-V3] some changes take effect after a restart", "settings", pending)
+		}
+	}
+}
+
+// fileVersion identifies the current content of a file by its size and
+// modification time, or is "" if it cannot be read.
+func fileVersion(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatInt(fi.Size(), 10) + "@" + fi.ModTime().String()
+}
+
+// runReload implements "easyss reload": it asks the running client to
+// reload its config file through the local HTTP proxy.
+func runReload(args []string) int {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	var configFile string
+	fs.StringVar(&configFile, "c", "config.json", "config file of the running client")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	resp, err := callLocalAPI(configFile, http.MethodPost, "/reload", 30*time.Second)
+	if errors.Is(err, errHTTPProxyDisabled) {
+		fmt.Fprintln(os.Stderr, err.Error()+"; send SIGHUP to the client instead")
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reload:", err)
+		return 1
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var res proxy.ReloadResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		fmt.Fprintln(os.Stderr, "reload:", err)
+		return 1
+	}
+	fmt.Println("configuration reloaded")
+	if len(res.RestartRequired) > 0 {
+		fmt.Println("restart to apply:", strings.Join(res.RestartRequired, ", "))
+	}
+	return 0
+}
+
+// errHTTPProxyDisabled is returned by callLocalAPI when the client has no
+// local HTTP proxy to serve the API.
+var errHTTPProxyDisabled = errors.New("the http proxy is disabled")
+
+// callLocalAPI sends a request for path to the local HTTP proxy of the
+// client running with configFile. Responses other than 200 OK are returned
+// as errors.
+func callLocalAPI(configFile, method, path string, timeout time.Duration) (*http.Response, error) {
+	cfg, err := config.LoadConfig(resolveConfigFile(configFile))
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+	if cfg.Local.HTTPPort <= 0 {
+		return nil, errHTTPProxyDisabled
+	}
+
+	req, err := http.NewRequest(method, "http://127.0.0.1:"+strconv.Itoa(cfg.Local.HTTPPort)+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(proxy.APIHeader, "1")
+	if cfg.AuthUsername != "" || cfg.AuthPassword != "" {
+		req.SetBasicAuth(cfg.AuthUsername, cfg.AuthPassword)
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
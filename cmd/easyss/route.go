@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nange/easyss/v3/client/proxy"
+	"github.com/nange/easyss/v3/client/router"
+)
+
+// runRoute implements "easyss route <command>".
+func runRoute(args []string) int {
+	if len(args) == 0 || args[0] != "explain" {
+		fmt.Fprintln(os.Stderr, "usage: easyss route explain [-c config.json] [-port N] [-network tcp|udp|icmp] [-process name|path|uid:N] <host>[:port]")
+		return 2
+	}
+	return runRouteExplain(args[1:])
+}
+
+// runRouteExplain implements "easyss route explain": it asks the running
+// client which rule routes a host and prints the answer, along with the
+// host's addresses and how connections made to them are routed.
+func runRouteExplain(args []string) int {
+	fs := flag.NewFlagSet("route explain", flag.ContinueOnError)
+	var configFile, network, proc string
+	var port int
+	fs.StringVar(&configFile, "c", "config.json", "config file of the running client")
+	fs.IntVar(&port, "port", 0, "destination port, for port rules")
+	fs.StringVar(&network, "network", "", "network of the connection (tcp, udp, icmp), for network rules")
+	fs.StringVar(&proc, "process", "", "program name, executable path or uid:N of the connecting process, for process rules")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: easyss route explain [-c config.json] [-port N] [-network tcp|udp|icmp] [-process name|path|uid:N] <host>[:port]")
+		return 2
+	}
+	host := fs.Arg(0)
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		if port, err = strconv.Atoi(p); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid port:", p)
+			return 2
+		}
+		host = h
+	}
+
+	q := url.Values{"host": {host}}
+	if port > 0 {
+		q.Set("port", strconv.Itoa(port))
+	}
+	if network != "" {
+		q.Set("network", network)
+	}
+	if proc != "" {
+		q.Set("process", proc)
+	}
+	resp, err := callLocalAPI(configFile, http.MethodGet, "/route/explain?"+q.Encode(), 10*time.Second)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "explain:", err)
+		return 1
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var res proxy.RouteExplanation
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		fmt.Fprintln(os.Stderr, "explain:", err)
+		return 1
+	}
+	fmt.Println(describeTrace(res.Trace))
+	if res.ResolveError != "" {
+		fmt.Println("resolve:", res.ResolveError)
+	}
+	if len(res.Addresses) > 0 {
+		fmt.Println("connections by address:")
+		for _, tr := range res.Addresses {
+			fmt.Println("  " + describeTrace(tr))
+		}
+	}
+	return 0
+}
+
+// describeTrace formats a trace as one line: the destination, the decision
+// and the check that made it.
+func describeTrace(tr router.Trace) string {
+	var b strings.Builder
+	if tr.Network != "" {
+		b.WriteString(tr.Network + " ")
+	}
+	b.WriteString(tr.Host)
+	if tr.Port > 0 {
+		b.WriteString(":" + strconv.Itoa(tr.Port))
+	}
+	if p := tr.Process; p != nil {
+		switch {
+		case p.Path != "":
+			b.WriteString(" from " + p.Path)
+		case p.Name != "":
+			b.WriteString(" from " + p.Name)
+		default:
+			b.WriteString(" from uid " + strconv.Itoa(p.UID))
+		}
+	}
+	b.WriteString(" -> " + tr.Rule.String())
+	if tr.Outbound != "" {
+		b.WriteString(" via " + tr.Outbound)
+	}
+	b.WriteString(" (")
+	switch tr.Source {
+	case router.SourceProxyRule:
+		b.WriteString("proxy_rule " + tr.Name)
+	case router.SourceCustomBlock:
+		b.WriteString("custom block list")
+	case router.SourceLAN:
+		b.WriteString("LAN address")
+	case router.SourcePolicyRule:
+		b.WriteString("routing.rules[" + tr.Name + "]")
+	case router.SourceRuleSet:
+		b.WriteString("rule set " + tr.Name)
+	case router.SourceCustomDirect:
+		b.WriteString("custom direct list")
+	case router.SourceCustomProxy:
+		b.WriteString("custom proxy list")
+	case router.SourceLearned:
+		b.WriteString("learned after direct failures")
+	case router.SourceGeoSite:
+		b.WriteString("geosite " + tr.Name)
+	case router.SourceGeoIP:
+		b.WriteString("geoip " + tr.Name)
+	case router.SourceTLD:
+		b.WriteString("country TLD")
+	case router.SourceRace:
+		if tr.Name == "" {
+			b.WriteString("no race winner yet")
+		} else {
+			b.WriteString("race won by " + tr.Name)
+		}
+	default:
+		b.WriteString(tr.Source)
+	}
+	if tr.Entry != "" {
+		b.WriteString(", entry " + strconv.Quote(tr.Entry))
+	}
+	if tr.Line > 0 {
+		b.WriteString(" at " + tr.File + ":" + strconv.Itoa(tr.Line))
+	}
+	b.WriteString(")")
+	return b.String()
+}
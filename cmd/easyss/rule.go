@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/nange/easyss/v3/client/proxy"
+)
+
+const ruleUsage = "usage: easyss rule add|remove [-c config.json] direct|proxy|block <entry>...\n       easyss rule list [-c config.json] direct|proxy|block"
+
+// runRule implements "easyss rule <command>": it lists and edits the
+// custom direct/proxy/block lists of the running client, which saves the
+// changes to the list files and applies them to new connections right away.
+func runRule(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, ruleUsage)
+		return 2
+	}
+	cmd := args[0]
+	if cmd != "add" && cmd != "remove" && cmd != "list" {
+		fmt.Fprintln(os.Stderr, ruleUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("rule "+cmd, flag.ContinueOnError)
+	var configFile string
+	fs.StringVar(&configFile, "c", "config.json", "config file of the running client")
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() < 1 || (cmd == "list") != (fs.NArg() == 1) {
+		fmt.Fprintln(os.Stderr, ruleUsage)
+		return 2
+	}
+	list := fs.Arg(0)
+
+	if cmd == "list" {
+		resp, err := callLocalAPI(configFile, http.MethodGet, "/rules?"+url.Values{"list": {list}}.Encode(), 10*time.Second)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "rule list:", err)
+			return 1
+		}
+		defer resp.Body.Close() //nolint:errcheck
+		var res proxy.RuleList
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			fmt.Fprintln(os.Stderr, "rule list:", err)
+			return 1
+		}
+		if res.File == "" {
+			fmt.Fprintf(os.Stderr, "no %s list file configured\n", list)
+			return 0
+		}
+		for _, e := range res.Entries {
+			fmt.Printf("%s:%d\t%s\n", res.File, e.Line, e.Entry)
+		}
+		return 0
+	}
+
+	method := http.MethodPost
+	if cmd == "remove" {
+		method = http.MethodDelete
+	}
+	code := 0
+	for _, entry := range fs.Args()[1:] {
+		q := url.Values{"list": {list}, "entry": {entry}}
+		resp, err := callLocalAPI(configFile, method, "/rules?"+q.Encode(), 10*time.Second)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rule %s %s: %v\n", cmd, entry, err)
+			code = 1
+			continue
+		}
+		var res proxy.RuleEditResult
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		_ = resp.Body.Close()
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "rule %s %s: %v\n", cmd, entry, err)
+			code = 1
+		case !res.Changed && cmd == "add":
+			fmt.Printf("%s: already in the %s list\n", entry, list)
+		case !res.Changed:
+			fmt.Printf("%s: not in the %s list\n", entry, list)
+		case cmd == "add":
+			fmt.Printf("%s: added to the %s list\n", entry, list)
+		default:
+			fmt.Printf("%s: removed from the %s list\n", entry, list)
+		}
+	}
+	return code
+}
@@ -28,6 +28,7 @@ func runApp(disableTray, daemon bool, app *App) {
 			closing:   make(chan struct{}),
 			trayBuilt: make(chan struct{}),
 		}
+		app.onReload = ta.afterReload
 
 		go func() {
 			c := make(chan os.Signal, 1)
@@ -58,6 +59,13 @@ func runApp(disableTray, daemon bool, app *App) {
 				proxyWasSet = true
 			}
 		}
+		app.onReload = func(prevHTTPPort int) {
+			if proxyWasSet && app.cfg.Local.HTTPPort != prevHTTPPort && app.cfg.Local.HTTPPort > 0 {
+				if err := setSysProxy(app.cfg.Local.HTTPPort); err != nil {
+					log.Warn("[EASYSS-V3] move system proxy to the new http port", "err", err)
+				}
+			}
+		}
 
 		if err := app.Start(); err != nil {
 			log.Error("[EASYSS-V3] start", "err", err)
@@ -6,11 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
 	"os"
 	"os/user"
 	"runtime"
+	"slices"
 	"sync"
 	"time"
 
@@ -19,7 +19,6 @@ import (
 	"github.com/nange/easyss/v3/client/tun"
 	"github.com/nange/easyss/v3/icon"
 	"github.com/nange/easyss/v3/log"
-	"github.com/nange/easyss/v3/protocol"
 	"github.com/nange/easyss/v3/util"
 )
 
@@ -158,12 +157,32 @@ func (a *TrayApp) selectServer(idx int) {
 		for _, v := range a.serverMenuItems {
 			v.SetChecked(false)
 		}
-		clone := a.cfg.Clone()
-		clone.SetDefaultServerIndex(idx)
-		if err := a.restartService(clone); err != nil {
-			log.Error("[SYSTRAY] changing server to", "addr", addr, "err", err)
+		// Without TUN the running client switches in place: listeners and
+		// established streams are kept and only new streams use the new
+		// server. TUN pins the server address in routes and DNS, so it
+		// still needs a full restart.
+		// Subscriptions may have changed the server list since the menu
+		// was built, so look the server up by address.
+		cur := slices.Index(a.cfg.ServerListAddrs(), addr)
+		if cur < 0 {
+			log.Error("[SYSTRAY] changing server to", "addr", addr, "err", "server no longer configured")
 			return
 		}
+		tunOn := a.TunMenu() != nil && a.TunMenu().IsChecked()
+		if !tunOn && a.core != nil && a.core.Client != nil {
+			if err := a.core.Client.SelectServer(cur); err != nil {
+				log.Error("[SYSTRAY] changing server to", "addr", addr, "err", err)
+				return
+			}
+			a.cfg.SetDefaultServerIndex(cur)
+		} else {
+			clone := a.cfg.Clone()
+			clone.SetDefaultServerIndex(cur)
+			if err := a.restartService(clone); err != nil {
+				log.Error("[SYSTRAY] changing server to", "addr", addr, "err", err)
+				return
+			}
+		}
 		a.serverMenuItems[idx].SetChecked(true)
 		log.Info("[SYSTRAY] changes server success to", "addr", addr)
 	}()
@@ -173,12 +192,13 @@ func (a *TrayApp) statsRefresher() {
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 
-	url := fmt.Sprintf("http://127.0.0.1:%d/stats", a.cfg.Local.HTTPPort)
 	httpClient := &http.Client{Timeout: 2 * time.Second}
 
 	for {
 		select {
 		case <-ticker.C:
+			// A reload may move the HTTP proxy to another port.
+			url := fmt.Sprintf("http://127.0.0.1:%d/stats", a.cfg.Local.HTTPPort)
 			rttMs, downSpeed := fetchStats(httpClient, url)
 			for i, mi := range a.serverMenuItems {
 				if mi.IsChecked() {
@@ -347,18 +367,7 @@ func (a *TrayApp) changeLogLevel(level string) {
 	a.cfg.Log.Level = level
 	log.Info("[SYSTRAY] log level changed", "level", level)
 
-	var slogLevel slog.Level
-	switch level {
-	case "debug":
-		slogLevel = slog.LevelDebug
-	case "warn":
-		slogLevel = slog.LevelWarn
-	case "error":
-		slogLevel = slog.LevelError
-	default:
-		slogLevel = slog.LevelInfo
-	}
-	log.SetLevel(slogLevel)
+	log.SetLevel(log.ParseLevel(level))
 
 	for l, item := range a.logLevelItems {
 		item.SetChecked(l == level)
@@ -432,7 +441,7 @@ func (a *TrayApp) createTun2socks() error {
 		return fmt.Errorf("client not initialized")
 	}
 	icmpHandler := tun.NewICMPHandler(a.core.Client.Router())
-	icmpHandler.SetProxy(a.core.StreamHandler, methodFromString(a.cfg.DefaultServer().Method))
+	icmpHandler.SetProxy(a.core.StreamHandler)
 	a.tunMgr.SetICMPHandler(icmpHandler)
 
 	go func() {
@@ -525,7 +534,10 @@ func (a *TrayApp) restartService(newCfg *config.ClientConfig) error {
 	}
 
 	*a.App = App{
-		cfg: newCfg,
+		cfg:        newCfg,
+		configFile: a.configFile,
+		prepare:    a.prepare,
+		onReload:   a.onReload,
 	}
 	if err := a.Start(); err != nil {
 		return err
@@ -539,6 +551,26 @@ func (a *TrayApp) restartService(newCfg *config.ClientConfig) error {
 	return nil
 }
 
+// afterReload brings the menus and the system proxy in line with a
+// reloaded configuration.
+func (a *TrayApp) afterReload(prevHTTPPort int) {
+	for r, item := range a.proxyRuleItems {
+		item.SetChecked(r == a.cfg.Routing.ProxyRule)
+	}
+	level := a.cfg.Log.Level
+	if level == "" {
+		level = "info"
+	}
+	for l, item := range a.logLevelItems {
+		item.SetChecked(l == level)
+	}
+	if a.cfg.Local.HTTPPort != prevHTTPPort && a.BrowserMenu() != nil && a.BrowserMenu().IsChecked() {
+		if err := a.setSysProxyOn(); err != nil {
+			log.Error("[SYSTRAY] reload: move sysproxy to the new http port", "err", err)
+		}
+	}
+}
+
 func (a *TrayApp) closeService() {
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -668,7 +700,3 @@ func (a *TrayApp) TunMenu() *systray.MenuItem {
 	defer a.mu.RUnlock()
 	return a.tunMenu
 }
-
-func methodFromString(s string) protocol.Method {
-	return protocol.MethodFromString(s)
-}
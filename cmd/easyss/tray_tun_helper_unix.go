@@ -138,7 +138,7 @@ func (a *TrayApp) createTun2socksViaHelper() error {
 	})
 
 	icmpHandler := tun.NewICMPHandler(a.core.Client.Router())
-	icmpHandler.SetProxy(a.core.StreamHandler, methodFromString(a.cfg.DefaultServer().Method))
+	icmpHandler.SetProxy(a.core.StreamHandler)
 	a.tunMgr.SetICMPHandler(icmpHandler)
 
 	go func() {
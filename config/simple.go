@@ -7,6 +7,9 @@ type SimpleConfig struct {
 	Method     string `json:"method"`
 	SN         string `json:"sn"`
 	CAPath     string `json:"ca_path"`
+	// Pin is the hex SHA-256 of the server certificate, see
+	// ServerProfile.Pin of the full-mode client config.
+	Pin string `json:"pin,omitempty"`
 
 	LocalPort        int  `json:"local_port"`
 	HTTPPort         int  `json:"http_port"`
@@ -20,10 +23,12 @@ type SimpleConfig struct {
 	IPV6Rule   string `json:"ipv6_rule"`
 	DirectFile string `json:"direct_file"`
 	ProxyFile  string `json:"proxy_file"`
+	BlockFile  string `json:"block_file,omitempty"`
 
 	Timeout     int    `json:"timeout"`
 	LogLevel    string `json:"log_level"`
 	LogFilePath string `json:"log_file_path"`
+	LogPrivacy  string `json:"log_privacy"`
 
 	TunConfig     string `json:"tun_config,omitempty"`
 	OutboundProto string `json:"outbound_proto"`
@@ -76,8 +76,14 @@ func log(level slog.Level, msg string, args ...any) {
 }
 
 func newReplaceAttrFunc(cn *time.Location) func([]string, slog.Attr) slog.Attr {
-	return func(_ []string, a slog.Attr) slog.Attr {
+	return func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) > 0 {
+			return redactAttr(a)
+		}
 		switch a.Key {
+		case slog.MessageKey:
+			return redactMessage(a)
+		case slog.LevelKey:
 		case slog.SourceKey:
 			source := a.Value.Any().(*slog.Source)
 
@@ -95,6 +101,8 @@ func newReplaceAttrFunc(cn *time.Location) func([]string, slog.Attr) slog.Attr {
 		case slog.TimeKey:
 			newTime := a.Value.Time().In(cn)
 			return slog.Time(a.Key, newTime)
+		default:
+			return redactAttr(a)
 		}
 		return a
 	}
@@ -152,17 +160,23 @@ func FileWriter(outputFile string) io.WriteCloser {
 	}
 }
 
-func Init(outputFile, level string) {
-	l := slog.LevelInfo
+// ParseLevel maps a configured level name (debug, info, warn, error) to a
+// slog.Level. Unknown names mean info.
+func ParseLevel(level string) slog.Level {
 	switch level {
 	case "debug":
-		l = slog.LevelDebug
+		return slog.LevelDebug
 	case "warn":
-		l = slog.LevelWarn
+		return slog.LevelWarn
 	case "error":
-		l = slog.LevelError
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
 	}
-	atomicLevel.SetLevel(l)
+}
+
+func Init(outputFile, level string) {
+	atomicLevel.SetLevel(ParseLevel(level))
 
 	if outputFile != "" {
 		SetLogger(slog.New(slog.NewMultiHandler(TextHandler(FileWriter(outputFile), &atomicLevel), DefaultHandler(&atomicLevel))))
@@ -0,0 +1,245 @@
+package log
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// PrivacyOff logs destinations verbatim.
+	PrivacyOff = "off"
+	// PrivacyHash replaces destinations with a keyed hash, so the same host
+	// can still be correlated across log lines without being revealed.
+	PrivacyHash = "hash"
+	// PrivacyTruncate keeps only a coarse form of destinations: the network
+	// prefix of IPs (/16 for IPv4, /32 for IPv6) and the TLD of domains.
+	PrivacyTruncate = "truncate"
+)
+
+// destinationKeys are attribute keys whose values are always destinations
+// (hosts, IPs, host:port pairs or lists of them). Values of the other keys,
+// and the message, are scanned for embedded IPs and domain names, except for
+// safeKeys.
+var destinationKeys = map[string]bool{
+	"target":    true,
+	"host":      true,
+	"domain":    true,
+	"subdomain": true,
+	"addr":      true,
+	"remote":    true,
+	"dst":       true,
+	"server":    true,
+	"answers":   true,
+	"ips":       true,
+	"client":    true,
+}
+
+// safeKeys are attribute keys whose values never hold a destination, such
+// as file paths, modes and protocol names; they are logged verbatim. Any key
+// missing here is scanned, so new call sites are covered by default.
+var safeKeys = map[string]bool{
+	"file":      true,
+	"path":      true,
+	"dir":       true,
+	"level":     true,
+	"mode":      true,
+	"method":    true,
+	"policy":    true,
+	"proto":     true,
+	"network":   true,
+	"endpoint":  true,
+	"transport": true,
+	"qtype":     true,
+	"version":   true,
+	"country":   true,
+	"strategy":  true,
+	"list":      true,
+	"rule":      true,
+	"process":   true,
+}
+
+var (
+	ipv4Regexp = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Regexp = regexp.MustCompile(`\[?\b(?:[0-9a-fA-F]{0,4}:){2,7}[0-9a-fA-F]{0,4}\b\]?`)
+	// domainRegexp matches dotted names ending in an alphabetic TLD, as they
+	// appear in resolver and dial errors ("lookup example.com: no such host").
+	domainRegexp = regexp.MustCompile(`\b(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,63}\b`)
+)
+
+// fileExts are suffixes that domainRegexp also matches in file names; such
+// tokens are left untouched so errors about config or log files stay readable.
+var fileExts = map[string]bool{
+	"log": true, "json": true, "txt": true, "yaml": true, "yml": true, "conf": true,
+	"pem": true, "key": true, "crt": true, "mmdb": true, "dat": true, "go": true,
+}
+
+type redactor struct {
+	mode string
+	key  []byte
+}
+
+var privacy atomic.Pointer[redactor]
+
+// SetPrivacy enables redaction of destinations (hostnames and IPs) in all log
+// output produced by the handlers of this package. mode is one of PrivacyOff,
+// PrivacyHash or PrivacyTruncate; an empty mode means PrivacyOff. key seeds
+// the keyed hash; when empty a random per-process key is used, so hashes
+// cannot be correlated across restarts.
+func SetPrivacy(mode, key string) error {
+	switch mode {
+	case "", PrivacyOff:
+		privacy.Store(nil)
+		return nil
+	case PrivacyHash, PrivacyTruncate:
+	default:
+		return fmt.Errorf("invalid log privacy mode %q: valid values are off, hash, truncate", mode)
+	}
+
+	k := []byte(key)
+	if len(k) == 0 {
+		k = make([]byte, 32)
+		_, _ = rand.Read(k)
+	}
+	privacy.Store(&redactor{mode: mode, key: k})
+	return nil
+}
+
+// RedactHost returns host, an IP, hostname or host:port, redacted as the
+// privacy mode set by SetPrivacy redacts destinations in log output, for
+// logs written outside the handlers of this package.
+func RedactHost(host string) string {
+	r := privacy.Load()
+	if r == nil {
+		return host
+	}
+	return r.destination(host)
+}
+
+// redactAttr rewrites a (non built-in) attribute when privacy mode is on.
+func redactAttr(a slog.Attr) slog.Attr {
+	r := privacy.Load()
+	if r == nil {
+		return a
+	}
+
+	v := a.Value.Resolve()
+	if destinationKeys[a.Key] {
+		switch v.Kind() {
+		case slog.KindString:
+			return slog.String(a.Key, r.destination(v.String()))
+		case slog.KindAny:
+			switch x := v.Any().(type) {
+			case []string:
+				out := make([]string, len(x))
+				for i, s := range x {
+					out[i] = r.destination(s)
+				}
+				return slog.Any(a.Key, out)
+			case fmt.Stringer:
+				return slog.String(a.Key, r.destination(x.String()))
+			}
+		}
+		return a
+	}
+
+	if safeKeys[a.Key] {
+		return a
+	}
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.embedded(v.String()))
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			return slog.String(a.Key, r.embedded(x.Error()))
+		case []string:
+			out := make([]string, len(x))
+			for i, s := range x {
+				out[i] = r.embedded(s)
+			}
+			return slog.Any(a.Key, out)
+		case fmt.Stringer:
+			return slog.String(a.Key, r.embedded(x.String()))
+		}
+	}
+	return a
+}
+
+// redactMessage rewrites the IPs and domain names embedded in the log
+// message.
+func redactMessage(a slog.Attr) slog.Attr {
+	r := privacy.Load()
+	if r == nil {
+		return a
+	}
+	return slog.String(a.Key, r.embedded(a.Value.String()))
+}
+
+// destination redacts a value that is entirely a host, IP or host:port.
+func (r *redactor) destination(s string) string {
+	if s == "" {
+		return s
+	}
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		return net.JoinHostPort(r.host(host), port)
+	}
+	// Answer strings such as "A 1.2.3.4" or "CNAME example.com." keep their
+	// record type prefix.
+	if typ, rest, ok := strings.Cut(s, " "); ok {
+		return typ + " " + r.destination(rest)
+	}
+	return r.host(s)
+}
+
+// embedded redacts the IPs and domain names appearing inside free-form
+// text.
+func (r *redactor) embedded(s string) string {
+	s = ipv4Regexp.ReplaceAllStringFunc(s, r.host)
+	s = ipv6Regexp.ReplaceAllStringFunc(s, func(m string) string {
+		if ip := net.ParseIP(strings.Trim(m, "[]")); ip != nil {
+			return strings.Replace(m, strings.Trim(m, "[]"), r.host(ip.String()), 1)
+		}
+		return m
+	})
+	return domainRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		if fileExts[strings.ToLower(m[strings.LastIndexByte(m, '.')+1:])] {
+			return m
+		}
+		return r.host(m)
+	})
+}
+
+// host redacts a bare hostname or IP.
+func (r *redactor) host(h string) string {
+	if h == "" {
+		return h
+	}
+	if r.mode == PrivacyTruncate {
+		return truncateHost(h)
+	}
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(strings.ToLower(strings.TrimSuffix(h, "."))))
+	return "h-" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+func truncateHost(h string) string {
+	if ip := net.ParseIP(h); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return fmt.Sprintf("%d.%d.x.x", ip4[0], ip4[1])
+		}
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(32, 128)), Mask: net.CIDRMask(32, 128)}).String()
+	}
+	h = strings.TrimSuffix(h, ".")
+	if i := strings.LastIndexByte(h, '.'); i >= 0 {
+		return "*" + h[i:]
+	}
+	return "*"
+}
@@ -0,0 +1,115 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func logWithPrivacy(t *testing.T, mode, key string, fn func()) string {
+	t.Helper()
+	original := Logger()
+	t.Cleanup(func() {
+		SetLogger(original)
+		_ = SetPrivacy(PrivacyOff, "")
+	})
+
+	if err := SetPrivacy(mode, key); err != nil {
+		t.Fatalf("SetPrivacy(%q): %v", mode, err)
+	}
+	var buf bytes.Buffer
+	SetLogger(slog.New(TextHandler(&buf, slog.LevelDebug)))
+	fn()
+	return buf.String()
+}
+
+func TestSetPrivacyInvalidMode(t *testing.T) {
+	if err := SetPrivacy("bogus", ""); err == nil {
+		t.Fatal("expected error for invalid mode")
+	}
+}
+
+func TestPrivacyOff(t *testing.T) {
+	out := logWithPrivacy(t, PrivacyOff, "", func() {
+		Info("[TCP_PROXY]", "target", "www.example.com:443")
+	})
+	if !strings.Contains(out, "target=www.example.com:443") {
+		t.Errorf("destination should be logged verbatim when privacy is off: %s", out)
+	}
+}
+
+func TestPrivacyHash(t *testing.T) {
+	out := logWithPrivacy(t, PrivacyHash, "secret", func() {
+		Info("[TCP_PROXY]", "target", "www.example.com:443", "local", "127.0.0.1:50000")
+		Info("[DNS_PROXY] result", "domain", "WWW.example.com.", "answers", []string{"A 93.184.216.34"})
+		Error("[TCP_DIRECT] connect", "err", errors.New("dial tcp: lookup www.example.com on 8.8.8.8:53: no such host"))
+		Error("[SERVER] read config", "err", errors.New("open config.json: no such file or directory"))
+	})
+
+	for _, leak := range []string{"example.com", "93.184.216.34", "8.8.8.8", "127.0.0.1"} {
+		if strings.Contains(out, leak) {
+			t.Errorf("output leaks %q: %s", leak, out)
+		}
+	}
+	if !strings.Contains(out, "config.json") {
+		t.Errorf("file names in errors should be kept: %s", out)
+	}
+	if !strings.Contains(out, ":443") {
+		t.Errorf("ports should be kept: %s", out)
+	}
+
+	// The same host hashes to the same value (case and trailing dot
+	// insensitive), so lines can still be correlated.
+	r := &redactor{mode: PrivacyHash, key: []byte("secret")}
+	first := r.host("www.example.com")
+	if !strings.Contains(out, "target="+first+":443") {
+		t.Errorf("expected hashed target %q in output: %s", first, out)
+	}
+	if !strings.Contains(out, "domain="+first) {
+		t.Errorf("expected domain hash %q to match target hash: %s", first, out)
+	}
+
+	other := &redactor{mode: PrivacyHash, key: []byte("other")}
+	if other.host("www.example.com") == first {
+		t.Error("hash must depend on the key")
+	}
+}
+
+func TestPrivacyTruncate(t *testing.T) {
+	out := logWithPrivacy(t, PrivacyTruncate, "", func() {
+		Info("[SERVER] proxy", "target", "www.example.com:443", "remote", "203.0.113.7:51234")
+		Info("[ICMP_PROXY]", "dst", "2001:db8:1234::1")
+	})
+
+	for _, want := range []string{"target=*.com:443", "remote=203.0.x.x:51234", "dst=2001:db8::/32"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output: %s", want, out)
+		}
+	}
+}
+
+func TestPrivacyRedactsEveryAttr(t *testing.T) {
+	out := logWithPrivacy(t, PrivacyHash, "secret", func() {
+		// client/dns/forward.go
+		Info("[DNS-FORWARD] blocked", "name", "ads.example.com.", "qtype", "A")
+		// client/router/router.go and customlist.go
+		Info("[ROUTER] custom direct matched", "host", "www.example.org", "entry", "*.example.org")
+		Info("[ROUTER] custom list edited", "list", "direct", "entry", "example.net", "file", "lists/direct.txt")
+		// Domains interpolated into the message.
+		Info("[ROUTER] rule set example.io loaded", "entries", []string{"example.dev", "10.0.0.1"})
+	})
+
+	for _, leak := range []string{"example.com", "example.org", "example.net", "example.io", "example.dev", "10.0.0.1"} {
+		if strings.Contains(out, leak) {
+			t.Errorf("output leaks %q: %s", leak, out)
+		}
+	}
+	// Safe keys are kept verbatim.
+	for _, want := range []string{"qtype=A", "list=direct", "file=lists/direct.txt"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output: %s", want, out)
+		}
+	}
+}
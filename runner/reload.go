@@ -0,0 +1,186 @@
+package runner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/client/proxy"
+	"github.com/nange/easyss/v3/client/subscription"
+	"github.com/nange/easyss/v3/log"
+)
+
+// SetReloadFunc installs fn as the handler of the HTTP proxy's /reload
+// endpoint, also for HTTP servers a later Reload starts.
+func (c *Core) SetReloadFunc(fn proxy.ReloadFunc) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	c.reloadFn = fn
+	if c.HTTPServer != nil {
+		c.HTTPServer.SetReloadFunc(fn)
+	}
+}
+
+// Reload applies next, a freshly loaded configuration, to the running core
+// without restarting it: routing, rule providers, shaper, transport tuning,
+// servers, subscriptions and the log level change in place, and only the local
+// servers whose settings changed are restarted. It returns the changed
+// settings that still need a restart. On error the running configuration
+// is unchanged, except that a local server failing to start again stays
+// down.
+func (c *Core) Reload(next *config.ClientConfig) ([]string, error) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	cur := c.Cfg
+	if next.Local.HTTPPort > 0 && next.Local.SocksPort <= 0 {
+		return nil, errSocksRequired
+	}
+
+	// Servers from subscriptions only exist at runtime; keep those whose
+	// subscription is still configured.
+	bySource := make(map[string][]*config.ServerProfile)
+	for _, s := range cur.ServerList() {
+		if s.Subscription != "" && slices.ContainsFunc(next.Subscriptions, func(sub config.Subscription) bool { return sub.URL == s.Subscription }) {
+			bySource[s.Subscription] = append(bySource[s.Subscription], s)
+		}
+	}
+	for src, servers := range bySource {
+		next.MergeSubscription(src, servers)
+	}
+
+	// Bind new ports before changing anything so a port in use fails the
+	// whole reload. A server keeping its port is restarted in place below.
+	socksAddr, httpAddr, dnsAddr := listenAddrs(cur)
+	nextSocks, nextHTTP, nextDNS := listenAddrs(next)
+	if nextSocks != "" && next.Local.SocksPort != cur.Local.SocksPort {
+		if err := prebindTCP(nextSocks); err != nil {
+			return nil, fmt.Errorf("socks5 server listen %s: %w", nextSocks, err)
+		}
+	}
+	if nextHTTP != "" && next.Local.HTTPPort != cur.Local.HTTPPort {
+		if err := prebindTCP(nextHTTP); err != nil {
+			return nil, fmt.Errorf("http proxy server listen %s: %w", nextHTTP, err)
+		}
+	}
+	if nextDNS != "" && dnsAddr == "" {
+		if err := prebindUDP(nextDNS); err != nil {
+			return nil, fmt.Errorf("dns forward server listen %s: %w", nextDNS, err)
+		}
+	}
+
+	// Client.Reload replaces the routing settings, so compare first.
+	ruleSetsChanged := !slices.Equal(next.Routing.RuleSets, cur.Routing.RuleSets)
+	if err := c.Client.Reload(next); err != nil {
+		return nil, err
+	}
+	c.StreamHandler.SetShaperConfig(c.Client.ShaperConfig())
+
+	if next.Log.Level != cur.Log.Level {
+		cur.Log.Level = next.Log.Level
+		log.SetLevel(log.ParseLevel(next.Log.Level))
+		log.Info("[EASYSS] log level changed", "level", next.Log.Level)
+	}
+
+	if !slices.Equal(next.Subscriptions, cur.Subscriptions) {
+		if c.subs != nil {
+			c.subs.Stop()
+			c.subs = nil
+		}
+		cur.Subscriptions = next.Subscriptions
+		if len(cur.Subscriptions) > 0 {
+			// A new updater has not fetched anything yet, so it refreshes
+			// every subscription right away.
+			c.subs = subscription.New(cur, subscription.DefaultCacheDir(), nil)
+			c.subs.Start(c.Client.UpdateServers)
+		}
+	}
+
+	if ruleSetsChanged {
+		if c.rules != nil {
+			c.rules.Stop()
+			c.rules = nil
+		}
+		// The new provider loads from the cache and refreshes right away.
+		if c.rules = newRuleProvider(cur); c.rules != nil {
+			c.startRuleProvider()
+		}
+	}
+
+	// Streams take their method from the server they are opened against and
+	// the loop guards ask the client's current servers, so a server change
+	// needs no listener restart.
+	restartSocks := nextSocks != socksAddr || next.AuthUsername != cur.AuthUsername ||
+		next.AuthPassword != cur.AuthPassword || next.Local.EnableQUIC != cur.Local.EnableQUIC
+	restartHTTP := nextHTTP != httpAddr || next.Local.SocksPort != cur.Local.SocksPort ||
+		next.AuthUsername != cur.AuthUsername || next.AuthPassword != cur.AuthPassword
+	cur.Local.SocksPort = next.Local.SocksPort
+	cur.Local.HTTPPort = next.Local.HTTPPort
+	cur.Local.BindAll = next.Local.BindAll
+	cur.Local.EnableQUIC = next.Local.EnableQUIC
+	cur.Local.EnableForwardDNS = next.Local.EnableForwardDNS
+	cur.AuthUsername = next.AuthUsername
+	cur.AuthPassword = next.AuthPassword
+
+	var errs []error
+	if restartSocks {
+		if c.SocksServer != nil {
+			_ = c.SocksServer.Close()
+			c.SocksServer = nil
+		}
+		if nextSocks != "" {
+			errs = append(errs, c.startSocks(nextSocks))
+		}
+	}
+	if !restartSocks {
+		c.applyFindProcess()
+		c.applySniff()
+	}
+	if restartHTTP {
+		// Closing during a /reload returns once the listener is closed,
+		// so the reload is answered while the old server drains.
+		if c.HTTPServer != nil {
+			_ = c.HTTPServer.Close()
+			c.HTTPServer = nil
+		}
+		if nextHTTP != "" {
+			errs = append(errs, c.startHTTP(nextHTTP))
+		}
+	}
+	if nextDNS != dnsAddr {
+		if c.DNSServer != nil {
+			_ = c.DNSServer.Shutdown()
+			c.DNSServer = nil
+		}
+		if nextDNS != "" {
+			c.startDNS(nextDNS)
+		}
+	}
+
+	pending := restartRequired(cur, next)
+	log.Info("[EASYSS] configuration reloaded", "servers", len(cur.ServerList()), "socks_restarted", restartSocks, "http_restarted", restartHTTP, "restart_required", pending)
+	return pending, errors.Join(errs...)
+}
+
+// restartRequired lists the settings that differ between cur and next but
+// that Reload does not apply.
+func restartRequired(cur, next *config.ClientConfig) []string {
+	var pending []string
+	add := func(changed bool, name string) {
+		if changed {
+			pending = append(pending, name)
+		}
+	}
+	add(cur.Failover != next.Failover, "failover")
+	add(cur.Timeout != next.Timeout, "timeout")
+	add(cur.Routing.IPV6Rule != next.Routing.IPV6Rule, "routing.ipv6_rule")
+	add(cur.Local.EnableTun2socks != next.Local.EnableTun2socks, "local.enable_tun2socks")
+	add(!bytes.Equal(cur.Local.TunConfig, next.Local.TunConfig), "local.tun_config")
+	add(cur.Local.DisableSysProxy != next.Local.DisableSysProxy, "local.disable_sys_proxy")
+	add(cur.Log.FilePath != next.Log.FilePath, "log.file_path")
+	add(cur.Log.Privacy != next.Log.Privacy || cur.Log.PrivacyKey != next.Log.PrivacyKey, "log.privacy")
+	add(cur.PprofEnabled != next.PprofEnabled, "pprof_enabled")
+	return pending
+}
@@ -1,19 +1,26 @@
 package runner
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"slices"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/nange/easyss/v3/client"
+	"github.com/nange/easyss/v3/client/balancer"
 	"github.com/nange/easyss/v3/client/config"
 	"github.com/nange/easyss/v3/client/dns"
+	"github.com/nange/easyss/v3/client/process"
 	"github.com/nange/easyss/v3/client/proxy"
+	"github.com/nange/easyss/v3/client/router"
+	"github.com/nange/easyss/v3/client/ruleprovider"
+	"github.com/nange/easyss/v3/client/subscription"
 	"github.com/nange/easyss/v3/log"
-	"github.com/nange/easyss/v3/protocol"
-	"github.com/nange/easyss/v3/shaper"
 	"github.com/nange/easyss/v3/stats"
 )
 
@@ -26,49 +33,57 @@ type Core struct {
 	HTTPServer    *proxy.HTTPProxyServer
 	StreamHandler *proxy.StreamHandler
 	DNSServer     *dns.ForwardServer
+
+	subs     *subscription.Updater
+	rules    *ruleprovider.Updater
+	procs    *process.Finder
+	reloadMu sync.Mutex
+	reloadFn proxy.ReloadFunc
 }
 
 func Run(cfg *config.ClientConfig) (*Core, error) {
+	var subs *subscription.Updater
+	if len(cfg.Subscriptions) > 0 {
+		subs = subscription.New(cfg, subscription.DefaultCacheDir(), nil)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.TimeoutDuration())
+		subs.Load(ctx)
+		cancel()
+	}
+	rules := newRuleProvider(cfg)
+
 	cli, err := client.New(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	method := protocol.MethodFromString(cfg.DefaultServer().Method)
-	if method == 0 {
-		method = protocol.MethodAES256GCM
-	}
-
-	shaperCfg := shaper.Config{
-		BatchWindowMS: cfg.Shaper.BatchWindowMS,
-		Cover: shaper.CoverConfig{
-			BudgetRatio: cfg.Shaper.CoverBudgetRatio,
-			BudgetCap:   cfg.Shaper.CoverBudgetCap,
-		},
-	}
-
 	timeout := cfg.TimeoutDuration()
 	streamIdleTimeout := 10 * timeout
-	udpIdleTimeout := 2 * timeout
 	dialTimeout := timeout / 2
 
-	streamHandler := proxy.NewStreamHandler(cli.Transport(), cli.MasterKey(), shaperCfg, streamIdleTimeout)
+	streamHandler := proxy.NewBalancedStreamHandler(cli.Balancer(), cli.ShaperConfig(), streamIdleTimeout)
+	cli.Balancer().StartProbing(cfg.ProbeIntervalDuration(), dialTimeout, func(ctx context.Context, u *balancer.Upstream) (time.Duration, error) {
+		return streamHandler.Probe(ctx, u, cfg.Failover.ProbeTarget)
+	})
 
 	c := &Core{
 		Cfg:           cfg,
 		Client:        cli,
 		StreamHandler: streamHandler,
 	}
+	if subs != nil {
+		c.subs = subs
+		subs.Start(cli.UpdateServers)
+	}
+	if rules != nil {
+		c.rules = rules
+		c.startRuleProvider()
+	}
 
 	// Pre-bind all local listen addresses before starting any server
 	// goroutine, so a listen failure (e.g. port already in use) aborts
 	// startup with an error instead of being logged and silently ignored.
-	var socksAddr, httpAddr, dnsAddr string
-	if cfg.Local.SocksPort > 0 {
-		socksAddr = "127.0.0.1:" + strconv.Itoa(cfg.Local.SocksPort)
-		if cfg.Local.BindAll {
-			socksAddr = "[::]:" + strconv.Itoa(cfg.Local.SocksPort)
-		}
+	socksAddr, httpAddr, dnsAddr := listenAddrs(cfg)
+	if socksAddr != "" {
 		if err := prebindTCP(socksAddr); err != nil {
 			c.cleanup()
 			return nil, fmt.Errorf("socks5 server listen %s: %w", socksAddr, err)
@@ -79,17 +94,12 @@ func Run(cfg *config.ClientConfig) (*Core, error) {
 			_ = cli.Close()
 			return nil, errSocksRequired
 		}
-		httpAddr = "127.0.0.1:" + strconv.Itoa(cfg.Local.HTTPPort)
-		if cfg.Local.BindAll {
-			httpAddr = "[::]:" + strconv.Itoa(cfg.Local.HTTPPort)
-		}
 		if err := prebindTCP(httpAddr); err != nil {
 			c.cleanup()
 			return nil, fmt.Errorf("http proxy server listen %s: %w", httpAddr, err)
 		}
 	}
-	if cfg.Local.EnableForwardDNS {
-		dnsAddr = "127.0.0.1:53"
+	if dnsAddr != "" {
 		if err := prebindUDP(dnsAddr); err != nil {
 			c.cleanup()
 			return nil, fmt.Errorf("dns forward server listen %s: %w", dnsAddr, err)
@@ -97,51 +107,19 @@ func Run(cfg *config.ClientConfig) (*Core, error) {
 	}
 
 	if socksAddr != "" {
-		serverDomain := ""
-		if svr := cfg.DefaultServer(); svr != nil && net.ParseIP(svr.Address) == nil {
-			serverDomain = svr.Address
-		}
-		socksServer, err := proxy.NewSocks5Server(socksAddr, cfg.AuthUsername, cfg.AuthPassword,
-			streamHandler, cli.Router(), serverDomain, method, !cfg.Local.EnableQUIC, dialTimeout, udpIdleTimeout, cli.DialContext)
-		if err != nil {
+		if err := c.startSocks(socksAddr); err != nil {
 			_ = cli.Close()
 			return nil, err
 		}
-		c.SocksServer = socksServer
-		log.Info("[EASYSS] starting socks5 server", "addr", socksAddr)
-		c.SocksServer.MarkStarted()
-		go func() {
-			if err := c.SocksServer.Start(); err != nil && !errors.Is(err, net.ErrClosed) {
-				log.Error("[EASYSS] socks5 server", "err", err)
-			}
-		}()
 	}
-
 	if httpAddr != "" {
-		socksAddr := "127.0.0.1:" + strconv.Itoa(cfg.Local.SocksPort)
-		httpServer, err := proxy.NewHTTPProxyServer(httpAddr, socksAddr, cfg.AuthUsername, cfg.AuthPassword,
-			timeout, streamHandler, cli.Router(), method, cli.DialContext)
-		if err != nil {
+		if err := c.startHTTP(httpAddr); err != nil {
 			c.cleanup()
 			return nil, err
 		}
-		c.HTTPServer = httpServer
-		log.Info("[EASYSS] starting http proxy server", "addr", httpAddr)
-		go func() {
-			if err := c.HTTPServer.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-				log.Error("[EASYSS] http proxy server", "err", err)
-			}
-		}()
 	}
-
 	if dnsAddr != "" {
-		c.DNSServer = dns.NewForwardServer(dnsAddr, cli.Router().ShouldIPV6Disable())
-		log.Info("[EASYSS] starting dns forward server", "addr", dnsAddr)
-		go func() {
-			if err := c.DNSServer.Start(); err != nil {
-				log.Error("[EASYSS] dns forward server", "err", err)
-			}
-		}()
+		c.startDNS(dnsAddr)
 	}
 
 	log.Info("[EASYSS] started successfully")
@@ -154,6 +132,133 @@ func Run(cfg *config.ClientConfig) (*Core, error) {
 	return c, nil
 }
 
+// newRuleProvider loads the rule sets cfg configures by URL, or returns nil
+// if there are none.
+func newRuleProvider(cfg *config.ClientConfig) *ruleprovider.Updater {
+	if !slices.ContainsFunc(cfg.Routing.RuleSets, func(rs config.RuleSetConfig) bool { return rs.URL != "" }) {
+		return nil
+	}
+	rules := ruleprovider.New(cfg.Routing.RuleSets, ruleprovider.DefaultCacheDir(), cfg.TimeoutDuration(), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.TimeoutDuration())
+	rules.Load(ctx)
+	cancel()
+	return rules
+}
+
+// startRuleProvider applies the loaded rule sets and starts refreshing
+// them; fetches that fail directly go through the proxy.
+func (c *Core) startRuleProvider() {
+	c.rules.Start(c.Client.UpdateRuleSet, func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return c.StreamHandler.DialTunnel(ctx, c.Client.Balancer().Pick(), addr)
+	})
+}
+
+// listenAddrs returns the addresses of the enabled local servers.
+func listenAddrs(cfg *config.ClientConfig) (socksAddr, httpAddr, dnsAddr string) {
+	host := "127.0.0.1:"
+	if cfg.Local.BindAll {
+		host = "[::]:"
+	}
+	if cfg.Local.SocksPort > 0 {
+		socksAddr = host + strconv.Itoa(cfg.Local.SocksPort)
+	}
+	if cfg.Local.HTTPPort > 0 {
+		httpAddr = host + strconv.Itoa(cfg.Local.HTTPPort)
+	}
+	if cfg.Local.EnableForwardDNS {
+		dnsAddr = "127.0.0.1:53"
+	}
+	return socksAddr, httpAddr, dnsAddr
+}
+
+func (c *Core) startSocks(addr string) error {
+	cfg := c.Cfg
+	timeout := cfg.TimeoutDuration()
+	socksServer, err := proxy.NewSocks5Server(addr, cfg.AuthUsername, cfg.AuthPassword,
+		c.StreamHandler, c.Client.Router(), !cfg.Local.EnableQUIC, timeout/2, 2*timeout, c.Client.DialContext)
+	if err != nil {
+		return err
+	}
+	c.SocksServer = socksServer
+	c.applyFindProcess()
+	c.applySniff()
+	log.Info("[EASYSS] starting socks5 server", "addr", addr)
+	socksServer.MarkStarted()
+	go func() {
+		if err := socksServer.Start(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Error("[EASYSS] socks5 server", "err", err)
+		}
+	}()
+	return nil
+}
+
+// applyFindProcess sets up the socks5 server's process lookups as
+// routing.find_process says. The finder, and its cache, is shared across
+// reloads.
+func (c *Core) applyFindProcess() {
+	if c.SocksServer == nil {
+		return
+	}
+	mode := c.Cfg.Routing.FindProcess
+	if !process.Supported {
+		if mode == config.FindProcessAlways || mode != config.FindProcessOff && c.Client.Router().HasProcessRules() {
+			log.Warn("[EASYSS] finding the process of connections is only supported on linux, process rules never match")
+		}
+		c.SocksServer.SetProcessFinder(nil, false)
+		return
+	}
+	if mode == config.FindProcessOff {
+		c.SocksServer.SetProcessFinder(nil, false)
+		return
+	}
+	if c.procs == nil {
+		c.procs = process.NewFinder()
+	}
+	c.SocksServer.SetProcessFinder(c.procs, mode == config.FindProcessAlways)
+}
+
+// applySniff makes the socks5 server sniff the domains of the IP
+// connections tun2socks hands it, unless routing.disable_sniff is set.
+func (c *Core) applySniff() {
+	if c.SocksServer == nil {
+		return
+	}
+	c.SocksServer.SetSniffing(c.Cfg.Local.EnableTun2socks && !c.Cfg.Routing.DisableSniff)
+}
+
+func (c *Core) startHTTP(addr string) error {
+	cfg := c.Cfg
+	socksAddr := "127.0.0.1:" + strconv.Itoa(cfg.Local.SocksPort)
+	httpServer, err := proxy.NewHTTPProxyServer(addr, socksAddr, cfg.AuthUsername, cfg.AuthPassword,
+		cfg.TimeoutDuration(), c.StreamHandler, c.Client.Router(), c.Client.DialContext)
+	if err != nil {
+		return err
+	}
+	httpServer.SetReloadFunc(c.reloadFn)
+	c.HTTPServer = httpServer
+	log.Info("[EASYSS] starting http proxy server", "addr", addr)
+	go func() {
+		if err := httpServer.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("[EASYSS] http proxy server", "err", err)
+		}
+	}()
+	return nil
+}
+
+func (c *Core) startDNS(addr string) {
+	rt := c.Client.Router()
+	dnsServer := dns.NewForwardServer(addr, rt.ShouldIPV6Disable(), func(domain string) bool {
+		return rt.MatchHostRule(domain) == router.HostRuleBlock
+	})
+	c.DNSServer = dnsServer
+	log.Info("[EASYSS] starting dns forward server", "addr", addr)
+	go func() {
+		if err := dnsServer.Start(); err != nil {
+			log.Error("[EASYSS] dns forward server", "err", err)
+		}
+	}()
+}
+
 func (c *Core) Stop() {
 	c.cleanup()
 	log.Info("[EASYSS] stopped")
@@ -181,6 +286,12 @@ func prebindUDP(addr string) error {
 }
 
 func (c *Core) cleanup() {
+	if c.subs != nil {
+		c.subs.Stop()
+	}
+	if c.rules != nil {
+		c.rules.Stop()
+	}
 	if c.SocksServer != nil {
 		_ = c.SocksServer.Close()
 	}
@@ -3,10 +3,14 @@ package runner
 import (
 	"net"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/nange/easyss/v3/client/config"
+	"github.com/nange/easyss/v3/client/router"
 )
 
 func testConfig() *config.ClientConfig {
@@ -146,3 +150,78 @@ func TestRunOKWhenPortsAreFree(t *testing.T) {
 	}
 	core.Stop()
 }
+
+func TestReloadRebindsOnlyChangedListeners(t *testing.T) {
+	cfg := testConfig()
+	cfg.Local.SocksPort = freePort(t)
+	cfg.Local.HTTPPort = freePort(t)
+
+	core, err := Run(cfg)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	defer core.Stop()
+	socks, httpServer := core.SocksServer, core.HTTPServer
+
+	next := testConfig()
+	next.Local.SocksPort = cfg.Local.SocksPort
+	next.Local.HTTPPort = freePort(t)
+	next.Routing.ProxyRule = "direct"
+	next.Timeout = cfg.Timeout + 1
+	pending, err := core.Reload(next)
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	if core.SocksServer != socks {
+		t.Error("socks5 server restarted although its settings did not change")
+	}
+	if core.HTTPServer == httpServer {
+		t.Error("http proxy server not restarted on the new port")
+	}
+	// The server starts listening in the background.
+	var conn net.Conn
+	for range 50 {
+		if conn, err = net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(next.Local.HTTPPort)); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("new http port is not listening: %v", err)
+	}
+	if got := core.Client.Router().ProxyRule(); got != router.ProxyRuleDirect {
+		t.Errorf("proxy rule = %d, want direct", got)
+	}
+	if !slices.Equal(pending, []string{"timeout"}) {
+		t.Errorf("restart required = %v, want [timeout]", pending)
+	}
+	if cfg.Local.HTTPPort != next.Local.HTTPPort || cfg.Timeout == next.Timeout {
+		t.Error("running config should take applied settings only")
+	}
+}
+
+func TestReloadKeepsStateOnError(t *testing.T) {
+	cfg := testConfig()
+	cfg.Local.SocksPort = freePort(t)
+	cfg.Local.HTTPPort = 0
+
+	core, err := Run(cfg)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	defer core.Stop()
+
+	next := testConfig()
+	next.Local.SocksPort = cfg.Local.SocksPort
+	next.Local.HTTPPort = 0
+	next.Routing.ProxyRule = "direct"
+	next.Routing.Rules = []config.RouteRule{{Outbound: "missing", Hosts: []string{"example.org"}}}
+	if _, err := core.Reload(next); err == nil {
+		t.Fatal("expected error for rule naming an unknown server")
+	}
+	if got := core.Client.Router().ProxyRule(); got == router.ProxyRuleDirect {
+		t.Error("failed reload changed the proxy rule")
+	}
+}
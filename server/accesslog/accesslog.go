@@ -0,0 +1,147 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+)
+
+// CloseReason describes how a proxied stream ended.
+type CloseReason string
+
+const (
+	// CloseFIN is a graceful close: the target or the client finished the
+	// stream normally.
+	CloseFIN CloseReason = "fin"
+	// CloseRST means the client aborted the stream with a RST frame.
+	CloseRST CloseReason = "rst"
+	// CloseIdleTimeout means no data flowed for the stream idle timeout.
+	CloseIdleTimeout CloseReason = "idle_timeout"
+	// CloseError covers dial failures and relay I/O errors.
+	CloseError CloseReason = "error"
+)
+
+// Entry is one line of the access log, written when a stream finishes.
+// There is no user: all clients share the server's single password, so a
+// stream carries no identity beyond its client IP. ClientIP is redacted as
+// the log privacy mode says (see log.SetPrivacy); the target is not, as
+// recording it is the point of the access log.
+type Entry struct {
+	Time       time.Time   `json:"time"`
+	ClientIP   string      `json:"client_ip"`
+	Endpoint   string      `json:"endpoint"`
+	Target     string      `json:"target"`
+	ResolvedIP string      `json:"resolved_ip,omitempty"`
+	BytesUp    int64       `json:"bytes_up"`
+	BytesDown  int64       `json:"bytes_down"`
+	DurationMS int64       `json:"duration_ms"`
+	Close      CloseReason `json:"close"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// Logger writes access log entries as JSON lines. A nil *Logger hands out nil
+// records, whose methods are no-ops, so handlers need not check whether the
+// access log is enabled.
+type Logger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{enc: json.NewEncoder(w)}
+}
+
+// Start begins the record of a stream. The entry is written by Finish.
+func (l *Logger) Start(clientIP, endpoint, target string) *Record {
+	if l == nil {
+		return nil
+	}
+	return &Record{
+		l:        l,
+		start:    time.Now(),
+		clientIP: clientIP,
+		endpoint: endpoint,
+		target:   target,
+	}
+}
+
+func (l *Logger) write(e Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_ = l.enc.Encode(e)
+}
+
+// Record accumulates the accounting of one stream. Byte counters may be
+// updated concurrently by the two relay directions.
+type Record struct {
+	l        *Logger
+	start    time.Time
+	clientIP string
+	endpoint string
+	target   string
+
+	resolved atomic.Pointer[string]
+	up       atomic.Int64
+	down     atomic.Int64
+	once     sync.Once
+}
+
+// SetResolved records the address actually dialed for the target.
+func (r *Record) SetResolved(addr net.Addr) {
+	if r == nil || addr == nil {
+		return
+	}
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	r.resolved.Store(&ip)
+}
+
+// AddUp counts bytes relayed from the client to the target.
+func (r *Record) AddUp(n int) {
+	if r == nil || n <= 0 {
+		return
+	}
+	r.up.Add(int64(n))
+}
+
+// AddDown counts bytes relayed from the target to the client.
+func (r *Record) AddDown(n int) {
+	if r == nil || n <= 0 {
+		return
+	}
+	r.down.Add(int64(n))
+}
+
+// Finish writes the entry. Only the first call has an effect, so a deferred
+// fallback Finish never overrides a more specific reason.
+func (r *Record) Finish(reason CloseReason, err error) {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		e := Entry{
+			Time:       r.start,
+			ClientIP:   log.RedactHost(r.clientIP),
+			Endpoint:   r.endpoint,
+			Target:     r.target,
+			BytesUp:    r.up.Load(),
+			BytesDown:  r.down.Load(),
+			DurationMS: time.Since(r.start).Milliseconds(),
+			Close:      reason,
+		}
+		if p := r.resolved.Load(); p != nil {
+			e.ResolvedIP = *p
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		r.l.write(e)
+	})
+}
@@ -0,0 +1,70 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/nange/easyss/v3/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordFinish(t *testing.T) {
+	var buf bytes.Buffer
+	rec := NewLogger(&buf).Start("198.51.100.1", "/v3/tcp", "example.com:443")
+	rec.SetResolved(&net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 443})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); rec.AddUp(10) }()
+		go func() { defer wg.Done(); rec.AddDown(100) }()
+	}
+	wg.Wait()
+
+	rec.Finish(CloseError, errors.New("connection reset by peer"))
+	// Subsequent calls must not write a second entry.
+	rec.Finish(CloseFIN, nil)
+
+	var e Entry
+	dec := json.NewDecoder(&buf)
+	require.NoError(t, dec.Decode(&e))
+	require.False(t, dec.More(), "only one entry expected")
+
+	require.Equal(t, "198.51.100.1", e.ClientIP)
+	require.Equal(t, "/v3/tcp", e.Endpoint)
+	require.Equal(t, "example.com:443", e.Target)
+	require.Equal(t, "203.0.113.9", e.ResolvedIP)
+	require.Equal(t, int64(100), e.BytesUp)
+	require.Equal(t, int64(1000), e.BytesDown)
+	require.Equal(t, CloseError, e.Close)
+	require.Equal(t, "connection reset by peer", e.Error)
+	require.False(t, e.Time.IsZero())
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	rec := l.Start("198.51.100.1", "/v3/udp", "1.1.1.1:53")
+	require.Nil(t, rec)
+
+	// All record methods are no-ops on nil.
+	rec.SetResolved(&net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 53})
+	rec.AddUp(1)
+	rec.AddDown(1)
+	rec.Finish(CloseFIN, nil)
+}
+
+func TestClientIPPrivacy(t *testing.T) {
+	require.NoError(t, log.SetPrivacy(log.PrivacyTruncate, ""))
+	defer log.SetPrivacy(log.PrivacyOff, "") //nolint:errcheck
+
+	var buf bytes.Buffer
+	NewLogger(&buf).Start("198.51.100.1", "/v3/tcp", "example.com:443").Finish(CloseFIN, nil)
+	var e Entry
+	require.NoError(t, json.NewDecoder(&buf).Decode(&e))
+	require.Equal(t, "198.51.x.x", e.ClientIP)
+	require.Equal(t, "example.com:443", e.Target)
+}
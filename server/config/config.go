@@ -3,6 +3,14 @@ package config
 type LogConfig struct {
 	Level    string `json:"level"`
 	FilePath string `json:"file_path"`
+	// ProbeFilePath enables the JSON-lines probe log of rejected handshakes.
+	ProbeFilePath string `json:"probe_file_path"`
+	// AccessFilePath enables the JSON-lines access log of proxied streams.
+	AccessFilePath string `json:"access_file_path"`
+	// Privacy redacts destinations in the diagnostic log: off, hash or
+	// truncate. PrivacyKey seeds the keyed hash.
+	Privacy    string `json:"privacy"`
+	PrivacyKey string `json:"privacy_key"`
 }
 
 type TransportConfig struct {
@@ -14,6 +22,52 @@ type NextProxyConfig struct {
 	NextProxyFile string `json:"next_proxy_file"`
 	EnableUDP     bool   `json:"enable_udp"`
 	AllHost       bool   `json:"all_host"`
+	// Groups are additional named upstream groups, matched in order before
+	// the group defined by URL above.
+	Groups []NextProxyGroupConfig `json:"groups"`
+	// HealthCheckInterval is the period in seconds of the TCP health checks
+	// of every upstream; 0 means 30, negative disables them.
+	HealthCheckInterval int `json:"health_check_interval"`
+}
+
+// NextProxyGroupConfig is a named set of upstream proxies sharing one rule
+// file.
+type NextProxyGroupConfig struct {
+	Name          string   `json:"name"`
+	URLs          []string `json:"urls"`
+	NextProxyFile string   `json:"next_proxy_file"`
+	// Strategy picks the upstream: failover (default), round_robin or
+	// lowest_latency.
+	Strategy  string `json:"strategy"`
+	EnableUDP bool   `json:"enable_udp"`
+	AllHost   bool   `json:"all_host"`
+}
+
+// DNSConfig configures how the server resolves target hostnames. With no
+// servers and no hosts the system resolver is used as before.
+type DNSConfig struct {
+	// Servers are upstream resolvers tried in order: "1.1.1.1" or
+	// "udp://1.1.1.1:53", "tcp://8.8.8.8:53", "tls://1.1.1.1:853" (DoT) and
+	// "https://cloudflare-dns.com/dns-query" (DoH).
+	Servers []string `json:"servers"`
+	// Hosts maps hostnames to fixed addresses, bypassing the upstreams.
+	Hosts map[string][]string `json:"hosts"`
+	// Strategy orders IPv4 and IPv6 answers for outbound dials:
+	// happy_eyeballs (default), prefer_ipv4 or prefer_ipv6.
+	Strategy string `json:"strategy"`
+}
+
+// EgressConfig selects the local source address of outbound connections.
+// With no sources the operating system picks it as before.
+type EgressConfig struct {
+	// Sources are local IPs, interface names (all their global addresses) or
+	// CIDR prefixes. A prefix yields an address inside it for every
+	// connection, which needs the prefix routed to the host (IPv6
+	// random-in-prefix).
+	Sources []string `json:"sources"`
+	// Strategy picks a source per connection: fixed (default), round_robin,
+	// per_user (client IP), per_target (target host) or random.
+	Strategy string `json:"strategy"`
 }
 
 type ServerConfig struct {
@@ -31,7 +85,10 @@ type ServerConfig struct {
 	BatchWindowMS        int             `json:"batch_window_ms"`
 	CoverBudgetRatio     float64         `json:"cover_budget_ratio"`
 	CoverBudgetCap       int             `json:"cover_budget_cap"`
+	Egress               EgressConfig    `json:"egress"`
 	NextProxy            NextProxyConfig `json:"-"`
+	Log                  LogConfig       `json:"-"`
+	DNS                  DNSConfig       `json:"-"`
 	PprofEnabled         bool            `json:"pprof_enabled"`
 }
 
@@ -41,6 +98,7 @@ type FileConfig struct {
 	Log           LogConfig       `json:"log"`
 	Transport     TransportConfig `json:"transport"`
 	NextProxy     NextProxyConfig `json:"next_proxy"`
+	DNS           DNSConfig       `json:"dns"`
 	Timeout       int             `json:"timeout"`
 }
 
@@ -48,6 +106,8 @@ func (fc *FileConfig) EffectiveServerConfig() ServerConfig {
 	cfg := fc.Server
 	cfg.Timeout = fc.Timeout
 	cfg.NextProxy = fc.NextProxy
+	cfg.Log = fc.Log
+	cfg.DNS = fc.DNS
 	return cfg
 }
 
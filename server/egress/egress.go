@@ -0,0 +1,272 @@
+// Package egress chooses the local source address of the server's outbound
+// TCP, UDP and ICMP sockets from a configured pool.
+package egress
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/nange/easyss/v3/server/config"
+)
+
+const (
+	// StrategyFixed always uses the first source of the target's family,
+	// and one address of it if it is a prefix.
+	StrategyFixed = "fixed"
+	// StrategyRoundRobin rotates through the sources per connection.
+	StrategyRoundRobin = "round_robin"
+	// StrategyPerUser pins every client IP to one source.
+	StrategyPerUser = "per_user"
+	// StrategyPerTarget pins every target host to one source.
+	StrategyPerTarget = "per_target"
+	// StrategyRandom picks a random source, and a random address inside
+	// prefix sources, for every connection.
+	StrategyRandom = "random"
+)
+
+// source is a single local address, or a prefix addresses are drawn from.
+type source struct {
+	ip     net.IP
+	prefix *net.IPNet
+}
+
+// Pool is a set of local source addresses and the strategy choosing among
+// them. A nil *Pool binds nothing and lets the operating system choose.
+type Pool struct {
+	v4, v6   []source
+	strategy string
+	next     atomic.Uint64
+}
+
+// New builds a Pool from cfg. It returns nil when no sources are configured.
+func New(cfg config.EgressConfig) (*Pool, error) {
+	if len(cfg.Sources) == 0 {
+		return nil, nil
+	}
+
+	p := &Pool{strategy: cfg.Strategy}
+	switch p.strategy {
+	case "":
+		p.strategy = StrategyFixed
+	case StrategyFixed, StrategyRoundRobin, StrategyPerUser, StrategyPerTarget, StrategyRandom:
+	default:
+		return nil, fmt.Errorf("invalid egress strategy %q: valid values are fixed, round_robin, per_user, per_target, random", cfg.Strategy)
+	}
+
+	for _, s := range cfg.Sources {
+		srcs, err := parseSource(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, src := range srcs {
+			if src.ip.To4() != nil {
+				p.v4 = append(p.v4, src)
+			} else {
+				p.v6 = append(p.v6, src)
+			}
+		}
+	}
+	return p, nil
+}
+
+func parseSource(s string) ([]source, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return []source{{ip: ip}}, nil
+	}
+	if strings.Contains(s, "/") {
+		_, prefix, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress source %q: %w", s, err)
+		}
+		return []source{{ip: prefix.IP, prefix: prefix}}, nil
+	}
+
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress source %q: not an IP, prefix or interface: %w", s, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("egress interface %s: %w", s, err)
+	}
+	var srcs []source
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+			srcs = append(srcs, source{ip: ipnet.IP})
+		}
+	}
+	if len(srcs) == 0 {
+		return nil, fmt.Errorf("egress interface %s has no global unicast address", s)
+	}
+	return srcs, nil
+}
+
+// Strategy returns the effective selection strategy.
+func (p *Pool) Strategy() string {
+	if p == nil {
+		return ""
+	}
+	return p.strategy
+}
+
+// Select returns the source address for a connection to remote, or nil when
+// the pool has no source of remote's family. client and target are the keys
+// of the per_user and per_target strategies.
+func (p *Pool) Select(remote net.IP, client, target string) net.IP {
+	ip, _ := p.selectSource(remote, client, target)
+	return ip
+}
+
+// selectSource implements Select, also reporting whether the address was
+// drawn from a prefix, and may not be assigned to any interface.
+func (p *Pool) selectSource(remote net.IP, client, target string) (ip net.IP, inPrefix bool) {
+	if p == nil {
+		return nil, false
+	}
+	srcs := p.v6
+	if remote.To4() != nil {
+		srcs = p.v4
+	}
+	if len(srcs) == 0 {
+		return nil, false
+	}
+
+	var key string
+	var idx uint64
+	switch p.strategy {
+	case StrategyFixed:
+		// A constant key pins the address inside a prefix.
+		key = StrategyFixed
+	case StrategyRoundRobin:
+		idx = p.next.Add(1) - 1
+	case StrategyPerUser:
+		key = client
+		idx = hashKey(key)
+	case StrategyPerTarget:
+		key = target
+		idx = hashKey(key)
+	case StrategyRandom:
+		idx = rand.Uint64()
+	}
+	src := srcs[idx%uint64(len(srcs))]
+	if src.prefix == nil {
+		return src.ip, false
+	}
+	return addressIn(src.prefix, key), true
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// addressIn returns an address inside prefix: derived from key when set, so
+// the same key keeps the same address, random otherwise.
+func addressIn(prefix *net.IPNet, key string) net.IP {
+	host := make([]byte, len(prefix.IP))
+	if key != "" {
+		sum := sha256.Sum256([]byte(key))
+		copy(host, sum[:])
+	} else {
+		for i := range host {
+			host[i] = byte(rand.Uint32())
+		}
+	}
+	ip := make(net.IP, len(prefix.IP))
+	for i := range ip {
+		ip[i] = prefix.IP[i] | (host[i] &^ prefix.Mask[i])
+	}
+	return ip
+}
+
+// ContextDialer dials a network address; *net.Dialer satisfies it.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Dialer returns a dialer that binds every connection it makes to a source
+// chosen for client and target. It expects literal IP addresses, as passed
+// by the server resolver; a hostname is dialed unbound. A nil pool returns
+// base unchanged.
+func (p *Pool) Dialer(base *net.Dialer, client, target string) ContextDialer {
+	if p == nil {
+		return base
+	}
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	return &boundDialer{pool: p, base: base, client: client, target: host}
+}
+
+type boundDialer struct {
+	pool   *Pool
+	base   *net.Dialer
+	client string
+	target string
+}
+
+func (d *boundDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	remote := net.ParseIP(host)
+	if remote == nil {
+		return d.base.DialContext(ctx, network, addr)
+	}
+	local, inPrefix := d.pool.selectSource(remote, d.client, d.target)
+	if local == nil {
+		return d.base.DialContext(ctx, network, addr)
+	}
+
+	bound := *d.base
+	bound.LocalAddr = localAddr(network, local)
+	if inPrefix {
+		v6 := local.To4() == nil
+		bound.Control = func(network, address string, c syscall.RawConn) error {
+			if d.base.Control != nil {
+				if err := d.base.Control(network, address, c); err != nil {
+					return err
+				}
+			}
+			return freebind(c, v6)
+		}
+	}
+	return bound.DialContext(ctx, network, addr)
+}
+
+// localAddr returns ip as the net.Addr type network expects for a local
+// address.
+func localAddr(network string, ip net.IP) net.Addr {
+	switch {
+	case strings.HasPrefix(network, "tcp"):
+		return &net.TCPAddr{IP: ip}
+	case strings.HasPrefix(network, "udp"):
+		return &net.UDPAddr{IP: ip}
+	default:
+		return &net.IPAddr{IP: ip}
+	}
+}
+
+type clientKey struct{}
+
+// WithClient returns a context carrying the client IP used by the per_user
+// strategy.
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFrom returns the client IP stored by WithClient.
+func ClientFrom(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
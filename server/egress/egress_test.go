@@ -0,0 +1,143 @@
+package egress
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	p, err := New(config.EgressConfig{})
+	require.NoError(t, err)
+	require.Nil(t, p)
+	require.Nil(t, p.Select(net.ParseIP("1.1.1.1"), "c", "t"))
+
+	_, err = New(config.EgressConfig{Sources: []string{"192.0.2.1"}, Strategy: "sticky"})
+	require.Error(t, err)
+	_, err = New(config.EgressConfig{Sources: []string{"no-such-interface0"}})
+	require.Error(t, err)
+
+	p, err = New(config.EgressConfig{Sources: []string{"192.0.2.1", "2001:db8::/64"}})
+	require.NoError(t, err)
+	require.Equal(t, StrategyFixed, p.Strategy())
+}
+
+func TestSelectFamily(t *testing.T) {
+	p, err := New(config.EgressConfig{Sources: []string{"192.0.2.1", "192.0.2.2"}})
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1", p.Select(net.ParseIP("8.8.8.8"), "", "").String())
+	// No IPv6 source: the operating system chooses.
+	require.Nil(t, p.Select(net.ParseIP("2001:4860::8888"), "", ""))
+}
+
+func TestSelectStrategies(t *testing.T) {
+	sources := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	remote := net.ParseIP("8.8.8.8")
+
+	rr, err := New(config.EgressConfig{Sources: sources, Strategy: StrategyRoundRobin})
+	require.NoError(t, err)
+	var got []string
+	for range 4 {
+		got = append(got, rr.Select(remote, "", "").String())
+	}
+	require.Equal(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.1"}, got)
+
+	for _, strategy := range []string{StrategyPerUser, StrategyPerTarget} {
+		p, err := New(config.EgressConfig{Sources: sources, Strategy: strategy})
+		require.NoError(t, err)
+		first := p.Select(remote, "203.0.113.7", "example.com")
+		for range 5 {
+			require.Equal(t, first, p.Select(remote, "203.0.113.7", "example.com"), strategy)
+		}
+	}
+}
+
+func TestSelectPrefix(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:1:2::/64")
+	remote := net.ParseIP("2001:4860::8888")
+
+	random, err := New(config.EgressConfig{Sources: []string{prefix.String()}, Strategy: StrategyRandom})
+	require.NoError(t, err)
+	a, b := random.Select(remote, "", ""), random.Select(remote, "", "")
+	require.True(t, prefix.Contains(a))
+	require.True(t, prefix.Contains(b))
+	require.NotEqual(t, a, b)
+
+	perUser, err := New(config.EgressConfig{Sources: []string{prefix.String()}, Strategy: StrategyPerUser})
+	require.NoError(t, err)
+	u1 := perUser.Select(remote, "203.0.113.7", "")
+	require.True(t, prefix.Contains(u1))
+	require.Equal(t, u1, perUser.Select(remote, "203.0.113.7", ""))
+	require.NotEqual(t, u1, perUser.Select(remote, "203.0.113.8", ""))
+
+	fixed, err := New(config.EgressConfig{Sources: []string{prefix.String()}})
+	require.NoError(t, err)
+	pinned := fixed.Select(remote, "203.0.113.7", "a.example.com")
+	require.True(t, prefix.Contains(pinned))
+	require.Equal(t, pinned, fixed.Select(remote, "203.0.113.8", "b.example.com"))
+}
+
+func TestDialerBindsSource(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close() //nolint:errcheck
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c.RemoteAddr()
+		_ = c.Close()
+	}()
+
+	p, err := New(config.EgressConfig{Sources: []string{"127.0.0.2"}})
+	require.NoError(t, err)
+	ctx := WithClient(context.Background(), "203.0.113.7")
+	require.Equal(t, "203.0.113.7", ClientFrom(ctx))
+
+	conn, err := p.Dialer(&net.Dialer{}, ClientFrom(ctx), ln.Addr().String()).DialContext(ctx, "tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	require.Equal(t, "127.0.0.2", conn.LocalAddr().(*net.TCPAddr).IP.String())
+	require.Equal(t, "127.0.0.2", (<-accepted).(*net.TCPAddr).IP.String())
+
+	var nilPool *Pool
+	require.IsType(t, &net.Dialer{}, nilPool.Dialer(&net.Dialer{}, "", ""))
+}
+
+func TestDialerBindsIPv6Prefix(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback unavailable:", err)
+	}
+	defer ln.Close() //nolint:errcheck
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			_ = c.Close()
+		}
+	}()
+
+	loopback, err := New(config.EgressConfig{Sources: []string{"::1/128"}})
+	require.NoError(t, err)
+	conn, err := loopback.Dialer(&net.Dialer{}, "", "").DialContext(context.Background(), "tcp", ln.Addr().String())
+	require.NoError(t, err)
+	require.Equal(t, "::1", conn.LocalAddr().(*net.TCPAddr).IP.String())
+	_ = conn.Close()
+
+	// No interface holds the prefix, so binding it needs IPV6_FREEBIND.
+	_, prefix, _ := net.ParseCIDR("2001:db8:77::/64")
+	unassigned, err := New(config.EgressConfig{Sources: []string{prefix.String()}})
+	require.NoError(t, err)
+	conn, err = unassigned.Dialer(&net.Dialer{}, "", "").DialContext(context.Background(), "udp", "[::1]:53")
+	if runtime.GOOS != "linux" {
+		return
+	}
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	require.True(t, prefix.Contains(conn.LocalAddr().(*net.UDPAddr).IP))
+}
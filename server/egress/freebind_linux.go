@@ -0,0 +1,27 @@
+//go:build linux
+
+package egress
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// freebind sets IP_FREEBIND, or IPV6_FREEBIND on an IPv6 socket, so the
+// socket can bind a prefix address that is routed to the host but not
+// assigned to any interface.
+func freebind(c syscall.RawConn, v6 bool) error {
+	level, opt := unix.SOL_IP, unix.IP_FREEBIND
+	if v6 {
+		level, opt = unix.SOL_IPV6, unix.IPV6_FREEBIND
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, opt, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package egress
+
+import "syscall"
+
+// freebind is a no-op: prefix addresses must be assigned to an interface on
+// this platform.
+func freebind(syscall.RawConn, bool) error {
+	return nil
+}
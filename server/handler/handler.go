@@ -13,7 +13,11 @@ import (
 	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/server/accesslog"
+	"github.com/nange/easyss/v3/server/egress"
 	"github.com/nange/easyss/v3/server/nextproxy"
+	"github.com/nange/easyss/v3/server/probe"
+	"github.com/nange/easyss/v3/server/resolver"
 	"github.com/nange/easyss/v3/shaper"
 	"github.com/nange/easyss/v3/stats"
 	"github.com/nange/easyss/v3/util"
@@ -26,12 +30,14 @@ type ProxyHandler struct {
 	batchWindowMS    int
 	coverBudgetRatio float64
 	coverBudgetCap   int
-	nextProxy        *nextproxy.NextProxy
+	nextProxy        *nextproxy.Router
 	tcpHandler       *TCPHandler
 	udpHandler       *UDPHandler
 	icmpHandler      *ICMPHandler
 	saltCache        *saltCache
 	ipLimiter        *ipRateLimiter
+	probeLog         *probe.Logger
+	accessLog        *accesslog.Logger
 }
 
 type ProxyHandlerConfig struct {
@@ -44,7 +50,11 @@ type ProxyHandlerConfig struct {
 	BatchWindowMS     int
 	CoverBudgetRatio  float64
 	CoverBudgetCap    int
-	NextProxy         *nextproxy.NextProxy
+	NextProxy         *nextproxy.Router
+	Resolver          *resolver.Resolver
+	Egress            *egress.Pool
+	ProbeLog          *probe.Logger
+	AccessLog         *accesslog.Logger
 }
 
 func NewProxyHandler(cfg ProxyHandlerConfig) *ProxyHandler {
@@ -86,11 +96,13 @@ func NewProxyHandler(cfg ProxyHandlerConfig) *ProxyHandler {
 		coverBudgetRatio: coverBudgetRatio,
 		coverBudgetCap:   coverBudgetCap,
 		nextProxy:        cfg.NextProxy,
-		tcpHandler:       NewTCPHandler(cfg.StreamIdleTimeout, cfg.Timeout, cfg.NextProxy),
-		udpHandler:       NewUDPHandler(cfg.UDPIdleTimeout, cfg.NextProxy),
-		icmpHandler:      NewICMPHandler(),
+		tcpHandler:       NewTCPHandler(cfg.StreamIdleTimeout, cfg.Timeout, cfg.NextProxy, cfg.Resolver, cfg.Egress),
+		udpHandler:       NewUDPHandler(cfg.UDPIdleTimeout, cfg.NextProxy, cfg.Resolver, cfg.Egress),
+		icmpHandler:      NewICMPHandler(cfg.Egress),
 		saltCache:        newSaltCache(),
 		ipLimiter:        newIPRateLimiter(),
+		probeLog:         cfg.ProbeLog,
+		accessLog:        cfg.AccessLog,
 	}
 }
 
@@ -112,6 +124,14 @@ func serveReject(w http.ResponseWriter, code int) {
 	w.WriteHeader(code)
 }
 
+// recordProbe counts a rejected request under its reason and appends it to
+// the probe log (if enabled), so probing campaigns can be told apart from
+// ordinary handshake failures.
+func (h *ProxyHandler) recordProbe(r *http.Request, reason probe.Reason) {
+	stats.RecordServerProbe(string(reason))
+	h.probeLog.Log(probe.NewEvent(r, reason))
+}
+
 func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -121,18 +141,21 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	if !r.ProtoAtLeast(2, 0) {
+		h.recordProbe(r, probe.ReasonNotHTTP2)
 		ServeFallback(w, r)
 		return
 	}
 
 	saltB64 := r.Header.Get("x-es")
 	if saltB64 == "" {
+		h.recordProbe(r, probe.ReasonNoSalt)
 		ServeFallback(w, r)
 		return
 	}
 
 	salt, err := base64.RawURLEncoding.DecodeString(saltB64)
 	if err != nil || len(salt) != 16 {
+		h.recordProbe(r, probe.ReasonBadSalt)
 		ServeFallback(w, r)
 		return
 	}
@@ -143,6 +166,7 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !h.ipLimiter.Allow(clientIP(r)) {
 		log.Error("[SERVER] handshake rate limited", "remote", r.RemoteAddr)
 		stats.RecordServerHandshakeError()
+		h.recordProbe(r, probe.ReasonRateLimited)
 		serveReject(w, http.StatusTooManyRequests)
 		return
 	}
@@ -155,6 +179,7 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if h.saltCache.MarkSeen(saltB64) {
 		log.Error("[SERVER] replayed salt", "remote", r.RemoteAddr, "endpoint", r.URL.Path)
 		stats.RecordServerHandshakeError()
+		h.recordProbe(r, probe.ReasonReplay)
 		serveReject(w, http.StatusBadRequest)
 		return
 	}
@@ -171,6 +196,7 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		log.Error("[SERVER] read first record", "remote", r.RemoteAddr, "endpoint", endpoint, "err", err)
 		stats.RecordServerHandshakeError()
 		if errors.Is(err, crypto.ErrHandshakeTimeout) {
+			h.recordProbe(r, probe.ReasonHandshakeTimeout)
 			// The client connected but its bootstrap record did not arrive in
 			// time (congested link, connection dying). A real HTTP/2 site
 			// (nginx) answers a late/absent request body with 408 Request
@@ -185,6 +211,7 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// server stays indistinguishable from a real site for keyless
 		// requests; the easyss client detects the non-encrypted payload on
 		// its first session read and reports a clear handshake-rejected error.
+		h.recordProbe(r, probe.ReasonDecryptFailed)
 		ServeFallback(w, r)
 		return
 	}
@@ -192,6 +219,7 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !first.Handshake.MatchesEndpoint(endpoint) {
 		log.Error("[SERVER] endpoint mismatch", "remote", r.RemoteAddr, "proto", first.Handshake.Proto.String(), "endpoint", endpoint)
 		stats.RecordServerHandshakeError()
+		h.recordProbe(r, probe.ReasonEndpointMismatch)
 		serveReject(w, http.StatusNotFound)
 		return
 	}
@@ -199,6 +227,7 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !h.allowedMethods[first.Handshake.Method] {
 		log.Error("[SERVER] method not allowed", "remote", r.RemoteAddr, "method", first.Handshake.Method.String())
 		stats.RecordServerHandshakeError()
+		h.recordProbe(r, probe.ReasonMethodNotAllowed)
 		serveReject(w, http.StatusMethodNotAllowed)
 		return
 	}
@@ -267,6 +296,9 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s2cShaper := shaper.New(s2cWriter, s2cCfg)
 	defer s2cShaper.Close() //nolint:errcheck
 
+	rec := h.accessLog.Start(clientIP(r), endpoint, target)
+	ctx := egress.WithClient(r.Context(), clientIP(r))
+
 	var handleErr error
 	switch endpoint {
 	case sharedconfig.EndpointTCP:
@@ -274,13 +306,13 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// cancelRead unblocks the relay's client-read goroutine immediately
 		// when the relay terminates (idle timeout/error), instead of letting
 		// it linger on the request body until net/http closes it.
-		handleErr = h.tcpHandler.Handle(r.Context(), c2sReader, s2cShaper, target, func() { _ = r.Body.Close() })
+		handleErr = h.tcpHandler.Handle(ctx, c2sReader, s2cShaper, target, rec, func() { _ = r.Body.Close() })
 	case sharedconfig.EndpointUDP:
 		stats.RecordServerUDPStream()
-		handleErr = h.udpHandler.Handle(r.Context(), c2sReader, s2cShaper, target)
+		handleErr = h.udpHandler.Handle(ctx, c2sReader, s2cShaper, target, rec)
 	case sharedconfig.EndpointICMP:
 		stats.RecordServerICMPStream()
-		handleErr = h.icmpHandler.Handle(c2sReader, s2cShaper, target)
+		handleErr = h.icmpHandler.Handle(ctx, c2sReader, s2cShaper, target, rec)
 	}
 	if handleErr != nil {
 		log.Info("[SERVER] handler finished with error", "target", target, "endpoint", endpoint, "err", handleErr)
@@ -167,7 +167,7 @@ func TestDialTimeout(t *testing.T) {
 }
 
 func TestNewTCPHandler_DialTimeout(t *testing.T) {
-	h := NewTCPHandler(120*time.Second, 30*time.Second, nil)
+	h := NewTCPHandler(120*time.Second, 30*time.Second, nil, nil, nil)
 	if h == nil {
 		t.Fatal("NewTCPHandler returned nil")
 	}
@@ -183,21 +183,21 @@ func TestNewTCPHandler_DialTimeout(t *testing.T) {
 }
 
 func TestNewTCPHandler(t *testing.T) {
-	h := NewTCPHandler(120*time.Second, 30*time.Second, nil)
+	h := NewTCPHandler(120*time.Second, 30*time.Second, nil, nil, nil)
 	if h == nil {
 		t.Fatal("NewTCPHandler returned nil")
 	}
 }
 
 func TestNewUDPHandler(t *testing.T) {
-	h := NewUDPHandler(30*time.Second, nil)
+	h := NewUDPHandler(30*time.Second, nil, nil, nil)
 	if h == nil {
 		t.Fatal("NewUDPHandler returned nil")
 	}
 }
 
 func TestNewICMPHandler(t *testing.T) {
-	h := NewICMPHandler()
+	h := NewICMPHandler(nil)
 	if h == nil {
 		t.Fatal("NewICMPHandler returned nil")
 	}
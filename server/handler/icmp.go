@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"encoding/binary"
 	"io"
 	"net"
@@ -9,6 +10,8 @@ import (
 	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/server/accesslog"
+	"github.com/nange/easyss/v3/server/egress"
 	"github.com/nange/easyss/v3/shaper"
 	"github.com/nange/easyss/v3/util/bytespool"
 	"golang.org/x/net/icmp"
@@ -17,25 +20,31 @@ import (
 )
 
 type ICMPHandler struct {
+	egress *egress.Pool
 }
 
-func NewICMPHandler() *ICMPHandler {
-	return &ICMPHandler{}
+func NewICMPHandler(pool *egress.Pool) *ICMPHandler {
+	return &ICMPHandler{egress: pool}
 }
 
-func (h *ICMPHandler) Handle(dr *crypto.DecryptedReader, s2c shaper.Shaper, target string) error {
+// Handle performs a single echo exchange with the target. rec (may be nil)
+// receives the stream accounting for the access log.
+func (h *ICMPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, target string, rec *accesslog.Record) error {
 	for {
 		frame, err := dr.ReadFrame()
 		if err != nil {
+			rec.Finish(accesslog.CloseError, err)
 			return err
 		}
 
 		switch frame.Type {
 		case protocol.FrameDATA:
-			replyPayload, err := h.icmpExchange(target, frame.Payload)
+			rec.AddUp(len(frame.Payload))
+			replyPayload, err := h.icmpExchange(ctx, target, frame.Payload)
 			if err != nil {
 				_ = s2c.PushFrame(protocol.NewFrameRST())
 				_ = s2c.Flush()
+				rec.Finish(accesslog.CloseError, err)
 				return err
 			}
 
@@ -44,9 +53,15 @@ func (h *ICMPHandler) Handle(dr *crypto.DecryptedReader, s2c shaper.Shaper, targ
 			_ = s2c.PushFrame(dataFrame)
 			_ = s2c.PushFrame(finFrame)
 			_ = s2c.Flush()
+			rec.AddDown(len(replyPayload))
+			rec.Finish(accesslog.CloseFIN, nil)
 			return nil
 
-		case protocol.FrameFIN, protocol.FrameRST:
+		case protocol.FrameFIN:
+			rec.Finish(accesslog.CloseFIN, nil)
+			return nil
+		case protocol.FrameRST:
+			rec.Finish(accesslog.CloseRST, nil)
 			return nil
 		case protocol.FramePADDING, protocol.FrameCOVER:
 			continue
@@ -54,7 +69,7 @@ func (h *ICMPHandler) Handle(dr *crypto.DecryptedReader, s2c shaper.Shaper, targ
 	}
 }
 
-func (h *ICMPHandler) icmpExchange(target string, payload []byte) ([]byte, error) {
+func (h *ICMPHandler) icmpExchange(ctx context.Context, target string, payload []byte) ([]byte, error) {
 	log.Debug("[ICMP] exchange", "target", target)
 
 	if len(payload) < 4 {
@@ -69,7 +84,8 @@ func (h *ICMPHandler) icmpExchange(target string, payload []byte) ([]byte, error
 		parseProto = 58
 	}
 
-	conn, err := net.DialTimeout(dialNet, target, 5*time.Second)
+	d := h.egress.Dialer(&net.Dialer{Timeout: 5 * time.Second}, egress.ClientFrom(ctx), target)
+	conn, err := d.DialContext(ctx, dialNet, target)
 	if err != nil {
 		log.Error("[ICMP] dial target failed", "target", target, "err", err)
 		return nil, err
@@ -4,16 +4,20 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	sharedconfig "github.com/nange/easyss/v3/config"
 	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/server/probe"
+	"github.com/nange/easyss/v3/stats"
 	"github.com/stretchr/testify/require"
 )
 
@@ -215,3 +219,43 @@ func TestServeHTTP_ValidHandshakeOctetStream(t *testing.T) {
 		t.Errorf("Content-Type = %q, want application/octet-stream", ct)
 	}
 }
+
+// TestServeHTTP_ProbeLog verifies that rejected requests are classified and
+// written to the probe log with the source and TLS details.
+func TestServeHTTP_ProbeLog(t *testing.T) {
+	var buf syncBuffer
+	h := newRejectHandler(time.Second).(*ProxyHandler)
+	h.probeLog = probe.NewLogger(&buf)
+	srv := newRejectTestServer(t, h)
+	tr := newRejectTestClient(t)
+
+	before := stats.Collect().ServerProbes["bad_salt"]
+	resp, _ := postBootstrap(t, tr, srv.URL+sharedconfig.EndpointTCP, "not-a-salt", bytes.NewReader(nil))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, before+1, stats.Collect().ServerProbes["bad_salt"])
+
+	var ev probe.Event
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &ev))
+	require.Equal(t, probe.ReasonBadSalt, ev.Reason)
+	require.Equal(t, "127.0.0.1", ev.Source)
+	require.Equal(t, sharedconfig.EndpointTCP, ev.Path)
+	require.Equal(t, "h2", ev.ALPN)
+	require.Contains(t, ev.Headers, "x-es")
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
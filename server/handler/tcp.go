@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/nange/easyss/v3/config"
@@ -13,7 +14,10 @@ import (
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/protocol"
 	"github.com/nange/easyss/v3/relay"
+	"github.com/nange/easyss/v3/server/accesslog"
+	"github.com/nange/easyss/v3/server/egress"
 	"github.com/nange/easyss/v3/server/nextproxy"
+	"github.com/nange/easyss/v3/server/resolver"
 	"github.com/nange/easyss/v3/shaper"
 	"github.com/nange/easyss/v3/stats"
 	"github.com/nange/easyss/v3/util"
@@ -23,7 +27,9 @@ import (
 type TCPHandler struct {
 	dialer      *net.Dialer
 	dialContext func(context.Context, string, string) (net.Conn, error)
-	nextProxy   *nextproxy.NextProxy
+	nextProxy   *nextproxy.Router
+	resolver    *resolver.Resolver
+	egress      *egress.Pool
 	idleTimeout time.Duration
 	dialTimeout time.Duration
 }
@@ -41,7 +47,7 @@ func DialTimeout(timeout time.Duration) time.Duration {
 	return d
 }
 
-func NewTCPHandler(idleTimeout, timeout time.Duration, np *nextproxy.NextProxy) *TCPHandler {
+func NewTCPHandler(idleTimeout, timeout time.Duration, np *nextproxy.Router, res *resolver.Resolver, pool *egress.Pool) *TCPHandler {
 	if idleTimeout <= 0 {
 		idleTimeout = 300 * time.Second
 	}
@@ -52,24 +58,30 @@ func NewTCPHandler(idleTimeout, timeout time.Duration, np *nextproxy.NextProxy)
 	return &TCPHandler{
 		dialer:      &net.Dialer{Timeout: dialTimeout, KeepAlive: timeout},
 		nextProxy:   np,
+		resolver:    res,
+		egress:      pool,
 		idleTimeout: idleTimeout,
 		dialTimeout: dialTimeout,
 	}
 }
 
-func (h *TCPHandler) dialTarget(ctx context.Context, network, addr string) (net.Conn, error) {
-	if h.nextProxy != nil && h.nextProxy.ShouldProxy(addr) {
-		log.Info("[TCP_HANDLE] dialing via next proxy", "target", addr, "proxy", h.nextProxy.URL().String())
-		return h.nextProxy.DialContext(ctx, network, addr)
+// dialTarget connects to addr directly or through the matching next-proxy
+// group. via is the host:port of the next-proxy upstream used, empty for a
+// direct connection.
+func (h *TCPHandler) dialTarget(ctx context.Context, network, addr string) (conn net.Conn, via string, err error) {
+	if np := h.nextProxy.Select(addr); np != nil {
+		log.Info("[TCP_HANDLE] dialing via next proxy", "target", addr, "group", np.Name())
+		return np.DialUpstream(ctx, network, addr)
 	}
 	// Test-only injection point; nil in production.
 	if h.dialContext != nil {
-		return h.dialContext(ctx, network, addr)
+		conn, err = h.dialContext(ctx, network, addr)
+		return conn, "", err
 	}
-	d := h.dialer
-	conn, err := d.DialContext(ctx, outboundTCPNetwork(addr), addr)
+	d := h.egress.Dialer(h.dialer, egress.ClientFrom(ctx), addr)
+	conn, err = h.resolver.Dial(ctx, d, outboundTCPNetwork(addr), addr)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	// Post-dial SSRF guard: verify the actual remote IP is not a LAN address.
 	// This defends against DNS rebinding attacks where a domain resolves to a
@@ -77,10 +89,10 @@ func (h *TCPHandler) dialTarget(ctx context.Context, network, addr string) (net.
 	if ra := conn.RemoteAddr(); ra != nil {
 		if host, _, e := net.SplitHostPort(ra.String()); e == nil && util.IsLANIP(host) {
 			_ = conn.Close()
-			return nil, fmt.Errorf("ssrf: rejected lan destination %s", host)
+			return nil, "", fmt.Errorf("ssrf: rejected lan destination %s", host)
 		}
 	}
-	return conn, nil
+	return conn, "", nil
 }
 
 func outboundTCPNetwork(addr string) string {
@@ -102,25 +114,26 @@ func outboundTCPNetwork(addr string) string {
 // cancelRead is invoked when the relay terminates (timeout/error/completion);
 // it unblocks a copy goroutine that may be stuck reading from the client
 // (e.g. the HTTP/2 request body), so no goroutine lingers after the handler
-// returns.
-func (h *TCPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, target string, cancelRead func()) error {
+// returns. rec (may be nil) receives the stream accounting for the access
+// log.
+func (h *TCPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, target string, rec *accesslog.Record, cancelRead func()) error {
 	log.Info("[TCP_HANDLE] dialing target", "target", target, "timeout", h.dialTimeout)
-	targetConn, err := h.dialTarget(ctx, "tcp", target)
+	targetConn, via, err := h.dialTarget(ctx, "tcp", target)
 	if err != nil {
 		log.Error("[TCP_HANDLE] dial failed", "target", target, "err", err)
 		_ = s2c.PushFrame(protocol.NewFrameRST())
 		_ = s2c.Flush()
+		rec.Finish(accesslog.CloseError, err)
 		return err
 	}
 	defer targetConn.Close() //nolint:errcheck
 	// When dialing via the next proxy, the socks5 client connection reports a
 	// nil RemoteAddr (the library's RemoteAddr() returns an unset field), so
-	// fall back to the configured proxy address for observability.
-	remote := ""
-	if h.nextProxy != nil && h.nextProxy.ShouldProxy(target) {
-		remote = h.nextProxy.URL().Host
-	} else if ra := targetConn.RemoteAddr(); ra != nil {
+	// report the upstream proxy address for observability.
+	remote := via
+	if ra := targetConn.RemoteAddr(); via == "" && ra != nil {
 		remote = ra.String()
+		rec.SetResolved(ra)
 	}
 	log.Info("[TCP_HANDLE] target connected", "target", target, "remote", remote)
 	m := stats.NewStreamMeter("tcp_handle", target)
@@ -131,14 +144,15 @@ func (h *TCPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c
 		_ = s2c.Flush()
 	}
 
+	var clientRST atomic.Bool
 	result := relay.Bidirectional(h.idleTimeout, func() {
 		if cancelRead != nil {
 			cancelRead()
 		}
 		_ = targetConn.Close()
 	},
-		func(signal func()) error { return h.copyFromClient(dr, targetConn, signal) },
-		func(signal func()) error { return h.copyFromTarget(targetConn, s2c, signal, m) },
+		func(signal func()) error { return h.copyFromClient(dr, targetConn, signal, rec, &clientRST) },
+		func(signal func()) error { return h.copyFromTarget(targetConn, s2c, signal, m, rec) },
 	)
 	// Log the stream outcome (bytes relayed and exit reason) at INFO level so
 	// targets whose connection was established but later stalled, reset or
@@ -148,6 +162,16 @@ func (h *TCPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c
 		attrs = append(attrs, "err", result.Err.Error())
 	}
 	log.Info("[TCP_HANDLE] stream closed", attrs...)
+	switch {
+	case result.TimedOut:
+		rec.Finish(accesslog.CloseIdleTimeout, nil)
+	case result.Err != nil:
+		rec.Finish(accesslog.CloseError, result.Err)
+	case clientRST.Load():
+		rec.Finish(accesslog.CloseRST, nil)
+	default:
+		rec.Finish(accesslog.CloseFIN, nil)
+	}
 	if result.TimedOut {
 		log.Debug("[TCP_HANDLE] idle timeout", "target", target, "timeout", h.idleTimeout)
 		sendRST()
@@ -159,7 +183,7 @@ func (h *TCPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c
 	return result.Err
 }
 
-func (h *TCPHandler) copyFromClient(dr *crypto.DecryptedReader, dst net.Conn, signalActivity func()) error {
+func (h *TCPHandler) copyFromClient(dr *crypto.DecryptedReader, dst net.Conn, signalActivity func(), rec *accesslog.Record, clientRST *atomic.Bool) error {
 	for {
 		frame, err := dr.ReadFrame()
 		if err != nil {
@@ -173,6 +197,7 @@ func (h *TCPHandler) copyFromClient(dr *crypto.DecryptedReader, dst net.Conn, si
 				if _, wErr := dst.Write(frame.Payload); wErr != nil {
 					return wErr
 				}
+				rec.AddUp(len(frame.Payload))
 			}
 		case protocol.FrameFIN:
 			signalActivity()
@@ -181,6 +206,7 @@ func (h *TCPHandler) copyFromClient(dr *crypto.DecryptedReader, dst net.Conn, si
 			}
 			continue
 		case protocol.FrameRST:
+			clientRST.Store(true)
 			return io.EOF
 		case protocol.FramePADDING, protocol.FrameCOVER:
 			continue
@@ -188,7 +214,7 @@ func (h *TCPHandler) copyFromClient(dr *crypto.DecryptedReader, dst net.Conn, si
 	}
 }
 
-func (h *TCPHandler) copyFromTarget(src net.Conn, s2c shaper.Shaper, signalActivity func(), m *stats.StreamMeter) error {
+func (h *TCPHandler) copyFromTarget(src net.Conn, s2c shaper.Shaper, signalActivity func(), m *stats.StreamMeter, rec *accesslog.Record) error {
 	buf := bytespool.Get(config.ServerTCPStreamBufferSize)
 	defer bytespool.MustPut(buf)
 	for {
@@ -201,6 +227,7 @@ func (h *TCPHandler) copyFromTarget(src net.Conn, s2c shaper.Shaper, signalActiv
 				return wErr
 			}
 			m.Add(n, "read_target")
+			rec.AddDown(n)
 		}
 		if err != nil {
 			if errors.Is(err, io.EOF) {
@@ -1,7 +1,9 @@
 package handler
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"io"
 	"net"
 	"sync"
@@ -12,6 +14,7 @@ import (
 	sharedconfig "github.com/nange/easyss/v3/config"
 	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/server/accesslog"
 	"github.com/nange/easyss/v3/shaper"
 )
 
@@ -85,7 +88,7 @@ func (c *stubConn) SetReadDeadline(t time.Time) error { return nil }
 func (c *stubConn) SetWriteDeadline(t time.Time) error { return nil }
 
 func TestTCPHandler_CancelReadOnIdleTimeout(t *testing.T) {
-	h := NewTCPHandler(150*time.Millisecond, 5*time.Second, nil)
+	h := NewTCPHandler(150*time.Millisecond, 5*time.Second, nil, nil, nil)
 	// A silent peer: the stub accepts writes and never produces data, with a
 	// public remote address so the post-dial SSRF guard passes.
 	stub := newStubConn(&net.TCPAddr{IP: net.ParseIP("8.8.8.8"), Port: 53})
@@ -109,9 +112,12 @@ func TestTCPHandler_CancelReadOnIdleTimeout(t *testing.T) {
 	dr := crypto.NewDecryptedReader(pr, aad, enc, counter)
 	s2c := shaper.New(crypto.NewRecordWriter(io.Discard, enc, counter, aad), shaper.Config{})
 
+	var logBuf bytes.Buffer
+	rec := accesslog.NewLogger(&logBuf).Start("198.51.100.1", sharedconfig.EndpointTCP, "8.8.8.8:53")
+
 	var cancelled atomic.Bool
 	start := time.Now()
-	err = h.Handle(context.Background(), dr, s2c, "8.8.8.8:53", func() { cancelled.Store(true) })
+	err = h.Handle(context.Background(), dr, s2c, "8.8.8.8:53", rec, func() { cancelled.Store(true) })
 	if err == nil {
 		t.Fatal("Handle should return an error on idle timeout")
 	}
@@ -122,4 +128,15 @@ func TestTCPHandler_CancelReadOnIdleTimeout(t *testing.T) {
 		t.Fatal("Handle took too long to return")
 	}
 	_ = pw.Close()
+
+	var entry accesslog.Entry
+	if err := json.Unmarshal(logBuf.Bytes(), &entry); err != nil {
+		t.Fatalf("access log entry: %v", err)
+	}
+	if entry.Close != accesslog.CloseIdleTimeout {
+		t.Errorf("close reason = %q, want %q", entry.Close, accesslog.CloseIdleTimeout)
+	}
+	if entry.ResolvedIP != "8.8.8.8" {
+		t.Errorf("resolved ip = %q, want 8.8.8.8", entry.ResolvedIP)
+	}
 }
@@ -15,7 +15,10 @@ import (
 	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/log"
 	"github.com/nange/easyss/v3/protocol"
+	"github.com/nange/easyss/v3/server/accesslog"
+	"github.com/nange/easyss/v3/server/egress"
 	"github.com/nange/easyss/v3/server/nextproxy"
+	"github.com/nange/easyss/v3/server/resolver"
 	"github.com/nange/easyss/v3/shaper"
 	"github.com/nange/easyss/v3/util"
 	"github.com/nange/easyss/v3/util/bytespool"
@@ -25,21 +28,28 @@ const udpBufSize = protocol.MaxPlainRecordSize - protocol.FrameHeaderSize
 
 type UDPHandler struct {
 	idleTimeout time.Duration
-	nextProxy   *nextproxy.NextProxy
+	nextProxy   *nextproxy.Router
+	resolver    *resolver.Resolver
+	egress      *egress.Pool
 }
 
-func NewUDPHandler(idleTimeout time.Duration, np *nextproxy.NextProxy) *UDPHandler {
+func NewUDPHandler(idleTimeout time.Duration, np *nextproxy.Router, res *resolver.Resolver, pool *egress.Pool) *UDPHandler {
 	if idleTimeout <= 0 {
 		idleTimeout = 30 * time.Second
 	}
 	h := &UDPHandler{
 		idleTimeout: idleTimeout,
 		nextProxy:   np,
+		resolver:    res,
+		egress:      pool,
 	}
 	return h
 }
 
-func (h *UDPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, target string) error {
+// Handle relays datagrams between the client and the target until either
+// side closes or the association is idle. rec (may be nil) receives the
+// stream accounting for the access log.
+func (h *UDPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c shaper.Shaper, target string, rec *accesslog.Record) error {
 	log.Debug("[UDP] handler starting", "target", target)
 
 	conn, err := h.dialTarget(ctx, target)
@@ -47,8 +57,12 @@ func (h *UDPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c
 		log.Error("[UDP] dial target failed", "target", target, "err", err)
 		_ = s2c.PushFrame(protocol.NewFrameRST())
 		_ = s2c.Flush()
+		rec.Finish(accesslog.CloseError, err)
 		return err
 	}
+	if h.nextProxyFor(target) == nil {
+		rec.SetResolved(conn.RemoteAddr())
+	}
 	var dnsDetected atomic.Bool
 	var dnsChecked atomic.Bool
 
@@ -58,7 +72,7 @@ func (h *UDPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c
 	defer conn.Close() //nolint:errcheck
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- h.readFromTarget(conn, s2c, done, &dnsDetected)
+		errCh <- h.readFromTarget(conn, s2c, done, &dnsDetected, rec)
 	}()
 	frameCh := make(chan udpFrameResult, 1)
 	go func() {
@@ -87,14 +101,19 @@ func (h *UDPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c
 		case err := <-errCh:
 			closeDone()
 			if errors.Is(err, io.EOF) {
+				// readFromTarget reports EOF when the target stayed silent
+				// for the idle timeout.
+				rec.Finish(accesslog.CloseIdleTimeout, nil)
 				return nil
 			}
 			sendRST()
+			rec.Finish(accesslog.CloseError, err)
 			return err
 		case res := <-frameCh:
 			if res.err != nil {
 				closeDone()
 				sendRST()
+				rec.Finish(accesslog.CloseError, res.err)
 				return res.err
 			}
 			if !timer.Stop() {
@@ -112,24 +131,32 @@ func (h *UDPHandler) Handle(ctx context.Context, dr *crypto.DecryptedReader, s2c
 				if err := msg.Unpack(res.frame.Payload); err == nil && util.IsDNSRequest(msg) {
 					dnsDetected.Store(true)
 					domain := strings.TrimSuffix(msg.Question[0].Name, ".")
-					viaNextProxy := h.nextProxy.IsCustomDomain(domain)
+					viaNextProxy := h.nextProxy.CustomDomainGroup(domain) != nil
 					log.Info("[UDP_DNS]", "domain", domain, "target", target, "via_next_proxy", viaNextProxy)
 				}
 				dnsChecked.Store(true)
 			}
 
-			if err := h.handleClientFrame(conn, res.frame); err != nil {
+			if err := h.handleClientFrame(conn, res.frame, rec); err != nil {
 				closeDone()
 				sendRST()
+				rec.Finish(accesslog.CloseError, err)
 				return err
 			}
-			if res.frame.Type == protocol.FrameFIN || res.frame.Type == protocol.FrameRST {
+			switch res.frame.Type {
+			case protocol.FrameFIN:
+				closeDone()
+				rec.Finish(accesslog.CloseFIN, nil)
+				return nil
+			case protocol.FrameRST:
 				closeDone()
+				rec.Finish(accesslog.CloseRST, nil)
 				return nil
 			}
 		case <-timer.C:
 			closeDone()
 			log.Debug("[UDP] idle timeout", "target", target, "timeout", h.idleTimeout)
+			rec.Finish(accesslog.CloseIdleTimeout, nil)
 			return nil
 		}
 	}
@@ -140,11 +167,12 @@ type udpFrameResult struct {
 	err   error
 }
 
-func (h *UDPHandler) handleClientFrame(conn net.Conn, frame protocol.Frame) error {
+func (h *UDPHandler) handleClientFrame(conn net.Conn, frame protocol.Frame, rec *accesslog.Record) error {
 	switch frame.Type {
 	case protocol.FrameDATAGRAM:
 		if len(frame.Payload) > 0 {
-			_, err := conn.Write(frame.Payload)
+			n, err := conn.Write(frame.Payload)
+			rec.AddUp(n)
 			return err
 		}
 	case protocol.FrameFIN, protocol.FrameRST, protocol.FramePADDING, protocol.FrameCOVER:
@@ -153,16 +181,19 @@ func (h *UDPHandler) handleClientFrame(conn net.Conn, frame protocol.Frame) erro
 	return nil
 }
 
+// nextProxyFor returns the next-proxy group datagrams for target are relayed
+// through, or nil when they go direct.
+func (h *UDPHandler) nextProxyFor(target string) *nextproxy.NextProxy {
+	return h.nextProxy.SelectUDP(target)
+}
+
 func (h *UDPHandler) dialTarget(ctx context.Context, target string) (net.Conn, error) {
-	host := target
-	if h, _, err := net.SplitHostPort(target); err == nil {
-		host = h
-	}
-	if h.nextProxy != nil && h.nextProxy.EnableUDP() && h.nextProxy.ShouldProxy(host) {
-		log.Info("[UDP] dialing via next proxy", "target", target, "proxy", h.nextProxy.URL().String())
-		return h.nextProxy.DialContext(ctx, "udp", target)
+	if np := h.nextProxyFor(target); np != nil {
+		log.Info("[UDP] dialing via next proxy", "target", target, "group", np.Name())
+		return np.DialContext(ctx, "udp", target)
 	}
-	conn, err := net.DialTimeout("udp", target, h.idleTimeout)
+	d := h.egress.Dialer(&net.Dialer{Timeout: h.idleTimeout}, egress.ClientFrom(ctx), target)
+	conn, err := h.resolver.Dial(ctx, d, "udp", target)
 	if err != nil {
 		return nil, err
 	}
@@ -176,7 +207,7 @@ func (h *UDPHandler) dialTarget(ctx context.Context, target string) (net.Conn, e
 	return conn, nil
 }
 
-func (h *UDPHandler) readFromTarget(conn net.Conn, s2c shaper.Shaper, done <-chan struct{}, dnsDetected *atomic.Bool) error {
+func (h *UDPHandler) readFromTarget(conn net.Conn, s2c shaper.Shaper, done <-chan struct{}, dnsDetected *atomic.Bool, rec *accesslog.Record) error {
 	buf := bytespool.Get(udpBufSize)
 	defer bytespool.MustPut(buf)
 	for {
@@ -204,15 +235,15 @@ func (h *UDPHandler) readFromTarget(conn net.Conn, s2c shaper.Shaper, done <-cha
 				msg := &dns.Msg{}
 				if err := msg.Unpack(buf[:n]); err == nil && msg.Response && len(msg.Question) > 0 {
 					domain := strings.TrimSuffix(msg.Question[0].Name, ".")
-					if h.nextProxy.IsCustomDomain(domain) {
+					if g := h.nextProxy.CustomDomainGroup(domain); g != nil {
 						for _, ans := range msg.Answer {
 							switch a := ans.(type) {
 							case *dns.A:
-								h.nextProxy.AddIP(a.A.String())
+								g.AddIP(a.A.String())
 							case *dns.AAAA:
-								h.nextProxy.AddIP(a.AAAA.String())
+								g.AddIP(a.AAAA.String())
 							case *dns.CNAME:
-								h.nextProxy.AddDomain(strings.TrimSuffix(a.Target, "."))
+								g.AddDomain(strings.TrimSuffix(a.Target, "."))
 							}
 						}
 					}
@@ -223,6 +254,7 @@ func (h *UDPHandler) readFromTarget(conn net.Conn, s2c shaper.Shaper, done <-cha
 			if wErr := s2c.PushFrame(frame); wErr != nil {
 				return wErr
 			}
+			rec.AddDown(n)
 		}
 	}
 }
@@ -0,0 +1,204 @@
+package nextproxy
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+)
+
+// upstream is one proxy of a group with its last health-check result.
+type upstream struct {
+	url   *url.URL
+	alive atomic.Bool
+	// latency is the last successful health-check connect time in
+	// nanoseconds; zero until the first check.
+	latency atomic.Int64
+}
+
+// candidates returns the upstreams in the order a dial should try them:
+// healthy ones by strategy, then dead ones as a last resort.
+func (np *NextProxy) candidates() []*upstream {
+	var alive, dead []*upstream
+	for _, u := range np.upstreams {
+		if u.alive.Load() {
+			alive = append(alive, u)
+		} else {
+			dead = append(dead, u)
+		}
+	}
+
+	switch np.strategy {
+	case StrategyRoundRobin:
+		if n := len(alive); n > 1 {
+			start := int(np.next.Add(1)-1) % n
+			alive = append(alive[start:], alive[:start]...)
+		}
+	case StrategyLowestLatency:
+		slices.SortStableFunc(alive, func(a, b *upstream) int {
+			return cmpLatency(a.latency.Load(), b.latency.Load())
+		})
+	}
+	return append(alive, dead...)
+}
+
+// cmpLatency orders measured latencies before unmeasured ones.
+func cmpLatency(a, b int64) int {
+	if a == 0 {
+		a = math.MaxInt64
+	}
+	if b == 0 {
+		b = math.MaxInt64
+	}
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// check probes every upstream with a TCP connect and records whether it is
+// reachable and how long the connect took.
+func (np *NextProxy) check(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, u := range np.upstreams {
+		wg.Go(func() {
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", proxyAddr(u.url), timeout)
+			if err != nil {
+				if u.alive.Swap(false) {
+					log.Warn("[NEXTPROXY] upstream down", "group", np.name, "upstream", u.url.Redacted(), "err", err)
+				}
+				return
+			}
+			_ = conn.Close()
+			u.latency.Store(int64(max(time.Since(start), time.Nanosecond)))
+			if !u.alive.Swap(true) {
+				log.Info("[NEXTPROXY] upstream up", "group", np.name, "upstream", u.url.Redacted())
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// Router holds the next-proxy groups in priority order; a target uses the
+// first group whose rules match it.
+type Router struct {
+	groups []*NextProxy
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewRouter returns a Router over the non-nil groups, or nil if there are
+// none.
+func NewRouter(groups ...*NextProxy) *Router {
+	r := &Router{}
+	for _, g := range groups {
+		if g != nil {
+			r.groups = append(r.groups, g)
+		}
+	}
+	if len(r.groups) == 0 {
+		return nil
+	}
+	return r
+}
+
+// Groups returns the groups in priority order.
+func (r *Router) Groups() []*NextProxy {
+	if r == nil {
+		return nil
+	}
+	return r.groups
+}
+
+// Select returns the group host (with or without port) is proxied through,
+// or nil when it should be dialed directly.
+func (r *Router) Select(host string) *NextProxy {
+	if r == nil {
+		return nil
+	}
+	for _, g := range r.groups {
+		if g.ShouldProxy(host) {
+			return g
+		}
+	}
+	return nil
+}
+
+// SelectUDP is Select for UDP: the first matching group is used only if it
+// relays UDP, otherwise the datagrams go direct.
+func (r *Router) SelectUDP(host string) *NextProxy {
+	g := r.Select(host)
+	if g == nil || !g.EnableUDP() {
+		return nil
+	}
+	return g
+}
+
+// CustomDomainGroup returns the first group whose rule file lists domain.
+func (r *Router) CustomDomainGroup(domain string) *NextProxy {
+	if r == nil {
+		return nil
+	}
+	for _, g := range r.groups {
+		if g.IsCustomDomain(domain) {
+			return g
+		}
+	}
+	return nil
+}
+
+// SetDialTimeout sets the dial timeout of every group.
+func (r *Router) SetDialTimeout(d time.Duration) {
+	if r == nil {
+		return
+	}
+	for _, g := range r.groups {
+		g.SetDialTimeout(d)
+	}
+}
+
+// StartHealthChecks probes every upstream each interval until Close. Groups
+// with a single upstream are checked too, so a dead proxy is reported in
+// the log. An interval <= 0 disables checking.
+func (r *Router) StartHealthChecks(interval, timeout time.Duration) {
+	if r == nil || interval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, g := range r.groups {
+				g.check(timeout)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops the health checks.
+func (r *Router) Close() {
+	if r == nil || r.cancel == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+}
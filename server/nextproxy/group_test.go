@@ -0,0 +1,122 @@
+package nextproxy
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func hosts(us []*upstream) []string {
+	var out []string
+	for _, u := range us {
+		out = append(out, u.url.Host)
+	}
+	return out
+}
+
+func TestNewGroup(t *testing.T) {
+	_, err := NewGroup(Options{Name: "empty"})
+	require.Error(t, err)
+	_, err = NewGroup(Options{Name: "g", URLs: []string{"socks5://a:1"}, Strategy: "random"})
+	require.Error(t, err)
+	_, err = NewGroup(Options{Name: "g", URLs: []string{"socks5://a:1", "http://b:2"}, EnableUDP: true})
+	require.ErrorContains(t, err, "cannot carry udp")
+
+	g, err := NewGroup(Options{Name: "g", URLs: []string{"socks5://a:1", "http://b:2"}})
+	require.NoError(t, err)
+	require.Equal(t, "g", g.Name())
+	require.Equal(t, StrategyFailover, g.strategy)
+	require.Equal(t, "a:1", g.URL().Host)
+}
+
+func TestCandidates(t *testing.T) {
+	urls := []string{"socks5://a:1", "socks5://b:2", "socks5://c:3"}
+
+	failover, err := NewGroup(Options{Name: "f", URLs: urls})
+	require.NoError(t, err)
+	failover.upstreams[0].alive.Store(false)
+	require.Equal(t, []string{"b:2", "c:3", "a:1"}, hosts(failover.candidates()))
+
+	rr, err := NewGroup(Options{Name: "rr", URLs: urls, Strategy: StrategyRoundRobin})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a:1", "b:2", "c:3"}, hosts(rr.candidates()))
+	require.Equal(t, []string{"b:2", "c:3", "a:1"}, hosts(rr.candidates()))
+	require.Equal(t, []string{"c:3", "a:1", "b:2"}, hosts(rr.candidates()))
+
+	fastest, err := NewGroup(Options{Name: "l", URLs: urls, Strategy: StrategyLowestLatency})
+	require.NoError(t, err)
+	fastest.upstreams[0].latency.Store(int64(50 * time.Millisecond))
+	fastest.upstreams[2].latency.Store(int64(10 * time.Millisecond))
+	// b has not been measured yet and sorts last among the healthy ones.
+	require.Equal(t, []string{"c:3", "a:1", "b:2"}, hosts(fastest.candidates()))
+}
+
+func TestHealthCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close() //nolint:errcheck
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, dead.Close())
+
+	g, err := NewGroup(Options{Name: "g", URLs: []string{"socks5://" + dead.Addr().String(), "socks5://" + ln.Addr().String()}})
+	require.NoError(t, err)
+	g.check(time.Second)
+	require.False(t, g.upstreams[0].alive.Load())
+	require.True(t, g.upstreams[1].alive.Load())
+	require.NotZero(t, g.upstreams[1].latency.Load())
+	require.Equal(t, ln.Addr().String(), g.candidates()[0].url.Host)
+}
+
+func TestDialUpstreamFailover(t *testing.T) {
+	target := echoServer(t)
+	proxy := httptest.NewServer(connectProxy(t, ""))
+	defer proxy.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, dead.Close())
+
+	g, err := NewGroup(Options{Name: "g", URLs: []string{"http://" + dead.Addr().String(), proxy.URL}})
+	require.NoError(t, err)
+	conn, via, err := g.DialUpstream(context.Background(), "tcp", target)
+	require.NoError(t, err)
+	require.Equal(t, proxy.Listener.Addr().String(), via)
+	roundTrip(t, conn)
+}
+
+func TestRouterSelect(t *testing.T) {
+	streaming, err := NewGroup(Options{Name: "streaming", URLs: []string{"socks5://a:1"}, EnableUDP: true})
+	require.NoError(t, err)
+	streaming.AddDomain("netflix.com")
+	rest, err := New("http://b:2", false, true)
+	require.NoError(t, err)
+
+	r := NewRouter(nil, streaming, rest)
+	require.Len(t, r.Groups(), 2)
+	require.Equal(t, streaming, r.Select("www.netflix.com:443"))
+	require.Equal(t, rest, r.Select("example.com:443"))
+	require.Equal(t, streaming, r.CustomDomainGroup("netflix.com"))
+	require.Nil(t, r.CustomDomainGroup("example.com"))
+
+	require.Equal(t, streaming, r.SelectUDP("www.netflix.com:443"))
+	// The catch-all group cannot carry UDP, so those datagrams go direct.
+	require.Nil(t, r.SelectUDP("example.com:443"))
+
+	require.Nil(t, NewRouter(nil))
+	var nilRouter *Router
+	require.Nil(t, nilRouter.Select("example.com"))
+	nilRouter.Close()
+}
+
+func TestRouterHealthChecksStop(t *testing.T) {
+	g, err := New("socks5://127.0.0.1:1", false, true)
+	require.NoError(t, err)
+	r := NewRouter(g)
+	r.StartHealthChecks(10*time.Millisecond, 100*time.Millisecond)
+	require.Eventually(t, func() bool { return !g.upstreams[0].alive.Load() }, time.Second, 10*time.Millisecond)
+	r.Close()
+}
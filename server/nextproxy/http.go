@@ -0,0 +1,142 @@
+package nextproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nange/easyss/v3/log"
+)
+
+// ErrUDPNotSupported is returned when UDP is dialed through an HTTP(S)
+// proxy, which can only tunnel TCP with CONNECT.
+var ErrUDPNotSupported = errors.New("next proxy: http(s) upstream cannot carry udp")
+
+// dialHTTPContext opens a CONNECT tunnel to addr through an http:// or
+// https:// proxy.
+func (np *NextProxy) dialHTTPContext(ctx context.Context, u *url.URL, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, ErrUDPNotSupported
+	}
+	log.Debug("[NEXTPROXY] connecting via HTTP proxy", "addr", u.Host, "scheme", u.Scheme, "target", addr)
+
+	dialTimeout := np.dialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr(u))
+	if err != nil {
+		return nil, err
+	}
+	// Bound the TLS and CONNECT handshakes by ctx; the deadline is cleared
+	// once the tunnel is up.
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	if u.Scheme == "https" {
+		cfg := np.tlsConfig
+		if cfg == nil {
+			cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		cfg = cfg.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("http proxy tls handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	tunnel, err := connect(conn, u, addr)
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("http proxy connect cancelled: %w", ctx.Err())
+		}
+		return nil, err
+	}
+	if !stop() {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy connect cancelled: %w", ctx.Err())
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// connect sends a CONNECT request for addr over conn and returns a conn
+// positioned at the start of the tunnelled stream.
+func connect(conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("http proxy write connect: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("http proxy read response: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("http proxy connect %s: %s", addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns bytes the proxy sent right after its response before
+// reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// proxyAddr returns host:port of the proxy, defaulting the port by scheme as
+// net/http does for proxy URLs.
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,148 @@
+package nextproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// connectProxy is a minimal CONNECT proxy stand-in. When auth is set it
+// requires matching basic credentials.
+func connectProxy(t *testing.T, auth string) http.Handler {
+	t.Helper()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "connect only", http.StatusMethodNotAllowed)
+			return
+		}
+		if auth != "" && r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer target.Close() //nolint:errcheck
+
+		client, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer client.Close() //nolint:errcheck
+		_, _ = io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() { _, _ = io.Copy(target, client) }()
+		_, _ = io.Copy(client, target)
+	})
+}
+
+// echoServer returns the address of a TCP server echoing every connection.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close() //nolint:errcheck
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func roundTrip(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close() //nolint:errcheck
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+}
+
+func TestHTTPConnect(t *testing.T) {
+	target := echoServer(t)
+	proxy := httptest.NewServer(connectProxy(t, ""))
+	defer proxy.Close()
+
+	np, err := New(proxy.URL, false, true)
+	require.NoError(t, err)
+	conn, err := np.DialContext(context.Background(), "tcp", target)
+	require.NoError(t, err)
+	roundTrip(t, conn)
+}
+
+func TestHTTPSConnectWithAuth(t *testing.T) {
+	target := echoServer(t)
+	proxy := httptest.NewTLSServer(connectProxy(t, "alice:s3cret"))
+	defer proxy.Close()
+	proxyURL := strings.Replace(proxy.URL, "https://", "https://alice:s3cret@", 1)
+
+	np, err := New(proxyURL, false, true)
+	require.NoError(t, err)
+	np.tlsConfig = proxy.Client().Transport.(*http.Transport).TLSClientConfig
+	conn, err := np.DialContext(context.Background(), "tcp", target)
+	require.NoError(t, err)
+	roundTrip(t, conn)
+
+	bad, err := New(strings.Replace(proxyURL, "s3cret", "wrong", 1), false, true)
+	require.NoError(t, err)
+	bad.tlsConfig = np.tlsConfig
+	_, err = bad.DialContext(context.Background(), "tcp", target)
+	require.ErrorContains(t, err, "407")
+}
+
+func TestHTTPConnectRejectsUDP(t *testing.T) {
+	_, err := New("http://127.0.0.1:3128", true, true)
+	require.ErrorContains(t, err, "cannot carry udp")
+
+	np, err := New("https://127.0.0.1:3128", false, true)
+	require.NoError(t, err)
+	require.False(t, np.EnableUDP())
+	_, err = np.DialContext(context.Background(), "udp", "8.8.8.8:53")
+	require.True(t, errors.Is(err, ErrUDPNotSupported))
+}
+
+func TestHTTPConnectCancelled(t *testing.T) {
+	// A proxy that accepts but never answers the CONNECT request.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close() //nolint:errcheck
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close() //nolint:errcheck
+		}
+	}()
+
+	np, err := New("http://"+ln.Addr().String(), false, true)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = np.DialContext(ctx, "tcp", "example.com:443")
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
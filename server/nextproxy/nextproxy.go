@@ -2,12 +2,15 @@ package nextproxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nange/easyss/v3/log"
@@ -15,11 +18,29 @@ import (
 	"github.com/txthinking/socks5"
 )
 
+const (
+	// StrategyFailover uses the first healthy upstream in configured order.
+	StrategyFailover = "failover"
+	// StrategyRoundRobin rotates through the healthy upstreams.
+	StrategyRoundRobin = "round_robin"
+	// StrategyLowestLatency uses the healthy upstream with the lowest
+	// health-check latency.
+	StrategyLowestLatency = "lowest_latency"
+)
+
+// NextProxy is a named group of upstream proxies sharing one rule set. Dials
+// pick an upstream by the group's strategy, skipping upstreams the health
+// checker found dead and falling back to the next one when a dial fails.
 type NextProxy struct {
-	url         *url.URL
+	name        string
+	upstreams   []*upstream
+	strategy    string
+	next        atomic.Uint64
 	enableUDP   bool
 	allHost     bool
 	dialTimeout time.Duration
+	// tlsConfig overrides the client TLS config of https proxies (tests).
+	tlsConfig *tls.Config
 
 	mu             sync.RWMutex
 	ips            map[string]struct{}
@@ -28,29 +49,74 @@ type NextProxy struct {
 	domainPatterns []*regexp.Regexp
 }
 
+// Options configures a NextProxy group.
+type Options struct {
+	Name      string
+	URLs      []string
+	Strategy  string
+	EnableUDP bool
+	AllHost   bool
+}
+
+// New returns a single-upstream group, or nil when proxyURL is empty.
 func New(proxyURL string, enableUDP, allHost bool) (*NextProxy, error) {
 	if proxyURL == "" {
 		return nil, nil
 	}
+	return NewGroup(Options{Name: "default", URLs: []string{proxyURL}, EnableUDP: enableUDP, AllHost: allHost})
+}
 
-	u, err := url.Parse(proxyURL)
-	if err != nil {
-		return nil, err
+// NewGroup returns a group of one or more upstreams.
+func NewGroup(opts Options) (*NextProxy, error) {
+	if len(opts.URLs) == 0 {
+		return nil, fmt.Errorf("next proxy group %q has no upstream url", opts.Name)
 	}
-	if u.Scheme != "socks5" {
-		return nil, fmt.Errorf("unsupported next proxy scheme %q", u.Scheme)
+	strategy := opts.Strategy
+	switch strategy {
+	case "":
+		strategy = StrategyFailover
+	case StrategyFailover, StrategyRoundRobin, StrategyLowestLatency:
+	default:
+		return nil, fmt.Errorf("next proxy group %q: invalid strategy %q: valid values are failover, round_robin, lowest_latency", opts.Name, strategy)
 	}
 
 	np := &NextProxy{
-		url:       u,
-		enableUDP: enableUDP,
-		allHost:   allHost,
+		name:      opts.Name,
+		strategy:  strategy,
+		enableUDP: opts.EnableUDP,
+		allHost:   opts.AllHost,
 		ips:       make(map[string]struct{}),
 		domains:   make(map[string]struct{}),
 	}
+	for _, raw := range opts.URLs {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "socks5":
+		case "http", "https":
+			if opts.EnableUDP {
+				return nil, fmt.Errorf("next proxy scheme %q cannot carry udp: disable enable_udp or use socks5", u.Scheme)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported next proxy scheme %q", u.Scheme)
+		}
+		up := &upstream{url: u}
+		up.alive.Store(true)
+		np.upstreams = append(np.upstreams, up)
+	}
 	return np, nil
 }
 
+// Name returns the group name.
+func (np *NextProxy) Name() string {
+	if np == nil {
+		return ""
+	}
+	return np.name
+}
+
 func (np *NextProxy) LoadProxyFile(proxyFile string) error {
 	if np == nil {
 		return nil
@@ -186,7 +252,8 @@ func (np *NextProxy) AddDomain(domain string) {
 	np.mu.Unlock()
 }
 
-// SetDialTimeout sets the timeout for dialing the SOCKS5 proxy.
+// SetDialTimeout sets the timeout for dialing the proxy and completing its
+// handshake.
 func (np *NextProxy) SetDialTimeout(d time.Duration) {
 	if np == nil {
 		return
@@ -198,19 +265,47 @@ func (np *NextProxy) Dial(network, addr string) (net.Conn, error) {
 	return np.DialContext(context.Background(), network, addr)
 }
 
+// DialContext connects to addr through one of the group's upstreams.
 func (np *NextProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	return np.dialSOCKS5Context(ctx, network, addr)
+	conn, _, err := np.DialUpstream(ctx, network, addr)
+	return conn, err
+}
+
+// DialUpstream is DialContext that also returns the host:port of the
+// upstream carrying the connection. Upstreams are tried in strategy order;
+// a failed dial moves on to the next one. HTTP(S) upstreams only tunnel TCP
+// and return ErrUDPNotSupported for udp networks.
+func (np *NextProxy) DialUpstream(ctx context.Context, network, addr string) (net.Conn, string, error) {
+	var lastErr error
+	for _, u := range np.candidates() {
+		var conn net.Conn
+		var err error
+		if u.url.Scheme == "http" || u.url.Scheme == "https" {
+			conn, err = np.dialHTTPContext(ctx, u.url, network, addr)
+		} else {
+			conn, err = np.dialSOCKS5Context(ctx, u.url, network, addr)
+		}
+		if err == nil {
+			return conn, u.url.Host, nil
+		}
+		if errors.Is(err, ErrUDPNotSupported) || ctx.Err() != nil {
+			return nil, "", err
+		}
+		log.Warn("[NEXTPROXY] upstream dial failed", "group", np.name, "upstream", u.url.Redacted(), "target", addr, "err", err)
+		lastErr = err
+	}
+	return nil, "", lastErr
 }
 
-func (np *NextProxy) dialSOCKS5Context(ctx context.Context, network, addr string) (net.Conn, error) {
+func (np *NextProxy) dialSOCKS5Context(ctx context.Context, u *url.URL, network, addr string) (net.Conn, error) {
 	username := ""
 	password := ""
-	if np.url.User != nil {
-		username = np.url.User.Username()
-		password, _ = np.url.User.Password()
-		log.Info("[NEXTPROXY] connecting via SOCKS5 proxy", "addr", np.url.Host, "network", network, "target", addr)
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+		log.Info("[NEXTPROXY] connecting via SOCKS5 proxy", "addr", u.Host, "network", network, "target", addr)
 	} else {
-		log.Debug("[NEXTPROXY] connecting via SOCKS5 proxy", "addr", np.url.Host, "network", network, "target", addr)
+		log.Debug("[NEXTPROXY] connecting via SOCKS5 proxy", "addr", u.Host, "network", network, "target", addr)
 	}
 
 	dialTimeout := np.dialTimeout
@@ -230,7 +325,7 @@ func (np *NextProxy) dialSOCKS5Context(ctx context.Context, network, addr string
 	ch := make(chan result, 1)
 
 	go func() {
-		c, err := socks5.NewClient(np.url.Host, username, password, socksTimeout, socksTimeout)
+		c, err := socks5.NewClient(u.Host, username, password, socksTimeout, socksTimeout)
 		if err != nil {
 			ch <- result{nil, err}
 			return
@@ -272,11 +367,12 @@ func (np *NextProxy) dialSOCKS5Context(ctx context.Context, network, addr string
 	}
 }
 
+// URL returns the first upstream of the group.
 func (np *NextProxy) URL() *url.URL {
 	if np == nil {
 		return nil
 	}
-	return np.url
+	return np.upstreams[0].url
 }
 
 func (np *NextProxy) EnableUDP() bool {
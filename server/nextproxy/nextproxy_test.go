@@ -46,7 +46,7 @@ func TestNew(t *testing.T) {
 	})
 
 	t.Run("不支持的 scheme 返回错误", func(t *testing.T) {
-		_, err := New("http://proxy.example.com:8080", false, false)
+		_, err := New("ftp://proxy.example.com:8080", false, false)
 		if err == nil || !strings.Contains(err.Error(), "unsupported next proxy scheme") {
 			t.Fatalf("expected unsupported scheme error, got %v", err)
 		}
@@ -57,11 +57,11 @@ func TestNew(t *testing.T) {
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if np.url.Scheme != "socks5" {
-			t.Errorf("scheme = %q", np.url.Scheme)
+		if np.URL().Scheme != "socks5" {
+			t.Errorf("scheme = %q", np.URL().Scheme)
 		}
-		if np.url.Host != "proxy.example.com:1080" {
-			t.Errorf("host = %q", np.url.Host)
+		if np.URL().Host != "proxy.example.com:1080" {
+			t.Errorf("host = %q", np.URL().Host)
 		}
 	})
 }
@@ -0,0 +1,191 @@
+package probe
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reason classifies why a request to a proxy endpoint was rejected. Each
+// value maps to one rejection branch of handler.ProxyHandler.ServeHTTP.
+type Reason string
+
+const (
+	ReasonNotHTTP2         Reason = "not_http2"
+	ReasonNoSalt           Reason = "no_salt"
+	ReasonBadSalt          Reason = "bad_salt"
+	ReasonRateLimited      Reason = "rate_limited"
+	ReasonReplay           Reason = "replay"
+	ReasonHandshakeTimeout Reason = "handshake_timeout"
+	ReasonDecryptFailed    Reason = "decrypt_failed"
+	ReasonEndpointMismatch Reason = "endpoint_mismatch"
+	ReasonMethodNotAllowed Reason = "method_not_allowed"
+)
+
+// Event is one line of the probe log.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Source    string    `json:"source"`
+	Reason    Reason    `json:"reason"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Host      string    `json:"host,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Headers   []string  `json:"headers,omitempty"`
+	SNI       string    `json:"sni,omitempty"`
+	ALPN      string    `json:"alpn,omitempty"`
+	// Count is the number of events the line stands for, set when events
+	// over the per-source cap were folded into it. The other fields are
+	// those of the last folded event.
+	Count int `json:"count,omitempty"`
+}
+
+// NewEvent builds an Event from a rejected request. Only header names are
+// kept (plus the user agent), so header values such as the x-es salt or
+// cookies never end up in the log.
+func NewEvent(r *http.Request, reason Reason) Event {
+	source, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		source = r.RemoteAddr
+	}
+	ev := Event{
+		Time:      time.Now(),
+		Source:    source,
+		Reason:    reason,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Proto:     r.Proto,
+		Host:      r.Host,
+		UserAgent: r.UserAgent(),
+	}
+	if len(r.Header) > 0 {
+		ev.Headers = make([]string, 0, len(r.Header))
+		for k := range r.Header {
+			ev.Headers = append(ev.Headers, strings.ToLower(k))
+		}
+		slices.Sort(ev.Headers)
+	}
+	if r.TLS != nil {
+		ev.SNI = r.TLS.ServerName
+		ev.ALPN = r.TLS.NegotiatedProtocol
+	}
+	return ev
+}
+
+const (
+	// sourceBurst is how many events of one source are written per
+	// sourceWindow; later ones are only counted, and written as one line
+	// per reason when the window ends.
+	sourceBurst  = 10
+	sourceWindow = time.Minute
+	// maxSources bounds the sources tracked at once; the events of
+	// further sources are folded under OtherSource.
+	maxSources = 4096
+)
+
+// OtherSource is the source of the lines folding the events of sources
+// beyond maxSources.
+const OtherSource = "other"
+
+// Logger writes probe events as JSON lines. A nil *Logger discards events,
+// so callers need not check whether probe logging is enabled.
+//
+// To keep a probe storm from filling the disk, each source gets
+// sourceBurst lines per sourceWindow; its further events are folded into
+// one line per reason, with Count set, written when the window ends or on
+// Flush.
+type Logger struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	sources map[string]*sourceWindowState
+	swept   time.Time
+}
+
+type sourceWindowState struct {
+	start  time.Time
+	logged int
+	folded map[Reason]*Event
+}
+
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{enc: json.NewEncoder(w), sources: make(map[string]*sourceWindowState)}
+}
+
+func (l *Logger) Log(ev Event) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ev.Time.Sub(l.swept) >= sourceWindow {
+		l.swept = ev.Time
+		for src, st := range l.sources {
+			if ev.Time.Sub(st.start) >= sourceWindow {
+				l.flush(st)
+				delete(l.sources, src)
+			}
+		}
+	}
+
+	src := ev.Source
+	st := l.sources[src]
+	if st != nil && ev.Time.Sub(st.start) >= sourceWindow {
+		l.flush(st)
+		delete(l.sources, src)
+		st = nil
+	}
+	if st == nil && len(l.sources) >= maxSources {
+		src = OtherSource
+		st = l.sources[src]
+	}
+	if st == nil {
+		st = &sourceWindowState{start: ev.Time}
+		l.sources[src] = st
+	}
+	if src != OtherSource && st.logged < sourceBurst {
+		st.logged++
+		_ = l.enc.Encode(ev)
+		return
+	}
+	count := 1
+	if prev := st.folded[ev.Reason]; prev != nil {
+		count += prev.Count
+	}
+	if st.folded == nil {
+		st.folded = make(map[Reason]*Event)
+	}
+	ev.Source, ev.Count = src, count
+	st.folded[ev.Reason] = &ev
+}
+
+// Flush writes the events folded so far.
+func (l *Logger) Flush() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, st := range l.sources {
+		l.flush(st)
+	}
+}
+
+// flush writes the events folded in st, by reason.
+func (l *Logger) flush(st *sourceWindowState) {
+	reasons := make([]Reason, 0, len(st.folded))
+	for r := range st.folded {
+		reasons = append(reasons, r)
+	}
+	slices.Sort(reasons)
+	for _, r := range reasons {
+		_ = l.enc.Encode(st.folded[r])
+	}
+	clear(st.folded)
+}
@@ -0,0 +1,132 @@
+package probe
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEvent(t *testing.T) {
+	r := httptest.NewRequest("POST", "https://example.com/v3/tcp", nil)
+	r.RemoteAddr = "203.0.113.7:51234"
+	r.Header.Set("User-Agent", "curl/8.0")
+	r.Header.Set("X-Es", "secret-salt")
+	r.Header.Set("Accept", "*/*")
+	r.TLS = &tls.ConnectionState{ServerName: "example.com", NegotiatedProtocol: "h2"}
+
+	ev := NewEvent(r, ReasonBadSalt)
+	require.Equal(t, "203.0.113.7", ev.Source)
+	require.Equal(t, ReasonBadSalt, ev.Reason)
+	require.Equal(t, "/v3/tcp", ev.Path)
+	require.Equal(t, "curl/8.0", ev.UserAgent)
+	require.Equal(t, []string{"accept", "user-agent", "x-es"}, ev.Headers)
+	require.Equal(t, "example.com", ev.SNI)
+	require.Equal(t, "h2", ev.ALPN)
+
+	// Header values must never be logged.
+	var buf bytes.Buffer
+	NewLogger(&buf).Log(ev)
+	require.NotContains(t, buf.String(), "secret-salt")
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	l.Log(Event{Reason: ReasonNoSalt})
+}
+
+func TestLoggerCapsSource(t *testing.T) {
+	now := time.Now()
+	var buf bytes.Buffer
+	l := NewLogger(&buf)
+	for i := range sourceBurst + 20 {
+		reason := ReasonNotHTTP2
+		if i%2 == 1 {
+			reason = ReasonRateLimited
+		}
+		l.Log(Event{Time: now.Add(time.Duration(i) * time.Millisecond), Source: "198.51.100.1", Reason: reason})
+	}
+	require.Equal(t, sourceBurst, strings.Count(buf.String(), "\n"))
+
+	// The folded events are written, one line per reason, once the window
+	// of the source ends.
+	l.Log(Event{Time: now.Add(sourceWindow), Source: "198.51.100.1", Reason: ReasonNoSalt})
+	require.Equal(t, sourceBurst+3, strings.Count(buf.String(), "\n"))
+	require.Contains(t, buf.String(), `"reason":"not_http2","method":"","path":"","proto":"","count":10}`)
+
+	// Sources beyond maxSources are folded together.
+	for i := range maxSources {
+		l.Log(Event{Time: now.Add(sourceWindow), Source: fmt.Sprintf("10.0.%d.%d", i/256, i%256), Reason: ReasonNotHTTP2})
+	}
+	lines := strings.Count(buf.String(), "\n")
+	l.Flush()
+	require.Equal(t, lines+1, strings.Count(buf.String(), "\n"))
+	require.Contains(t, buf.String(), `"source":"other"`)
+
+	agg := NewAggregator(time.Time{})
+	require.NoError(t, agg.ReadEvents(&buf))
+	require.Equal(t, sourceBurst+20+1+maxSources, agg.Summary(0).Total)
+}
+
+func TestAggregator(t *testing.T) {
+	now := time.Now()
+	var buf bytes.Buffer
+	l := NewLogger(&buf)
+	l.Log(Event{Time: now.Add(-48 * time.Hour), Source: "198.51.100.1", Reason: ReasonNoSalt})
+	l.Log(Event{Time: now.Add(-time.Hour), Source: "198.51.100.1", Reason: ReasonNoSalt})
+	l.Log(Event{Time: now.Add(-time.Minute), Source: "198.51.100.1", Reason: ReasonDecryptFailed})
+	l.Log(Event{Time: now, Source: "198.51.100.2", Reason: ReasonNoSalt})
+	buf.WriteString("{truncated\n")
+
+	agg := NewAggregator(now.Add(-24 * time.Hour))
+	require.NoError(t, agg.ReadEvents(&buf))
+	sum := agg.Summary(1)
+
+	require.Equal(t, 3, sum.Total)
+	require.Equal(t, 1, sum.Skipped)
+	require.Equal(t, []Count{{Key: "no_salt", Count: 2}, {Key: "decrypt_failed", Count: 1}}, sum.Reasons)
+	require.Len(t, sum.Sources, 1)
+	require.Equal(t, "198.51.100.1", sum.Sources[0].Source)
+	require.Equal(t, 2, sum.Sources[0].Count)
+	require.True(t, sum.Sources[0].FirstSeen.Equal(now.Add(-time.Hour)))
+	require.True(t, sum.Sources[0].LastSeen.Equal(now.Add(-time.Minute)))
+}
+
+func TestSummarizeFilesIncludesBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "probes.log")
+	backup := filepath.Join(dir, "probes-2026-01-02T03-04-05.000.log")
+
+	write := func(name string, evs ...Event) {
+		var sb strings.Builder
+		for _, ev := range evs {
+			b, err := json.Marshal(ev)
+			require.NoError(t, err)
+			sb.Write(b)
+			sb.WriteByte('\n')
+		}
+		require.NoError(t, os.WriteFile(name, []byte(sb.String()), 0600))
+	}
+	write(backup, Event{Time: time.Now(), Source: "a", Reason: ReasonReplay})
+	write(path, Event{Time: time.Now(), Source: "b", Reason: ReasonReplay})
+
+	files, err := LogFiles(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{backup, path}, files)
+
+	sum, err := SummarizeFiles(path, time.Time{}, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, sum.Total)
+	require.Len(t, sum.Sources, 2)
+
+	_, err = SummarizeFiles(filepath.Join(dir, "missing.log"), time.Time{}, 0)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,196 @@
+package probe
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Count is a key with the number of events attributed to it.
+type Count struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// SourceCount aggregates the events of a single source IP.
+type SourceCount struct {
+	Source    string    `json:"source"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Reasons   []Count   `json:"reasons"`
+}
+
+// Summary is the aggregation of probe events in a time window.
+type Summary struct {
+	Since   time.Time     `json:"since"`
+	Total   int           `json:"total"`
+	Reasons []Count       `json:"reasons"`
+	Sources []SourceCount `json:"sources"`
+	Skipped int           `json:"skipped"`
+}
+
+// Aggregator accumulates probe events into a Summary.
+type Aggregator struct {
+	since   time.Time
+	total   int
+	skipped int
+	reasons map[string]int
+	sources map[string]*sourceAgg
+}
+
+type sourceAgg struct {
+	count     int
+	firstSeen time.Time
+	lastSeen  time.Time
+	reasons   map[string]int
+}
+
+// NewAggregator returns an Aggregator that ignores events older than since.
+// A zero since keeps every event.
+func NewAggregator(since time.Time) *Aggregator {
+	return &Aggregator{
+		since:   since,
+		reasons: make(map[string]int),
+		sources: make(map[string]*sourceAgg),
+	}
+}
+
+func (a *Aggregator) Add(ev Event) {
+	if !a.since.IsZero() && ev.Time.Before(a.since) {
+		return
+	}
+	n := max(ev.Count, 1)
+	a.total += n
+	a.reasons[string(ev.Reason)] += n
+
+	s, ok := a.sources[ev.Source]
+	if !ok {
+		s = &sourceAgg{firstSeen: ev.Time, lastSeen: ev.Time, reasons: make(map[string]int)}
+		a.sources[ev.Source] = s
+	}
+	s.count += n
+	s.reasons[string(ev.Reason)] += n
+	if ev.Time.Before(s.firstSeen) {
+		s.firstSeen = ev.Time
+	}
+	if ev.Time.After(s.lastSeen) {
+		s.lastSeen = ev.Time
+	}
+}
+
+// ReadEvents adds every JSON line of r. Lines that fail to decode (e.g. a line
+// truncated by a crash) are counted as skipped instead of aborting.
+func (a *Aggregator) ReadEvents(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var ev Event
+		if err := json.Unmarshal(line, &ev); err != nil {
+			a.skipped++
+			continue
+		}
+		a.Add(ev)
+	}
+	return sc.Err()
+}
+
+// Summary returns the top reasons and the top sources. top <= 0 returns
+// every source.
+func (a *Aggregator) Summary(top int) Summary {
+	sum := Summary{
+		Since:   a.since,
+		Total:   a.total,
+		Reasons: sortCounts(a.reasons),
+		Skipped: a.skipped,
+	}
+	for src, s := range a.sources {
+		sum.Sources = append(sum.Sources, SourceCount{
+			Source:    src,
+			Count:     s.count,
+			FirstSeen: s.firstSeen,
+			LastSeen:  s.lastSeen,
+			Reasons:   sortCounts(s.reasons),
+		})
+	}
+	slices.SortFunc(sum.Sources, func(x, y SourceCount) int {
+		if x.Count != y.Count {
+			return y.Count - x.Count
+		}
+		return strings.Compare(x.Source, y.Source)
+	})
+	if top > 0 && len(sum.Sources) > top {
+		sum.Sources = sum.Sources[:top]
+	}
+	return sum
+}
+
+func sortCounts(m map[string]int) []Count {
+	counts := make([]Count, 0, len(m))
+	for k, v := range m {
+		counts = append(counts, Count{Key: k, Count: v})
+	}
+	slices.SortFunc(counts, func(x, y Count) int {
+		if x.Count != y.Count {
+			return y.Count - x.Count
+		}
+		return strings.Compare(x.Key, y.Key)
+	})
+	return counts
+}
+
+// LogFiles returns path together with the backups lumberjack rotated out of
+// it (name-<timestamp>.ext in the same directory), oldest first.
+func LogFiles(path string) ([]string, error) {
+	ext := filepath.Ext(path)
+	prefix := strings.TrimSuffix(path, ext)
+	backups, err := filepath.Glob(prefix + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	// Backup names embed a sortable timestamp.
+	slices.Sort(backups)
+
+	files := backups
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// SummarizeFiles aggregates the probe log at path and its rotated backups.
+func SummarizeFiles(path string, since time.Time, top int) (Summary, error) {
+	files, err := LogFiles(path)
+	if err != nil {
+		return Summary{}, err
+	}
+	if len(files) == 0 {
+		return Summary{}, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+
+	agg := NewAggregator(since)
+	for _, name := range files {
+		if err := readFile(agg, name); err != nil {
+			return Summary{}, err
+		}
+	}
+	return agg.Summary(top), nil
+}
+
+func readFile(agg *Aggregator, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck
+	return agg.ReadEvents(f)
+}
@@ -0,0 +1,124 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	queryTimeout = 5 * time.Second
+	// attemptDelay is the head start of each happy-eyeballs connection
+	// attempt before the next address is tried in parallel (RFC 8305).
+	attemptDelay = 250 * time.Millisecond
+)
+
+// ContextDialer dials a network address; *net.Dialer satisfies it.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Dial connects to addr with d, resolving a hostname through r and trying
+// the answers in strategy order: raced for happy eyeballs, one after another
+// for the prefer policies and for UDP, whose dial only fails when the host
+// cannot reach the address family, as on an IPv4-only host. A literal IP,
+// or a nil r, is dialed directly by d.
+func (r *Resolver) Dial(ctx context.Context, d ContextDialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if r == nil || err != nil || net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	ips, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, ip := range ips {
+		if matchNetwork(network, ip.IP) {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host}
+	}
+
+	var delay time.Duration
+	if r.strategy == StrategyHappyEyeballs && !strings.HasPrefix(network, "udp") {
+		delay = attemptDelay
+	}
+	return race(ctx, d, network, addrs, delay)
+}
+
+func matchNetwork(network string, ip net.IP) bool {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return ip.To4() != nil
+	case strings.HasSuffix(network, "6"):
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// race dials addrs in order, starting the next attempt when the previous one
+// fails or, if delay > 0, after delay has elapsed. The first connection wins;
+// late winners are closed.
+func race(ctx context.Context, d ContextDialer, network string, addrs []string, delay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		a := addrs[next]
+		next++
+		pending++
+		go func() {
+			c, err := d.DialContext(ctx, network, a)
+			results <- result{c, err}
+		}()
+	}
+
+	var timer <-chan time.Time
+	startNext := func() {
+		if next >= len(addrs) {
+			timer = nil
+			return
+		}
+		start()
+		if delay > 0 {
+			timer = time.After(delay)
+		}
+	}
+	startNext()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							_ = late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			startNext()
+		case <-timer:
+			startNext()
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,249 @@
+// Package resolver resolves target hostnames for the server's outbound dials
+// using configurable upstreams, a TTL-respecting cache and static hosts, and
+// dials the answers according to an IPv4/IPv6 preference policy.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coocood/freecache"
+	"github.com/miekg/dns"
+	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/server/config"
+)
+
+const (
+	// StrategyHappyEyeballs races IPv6 and IPv4 addresses (RFC 8305).
+	StrategyHappyEyeballs = "happy_eyeballs"
+	// StrategyPreferIPv4 tries every IPv4 address before any IPv6 one.
+	StrategyPreferIPv4 = "prefer_ipv4"
+	// StrategyPreferIPv6 tries every IPv6 address before any IPv4 one.
+	StrategyPreferIPv6 = "prefer_ipv6"
+)
+
+const (
+	cacheSize = 4 * 1024 * 1024
+	// maxCacheTTL caps how long an answer is kept regardless of its TTL.
+	maxCacheTTL = 60 * 60
+	// maxNegativeTTL caps the lifetime of NXDOMAIN/NODATA answers.
+	maxNegativeTTL = 5 * 60
+)
+
+// Resolver resolves hostnames and dials them. A nil *Resolver is valid and
+// behaves like the system resolver and a plain net.Dialer.
+type Resolver struct {
+	upstreams []upstream
+	hosts     map[string][]net.IPAddr
+	strategy  string
+	cache     *freecache.Cache
+}
+
+// New builds a Resolver from cfg. It returns nil when cfg is empty, so the
+// server keeps using the system resolver.
+func New(cfg config.DNSConfig) (*Resolver, error) {
+	if len(cfg.Servers) == 0 && len(cfg.Hosts) == 0 && cfg.Strategy == "" {
+		return nil, nil
+	}
+
+	r := &Resolver{strategy: cfg.Strategy}
+	switch r.strategy {
+	case "":
+		r.strategy = StrategyHappyEyeballs
+	case StrategyHappyEyeballs, StrategyPreferIPv4, StrategyPreferIPv6:
+	default:
+		return nil, fmt.Errorf("invalid dns strategy %q: valid values are happy_eyeballs, prefer_ipv4, prefer_ipv6", cfg.Strategy)
+	}
+
+	for _, s := range cfg.Servers {
+		u, err := parseUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	if len(r.upstreams) > 0 {
+		r.cache = freecache.NewCache(cacheSize)
+	}
+
+	r.hosts = make(map[string][]net.IPAddr, len(cfg.Hosts))
+	for name, addrs := range cfg.Hosts {
+		for _, a := range addrs {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid dns hosts entry %s: %q is not an IP address", name, a)
+			}
+			key := normalize(name)
+			r.hosts[key] = append(r.hosts[key], net.IPAddr{IP: ip})
+		}
+	}
+	return r, nil
+}
+
+// Strategy returns the effective address preference policy.
+func (r *Resolver) Strategy() string {
+	if r == nil {
+		return ""
+	}
+	return r.strategy
+}
+
+// LookupIPAddr returns the addresses of host ordered by the strategy. It has
+// the signature of net.Resolver.LookupIPAddr, so it can stand in for the
+// system resolver (see util.SetLANResolver).
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if r == nil {
+		return net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	name := normalize(host)
+	if addrs, ok := r.hosts[name]; ok {
+		return r.order(addrs), nil
+	}
+	if len(r.upstreams) == 0 {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		return r.order(addrs), nil
+	}
+
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	aaaa := make(chan result, 1)
+	go func() {
+		ips, err := r.query(ctx, name, dns.TypeAAAA)
+		aaaa <- result{ips, err}
+	}()
+	v4, errA := r.query(ctx, name, dns.TypeA)
+	res := <-aaaa
+
+	var addrs []net.IPAddr
+	for _, ip := range v4 {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	for _, ip := range res.ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	if len(addrs) == 0 {
+		if err := errors.Join(errA, res.err); err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: host}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return r.order(addrs), nil
+}
+
+// query resolves one record type through the cache and the upstreams, which
+// are tried in order until one gives an authoritative answer.
+func (r *Resolver) query(ctx context.Context, name string, qtype uint16) ([]net.IP, error) {
+	key := []byte(name + "/" + dns.TypeToString[qtype])
+	if v, err := r.cache.Get(key); err == nil {
+		msg := new(dns.Msg)
+		if err := msg.Unpack(v); err == nil {
+			return answerIPs(msg), nil
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+
+	var lastErr error
+	for _, u := range r.upstreams {
+		qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+		reply, err := u.exchange(qctx, m)
+		cancel()
+		if err != nil {
+			log.Debug("[RESOLVER] upstream query failed", "upstream", u.String(), "domain", name, "err", err)
+			lastErr = fmt.Errorf("%s: %w", u, err)
+			continue
+		}
+		if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s: %s", u, dns.RcodeToString[reply.Rcode])
+			continue
+		}
+		if ttl := cacheTTL(reply); ttl > 0 {
+			if v, err := reply.Pack(); err == nil {
+				_ = r.cache.Set(key, v, ttl)
+			}
+		}
+		return answerIPs(reply), nil
+	}
+	return nil, lastErr
+}
+
+// order arranges addrs by the strategy: one family first for the prefer
+// policies, alternating families starting with IPv6 for happy eyeballs.
+func (r *Resolver) order(addrs []net.IPAddr) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+
+	out := make([]net.IPAddr, 0, len(addrs))
+	switch r.strategy {
+	case StrategyPreferIPv4:
+		out = append(append(out, v4...), v6...)
+	case StrategyPreferIPv6:
+		out = append(append(out, v6...), v4...)
+	default:
+		for i := 0; i < len(v4) || i < len(v6); i++ {
+			if i < len(v6) {
+				out = append(out, v6[i])
+			}
+			if i < len(v4) {
+				out = append(out, v4[i])
+			}
+		}
+	}
+	return out
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func answerIPs(msg *dns.Msg) []net.IP {
+	var ips []net.IP
+	for _, rr := range msg.Answer {
+		switch a := rr.(type) {
+		case *dns.A:
+			ips = append(ips, a.A)
+		case *dns.AAAA:
+			ips = append(ips, a.AAAA)
+		}
+	}
+	return ips
+}
+
+// cacheTTL returns how many seconds msg may be cached: the smallest TTL of
+// its answers, or for a negative answer the SOA minimum (RFC 2308). Zero
+// means the answer must not be cached.
+func cacheTTL(msg *dns.Msg) int {
+	if len(msg.Answer) > 0 {
+		ttl := uint32(maxCacheTTL)
+		for _, rr := range msg.Answer {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+		return int(ttl)
+	}
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return int(min(soa.Minttl, soa.Hdr.Ttl, maxNegativeTTL))
+		}
+	}
+	return 0
+}
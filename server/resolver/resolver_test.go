@@ -0,0 +1,246 @@
+package resolver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coocood/freecache"
+	"github.com/miekg/dns"
+	"github.com/nange/easyss/v3/server/config"
+	"github.com/stretchr/testify/require"
+)
+
+// startDNSServer runs a UDP DNS server on localhost answering example.com
+// with fixed records and counting the queries it receives.
+func startDNSServer(t *testing.T, ttl uint32) (string, *atomic.Int32) {
+	t.Helper()
+	var queries atomic.Int32
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		w.WriteMsg(answer(req, ttl)) //nolint:errcheck
+	})}
+	go srv.ActivateAndServe() //nolint:errcheck
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return pc.LocalAddr().String(), &queries
+}
+
+func answer(req *dns.Msg, ttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	q := req.Question[0]
+	if q.Name != "example.com." {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = []dns.RR{&dns.SOA{
+			Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:  "ns.com.", Mbox: "admin.com.", Minttl: 30,
+		}}
+		return m
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+	switch q.Qtype {
+	case dns.TypeA:
+		m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.ParseIP("93.184.216.34")}}
+	case dns.TypeAAAA:
+		m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2606:2800:220:1::1")}}
+	}
+	return m
+}
+
+func TestNewEmpty(t *testing.T) {
+	r, err := New(config.DNSConfig{})
+	require.NoError(t, err)
+	require.Nil(t, r)
+
+	_, err = New(config.DNSConfig{Strategy: "fastest"})
+	require.Error(t, err)
+	_, err = New(config.DNSConfig{Servers: []string{"quic://1.1.1.1"}})
+	require.Error(t, err)
+	_, err = New(config.DNSConfig{Hosts: map[string][]string{"a.test": {"not-an-ip"}}})
+	require.Error(t, err)
+}
+
+func TestParseUpstream(t *testing.T) {
+	for spec, want := range map[string]string{
+		"1.1.1.1":             "1.1.1.1:53",
+		"udp://1.1.1.1:5353":  "1.1.1.1:5353",
+		"tcp://[2001:db8::1]": "[2001:db8::1]:53",
+		"tls://dns.google":    "dns.google:853",
+		"tls://1.1.1.1:8853":  "1.1.1.1:8853",
+	} {
+		u, err := parseUpstream(spec)
+		require.NoError(t, err, spec)
+		require.Equal(t, want, u.(*dnsUpstream).addr, spec)
+	}
+	u, err := parseUpstream("https://dns.google/dns-query")
+	require.NoError(t, err)
+	require.IsType(t, &dohUpstream{}, u)
+}
+
+func TestLookupHostsAndOrder(t *testing.T) {
+	hosts := map[string][]string{"Static.Test": {"192.0.2.1", "2001:db8::1", "192.0.2.2"}}
+	for strategy, want := range map[string][]string{
+		StrategyPreferIPv4:    {"192.0.2.1", "192.0.2.2", "2001:db8::1"},
+		StrategyPreferIPv6:    {"2001:db8::1", "192.0.2.1", "192.0.2.2"},
+		StrategyHappyEyeballs: {"2001:db8::1", "192.0.2.1", "192.0.2.2"},
+	} {
+		r, err := New(config.DNSConfig{Hosts: hosts, Strategy: strategy})
+		require.NoError(t, err)
+		addrs, err := r.LookupIPAddr(context.Background(), "static.test.")
+		require.NoError(t, err)
+		var got []string
+		for _, a := range addrs {
+			got = append(got, a.IP.String())
+		}
+		require.Equal(t, want, got, strategy)
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	addr, queries := startDNSServer(t, 300)
+	r, err := New(config.DNSConfig{Servers: []string{"udp://" + addr}, Strategy: StrategyPreferIPv4})
+	require.NoError(t, err)
+
+	for range 3 {
+		addrs, err := r.LookupIPAddr(context.Background(), "example.com")
+		require.NoError(t, err)
+		require.Len(t, addrs, 2)
+		require.Equal(t, "93.184.216.34", addrs[0].IP.String())
+	}
+	// One A and one AAAA query; the rest is served from the cache.
+	require.Equal(t, int32(2), queries.Load())
+
+	// Negative answers are cached for the SOA minimum.
+	_, err = r.LookupIPAddr(context.Background(), "missing.example")
+	var dnsErr *net.DNSError
+	require.ErrorAs(t, err, &dnsErr)
+	require.True(t, dnsErr.IsNotFound)
+	_, _ = r.LookupIPAddr(context.Background(), "missing.example")
+	require.Equal(t, int32(4), queries.Load())
+}
+
+func TestLookupZeroTTLNotCached(t *testing.T) {
+	addr, queries := startDNSServer(t, 0)
+	r, err := New(config.DNSConfig{Servers: []string{addr}})
+	require.NoError(t, err)
+
+	for range 2 {
+		_, err := r.LookupIPAddr(context.Background(), "example.com")
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(4), queries.Load())
+}
+
+func TestLookupFailover(t *testing.T) {
+	// Nothing listens on the first upstream.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := pc.LocalAddr().String()
+	require.NoError(t, pc.Close())
+
+	addr, _ := startDNSServer(t, 300)
+	r, err := New(config.DNSConfig{Servers: []string{dead, addr}})
+	require.NoError(t, err)
+	addrs, err := r.LookupIPAddr(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Len(t, addrs, 2)
+}
+
+func TestDoH(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "application/dns-message", req.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(req.Body)
+		q := new(dns.Msg)
+		require.NoError(t, q.Unpack(body))
+		require.Zero(t, q.Id)
+		out, _ := answer(q, 300).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(out)
+	}))
+	defer srv.Close()
+
+	r := &Resolver{
+		strategy:  StrategyHappyEyeballs,
+		upstreams: []upstream{&dohUpstream{url: srv.URL + "/dns-query", client: srv.Client()}},
+		cache:     freecache.NewCache(cacheSize),
+	}
+	ips, err := r.query(context.Background(), "example.com", dns.TypeA)
+	require.NoError(t, err)
+	require.Equal(t, "93.184.216.34", ips[0].String())
+}
+
+func TestDialFallsBack(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close() //nolint:errcheck
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// The IPv6 loopback has no listener on the port, so both policies must
+	// end up on the IPv4 address.
+	for _, strategy := range []string{StrategyHappyEyeballs, StrategyPreferIPv6} {
+		r, err := New(config.DNSConfig{
+			Hosts:    map[string][]string{"dual.test": {"::1", "127.0.0.1"}},
+			Strategy: strategy,
+		})
+		require.NoError(t, err)
+		conn, err := r.Dial(context.Background(), &net.Dialer{Timeout: time.Second}, "tcp", net.JoinHostPort("dual.test", port))
+		require.NoError(t, err, strategy)
+		require.Equal(t, ln.Addr().String(), conn.RemoteAddr().String())
+		_ = conn.Close()
+	}
+}
+
+// unreachableV6 is a dialer on a host without IPv6 connectivity.
+type unreachableV6 struct{ net.Dialer }
+
+func (d *unreachableV6) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ENETUNREACH}
+	}
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+func TestDialUDPFallsBack(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close() //nolint:errcheck
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+
+	// Happy eyeballs puts the IPv6 address first.
+	r, err := New(config.DNSConfig{
+		Hosts:    map[string][]string{"dual.test": {"::1", "127.0.0.1"}},
+		Strategy: StrategyHappyEyeballs,
+	})
+	require.NoError(t, err)
+	conn, err := r.Dial(context.Background(), &unreachableV6{}, "udp", net.JoinHostPort("dual.test", port))
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	require.Equal(t, pc.LocalAddr().String(), conn.RemoteAddr().String())
+}
+
+func TestNilResolver(t *testing.T) {
+	var r *Resolver
+	addrs, err := r.LookupIPAddr(context.Background(), "127.0.0.1")
+	require.NoError(t, err)
+	require.NotEmpty(t, addrs)
+	require.Empty(t, r.Strategy())
+}
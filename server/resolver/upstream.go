@@ -0,0 +1,144 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstream exchanges a single DNS message with a remote resolver.
+type upstream interface {
+	exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+// parseUpstream parses an upstream spec. A bare host or host:port means
+// plain UDP; otherwise the scheme selects the transport: udp, tcp, tls (DoT)
+// or https (DoH).
+func parseUpstream(spec string) (upstream, error) {
+	if !strings.Contains(spec, "://") {
+		spec = "udp://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns server %q: %w", spec, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid dns server %q: missing host", spec)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		return &dnsUpstream{
+			spec:   spec,
+			addr:   withDefaultPort(u.Host, "53"),
+			client: &dns.Client{Net: u.Scheme, UDPSize: dns.DefaultMsgSize},
+		}, nil
+	case "tls":
+		return &dnsUpstream{
+			spec: spec,
+			addr: withDefaultPort(u.Host, "853"),
+			client: &dns.Client{
+				Net:       "tcp-tls",
+				TLSConfig: &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+			},
+		}, nil
+	case "https":
+		return &dohUpstream{
+			url: u.String(),
+			client: &http.Client{
+				Transport: &http.Transport{
+					ForceAttemptHTTP2:   true,
+					TLSHandshakeTimeout: queryTimeout,
+					MaxIdleConnsPerHost: 4,
+					IdleConnTimeout:     90 * time.Second,
+				},
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid dns server %q: unsupported scheme %q", spec, u.Scheme)
+	}
+}
+
+func withDefaultPort(hostport, port string) string {
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport
+	}
+	return net.JoinHostPort(strings.Trim(hostport, "[]"), port)
+}
+
+// dnsUpstream speaks classic DNS over UDP, TCP or TLS.
+type dnsUpstream struct {
+	spec   string
+	addr   string
+	client *dns.Client
+}
+
+func (u *dnsUpstream) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	reply, _, err := u.client.ExchangeContext(ctx, m, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	// Retry a truncated UDP answer over TCP, as a stub resolver would.
+	if reply.Truncated && u.client.Net == "udp" {
+		tcp := &dns.Client{Net: "tcp"}
+		reply, _, err = tcp.ExchangeContext(ctx, m, u.addr)
+	}
+	return reply, err
+}
+
+func (u *dnsUpstream) String() string { return u.spec }
+
+// dohUpstream speaks DNS over HTTPS (RFC 8484) using POST.
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *dohUpstream) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 recommends a zero ID so responses are cache friendly.
+	q := m.Copy()
+	q.Id = 0
+	body, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(data); err != nil {
+		return nil, fmt.Errorf("doh: %w", err)
+	}
+	reply.Id = m.Id
+	return reply, nil
+}
+
+func (u *dohUpstream) String() string { return u.url }
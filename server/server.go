@@ -6,6 +6,7 @@ import (
 	"crypto/tls"
 	"encoding/hex"
 	"fmt"
+	"io"
 	stdlog "log"
 	"net/http"
 	"os"
@@ -19,10 +20,15 @@ import (
 	sharedconfig "github.com/nange/easyss/v3/config"
 	"github.com/nange/easyss/v3/crypto"
 	"github.com/nange/easyss/v3/log"
+	"github.com/nange/easyss/v3/server/accesslog"
 	"github.com/nange/easyss/v3/server/config"
+	"github.com/nange/easyss/v3/server/egress"
 	"github.com/nange/easyss/v3/server/handler"
 	"github.com/nange/easyss/v3/server/nextproxy"
+	"github.com/nange/easyss/v3/server/probe"
+	"github.com/nange/easyss/v3/server/resolver"
 	"github.com/nange/easyss/v3/stats"
+	"github.com/nange/easyss/v3/util"
 )
 
 type Server struct {
@@ -32,6 +38,11 @@ type Server struct {
 	certCache  *certmagic.Cache
 	statsDone  chan struct{}
 	statsOnce  sync.Once
+
+	probeWriter  io.WriteCloser
+	probeLog     *probe.Logger
+	accessWriter io.WriteCloser
+	nextProxy    *nextproxy.Router
 }
 
 func New(cfg *config.ServerConfig) (*Server, error) {
@@ -145,6 +156,7 @@ func (s *Server) statsLoop() {
 				"icmp", snap.ServerICMPStreams,
 				"hserr", snap.ServerHandshakeErrors,
 				"fallback", snap.ServerFallbackPages,
+				"probes", snap.ServerProbes,
 				"padding", stats.HumanBytes(snap.PaddingBytes),
 				"records", snap.RecordsWritten,
 			)
@@ -269,18 +281,47 @@ func (s *Server) Start() error {
 		return fmt.Errorf("derive master key: %w", err)
 	}
 
-	np, err := nextproxy.New(s.cfg.NextProxy.URL, s.cfg.NextProxy.EnableUDP, s.cfg.NextProxy.AllHost)
+	np, err := s.newNextProxyRouter(timeout)
 	if err != nil {
 		log.Error("[SERVER] next proxy init failed", "err", err)
 		return fmt.Errorf("next proxy: %w", err)
 	}
-	if np != nil {
-		if err := np.LoadProxyFile(s.cfg.NextProxy.NextProxyFile); err != nil {
-			log.Error("[SERVER] next proxy load file failed", "err", err)
-			return fmt.Errorf("next proxy load file: %w", err)
+	s.nextProxy = np
+
+	pool, err := egress.New(s.cfg.Egress)
+	if err != nil {
+		return fmt.Errorf("egress: %w", err)
+	}
+	res, err := resolver.New(s.cfg.DNS)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+	if pool != nil {
+		// Source addresses are picked per resolved IP, so hostnames must be
+		// resolved before dialing rather than inside net.Dialer.
+		if res == nil {
+			res, _ = resolver.New(config.DNSConfig{Strategy: resolver.StrategyHappyEyeballs})
 		}
-		np.SetDialTimeout(handler.DialTimeout(timeout))
-		log.Info("[SERVER] next proxy configured", "url", s.cfg.NextProxy.URL, "udp", s.cfg.NextProxy.EnableUDP, "all_host", s.cfg.NextProxy.AllHost)
+		log.Info("[SERVER] egress pool configured", "sources", s.cfg.Egress.Sources, "strategy", pool.Strategy())
+	}
+	if res != nil {
+		// The SSRF check must see the same answers as the dialer.
+		util.SetLANResolver(res)
+		log.Info("[SERVER] dns resolver configured", "servers", s.cfg.DNS.Servers, "hosts", len(s.cfg.DNS.Hosts), "strategy", res.Strategy())
+	}
+
+	var probeLog *probe.Logger
+	if path := s.cfg.Log.ProbeFilePath; path != "" {
+		s.probeWriter = log.FileWriter(path)
+		probeLog = probe.NewLogger(s.probeWriter)
+		s.probeLog = probeLog
+		log.Info("[SERVER] probe log enabled", "file", path)
+	}
+	var accessLog *accesslog.Logger
+	if path := s.cfg.Log.AccessFilePath; path != "" {
+		s.accessWriter = log.FileWriter(path)
+		accessLog = accesslog.NewLogger(s.accessWriter)
+		log.Info("[SERVER] access log enabled", "file", path)
 	}
 
 	streamIdleTimeout := 10 * timeout
@@ -296,6 +337,10 @@ func (s *Server) Start() error {
 		CoverBudgetRatio:  s.cfg.CoverBudgetRatio,
 		CoverBudgetCap:    s.cfg.CoverBudgetCap,
 		NextProxy:         np,
+		Resolver:          res,
+		Egress:            pool,
+		ProbeLog:          probeLog,
+		AccessLog:         accessLog,
 	})
 
 	s.mux = http.NewServeMux()
@@ -343,12 +388,69 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		s.certCache.Stop()
 		s.certCache = nil
 	}
+	s.nextProxy.Close()
+	// Close the probe and access logs after the HTTP server has drained, so
+	// in-flight streams are not written to a closed file.
+	if s.probeWriter != nil {
+		defer s.probeWriter.Close() //nolint:errcheck
+		defer s.probeLog.Flush()
+	}
+	if s.accessWriter != nil {
+		defer s.accessWriter.Close() //nolint:errcheck
+	}
 	if s.httpServer != nil {
 		return s.httpServer.Shutdown(ctx)
 	}
 	return nil
 }
 
+// newNextProxyRouter builds the next-proxy groups: the named groups in
+// configured order, then the group of next_proxy.url. It returns nil when no
+// next proxy is configured.
+func (s *Server) newNextProxyRouter(timeout time.Duration) (*nextproxy.Router, error) {
+	cfg := s.cfg.NextProxy
+	var groups []*nextproxy.NextProxy
+	for _, gc := range cfg.Groups {
+		g, err := nextproxy.NewGroup(nextproxy.Options{
+			Name:      gc.Name,
+			URLs:      gc.URLs,
+			Strategy:  gc.Strategy,
+			EnableUDP: gc.EnableUDP,
+			AllHost:   gc.AllHost,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := g.LoadProxyFile(gc.NextProxyFile); err != nil {
+			return nil, fmt.Errorf("group %s load file: %w", gc.Name, err)
+		}
+		groups = append(groups, g)
+		log.Info("[SERVER] next proxy group configured", "group", gc.Name, "upstreams", len(gc.URLs), "strategy", gc.Strategy, "udp", gc.EnableUDP, "all_host", gc.AllHost)
+	}
+
+	np, err := nextproxy.New(cfg.URL, cfg.EnableUDP, cfg.AllHost)
+	if err != nil {
+		return nil, err
+	}
+	if np != nil {
+		if err := np.LoadProxyFile(cfg.NextProxyFile); err != nil {
+			return nil, fmt.Errorf("load file: %w", err)
+		}
+		groups = append(groups, np)
+		log.Info("[SERVER] next proxy configured", "url", np.URL().Redacted(), "udp", cfg.EnableUDP, "all_host", cfg.AllHost)
+	}
+
+	router := nextproxy.NewRouter(groups...)
+	dialTimeout := handler.DialTimeout(timeout)
+	router.SetDialTimeout(dialTimeout)
+	interval := time.Duration(cfg.HealthCheckInterval) * time.Second
+	if cfg.HealthCheckInterval == 0 {
+		interval = 30 * time.Second
+	}
+	router.StartHealthChecks(interval, dialTimeout)
+	return router, nil
+}
+
 // stdErrorLog routes Go's internal http.Server/HTTP2 logs (connection-level
 // errors, PING timeouts, protocol errors, TLS handshake errors, etc.) through
 // easyss's slog logger. Handler panics are handled separately by the recover
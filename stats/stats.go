@@ -2,6 +2,7 @@ package stats
 
 import (
 	"fmt"
+	"maps"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -35,6 +36,10 @@ type stats struct {
 	dnsProxyQueries  atomic.Int64
 	dnsDirectQueries atomic.Int64
 
+	// Connections and DNS queries the routing rules blocked
+	blockedConnections atomic.Int64
+	blockedDNSQueries  atomic.Int64
+
 	paddingBytes   atomic.Int64
 	recordsWritten atomic.Int64
 
@@ -60,6 +65,10 @@ type stats struct {
 	serverHandshakeErrors atomic.Int64
 	serverFallbackPages   atomic.Int64
 
+	// Server-side rejected handshakes, keyed by probe reason
+	probeMu      sync.Mutex
+	serverProbes map[string]int64
+
 	// startTime keeps the monotonic clock reading so time.Since stays
 	// immune to wall-clock adjustments; nil means no active session.
 	startTime atomic.Pointer[time.Time]
@@ -82,6 +91,9 @@ func RecordDNSCacheMiss()   { g.dnsCacheMisses.Add(1) }
 func RecordDNSProxyQuery()  { g.dnsProxyQueries.Add(1) }
 func RecordDNSDirectQuery() { g.dnsDirectQueries.Add(1) }
 
+func RecordBlockedConnection() { g.blockedConnections.Add(1) }
+func RecordBlockedDNSQuery()   { g.blockedDNSQueries.Add(1) }
+
 func RecordPaddingBytes(n int) { g.paddingBytes.Add(int64(n)) }
 func RecordRecordWritten()     { g.recordsWritten.Add(1) }
 
@@ -109,6 +121,16 @@ func RecordServerICMPStream()     { g.serverICMPStreams.Add(1) }
 func RecordServerHandshakeError() { g.serverHandshakeErrors.Add(1) }
 func RecordServerFallbackPage()   { g.serverFallbackPages.Add(1) }
 
+// RecordServerProbe counts a rejected handshake under its probe reason.
+func RecordServerProbe(reason string) {
+	g.probeMu.Lock()
+	if g.serverProbes == nil {
+		g.serverProbes = make(map[string]int64)
+	}
+	g.serverProbes[reason]++
+	g.probeMu.Unlock()
+}
+
 // --- session lifecycle ---
 
 // ResetStartTime marks the start of a new session, e.g. on client start.
@@ -136,6 +158,8 @@ func ResetCounters() {
 	g.dnsCacheMisses.Store(0)
 	g.dnsProxyQueries.Store(0)
 	g.dnsDirectQueries.Store(0)
+	g.blockedConnections.Store(0)
+	g.blockedDNSQueries.Store(0)
 	g.paddingBytes.Store(0)
 	g.recordsWritten.Store(0)
 	g.priorityStreamsOpened.Store(0)
@@ -158,6 +182,10 @@ func ResetCounters() {
 	g.serverICMPStreams.Store(0)
 	g.serverHandshakeErrors.Store(0)
 	g.serverFallbackPages.Store(0)
+
+	g.probeMu.Lock()
+	g.serverProbes = nil
+	g.probeMu.Unlock()
 }
 
 // --- snapshot ---
@@ -177,6 +205,8 @@ type Snapshot struct {
 	DNSCacheMisses        int64 `json:"dns_cache_misses"`
 	DNSProxyQueries       int64 `json:"dns_proxy_queries"`
 	DNSDirectQueries      int64 `json:"dns_direct_queries"`
+	BlockedConnections    int64 `json:"blocked_connections"`
+	BlockedDNSQueries     int64 `json:"blocked_dns_queries"`
 	PaddingBytes          int64 `json:"padding_bytes"`
 	RecordsWritten        int64 `json:"records_written"`
 	RTTCount              int64 `json:"rtt_count"`
@@ -191,6 +221,9 @@ type Snapshot struct {
 	PriorityFallback      int64 `json:"priority_fallback"`
 	BulkFallback          int64 `json:"bulk_fallback"`
 
+	// Server-side rejected handshakes per probe reason
+	ServerProbes map[string]int64 `json:"server_probes,omitempty"`
+
 	// Speed
 	UploadSpeed            int64  `json:"upload_speed"`
 	DownloadSpeed          int64  `json:"download_speed"`
@@ -235,6 +268,13 @@ func Collect() Snapshot {
 	ewma := g.rttEWMA
 	g.rttMu.Unlock()
 
+	var probes map[string]int64
+	g.probeMu.Lock()
+	if len(g.serverProbes) > 0 {
+		probes = maps.Clone(g.serverProbes)
+	}
+	g.probeMu.Unlock()
+
 	upSpeed := g.uploadSpeed.Load()
 	downSpeed := g.downloadSpeed.Load()
 
@@ -259,6 +299,8 @@ func Collect() Snapshot {
 		DNSCacheMisses:         g.dnsCacheMisses.Load(),
 		DNSProxyQueries:        g.dnsProxyQueries.Load(),
 		DNSDirectQueries:       g.dnsDirectQueries.Load(),
+		BlockedConnections:     g.blockedConnections.Load(),
+		BlockedDNSQueries:      g.blockedDNSQueries.Load(),
 		PaddingBytes:           g.paddingBytes.Load(),
 		RecordsWritten:         g.recordsWritten.Load(),
 		RTTEWMA:                ewma,
@@ -268,6 +310,7 @@ func Collect() Snapshot {
 		ServerICMPStreams:      g.serverICMPStreams.Load(),
 		ServerHandshakeErrors:  g.serverHandshakeErrors.Load(),
 		ServerFallbackPages:    g.serverFallbackPages.Load(),
+		ServerProbes:           probes,
 		PriorityStreamsOpened:  g.priorityStreamsOpened.Load(),
 		BulkStreamsOpened:      g.bulkStreamsOpened.Load(),
 		PriorityFallback:       g.priorityFallback.Load(),
@@ -60,6 +60,8 @@ func TestResetCounters(t *testing.T) {
 	RecordDNSCacheMiss()
 	RecordDNSProxyQuery()
 	RecordDNSDirectQuery()
+	RecordBlockedConnection()
+	RecordBlockedDNSQuery()
 	RecordPaddingBytes(500)
 	RecordRecordWritten()
 	RecordStreamOpenedPriority()
@@ -72,6 +74,7 @@ func TestResetCounters(t *testing.T) {
 	RecordServerICMPStream()
 	RecordServerHandshakeError()
 	RecordServerFallbackPage()
+	RecordServerProbe("no_salt")
 	g.uploadSpeed.Store(1000)
 	g.downloadSpeed.Store(2000)
 	g.peakUploadSpeed.Store(3000)
@@ -86,6 +89,7 @@ func TestResetCounters(t *testing.T) {
 		snap.TCPConnections != 0 || snap.UDPAssociations != 0 ||
 		snap.DNSCacheHits != 0 || snap.DNSCacheMisses != 0 ||
 		snap.DNSProxyQueries != 0 || snap.DNSDirectQueries != 0 ||
+		snap.BlockedConnections != 0 || snap.BlockedDNSQueries != 0 ||
 		snap.PaddingBytes != 0 || snap.RecordsWritten != 0 ||
 		snap.PriorityStreamsOpened != 0 || snap.BulkStreamsOpened != 0 ||
 		snap.PriorityFallback != 0 || snap.BulkFallback != 0 ||
@@ -94,7 +98,7 @@ func TestResetCounters(t *testing.T) {
 		snap.PeakUploadSpeedHuman != "0 B/s" || snap.PeakDownloadSpeedHuman != "0 B/s" ||
 		snap.ServerTCPStreams != 0 || snap.ServerUDPStreams != 0 ||
 		snap.ServerICMPStreams != 0 || snap.ServerHandshakeErrors != 0 ||
-		snap.ServerFallbackPages != 0 {
+		snap.ServerFallbackPages != 0 || snap.ServerProbes != nil {
 		t.Fatalf("counters not fully reset: %+v", snap)
 	}
 }
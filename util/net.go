@@ -44,6 +44,23 @@ func IsLANHost(addr string) bool {
 	return IsLANIP(host)
 }
 
+// HostResolver looks up the addresses of a host; *net.Resolver satisfies it.
+type HostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var lanResolver HostResolver = net.DefaultResolver
+
+// SetLANResolver sets the resolver IsLANHostResolved uses for domain names,
+// so the SSRF check sees the same answers as the dialer. A nil r restores
+// the system resolver. It must be called before serving traffic.
+func SetLANResolver(r HostResolver) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	lanResolver = r
+}
+
 // IsLANHostResolved is the SSRF-safe variant of IsLANHost: when the host is a domain
 // name rather than a literal IP, it resolves the name and rejects the request if any
 // resolved address is a LAN/private address. The fast IP-only path is used when the
@@ -77,7 +94,7 @@ func IsLANHostResolved(ctx context.Context, addr string) bool {
 		defer cancel()
 	}
 
-	ips, err := net.DefaultResolver.LookupIPAddr(resolveCtx, host)
+	ips, err := lanResolver.LookupIPAddr(resolveCtx, host)
 	if err != nil {
 		// On resolution failure, fail open (return false) so the dial layer can
 		// produce the actual error. SSRF protection relies on the next check
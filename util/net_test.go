@@ -2,6 +2,7 @@ package util
 
 import (
 	"context"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -247,6 +248,23 @@ func TestIsLANHostResolved(t *testing.T) {
 	assert.False(t, IsLANHostResolved(ctx, "invalid:0"))
 }
 
+type fixedResolver []net.IPAddr
+
+func (f fixedResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	return f, nil
+}
+
+func TestSetLANResolver(t *testing.T) {
+	t.Cleanup(func() { SetLANResolver(nil) })
+	ctx := context.Background()
+
+	SetLANResolver(fixedResolver{{IP: net.ParseIP("93.184.216.34")}, {IP: net.ParseIP("192.168.1.1")}})
+	assert.True(t, IsLANHostResolved(ctx, "rebind.example:443"))
+
+	SetLANResolver(fixedResolver{{IP: net.ParseIP("93.184.216.34")}})
+	assert.False(t, IsLANHostResolved(ctx, "localhost:80"))
+}
+
 func TestMapKeys(t *testing.T) {
 	t.Run("string keys", func(t *testing.T) {
 		m := map[string]int{"a": 1, "b": 2, "c": 3}